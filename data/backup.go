@@ -0,0 +1,91 @@
+// Online backup copies a partition's live documents into new data and lookup
+// files elsewhere, while the partition remains available for reads and writes.
+//
+// Like online compaction, documents are copied in small batches, and IDs of
+// documents changed in the meantime are tracked. Caller finishes the backup
+// under the exclusive partition lock by copying the changed documents again,
+// which makes the copy a snapshot of the partition at that moment.
+
+package data
+
+import (
+	"fmt"
+	"os"
+)
+
+// PartitionBackup is an online copy of a partition in progress.
+type PartitionBackup struct {
+	part      *Partition
+	newCol    *Collection
+	newLookup *HashTable
+}
+
+// Begin copying the partition into new data and lookup files. Changes to the partition are tracked from now on.
+// Caller must not hold DataLock.
+func (part *Partition) BeginBackup(colPath, lookupPath string) (backup *PartitionBackup, err error) {
+	for _, newPath := range []string{colPath, lookupPath} {
+		if _, err = os.Stat(newPath); err == nil {
+			return nil, fmt.Errorf("Destination file %s already exists", newPath)
+		}
+	}
+	part.DataLock.Lock()
+	if part.changed != nil {
+		part.DataLock.Unlock()
+		return nil, fmt.Errorf("Partition %s is already being compacted or backed up", part.col.Path)
+	}
+	part.changed = make(map[int]struct{})
+	part.DataLock.Unlock()
+	backup = &PartitionBackup{part: part}
+	if backup.newCol, err = part.OpenCollection(colPath); err != nil {
+		backup.Abort()
+		return nil, err
+	} else if backup.newLookup, err = part.OpenHashTable(lookupPath); err != nil {
+		backup.Abort()
+		return nil, err
+	}
+	return
+}
+
+// Copy all documents into the new files. Readers and writers are only blocked while a batch of documents is copied.
+// Caller must not hold DataLock.
+func (backup *PartitionBackup) Copy() error {
+	return backup.part.copyBatches(backup.newCol, backup.newLookup)
+}
+
+// Copy the documents changed since the backup began, stop tracking changes and close the new files.
+// Caller must hold DataLock exclusively.
+func (backup *PartitionBackup) Finish() (err error) {
+	part := backup.part
+	for id := range part.changed {
+		if err = part.copyDoc(backup.newCol, backup.newLookup, id); err != nil {
+			break
+		}
+	}
+	part.changed = nil
+	if err == nil {
+		err = backup.newCol.Shrink()
+	}
+	if err == nil {
+		err = backup.newLookup.completeRehash()
+	}
+	if closeErr := backup.newCol.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := backup.newLookup.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// Give up the backup: stop tracking changes and close the new files. Caller must not hold DataLock.
+func (backup *PartitionBackup) Abort() {
+	backup.part.DataLock.Lock()
+	backup.part.changed = nil
+	backup.part.DataLock.Unlock()
+	if backup.newCol != nil {
+		backup.newCol.Close()
+	}
+	if backup.newLookup != nil {
+		backup.newLookup.Close()
+	}
+}
@@ -0,0 +1,104 @@
+package data
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPartitionBackup(t *testing.T) {
+	colPath, htPath := "/tmp/tiedot_test_col", "/tmp/tiedot_test_ht"
+	bakColPath, bakHTPath := "/tmp/tiedot_test_col_bak", "/tmp/tiedot_test_ht_bak"
+	for _, filePath := range []string{colPath, htPath, bakColPath, bakHTPath} {
+		os.Remove(filePath)
+		defer os.Remove(filePath)
+	}
+	d := defaultConfig()
+	part, err := d.OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.Close()
+	docs := make(map[int]string)
+	for i := 0; i < 10000; i++ {
+		docs[i] = strconv.Itoa(i)
+		if _, err = part.Insert(i, []byte(docs[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backup, err := part.BeginBackup(bakColPath, bakHTPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = part.BeginBackup(bakColPath+"2", bakHTPath+"2"); err == nil {
+		t.Fatal("did not error")
+	} else if err = part.Compact(); err == nil {
+		t.Fatal("did not error")
+	}
+	// Write concurrently while the backup is being copied
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 3000; i += 3 {
+			part.DataLock.Lock()
+			if err := part.Update(i, []byte("updated")); err != nil {
+				t.Error(err)
+			}
+			if err := part.Delete(i + 1); err != nil {
+				t.Error(err)
+			}
+			if _, err := part.Insert(i+100000, []byte("new")); err != nil {
+				t.Error(err)
+			}
+			part.DataLock.Unlock()
+		}
+	}()
+	if err = backup.Copy(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	part.DataLock.Lock()
+	err = backup.Finish()
+	part.DataLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i += 3 {
+		docs[i] = "updated"
+		delete(docs, i+1)
+		docs[i+100000] = "new"
+	}
+	// Writes after the backup is finished are not in the backup
+	part.DataLock.Lock()
+	if err = part.Update(5000, []byte("too late")); err != nil {
+		t.Fatal(err)
+	}
+	part.DataLock.Unlock()
+	bak, err := d.OpenPartition(bakColPath, bakHTPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bak.Close()
+	count := 0
+	bak.ForEachDoc(0, 1, func(id int, doc []byte) bool {
+		count++
+		if expected, exists := docs[id]; !exists || strings.TrimSpace(string(doc)) != expected {
+			t.Error(id, string(doc), expected)
+			return false
+		}
+		if rev, _ := bak.Revision(id); id < 3000 && id%3 == 0 && rev != 2 {
+			t.Error(id, rev)
+			return false
+		}
+		return true
+	})
+	if count != len(docs) {
+		t.Fatal(count, len(docs))
+	}
+	// The partition is free for another backup or compaction
+	if err = part.Compact(); err != nil {
+		t.Fatal(err)
+	}
+}
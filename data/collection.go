@@ -1,12 +1,17 @@
 // Collection data file contains document data.
 //
-// Every document has a binary header and UTF-8 text content.
+// Every document has a binary header and UTF-8 text content. The header
+// consists of validity flag, room size, (since FormatChecksum) a CRC32C
+// checksum of the entire document room, which is verified upon read, and
+// (since FormatRevision) a revision number incremented by every update.
 //
 // Documents are inserted one after another, and occupies 2x original document
 // size to leave room for future updates.
 //
-// Deleted documents are marked as deleted and the space is irrecoverable until
-// a "scrub" action (in DB logic) is carried out.
+// Deleted documents are marked as deleted and their room is remembered in a
+// free space map, new documents are inserted into a suitable hole before
+// the end of data is considered. A "scrub" action (in DB logic) still
+// de-fragments the remaining free space.
 //
 // When update takes place, the new document may overwrite original document if
 // there is enough space, otherwise the original document is marked as deleted
@@ -15,64 +20,130 @@
 package data
 
 import (
+	"bytes"
 	"encoding/binary"
+	"hash/crc32"
+	"math"
 
 	"github.com/HouzuoGuo/tiedot/dberr"
 )
 
+var crc32c = crc32.MakeTable(crc32.Castagnoli) // CRC32C polynomial table for document checksum
+
 // Collection file contains document headers and document text data.
 type Collection struct {
 	*DataFile
 	*Config
+	free FreeSpace // holes left behind by deleted documents
 }
 
 // Open a collection file.
 func (conf *Config) OpenCollection(path string) (col *Collection, err error) {
 	col = new(Collection)
-	col.DataFile, err = OpenDataFile(path, conf.ColFileGrowth)
+	col.DataFile, err = openDataFile(path, conf.ColFileGrowth, conf.ReadOnly)
 	col.Config = conf
 	col.Config.CalculateConfigConstants()
+	if err == nil {
+		col.rebuildFreeSpace()
+	}
 	return
 }
 
 // Find and retrieve a document by ID (physical document location). Return value is a copy of the document.
+// Return nil if the document does not exist or is corrupted.
 func (col *Collection) Read(id int) []byte {
-	if id < 0 || id > col.Used-DocHeader || col.Buf[id] != 1 {
-		return nil
-	} else if room, _ := binary.Varint(col.Buf[id+1 : id+11]); room > int64(col.DocMaxRoom) {
-		return nil
-	} else if docEnd := id + DocHeader + int(room); docEnd >= col.Size {
-		return nil
+	doc, _ := col.ReadDoc(id)
+	return doc
+}
+
+// Find and retrieve a document by ID (physical document location). Return value is a copy of the document.
+// If checksum does not match the document content, the returned error is of type dberr.ErrorDocCorrupted.
+func (col *Collection) ReadDoc(id int) ([]byte, error) {
+	if id < 0 || id > col.Used-col.DocHeaderSize || col.Buf[id] != 1 {
+		return nil, dberr.New(dberr.ErrorNoDoc, id)
+	} else if room, _ := binary.Varint(col.Buf[id+1 : id+11]); room > int64(col.DocMaxRoom) || room < 0 {
+		return nil, dberr.New(dberr.ErrorNoDoc, id)
+	} else if docEnd := id + col.DocHeaderSize + int(room); docEnd >= col.Size {
+		return nil, dberr.New(dberr.ErrorNoDoc, id)
+	} else if !col.checksumMatches(id, docEnd) {
+		return nil, dberr.New(dberr.ErrorDocCorrupted, id)
 	} else {
 		docCopy := make([]byte, room)
-		copy(docCopy, col.Buf[id+DocHeader:docEnd])
-		return docCopy
+		copy(docCopy, col.Buf[id+col.DocHeaderSize:docEnd])
+		return docCopy, nil
+	}
+}
+
+// Calculate and store checksum of the document room, if the data file format has document checksum.
+func (col *Collection) writeChecksum(id, docEnd int) {
+	if col.DocChecksum() {
+		binary.BigEndian.PutUint32(col.Buf[id+DocHeader:id+DocHeader+DocChecksumSize], crc32.Checksum(col.Buf[id+col.DocHeaderSize:docEnd], crc32c))
+	}
+}
+
+// Return true if the stored checksum matches document room, or the data file format does not have document checksum.
+func (col *Collection) checksumMatches(id, docEnd int) bool {
+	if !col.DocChecksum() {
+		return true
+	}
+	return binary.BigEndian.Uint32(col.Buf[id+DocHeader:id+DocHeader+DocChecksumSize]) == crc32.Checksum(col.Buf[id+col.DocHeaderSize:docEnd], crc32c)
+}
+
+// Return the revision number of a document. Data file formats without revision number derive it from document content.
+// Caller must make sure that the document exists.
+func (col *Collection) Revision(id int) int {
+	if col.DocRevision() {
+		return int(binary.BigEndian.Uint64(col.Buf[id+DocHeader+DocChecksumSize : id+DocHeader+DocChecksumSize+DocRevisionSize]))
+	}
+	room, _ := binary.Varint(col.Buf[id+1 : id+11])
+	return int(crc32.Checksum(bytes.TrimRight(col.Buf[id+col.DocHeaderSize:id+col.DocHeaderSize+int(room)], " "), crc32c) & math.MaxInt32)
+}
+
+// Store the revision number of a document, if the data file format has document revision.
+func (col *Collection) writeRevision(id, rev int) {
+	if col.DocRevision() {
+		binary.BigEndian.PutUint64(col.Buf[id+DocHeader+DocChecksumSize:id+DocHeader+DocChecksumSize+DocRevisionSize], uint64(rev))
 	}
 }
 
 // Insert a new document, return the new document ID.
 func (col *Collection) Insert(data []byte) (id int, err error) {
+	return col.InsertRev(data, 1)
+}
+
+// Insert a new document that carries the revision number, return the new document ID.
+func (col *Collection) InsertRev(data []byte, rev int) (id int, err error) {
 	room := len(data) << 1
 	if room > col.DocMaxRoom {
 		return 0, dberr.New(dberr.ErrorDocTooLarge, col.DocMaxRoom, room)
 	}
-	id = col.Used
-	docSize := DocHeader + room
-	if err = col.EnsureSize(docSize); err != nil {
-		return
+	var docEnd int
+	if holeID, holeRoom, found := col.free.Take(room); found {
+		// Reuse the room of a deleted document
+		id, room = holeID, holeRoom
+		docEnd = id + col.DocHeaderSize + room
+	} else {
+		id = col.Used
+		docSize := col.DocHeaderSize + room
+		if err = col.EnsureSize(docSize); err != nil {
+			return
+		}
+		col.Used += docSize
+		docEnd = col.Used
 	}
-	col.Used += docSize
-	// Write validity, room, document data and padding
+	// Write validity, room, document data and padding, then checksum
 	col.Buf[id] = 1
 	binary.PutVarint(col.Buf[id+1:id+11], int64(room))
-	copy(col.Buf[id+DocHeader:col.Used], data)
-	for padding := id + DocHeader + len(data); padding < col.Used; padding += col.LenPadding {
+	copy(col.Buf[id+col.DocHeaderSize:docEnd], data)
+	for padding := id + col.DocHeaderSize + len(data); padding < docEnd; padding += col.LenPadding {
 		copySize := col.LenPadding
-		if padding+col.LenPadding >= col.Used {
-			copySize = col.Used - padding
+		if padding+col.LenPadding >= docEnd {
+			copySize = docEnd - padding
 		}
 		copy(col.Buf[padding:padding+copySize], col.Padding)
 	}
+	col.writeChecksum(id, docEnd)
+	col.writeRevision(id, rev)
 	return
 }
 
@@ -82,21 +153,21 @@ func (col *Collection) Update(id int, data []byte) (newID int, err error) {
 	if dataLen > col.DocMaxRoom {
 		return 0, dberr.New(dberr.ErrorDocTooLarge, col.DocMaxRoom, dataLen)
 	}
-	if id < 0 || id >= col.Used-DocHeader || col.Buf[id] != 1 {
+	if id < 0 || id >= col.Used-col.DocHeaderSize || col.Buf[id] != 1 {
 		return 0, dberr.New(dberr.ErrorNoDoc, id)
 	}
 	currentDocRoom, _ := binary.Varint(col.Buf[id+1 : id+11])
-	if currentDocRoom > int64(col.DocMaxRoom) {
+	if currentDocRoom > int64(col.DocMaxRoom) || currentDocRoom < 0 {
 		return 0, dberr.New(dberr.ErrorNoDoc, id)
 	}
-	if docEnd := id + DocHeader + int(currentDocRoom); docEnd >= col.Size {
+	if docEnd := id + col.DocHeaderSize + int(currentDocRoom); docEnd >= col.Size {
 		return 0, dberr.New(dberr.ErrorNoDoc, id)
 	}
 	if dataLen <= int(currentDocRoom) {
-		padding := id + DocHeader + len(data)
-		paddingEnd := id + DocHeader + int(currentDocRoom)
-		// Overwrite data and then overwrite padding
-		copy(col.Buf[id+DocHeader:padding], data)
+		padding := id + col.DocHeaderSize + len(data)
+		paddingEnd := id + col.DocHeaderSize + int(currentDocRoom)
+		// Overwrite data and then overwrite padding, then checksum
+		copy(col.Buf[id+col.DocHeaderSize:padding], data)
 		for ; padding < paddingEnd; padding += col.LenPadding {
 			copySize := col.LenPadding
 			if padding+col.LenPadding >= paddingEnd {
@@ -104,36 +175,53 @@ func (col *Collection) Update(id int, data []byte) (newID int, err error) {
 			}
 			copy(col.Buf[padding:padding+copySize], col.Padding)
 		}
+		col.writeChecksum(id, paddingEnd)
+		col.writeRevision(id, col.Revision(id)+1)
 		return id, nil
 	}
 
 	// No enough room - re-insert the document
+	rev := col.Revision(id)
 	col.Delete(id)
-	return col.Insert(data)
+	return col.InsertRev(data, rev+1)
 }
 
 // Delete a document by ID.
 func (col *Collection) Delete(id int) error {
 
-	if id < 0 || id > col.Used-DocHeader || col.Buf[id] != 1 {
+	if id < 0 || id > col.Used-col.DocHeaderSize || col.Buf[id] != 1 {
 		return dberr.New(dberr.ErrorNoDoc, id)
 	}
 
 	if col.Buf[id] == 1 {
 		col.Buf[id] = 0
+		if room, _ := binary.Varint(col.Buf[id+1 : id+11]); room >= 0 && room <= int64(col.DocMaxRoom) {
+			col.free.Put(id, int(room))
+		}
 	}
 
 	return nil
 }
 
-// Run the function on every document; stop when the function returns false.
+// Return the total room of deleted documents that is available for reuse.
+func (col *Collection) FreeRoom() int {
+	return col.free.Total()
+}
+
+// Clear the entire collection file and forget all holes.
+func (col *Collection) Clear() error {
+	col.free.Clear()
+	return col.DataFile.Clear()
+}
+
+// Run the function on every document; stop when the function returns false. Documents failing checksum are skipped.
 func (col *Collection) ForEachDoc(fun func(id int, doc []byte) bool) {
-	for id := 0; id < col.Used-DocHeader && id >= 0; {
+	for id := 0; id < col.Used-col.DocHeaderSize && id >= 0; {
 		validity := col.Buf[id]
 		room, _ := binary.Varint(col.Buf[id+1 : id+11])
-		docEnd := id + DocHeader + int(room)
-		if (validity == 0 || validity == 1) && room <= int64(col.DocMaxRoom) && docEnd > 0 && docEnd <= col.Used {
-			if validity == 1 && !fun(id, col.Buf[id+DocHeader:docEnd]) {
+		docEnd := id + col.DocHeaderSize + int(room)
+		if (validity == 0 || validity == 1) && room >= 0 && room <= int64(col.DocMaxRoom) && docEnd > 0 && docEnd <= col.Used {
+			if validity == 1 && col.checksumMatches(id, docEnd) && !fun(id, col.Buf[id+col.DocHeaderSize:docEnd]) {
 				break
 			}
 			id = docEnd
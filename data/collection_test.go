@@ -228,7 +228,7 @@ func TestCollectionGrowAndOutOfBoundAccess(t *testing.T) {
 		t.Fatalf("Failed to insert: %v", err)
 	}
 	// Test UsedSize
-	calculatedUsedSize := (DocHeader + 3*2) + (DocHeader+4*2)*2
+	calculatedUsedSize := (col.DocHeaderSize + 3*2) + (col.DocHeaderSize+4*2)*2
 	if col.Used != calculatedUsedSize {
 		t.Fatalf("Invalid UsedSize")
 	}
@@ -283,7 +283,7 @@ func TestCollectionGrowAndOutOfBoundAccess(t *testing.T) {
 		t.Fatal(err)
 	}
 	count++
-	calculatedUsedSize += count * (DocHeader + col.DocMaxRoom)
+	calculatedUsedSize += count * (col.DocHeaderSize + col.DocMaxRoom)
 	if col.Used != calculatedUsedSize {
 		t.Fatalf("Wrong UsedSize %d %d", col.Used, calculatedUsedSize)
 	}
@@ -294,3 +294,207 @@ func TestCollectionGrowAndOutOfBoundAccess(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDocChecksum(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	d := defaultConfig()
+	col, err := d.OpenCollection(tmp)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+		return
+	}
+	defer col.Close()
+	id0, err := col.Insert([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1, err := col.Insert([]byte("def"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Checksum is maintained by in-place update
+	if _, err = col.Update(id1, []byte("xyz")); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := col.ReadDoc(id1); err != nil || strings.TrimSpace(string(doc)) != "xyz" {
+		t.Fatal(doc, err)
+	}
+	// Flip a bit in document body
+	col.Buf[id0+col.DocHeaderSize] ^= 1
+	if _, err := col.ReadDoc(id0); dberr.Type(err) != dberr.ErrorDocCorrupted {
+		t.Fatal("Did not detect corruption", err)
+	}
+	if doc := col.Read(id0); doc != nil {
+		t.Fatal("Read corrupted document", doc)
+	}
+	successfullyRead := 0
+	col.ForEachDoc(func(id int, _ []byte) bool {
+		if id != id1 {
+			t.Fatal("Corrupted document should be skipped")
+		}
+		successfullyRead++
+		return true
+	})
+	if successfullyRead != 1 {
+		t.Fatalf("Should have read 1 document, but got %d", successfullyRead)
+	}
+}
+
+func TestLegacyFormatWithoutChecksum(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	d := defaultConfig()
+	d.FormatVersion = FormatLegacy
+	d.CalculateConfigConstants()
+	col, err := d.OpenCollection(tmp)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+		return
+	}
+	defer col.Close()
+	if col.DocHeaderSize != DocHeader {
+		t.Fatal(col.DocHeaderSize)
+	}
+	id, err := col.Insert([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if col.Used != DocHeader+3*2 {
+		t.Fatal(col.Used)
+	}
+	if doc, err := col.ReadDoc(id); err != nil || strings.TrimSpace(string(doc)) != "abc" {
+		t.Fatal(doc, err)
+	}
+}
+
+func TestFreeSpaceReuse(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	d := defaultConfig()
+	col, err := d.OpenCollection(tmp)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+		return
+	}
+	var ids [3]int
+	for i := range ids {
+		if ids[i], err = col.Insert([]byte("abcdef")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	used := col.Used
+	// The hole left by a deleted document is reused by a document of similar size
+	if err = col.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if col.FreeRoom() != 12 {
+		t.Fatal(col.FreeRoom())
+	}
+	if id, err := col.Insert([]byte("xyz")); err != nil || id != ids[1] || col.Used != used || col.FreeRoom() != 0 {
+		t.Fatal(id, err, col.Used, used)
+	}
+	if doc, err := col.ReadDoc(ids[1]); err != nil || strings.TrimSpace(string(doc)) != "xyz" {
+		t.Fatal(doc, err)
+	}
+	// A larger document does not fit into the hole and goes to the end
+	if err = col.Delete(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := col.Insert([]byte("abcdefghijklmnopqrstuvwxyz")); err != nil || id != used {
+		t.Fatal(id, err)
+	}
+	// Relocated document leaves a hole behind too
+	if newID, err := col.Update(ids[2], []byte("abcdefghijklmnopqrstuvwxyz")); err != nil || newID == ids[2] {
+		t.Fatal(newID, err)
+	}
+	if col.FreeRoom() != 24 {
+		t.Fatal(col.FreeRoom())
+	}
+	// Free space map is rebuilt upon reopening
+	if err = col.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if col, err = d.OpenCollection(tmp); err != nil {
+		t.Fatal(err)
+	}
+	defer col.Close()
+	if col.FreeRoom() != 24 {
+		t.Fatal(col.FreeRoom())
+	}
+	if id, err := col.Insert([]byte("abcdef")); err != nil || (id != ids[0] && id != ids[2]) {
+		t.Fatal(id, err)
+	}
+}
+
+func TestDocRevision(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	d := defaultConfig()
+	col, err := d.OpenCollection(tmp)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+		return
+	}
+	defer col.Close()
+	id, err := col.Insert([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	} else if rev := col.Revision(id); rev != 1 {
+		t.Fatal(rev)
+	}
+	// In-place update
+	if id, err = col.Update(id, []byte("def")); err != nil {
+		t.Fatal(err)
+	} else if rev := col.Revision(id); rev != 2 {
+		t.Fatal(rev)
+	}
+	// Re-insertion carries on with the revision
+	newID, err := col.Update(id, []byte("abcdefghijklmnopqrstuvwxyz"))
+	if err != nil || newID == id {
+		t.Fatal(newID, err)
+	} else if rev := col.Revision(newID); rev != 3 {
+		t.Fatal(rev)
+	}
+	if id, err = col.InsertRev([]byte("abc"), 10); err != nil {
+		t.Fatal(err)
+	} else if rev := col.Revision(id); rev != 10 {
+		t.Fatal(rev)
+	}
+	if doc, err := col.ReadDoc(id); err != nil || strings.TrimSpace(string(doc)) != "abc" {
+		t.Fatal(doc, err)
+	}
+}
+
+func TestLegacyFormatRevision(t *testing.T) {
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	d := defaultConfig()
+	d.FormatVersion = FormatHashHeader
+	d.CalculateConfigConstants()
+	col, err := d.OpenCollection(tmp)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+		return
+	}
+	defer col.Close()
+	if col.DocHeaderSize != DocHeader+DocChecksumSize {
+		t.Fatal(col.DocHeaderSize)
+	}
+	// Revision is derived from document content
+	id, err := col.Insert([]byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	abcRev := col.Revision(id)
+	if _, err = col.Update(id, []byte("def")); err != nil {
+		t.Fatal(err)
+	} else if rev := col.Revision(id); rev == abcRev || rev < 0 {
+		t.Fatal(rev, abcRev)
+	}
+	if _, err = col.Update(id, []byte("abc")); err != nil {
+		t.Fatal(err)
+	} else if rev := col.Revision(id); rev != abcRev {
+		t.Fatal(rev, abcRev)
+	}
+}
@@ -0,0 +1,224 @@
+// Online compaction rewrites a partition's live documents into new data and
+// lookup files while the partition remains available for reads and writes.
+//
+// Documents are copied in small batches, each under a brief read lock. IDs of
+// documents inserted, updated or deleted in the meantime are tracked, and are
+// copied again under the exclusive partition lock right before the new files
+// replace the original ones.
+//
+// A swap marker is written before the new files replace the original ones; if
+// the replacement is interrupted, it is finished when the partition is opened
+// again, so that data file and lookup table always belong together.
+
+package data
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	COMPACT_FILE_SUFFIX = ".compact"      // Suffix of the temporary files written by compaction.
+	COMPACT_SWAP_SUFFIX = ".compact-swap" // Suffix of the marker file that exists while compacted files replace the original ones.
+	compactBatches      = 64              // Number of lookup table portions to copy, one at a time.
+)
+
+// Record the ID of a changed document if a compaction or backup is in progress. Caller must hold DataLock exclusively.
+func (part *Partition) noteChange(id int) {
+	if part.changed != nil {
+		part.changed[id] = struct{}{}
+	}
+}
+
+// Copy the current version of a document into the new files, replacing the copy made earlier (if any).
+func (part *Partition) copyDoc(newCol *Collection, newLookup *HashTable, id int) (err error) {
+	for _, physID := range newLookup.Get(id, 0) {
+		newCol.Delete(physID)
+		newLookup.Remove(id, physID)
+	}
+	physID := part.lookup.Get(id, 1)
+	if len(physID) == 0 {
+		return
+	}
+	doc, readErr := part.col.ReadDoc(physID[0])
+	if readErr != nil {
+		tdlog.Noticef("Copy %s: skipped unreadable document %d - %v", part.col.Path, id, readErr)
+		return
+	}
+	newPhysID, err := newCol.InsertRev(doc, part.col.Revision(physID[0]))
+	if err != nil {
+		return
+	}
+	newLookup.Put(id, newPhysID)
+	return
+}
+
+// Copy all documents into the new files batch by batch, each batch under a brief read lock. Caller must not hold DataLock.
+func (part *Partition) copyBatches(newCol *Collection, newLookup *HashTable) (err error) {
+	for batch := 0; batch < compactBatches; batch++ {
+		part.DataLock.RLock()
+		ids, physIDs := part.lookup.GetPartition(batch, compactBatches)
+		for i, id := range ids {
+			doc, readErr := part.col.ReadDoc(physIDs[i])
+			if readErr != nil {
+				tdlog.Noticef("Copy %s: skipped unreadable document %d - %v", part.col.Path, id, readErr)
+				continue
+			}
+			var newPhysID int
+			if newPhysID, err = newCol.InsertRev(doc, part.col.Revision(physIDs[i])); err != nil {
+				part.DataLock.RUnlock()
+				return
+			}
+			newLookup.Put(id, newPhysID)
+		}
+		part.DataLock.RUnlock()
+	}
+	return
+}
+
+// Compact the partition: rewrite all documents into new files without holes, and replace the original files.
+// Readers and writers are only blocked while a batch of documents is copied, and during the final swap.
+// Caller must not hold DataLock.
+func (part *Partition) Compact() (err error) {
+	part.DataLock.Lock()
+	if part.changed != nil {
+		part.DataLock.Unlock()
+		return fmt.Errorf("Partition %s is already being compacted or backed up", part.col.Path)
+	}
+	colPath, lookupPath := part.col.Path, part.lookup.Path
+	if _, err = os.Stat(colPath + COMPACT_SWAP_SUFFIX); err == nil {
+		part.DataLock.Unlock()
+		return fmt.Errorf("Partition %s has not finished an earlier compaction, open it again to finish", colPath)
+	}
+	part.changed = make(map[int]struct{})
+	part.DataLock.Unlock()
+
+	newColPath, newLookupPath := colPath+COMPACT_FILE_SUFFIX, lookupPath+COMPACT_FILE_SUFFIX
+	var newCol *Collection
+	var newLookup *HashTable
+	swapping := false
+	// Clean up after failure
+	defer func() {
+		if err == nil || swapping {
+			return
+		}
+		part.DataLock.Lock()
+		part.changed = nil
+		part.DataLock.Unlock()
+		if newCol != nil {
+			newCol.Close()
+		}
+		if newLookup != nil {
+			newLookup.Close()
+		}
+		os.Remove(newColPath)
+		os.Remove(newLookupPath)
+		os.Remove(newLookupPath + REHASH_FILE_SUFFIX)
+	}()
+	os.Remove(newColPath)
+	os.Remove(newLookupPath)
+	if newCol, err = part.OpenCollection(newColPath); err != nil {
+		return
+	} else if newLookup, err = part.OpenHashTable(newLookupPath); err != nil {
+		return
+	}
+	if err = part.copyBatches(newCol, newLookup); err != nil {
+		return
+	}
+	// Catch up with concurrent changes and swap in the new files
+	part.DataLock.Lock()
+	defer part.DataLock.Unlock()
+	for id := range part.changed {
+		if err = part.copyDoc(newCol, newLookup, id); err != nil {
+			return
+		}
+	}
+	if err = newCol.Shrink(); err != nil {
+		return
+	} else if err = newLookup.completeRehash(); err != nil {
+		// The rehash file would not be found under the original path
+		return
+	}
+	// Once the marker is written, the new files replace the original ones even if the program exits in the meantime
+	if err = writeSwapMarker(colPath + COMPACT_SWAP_SUFFIX); err != nil {
+		return
+	}
+	swapping = true
+	if err = os.Rename(newColPath, colPath); err == nil {
+		newCol.Path = colPath
+		if err = os.Rename(newLookupPath, lookupPath); err == nil {
+			newLookup.Path = lookupPath
+			err = os.Remove(colPath + COMPACT_SWAP_SUFFIX)
+		}
+	}
+	if err != nil {
+		// Carry on with the new files, which belong together, under the paths they have
+		tdlog.CritNoRepeat("Compact %s: failed to replace original files, the partition finishes replacing them when it is opened again - %v", colPath, err)
+	}
+	// The original files are no longer reachable by path, close them to release disk space.
+	oldSize := part.col.Size
+	if closeErr := part.col.Close(); closeErr != nil {
+		tdlog.CritNoRepeat("Compact %s: failed to close original data file - %v", colPath, closeErr)
+	}
+	if closeErr := part.lookup.Close(); closeErr != nil {
+		tdlog.CritNoRepeat("Compact %s: failed to close original lookup table - %v", lookupPath, closeErr)
+	}
+	part.col, part.lookup = newCol, newLookup
+	part.changed = nil
+	tdlog.Noticef("Compact %s: data file size %d -> %d bytes", colPath, oldSize, newCol.Size)
+	return
+}
+
+// Create the marker file and make sure that it is on disk.
+func writeSwapMarker(markerPath string) error {
+	marker, err := os.Create(markerPath)
+	if err != nil {
+		return err
+	} else if err = marker.Sync(); err != nil {
+		marker.Close()
+		return err
+	}
+	return marker.Close()
+}
+
+// Return the files that hold the partition, which are the compacted ones if a compaction was interrupted while
+// replacing the original files by them.
+func compactedFiles(colPath, lookupPath string) (string, string) {
+	if _, err := os.Stat(colPath + COMPACT_SWAP_SUFFIX); err != nil {
+		return colPath, lookupPath
+	}
+	paths := []string{colPath, lookupPath}
+	for i, origPath := range paths {
+		if _, err := os.Stat(origPath + COMPACT_FILE_SUFFIX); err == nil {
+			paths[i] = origPath + COMPACT_FILE_SUFFIX
+		}
+	}
+	return paths[0], paths[1]
+}
+
+// Finish replacing the original files by compacted ones if a compaction was interrupted while doing so, or remove the
+// files left behind by a compaction that was interrupted earlier.
+func finishCompaction(colPath, lookupPath string) error {
+	markerPath := colPath + COMPACT_SWAP_SUFFIX
+	if _, err := os.Stat(markerPath); os.IsNotExist(err) {
+		for _, leftover := range []string{colPath + COMPACT_FILE_SUFFIX, lookupPath + COMPACT_FILE_SUFFIX, lookupPath + COMPACT_FILE_SUFFIX + REHASH_FILE_SUFFIX} {
+			if err = os.Remove(leftover); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, origPath := range []string{colPath, lookupPath} {
+		if _, err := os.Stat(origPath + COMPACT_FILE_SUFFIX); err == nil {
+			if err = os.Rename(origPath+COMPACT_FILE_SUFFIX, origPath); err != nil {
+				return err
+			}
+		}
+	}
+	tdlog.Noticef("Compact %s: finished replacing original files by compacted ones", colPath)
+	return os.Remove(markerPath)
+}
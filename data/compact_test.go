@@ -0,0 +1,195 @@
+package data
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPartitionCompact(t *testing.T) {
+	colPath := "/tmp/tiedot_test_col"
+	htPath := "/tmp/tiedot_test_ht"
+	os.Remove(colPath)
+	os.Remove(htPath)
+	defer os.Remove(colPath)
+	defer os.Remove(htPath)
+	d := defaultConfig()
+	d.ColFileGrowth = 1048576
+	part, err := d.OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fill up more than one file growth, then delete most of the documents
+	docs := make(map[int]string)
+	for i := 0; i < 30000; i++ {
+		if _, err = part.Insert(i, []byte(strconv.Itoa(i)+"-abcdefghijklmnopqrstuvwxyz")); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 0 {
+			docs[i] = strconv.Itoa(i) + "-abcdefghijklmnopqrstuvwxyz"
+			if err = part.Update(i, []byte(docs[i])); err != nil {
+				t.Fatal(err)
+			}
+		} else if err = part.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sizeBefore := part.col.Size
+	// Write concurrently while compaction is going on
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 3000; i += 20 {
+			part.DataLock.Lock()
+			if err := part.Update(i, []byte("updated")); err != nil {
+				t.Error(err)
+			}
+			if err := part.Delete(i + 10); err != nil {
+				t.Error(err)
+			}
+			if _, err := part.Insert(i+100000, []byte("new")); err != nil {
+				t.Error(err)
+			}
+			part.DataLock.Unlock()
+		}
+	}()
+	if err = part.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	for i := 0; i < 3000; i += 20 {
+		docs[i] = "updated"
+		delete(docs, i+10)
+		docs[i+100000] = "new"
+	}
+	// Verify document content, and that the space has been reclaimed
+	if part.col.Size >= sizeBefore || part.col.Path != colPath || part.lookup.Path != htPath {
+		t.Fatal(part.col.Size, sizeBefore, part.col.Path, part.lookup.Path)
+	}
+	if _, err := os.Stat(colPath + COMPACT_FILE_SUFFIX); !os.IsNotExist(err) {
+		t.Fatal("Temporary file is left behind", err)
+	}
+	verify := func() {
+		count := 0
+		part.ForEachDoc(0, 1, func(id int, doc []byte) bool {
+			count++
+			if expected, exists := docs[id]; !exists || strings.TrimSpace(string(doc)) != expected {
+				t.Fatal(id, string(doc), expected)
+			}
+			// Revisions are carried over
+			expectedRev := 2
+			if id >= 100000 {
+				expectedRev = 1
+			} else if id < 3000 && id%20 == 0 {
+				expectedRev = 3
+			}
+			if rev, err := part.Revision(id); err != nil || rev != expectedRev {
+				t.Fatal(id, rev, expectedRev, err)
+			}
+			return true
+		})
+		if count != len(docs) {
+			t.Fatal(count, len(docs))
+		}
+	}
+	verify()
+	// Reopen the compacted partition
+	if err = part.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if part, err = d.OpenPartition(colPath, htPath); err != nil {
+		t.Fatal(err)
+	}
+	verify()
+	if err = part.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionCompactInterruptedSwap(t *testing.T) {
+	colPath := "/tmp/tiedot_test_col"
+	htPath := "/tmp/tiedot_test_ht"
+	os.Remove(colPath)
+	os.RemoveAll(htPath)
+	defer os.Remove(colPath)
+	defer os.RemoveAll(htPath)
+	defer os.Remove(htPath + COMPACT_FILE_SUFFIX)
+	d := defaultConfig()
+	part, err := d.OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err = part.Insert(i, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		} else if i%2 == 1 {
+			if err = part.Delete(i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	verify := func() {
+		count := 0
+		part.ForEachDoc(0, 1, func(id int, doc []byte) bool {
+			count++
+			if id%2 == 1 || strings.TrimSpace(string(doc)) != strconv.Itoa(id) {
+				t.Fatal(id, string(doc))
+			}
+			return true
+		})
+		if count != 500 {
+			t.Fatal(count)
+		}
+		for i := 0; i < 1000; i += 2 {
+			if doc, err := part.Read(i); err != nil || strings.TrimSpace(string(doc)) != strconv.Itoa(i) {
+				t.Fatal(i, string(doc), err)
+			}
+		}
+	}
+	// The lookup table cannot be replaced after the data file has been
+	if err = os.Remove(htPath); err != nil {
+		t.Fatal(err)
+	} else if err = os.MkdirAll(path.Join(htPath, "obstacle"), 0700); err != nil {
+		t.Fatal(err)
+	} else if err = part.Compact(); err == nil {
+		t.Fatal("did not error")
+	} else if _, err = os.Stat(colPath + COMPACT_SWAP_SUFFIX); err != nil {
+		t.Fatal(err)
+	}
+	// The partition carries on with the new data file and lookup table
+	verify()
+	if err = part.Compact(); err == nil {
+		t.Fatal("did not error")
+	} else if err = part.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A read-only partition reads the compacted files without finishing the swap
+	readOnly := *d
+	readOnly.ReadOnly = true
+	if part, err = readOnly.OpenPartition(colPath, htPath); err != nil {
+		t.Fatal(err)
+	}
+	verify()
+	if err = part.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(colPath + COMPACT_SWAP_SUFFIX); err != nil {
+		t.Fatal(err)
+	}
+	// The swap is finished when the partition is opened again
+	if err = os.RemoveAll(htPath); err != nil {
+		t.Fatal(err)
+	} else if part, err = d.OpenPartition(colPath, htPath); err != nil {
+		t.Fatal(err)
+	}
+	defer part.Close()
+	verify()
+	for _, leftover := range []string{colPath + COMPACT_SWAP_SUFFIX, htPath + COMPACT_FILE_SUFFIX} {
+		if _, err = os.Stat(leftover); !os.IsNotExist(err) {
+			t.Fatal(leftover, err)
+		}
+	}
+}
@@ -10,9 +10,21 @@ import (
 
 const (
 	DefaultDocMaxRoom = 2 * 1048576 // DefaultDocMaxRoom is the default maximum size a single document may never exceed.
-	DocHeader         = 1 + 10      // DocHeader is the size of document header fields.
+	DocHeader         = 1 + 10      // DocHeader is the size of document header fields (validity and room).
+	DocChecksumSize   = 4           // DocChecksumSize is the size of document checksum that follows DocHeader in newer format.
+	DocRevisionSize   = 8           // DocRevisionSize is the size of document revision number that follows document checksum in newer format.
 	EntrySize         = 1 + 10 + 10 // EntrySize is the size of a single hash table entry.
 	BucketHeader      = 10          // BucketHeader is the size of hash table bucket's header fields.
+	HashTableHeader   = 64          // HashTableHeader is the size of hash table file header (geometry and rehash progress) in newer format.
+	RehashChainLength = 4           // RehashChainLength is the average number of buckets per chain that triggers doubling of hash table head buckets.
+)
+
+const (
+	FormatLegacy     = 1              // FormatLegacy is the data file format of tiedot 3.4 and older - documents do not carry checksum.
+	FormatChecksum   = 2              // FormatChecksum adds a CRC32C checksum of document room to document header.
+	FormatHashHeader = 3              // FormatHashHeader adds a header of hash table geometry to hash table files, allowing them to rehash.
+	FormatRevision   = 4              // FormatRevision adds a revision number, incremented by every update, to document header.
+	CurrentFormat    = FormatRevision // CurrentFormat is the data file format used by newly created databases.
 )
 
 /*
@@ -25,30 +37,84 @@ type Config struct {
 	PerBucket     int  // PerBucket is the number of entries pre-allocated to each hash table bucket.
 	HTFileGrowth  int  /// HTFileGrowth is the size (in bytes) to grow hash table file to fit in more entries.
 	HashBits      uint // HashBits is the number of bits to consider for hashing indexed key, also determines the initial number of buckets in a hash table file.
+	FormatVersion int  // FormatVersion determines the layout of data files, it is decided upon creation of a new database.
 
 	InitialBuckets int    `json:"-"` // InitialBuckets is the number of buckets initially allocated in a hash table file.
 	Padding        string `json:"-"` // Padding is pre-allocated filler (space characters) for new documents.
 	LenPadding     int    `json:"-"` // LenPadding is the calculated length of Padding string.
 	BucketSize     int    `json:"-"` // BucketSize is the calculated size of each hash table bucket.
+	DocHeaderSize  int    `json:"-"` // DocHeaderSize is the calculated size of document header in the data file format.
+	HTHeaderSize   int    `json:"-"` // HTHeaderSize is the calculated size of hash table file header in the data file format.
+
+	ReadOnly bool `json:"-"` // ReadOnly opens data files for reading, without finishing an interrupted compaction or rehash.
 }
 
 // CalculateConfigConstants assignes internal field values to calculation results derived from other fields.
+// The fields are only written if the results differ, so that files may be opened (e.g. by compaction or backup) while
+// other files of the same configuration are in use.
 func (conf *Config) CalculateConfigConstants() {
-	conf.Padding = strings.Repeat(" ", 128)
-	conf.LenPadding = len(conf.Padding)
+	calc := *conf
+	calc.Padding = strings.Repeat(" ", 128)
+	calc.LenPadding = len(calc.Padding)
+
+	calc.BucketSize = BucketHeader + calc.PerBucket*EntrySize
+	calc.InitialBuckets = 1 << calc.HashBits
 
-	conf.BucketSize = BucketHeader + conf.PerBucket*EntrySize
-	conf.InitialBuckets = 1 << conf.HashBits
+	calc.DocHeaderSize = DocHeader
+	if calc.DocChecksum() {
+		calc.DocHeaderSize += DocChecksumSize
+	}
+	if calc.DocRevision() {
+		calc.DocHeaderSize += DocRevisionSize
+	}
+
+	calc.HTHeaderSize = 0
+	if calc.HashTableRehash() {
+		calc.HTHeaderSize = HashTableHeader
+	}
+	if calc != *conf {
+		*conf = calc
+	}
+}
+
+// DocChecksum returns true if document headers carry a checksum in the data file format.
+func (conf *Config) DocChecksum() bool {
+	return conf.FormatVersion >= FormatChecksum
+}
+
+// DocRevision returns true if document headers carry a revision number in the data file format.
+func (conf *Config) DocRevision() bool {
+	return conf.FormatVersion >= FormatRevision
+}
+
+// HashTableRehash returns true if hash table files carry a header of their own geometry, which allows them to grow the number of head buckets.
+func (conf *Config) HashTableRehash() bool {
+	return conf.FormatVersion >= FormatHashHeader
 }
 
 // CreateOrReadConfig creates default performance configuration underneath the input database directory.
 func CreateOrReadConfig(path string) (conf *Config, err error) {
-	var file *os.File
-	var j []byte
-
 	if err = os.MkdirAll(path, 0700); err != nil {
 		return
 	}
+	return readConfig(path, true)
+}
+
+// ReadConfig reads the performance configuration of the database directory without creating or changing any file,
+// and the configuration opens data files read-only.
+func ReadConfig(path string) (conf *Config, err error) {
+	if conf, err = readConfig(path, false); err != nil {
+		return
+	}
+	conf.ReadOnly = true
+	conf.CalculateConfigConstants()
+	return
+}
+
+// Read the configuration file, or work out the configuration of a database without one and optionally write it down.
+func readConfig(path string, create bool) (conf *Config, err error) {
+	var file *os.File
+	var j []byte
 
 	filePath := fmt.Sprintf("%s/data-config.json", path)
 
@@ -59,8 +125,19 @@ func CreateOrReadConfig(path string) (conf *Config, err error) {
 	if file, err = os.OpenFile(filePath, os.O_RDONLY, 0644); err != nil {
 		if _, ok := err.(*os.PathError); ok {
 			// if we could not find the file because it doesn't exist, lets create it
-			// so the database always runs with these settings
+			// so the database always runs with these settings; collections that
+			// exist without the file belong to an older version of tiedot
 			err = nil
+			var legacy bool
+			if legacy, err = holdsCollections(path); err != nil {
+				return
+			} else if legacy {
+				conf.FormatVersion = FormatLegacy
+				conf.CalculateConfigConstants()
+			}
+			if !create {
+				return
+			}
 
 			if file, err = os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644); err != nil {
 				return
@@ -81,7 +158,9 @@ func CreateOrReadConfig(path string) (conf *Config, err error) {
 		}
 	} else {
 		// if we find the file we will leave it as it is and merge
-		// it into the default
+		// it into the default; a file without format version belongs
+		// to a database created by an older version of tiedot
+		conf.FormatVersion = FormatLegacy
 		var b []byte
 		if b, err = ioutil.ReadAll(file); err != nil {
 			return
@@ -97,6 +176,23 @@ func CreateOrReadConfig(path string) (conf *Config, err error) {
 	return
 }
 
+// Return true if the database directory already has collection directories in it. Hidden directories (e.g. change
+// log) are not collections.
+func holdsCollections(path string) (bool, error) {
+	content, err := ioutil.ReadDir(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, file := range content {
+		if file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func defaultConfig() *Config {
 	/*
 		The default configuration matches the constants defined in tiedot version 3.2 and older. They correspond to ~16MB
@@ -108,6 +204,7 @@ func defaultConfig() *Config {
 		PerBucket:     16,
 		HTFileGrowth:  HT_FILE_GROWTH,
 		HashBits:      HASH_BITS,
+		FormatVersion: CurrentFormat,
 	}
 
 	ret.CalculateConfigConstants()
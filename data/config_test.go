@@ -16,12 +16,13 @@ func TestEmtpyJsonConfig(t *testing.T) {
 		PerBucket:     16,
 		HTFileGrowth:  HT_FILE_GROWTH,
 		HashBits:      HASH_BITS,
+		FormatVersion: CurrentFormat,
 	}
 	d.CalculateConfigConstants()
 
 	tmp := "/tmp/tiedot_config_test_empty"
-	os.Remove(tmp)
-	defer os.Remove(tmp)
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
 
 	if err := verifyConfigFromPath(tmp, d); err != nil {
 		t.Fatal(err)
@@ -38,12 +39,13 @@ func TestConfiguredJsonConfig(t *testing.T) {
 		PerBucket:     16,
 		HTFileGrowth:  1048576,
 		HashBits:      11,
+		FormatVersion: FormatLegacy,
 	}
 	d.CalculateConfigConstants()
 
 	tmp := "/tmp/tiedot_config_test_configured"
-	os.Remove(tmp)
-	defer os.Remove(tmp)
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
 
 	if err := os.MkdirAll(tmp, 0700); err != nil {
 		t.Fatal(err)
@@ -106,9 +108,40 @@ func matchConfig(d1, d2 *Config) error {
 		return fmt.Errorf("HTFileGrowth configs differ %v != %v", d1.HTFileGrowth, d2.HTFileGrowth)
 	}
 
+	if d1.FormatVersion != d2.FormatVersion || d1.DocHeaderSize != d2.DocHeaderSize {
+		return fmt.Errorf("FormatVersion configs differ %v != %v", d1.FormatVersion, d2.FormatVersion)
+	}
+
+	if d1.HTHeaderSize != d2.HTHeaderSize {
+		return fmt.Errorf("HTHeaderSize configs differ %v != %v", d1.HTHeaderSize, d2.HTHeaderSize)
+	}
 	if d1.InitialBuckets != d2.InitialBuckets {
 		return fmt.Errorf("InitialBuckets configs differ %v != %v", d1.InitialBuckets, d2.InitialBuckets)
 	}
 
 	return nil
 }
+
+/*
+  Set up the configs when collections exist without a file
+*/
+func TestLegacyCollectionsConfig(t *testing.T) {
+	d := defaultConfig()
+	d.FormatVersion = FormatLegacy
+	d.CalculateConfigConstants()
+
+	tmp := "/tmp/tiedot_config_test_legacy"
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+
+	if err := os.MkdirAll(tmp+"/col", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyConfigFromPath(tmp, d); err != nil {
+		t.Fatal(err)
+	}
+	// The format is recorded for the next time
+	if err := verifyConfigFromPath(tmp, d); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,6 +3,7 @@
 package data
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/HouzuoGuo/tiedot/gommap"
@@ -33,8 +34,18 @@ func LooksEmpty(buf gommap.MMap) bool {
 
 // Open a data file that grows by the specified size.
 func OpenDataFile(path string, growth int) (file *DataFile, err error) {
+	return openDataFile(path, growth, false)
+}
+
+// Open a data file, a read-only file is mapped copy-on-write so that nothing is ever written into it.
+func openDataFile(path string, growth int, readOnly bool) (file *DataFile, err error) {
 	file = &DataFile{Path: path, Growth: growth}
-	if file.Fh, err = os.OpenFile(file.Path, os.O_CREATE|os.O_RDWR, 0600); err != nil {
+	if readOnly {
+		file.Fh, err = os.Open(file.Path)
+	} else {
+		file.Fh, err = os.OpenFile(file.Path, os.O_CREATE|os.O_RDWR, 0600)
+	}
+	if err != nil {
 		return
 	}
 	var size int64
@@ -42,7 +53,14 @@ func OpenDataFile(path string, growth int) (file *DataFile, err error) {
 		return
 	}
 	// Ensure the file is not smaller than file growth
-	if file.Size = int(size); file.Size < file.Growth {
+	if file.Size = int(size); readOnly {
+		if file.Size == 0 {
+			file.Fh.Close()
+			return nil, fmt.Errorf("%s is empty", file.Path)
+		} else if file.Buf, err = gommap.MapPrivate(file.Fh); err != nil {
+			return
+		}
+	} else if file.Size < file.Growth {
 		if err = file.EnsureSize(file.Growth); err != nil {
 			return
 		}
@@ -116,6 +134,24 @@ func (file *DataFile) EnsureSize(more int) (err error) {
 	return file.EnsureSize(more)
 }
 
+// Truncate the file to the smallest size (in multiples of 4KB) that holds the used portion, and release the rest of disk space.
+func (file *DataFile) Shrink() (err error) {
+	newSize := (file.Used/4096 + 1) * 4096
+	if newSize >= file.Size {
+		return
+	}
+	if err = file.Buf.Unmap(); err != nil {
+		return
+	} else if err = file.Fh.Truncate(int64(newSize)); err != nil {
+		return
+	} else if file.Buf, err = gommap.Map(file.Fh); err != nil {
+		return
+	}
+	tdlog.Infof("%s shrunk: %d -> %d bytes (%d bytes in-use)", file.Path, file.Size, newSize, file.Used)
+	file.Size = newSize
+	return
+}
+
 // Un-map the file buffer and close the file handle.
 func (file *DataFile) Close() (err error) {
 	if err = file.Buf.Unmap(); err != nil {
@@ -0,0 +1,88 @@
+// Free space map keeps track of the room left behind by deleted and relocated
+// documents, so that new documents may be inserted into the holes instead of
+// growing the data file.
+//
+// Holes are grouped into size classes by the bit length of their room; the
+// map is not persisted, it is rebuilt by walking the data file upon opening.
+
+package data
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// A hole left behind by a deleted document.
+type hole struct {
+	id, room int
+}
+
+// FreeSpace is a collection of free lists, one per size class.
+type FreeSpace struct {
+	classes [][]hole
+	total   int // total amount of free room in bytes
+}
+
+// Return the size class of a document room.
+func sizeClass(room int) int {
+	return bits.Len(uint(room))
+}
+
+// Record a hole of the given room at the physical document location.
+func (free *FreeSpace) Put(id, room int) {
+	class := sizeClass(room)
+	for len(free.classes) <= class {
+		free.classes = append(free.classes, nil)
+	}
+	free.classes[class] = append(free.classes[class], hole{id: id, room: room})
+	free.total += room
+}
+
+// Take a hole that is at least as large as the room, return its location and actual room.
+// To limit wasted space, only holes of the same or the next size class are considered.
+func (free *FreeSpace) Take(room int) (id, actualRoom int, found bool) {
+	class := sizeClass(room)
+	for c := class; c <= class+1 && c < len(free.classes); c++ {
+		list := free.classes[c]
+		for i := len(list) - 1; i >= 0; i-- {
+			if list[i].room >= room {
+				id, actualRoom = list[i].id, list[i].room
+				list[i] = list[len(list)-1]
+				free.classes[c] = list[:len(list)-1]
+				free.total -= actualRoom
+				return id, actualRoom, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// Return the total amount of free room.
+func (free *FreeSpace) Total() int {
+	return free.total
+}
+
+// Forget all holes.
+func (free *FreeSpace) Clear() {
+	free.classes = nil
+	free.total = 0
+}
+
+// Walk through the data file and record the room of every deleted document.
+func (col *Collection) rebuildFreeSpace() {
+	col.free.Clear()
+	for id := 0; id < col.Used-col.DocHeaderSize && id >= 0; {
+		validity := col.Buf[id]
+		room, _ := binary.Varint(col.Buf[id+1 : id+11])
+		docEnd := id + col.DocHeaderSize + int(room)
+		if (validity == 0 || validity == 1) && room >= 0 && room <= int64(col.DocMaxRoom) && docEnd > 0 && docEnd <= col.Used {
+			if validity == 0 {
+				col.free.Put(id, int(room))
+			}
+			id = docEnd
+		} else {
+			// Corrupted document - move on
+			id++
+		}
+	}
+}
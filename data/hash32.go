@@ -5,9 +5,15 @@ package data
 const (
 	HT_FILE_GROWTH = 8 * 1048576 // Default hash table file initial size & file growth
 	HASH_BITS      = 14          // Default nNumber of hash key bits
+	MAX_HASH_BITS  = 18          // Maximum number of hash key bits a hash table may grow to
 )
 
 // Return the portion (first HASH_BITS bytes) used for allocating the entry. The integer smearing process does not apply to 32-bit system.
 func (conf *Config) HashKey(key int) int {
-	return key & ((1 << conf.HashBits) - 1)
+	return hashKey(key, conf.HashBits)
+}
+
+// Return the portion (first bits) used for allocating the entry.
+func hashKey(key int, bits uint) int {
+	return key & ((1 << bits) - 1)
 }
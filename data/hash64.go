@@ -5,14 +5,21 @@ package data
 const (
 	HT_FILE_GROWTH = 32 * 1048576 // Default hash table file initial size & file growth
 	HASH_BITS      = 16           // Default number of hash key bits
+	MAX_HASH_BITS  = 24           // Maximum number of hash key bits a hash table may grow to
 )
 
 // Smear the integer entry key and return the portion (first HASH_BITS bytes) used for allocating the entry.
 func (conf *Config) HashKey(key int) int {
+	return hashKey(key, conf.HashBits)
+}
+
+// Smear the integer entry key and return the portion (first bits) used for allocating the entry.
+// Smearing does not depend on the number of bits, hence doubling the buckets splits every bucket into two.
+func hashKey(key int, bits uint) int {
 	// ========== Integer-smear start =======
 	key = key ^ (key >> 4)
 	key = (key ^ 0xdeadbeef) + (key << 5)
 	key = key ^ (key >> 11)
 	// ========== Integer-smear end =========
-	return key & ((1 << conf.HashBits) - 1)
+	return key & ((1 << bits) - 1)
 }
@@ -8,11 +8,17 @@
 // integer key and value. An entry key may have multiple values assigned to it,
 // however the combination of entry key and value must be unique across the
 // entire hash table.
+//
+// In newer data format, the file begins with a header that records the number of
+// head buckets. When chains become too long on average, the entries are moved
+// into a new file with twice as many head buckets, a few head buckets at a time
+// with every write, and the new file eventually replaces the original.
 
 package data
 
 import (
 	"encoding/binary"
+	"fmt"
 	"sync"
 
 	"github.com/HouzuoGuo/tiedot/tdlog"
@@ -24,31 +30,106 @@ type HashTable struct {
 	*DataFile
 	numBuckets int
 	Lock       *sync.RWMutex
+	headerSize int        // size of file header, 0 in legacy format
+	hashBits   uint       // number of hash key bits, decides the number of head buckets
+	baseBits   uint       // number of hash key bits upon creation, decides the partitioning of entries
+	rehash     *HashTable // the table with twice as many head buckets that entries are being moved into
+	rehashNext int        // the next head bucket to be moved into rehash table
 }
 
 // Open a hash table file.
 func (conf *Config) OpenHashTable(path string) (ht *HashTable, err error) {
-	ht = &HashTable{Config: conf, Lock: new(sync.RWMutex)}
-	if ht.DataFile, err = OpenDataFile(path, ht.HTFileGrowth); err != nil {
+	conf.CalculateConfigConstants()
+	return conf.openHashTable(path, conf.HashBits, conf.HashBits, new(sync.RWMutex))
+}
+
+// Open a hash table file, a new file is given the number of hash key bits.
+func (conf *Config) openHashTable(path string, hashBits, baseBits uint, lock *sync.RWMutex) (ht *HashTable, err error) {
+	ht = &HashTable{Config: conf, Lock: lock, hashBits: hashBits, baseBits: baseBits}
+	if ht.DataFile, err = openDataFile(path, ht.HTFileGrowth, conf.ReadOnly); err != nil {
 		return
 	}
 	conf.CalculateConfigConstants()
+	ht.headerSize = conf.HTHeaderSize
+	// A read-only file cannot grow to hold its head buckets
+	if conf.ReadOnly && ht.Size < ht.headerSize {
+		ht.DataFile.Close()
+		return nil, fmt.Errorf("%s is too small for its header", ht.Path)
+	}
+	rehashing := ht.readHeader()
+	if conf.ReadOnly && ht.bucketAddr(ht.numHeads()) > ht.Size {
+		ht.DataFile.Close()
+		return nil, fmt.Errorf("%s is too small for %d head buckets", ht.Path, ht.numHeads())
+	}
 	ht.calculateNumBuckets()
+	if rehashing {
+		err = ht.resumeRehash()
+	}
 	return
 }
 
+// Read hash table geometry and rehash progress from file header, initialise the header of a new file.
+func (ht *HashTable) readHeader() (rehashing bool) {
+	if ht.headerSize == 0 {
+		return false
+	}
+	hashBits, _ := binary.Varint(ht.Buf[0:10])
+	baseBits, _ := binary.Varint(ht.Buf[10:20])
+	progress, _ := binary.Varint(ht.Buf[20:30])
+	if hashBits == 0 {
+		// New file
+		ht.writeHeader()
+		return false
+	} else if hashBits < baseBits || baseBits < 1 || hashBits > MAX_HASH_BITS || progress < 0 || progress > 1<<uint(hashBits)+1 {
+		tdlog.CritNoRepeat("Bad hash table header - repair ASAP %s", ht.Path)
+		return false
+	}
+	ht.hashBits, ht.baseBits = uint(hashBits), uint(baseBits)
+	ht.rehashNext = int(progress) - 1
+	return progress > 0
+}
+
+// Write hash table geometry and rehash progress into file header.
+func (ht *HashTable) writeHeader() {
+	if ht.headerSize == 0 {
+		return
+	}
+	progress := 0
+	if ht.rehash != nil {
+		progress = ht.rehashNext + 1
+	}
+	binary.PutVarint(ht.Buf[0:10], int64(ht.hashBits))
+	binary.PutVarint(ht.Buf[10:20], int64(ht.baseBits))
+	binary.PutVarint(ht.Buf[20:30], int64(progress))
+}
+
+// Return the number of head buckets.
+func (ht *HashTable) numHeads() int {
+	return 1 << ht.hashBits
+}
+
+// Return the position of a bucket in the file.
+func (ht *HashTable) bucketAddr(bucket int) int {
+	return ht.headerSize + bucket*ht.BucketSize
+}
+
+// Return the head bucket of the key.
+func (ht *HashTable) HashKey(key int) int {
+	return hashKey(key, ht.hashBits)
+}
+
 // Follow the longest bucket chain to calculate total number of buckets, hence the "used size" of hash table file.
 func (ht *HashTable) calculateNumBuckets() {
-	ht.numBuckets = ht.Size / ht.BucketSize
-	largestBucketNum := ht.InitialBuckets - 1
-	for i := 0; i < ht.InitialBuckets; i++ {
+	ht.numBuckets = (ht.Size - ht.headerSize) / ht.BucketSize
+	largestBucketNum := ht.numHeads() - 1
+	for i := 0; i < ht.numHeads(); i++ {
 		lastBucket := ht.lastBucket(i)
 		if lastBucket > largestBucketNum && lastBucket < ht.numBuckets {
 			largestBucketNum = lastBucket
 		}
 	}
 	ht.numBuckets = largestBucketNum + 1
-	usedSize := ht.numBuckets * ht.BucketSize
+	usedSize := ht.bucketAddr(ht.numBuckets)
 	if usedSize > ht.Size {
 		ht.Used = ht.Size
 		ht.EnsureSize(usedSize - ht.Used)
@@ -62,12 +143,12 @@ func (ht *HashTable) nextBucket(bucket int) int {
 	if bucket >= ht.numBuckets {
 		return 0
 	}
-	bucketAddr := bucket * ht.BucketSize
+	bucketAddr := ht.bucketAddr(bucket)
 	nextUint, err := binary.Varint(ht.Buf[bucketAddr : bucketAddr+10])
 	next := int(nextUint)
 	if next == 0 {
 		return 0
-	} else if err < 0 || next <= bucket || next >= ht.numBuckets || next < ht.InitialBuckets {
+	} else if err < 0 || next <= bucket || next >= ht.numBuckets || next < ht.numHeads() {
 		tdlog.CritNoRepeat("Bad hash table - repair ASAP %s", ht.Path)
 		return 0
 	} else {
@@ -89,25 +170,65 @@ func (ht *HashTable) lastBucket(bucket int) int {
 // Create and chain a new bucket.
 func (ht *HashTable) growBucket(bucket int) {
 	ht.EnsureSize(ht.BucketSize)
-	lastBucketAddr := ht.lastBucket(bucket) * ht.BucketSize
+	lastBucketAddr := ht.bucketAddr(ht.lastBucket(bucket))
 	binary.PutVarint(ht.Buf[lastBucketAddr:lastBucketAddr+10], int64(ht.numBuckets))
 	ht.Used += ht.BucketSize
 	ht.numBuckets++
 }
 
-// Clear the entire hash table.
+// Clear the entire hash table, and shrink it back to the initial number of head buckets.
 func (ht *HashTable) Clear() (err error) {
+	if ht.rehash != nil {
+		ht.abandonRehash()
+	}
 	if err = ht.DataFile.Clear(); err != nil {
 		return
 	}
+	ht.hashBits = ht.baseBits
+	ht.writeHeader()
 	ht.calculateNumBuckets()
 	return
 }
 
+// Close the hash table file, as well as the file that entries are being moved into.
+func (ht *HashTable) Close() (err error) {
+	if ht.rehash != nil {
+		if err = ht.rehash.Close(); err != nil {
+			return
+		}
+	}
+	return ht.DataFile.Close()
+}
+
+// Return the table that holds the entries of the key - the rehash table if the key's head bucket has been moved.
+func (ht *HashTable) route(key int) *HashTable {
+	if ht.rehash != nil && ht.HashKey(key) < ht.rehashNext {
+		return ht.rehash
+	}
+	return ht
+}
+
 // Store the entry into a vacant (invalidated or empty) place in the appropriate bucket.
 func (ht *HashTable) Put(key, val int) {
+	ht.stepRehash()
+	ht.route(key).put(key, val)
+}
+
+// Look up values by key.
+func (ht *HashTable) Get(key, limit int) (vals []int) {
+	return ht.route(key).get(key, limit)
+}
+
+// Flag an entry as invalid, so that Get will not return it later on.
+func (ht *HashTable) Remove(key, val int) {
+	ht.stepRehash()
+	ht.route(key).remove(key, val)
+}
+
+// Store the entry into a vacant place in this table, regardless of rehash progress.
+func (ht *HashTable) put(key, val int) {
 	for bucket, entry := ht.HashKey(key), 0; ; {
-		entryAddr := bucket*ht.BucketSize + BucketHeader + entry*EntrySize
+		entryAddr := ht.bucketAddr(bucket) + BucketHeader + entry*EntrySize
 		if ht.Buf[entryAddr] != 1 {
 			ht.Buf[entryAddr] = 1
 			binary.PutVarint(ht.Buf[entryAddr+1:entryAddr+11], int64(key))
@@ -118,22 +239,22 @@ func (ht *HashTable) Put(key, val int) {
 			entry = 0
 			if bucket = ht.nextBucket(bucket); bucket == 0 {
 				ht.growBucket(ht.HashKey(key))
-				ht.Put(key, val)
+				ht.put(key, val)
 				return
 			}
 		}
 	}
 }
 
-// Look up values by key.
-func (ht *HashTable) Get(key, limit int) (vals []int) {
+// Look up values by key in this table, regardless of rehash progress.
+func (ht *HashTable) get(key, limit int) (vals []int) {
 	if limit == 0 {
 		vals = make([]int, 0, 10)
 	} else {
 		vals = make([]int, 0, limit)
 	}
 	for count, entry, bucket := 0, 0, ht.HashKey(key); ; {
-		entryAddr := bucket*ht.BucketSize + BucketHeader + entry*EntrySize
+		entryAddr := ht.bucketAddr(bucket) + BucketHeader + entry*EntrySize
 		entryKey, _ := binary.Varint(ht.Buf[entryAddr+1 : entryAddr+11])
 		entryVal, _ := binary.Varint(ht.Buf[entryAddr+11 : entryAddr+21])
 		if ht.Buf[entryAddr] == 1 {
@@ -155,10 +276,10 @@ func (ht *HashTable) Get(key, limit int) (vals []int) {
 	}
 }
 
-// Flag an entry as invalid, so that Get will not return it later on.
-func (ht *HashTable) Remove(key, val int) {
+// Flag an entry as invalid in this table, regardless of rehash progress.
+func (ht *HashTable) remove(key, val int) {
 	for entry, bucket := 0, ht.HashKey(key); ; {
-		entryAddr := bucket*ht.BucketSize + BucketHeader + entry*EntrySize
+		entryAddr := ht.bucketAddr(bucket) + BucketHeader + entry*EntrySize
 		entryKey, _ := binary.Varint(ht.Buf[entryAddr+1 : entryAddr+11])
 		entryVal, _ := binary.Varint(ht.Buf[entryAddr+11 : entryAddr+21])
 		if ht.Buf[entryAddr] == 1 {
@@ -180,8 +301,13 @@ func (ht *HashTable) Remove(key, val int) {
 
 // Divide the entire hash table into roughly equally sized partitions, and return the start/end key range of the chosen partition.
 func (conf *Config) GetPartitionRange(partNum, totalParts int) (start int, end int) {
-	perPart := conf.InitialBuckets / totalParts
-	leftOver := conf.InitialBuckets % totalParts
+	return partitionRange(conf.InitialBuckets, partNum, totalParts)
+}
+
+// Divide the head buckets into roughly equally sized partitions, and return the start/end head bucket of the chosen partition.
+func partitionRange(numHeads, partNum, totalParts int) (start int, end int) {
+	perPart := numHeads / totalParts
+	leftOver := numHeads % totalParts
 	start = partNum * perPart
 	if leftOver > 0 {
 		if partNum == 0 {
@@ -195,7 +321,7 @@ func (conf *Config) GetPartitionRange(partNum, totalParts int) (start int, end i
 	}
 	end += start + perPart
 	if partNum == totalParts-1 {
-		end = conf.InitialBuckets
+		end = numHeads
 	}
 	return
 }
@@ -206,7 +332,7 @@ func (ht *HashTable) collectEntries(head int) (keys, vals []int) {
 	vals = make([]int, 0, ht.PerBucket)
 	var entry, bucket int = 0, head
 	for {
-		entryAddr := bucket*ht.BucketSize + BucketHeader + entry*EntrySize
+		entryAddr := ht.bucketAddr(bucket) + BucketHeader + entry*EntrySize
 		entryKey, _ := binary.Varint(ht.Buf[entryAddr+1 : entryAddr+11])
 		entryVal, _ := binary.Varint(ht.Buf[entryAddr+11 : entryAddr+21])
 		if ht.Buf[entryAddr] == 1 {
@@ -225,15 +351,27 @@ func (ht *HashTable) collectEntries(head int) (keys, vals []int) {
 }
 
 // Return all entries in the chosen partition.
+// Partitions are made of the head buckets the table was created with, so that they stay the same as the table grows.
 func (ht *HashTable) GetPartition(partNum, partSize int) (keys, vals []int) {
-	rangeStart, rangeEnd := ht.GetPartitionRange(partNum, partSize)
-	prealloc := (rangeEnd - rangeStart) * ht.PerBucket
+	baseHeads := 1 << ht.baseBits
+	rangeStart, rangeEnd := partitionRange(baseHeads, partNum, partSize)
+	prealloc := (rangeEnd - rangeStart) * (ht.numHeads() / baseHeads) * ht.PerBucket
 	keys = make([]int, 0, prealloc)
 	vals = make([]int, 0, prealloc)
-	for head := rangeStart; head < rangeEnd; head++ {
-		k, v := ht.collectEntries(head)
+	collect := func(table *HashTable, head int) {
+		k, v := table.collectEntries(head)
 		keys = append(keys, k...)
 		vals = append(vals, v...)
 	}
+	for base := rangeStart; base < rangeEnd; base++ {
+		for head := base; head < ht.numHeads(); head += baseHeads {
+			if ht.rehash != nil && head < ht.rehashNext {
+				collect(ht.rehash, head)
+				collect(ht.rehash, head+ht.numHeads())
+			} else {
+				collect(ht, head)
+			}
+		}
+	}
 	return
 }
@@ -16,8 +16,8 @@ func TestPutGetReopenClear(t *testing.T) {
 		t.Fatalf("Failed to open: %v", err)
 	}
 	// Test initial size information
-	if !(ht.numBuckets == d.InitialBuckets && ht.Used == d.InitialBuckets*d.BucketSize && ht.Size == d.HTFileGrowth) {
-		t.Fatal("Wrong size", ht.numBuckets, d.InitialBuckets, ht.Used, d.InitialBuckets*d.BucketSize, ht.Size, d.HTFileGrowth)
+	if !(ht.numBuckets == d.InitialBuckets && ht.Used == d.HTHeaderSize+d.InitialBuckets*d.BucketSize && ht.Size == d.HTFileGrowth) {
+		t.Fatal("Wrong size", ht.numBuckets, d.InitialBuckets, ht.Used, d.HTHeaderSize+d.InitialBuckets*d.BucketSize, ht.Size, d.HTFileGrowth)
 	}
 	for i := int(0); i < 1024*1024; i++ {
 		ht.Put(i, i)
@@ -40,7 +40,7 @@ func TestPutGetReopenClear(t *testing.T) {
 	if reopened.numBuckets != numBuckets {
 		t.Fatalf("Wrong numBuckets %d, expected %d", reopened.numBuckets, numBuckets)
 	}
-	if reopened.Used != numBuckets*d.BucketSize {
+	if reopened.Used != d.HTHeaderSize+numBuckets*d.BucketSize {
 		t.Fatalf("Wrong UsedSize")
 	}
 	for i := int(0); i < 1024*1024; i++ {
@@ -53,7 +53,7 @@ func TestPutGetReopenClear(t *testing.T) {
 	if err = reopened.Clear(); err != nil {
 		t.Fatal(err)
 	}
-	if !(reopened.numBuckets == d.InitialBuckets && reopened.Used == d.InitialBuckets*d.BucketSize) {
+	if !(reopened.numBuckets == d.InitialBuckets && reopened.Used == d.HTHeaderSize+d.InitialBuckets*d.BucketSize) {
 		t.Fatal("Did not clear the hash table")
 	}
 	allKV := make(map[int]int)
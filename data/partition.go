@@ -21,6 +21,8 @@ type Partition struct {
 
 	exclUpdate     map[int]chan struct{}
 	exclUpdateLock *sync.Mutex // guard against concurrent exclusive locking of documents
+
+	changed map[int]struct{} // IDs of documents changed during an online compaction or backup, guarded by DataLock
 }
 
 func (conf *Config) newPartition() *Partition {
@@ -37,6 +39,11 @@ func (conf *Config) newPartition() *Partition {
 func (conf *Config) OpenPartition(colPath, lookupPath string) (part *Partition, err error) {
 	part = conf.newPartition()
 	part.CalculateConfigConstants()
+	if conf.ReadOnly {
+		colPath, lookupPath = compactedFiles(colPath, lookupPath)
+	} else if err = finishCompaction(colPath, lookupPath); err != nil {
+		return
+	}
 	if part.col, err = conf.OpenCollection(colPath); err != nil {
 		return
 	} else if part.lookup, err = conf.OpenHashTable(lookupPath); err != nil {
@@ -47,14 +54,25 @@ func (conf *Config) OpenPartition(colPath, lookupPath string) (part *Partition,
 
 // Insert a document. The ID may be used to retrieve/update/delete the document later on.
 func (part *Partition) Insert(id int, data []byte) (physID int, err error) {
-	physID, err = part.col.Insert(data)
+	return part.InsertRev(id, data, 1)
+}
+
+// Insert a document that carries the revision number, e.g. a document recovered from another partition.
+func (part *Partition) InsertRev(id int, data []byte, rev int) (physID int, err error) {
+	physID, err = part.col.InsertRev(data, rev)
 	if err != nil {
 		return
 	}
 	part.lookup.Put(id, physID)
+	part.noteChange(id)
 	return
 }
 
+// Return true if a document exists under the ID.
+func (part *Partition) Exists(id int) bool {
+	return len(part.lookup.Get(id, 1)) > 0
+}
+
 // Find and retrieve a document by ID.
 func (part *Partition) Read(id int) ([]byte, error) {
 	physID := part.lookup.Get(id, 1)
@@ -63,15 +81,31 @@ func (part *Partition) Read(id int) ([]byte, error) {
 		return nil, dberr.New(dberr.ErrorNoDoc, id)
 	}
 
-	data := part.col.Read(physID[0])
+	data, err := part.col.ReadDoc(physID[0])
 
-	if data == nil {
+	if dberr.Type(err) == dberr.ErrorDocCorrupted {
+		return nil, dberr.New(dberr.ErrorDocCorrupted, id)
+	} else if err != nil {
 		return nil, dberr.New(dberr.ErrorNoDoc, id)
 	}
 
 	return data, nil
 }
 
+// Find and retrieve a document and its revision number by ID.
+func (part *Partition) ReadRev(id int) (data []byte, rev int, err error) {
+	if data, err = part.Read(id); err != nil {
+		return
+	}
+	return data, part.col.Revision(part.lookup.Get(id, 1)[0]), nil
+}
+
+// Return the revision number of a document.
+func (part *Partition) Revision(id int) (int, error) {
+	_, rev, err := part.ReadRev(id)
+	return rev, err
+}
+
 // Update a document.
 func (part *Partition) Update(id int, data []byte) (err error) {
 	physID := part.lookup.Get(id, 1)
@@ -86,6 +120,7 @@ func (part *Partition) Update(id int, data []byte) (err error) {
 		part.lookup.Remove(id, physID[0])
 		part.lookup.Put(id, newID)
 	}
+	part.noteChange(id)
 	return
 }
 
@@ -123,6 +158,7 @@ func (part *Partition) Delete(id int) (err error) {
 	}
 	part.col.Delete(physID[0])
 	part.lookup.Remove(id, physID[0])
+	part.noteChange(id)
 	return
 }
 
@@ -140,6 +176,17 @@ func (part *Partition) ForEachDoc(partNum, totalPart int, fun func(id int, doc [
 	return true
 }
 
+// Return IDs of documents that are addressed by the lookup table but cannot be read (e.g. checksum mismatch).
+func (part *Partition) CorruptDocIDs() (ids []int) {
+	keys, physIDs := part.lookup.GetPartition(0, 1)
+	for i, id := range keys {
+		if _, err := part.col.ReadDoc(physIDs[i]); err != nil {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
 // Return approximate number of documents in the partition.
 func (part *Partition) ApproxDocCount() int {
 	totalPart := 24 // not magic; a larger number makes estimation less accurate, but improves performance
@@ -63,6 +63,17 @@ func TestPartitionDocCRUD(t *testing.T) {
 		}
 		return true
 	})
+	// Corrupt a document
+	if corrupted := part.CorruptDocIDs(); len(corrupted) != 0 {
+		t.Fatal(corrupted)
+	}
+	part.col.Buf[part.lookup.Get(2, 1)[0]+part.DocHeaderSize] = 'x'
+	if _, err = part.Read(2); dberr.Type(err) != dberr.ErrorDocCorrupted {
+		t.Fatal("Did not detect corruption", err)
+	}
+	if corrupted := part.CorruptDocIDs(); len(corrupted) != 1 || corrupted[0] != 2 {
+		t.Fatal(corrupted)
+	}
 	// Finish up
 	if err = part.Clear(); err != nil {
 		t.Fatal(err)
@@ -0,0 +1,143 @@
+// Incremental rehashing doubles the number of head buckets of a hash table
+// whose chains have become too long on average.
+//
+// Entries are moved into a new file with twice as many head buckets, a few
+// head buckets at a time with every write. Until all head buckets are moved,
+// an entry is looked up in the new file if its head bucket has been moved, or
+// otherwise in the original file. The rehash progress is recorded in the file
+// header of the original, so that rehashing resumes after the table is opened
+// again. Eventually the new file replaces the original.
+
+package data
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	REHASH_FILE_SUFFIX = ".rehash" // Suffix of the hash table file that entries are being moved into.
+	rehashStepHeads    = 2         // Number of head buckets to move into the rehash table upon every write.
+)
+
+// Move a few head buckets into the rehash table, or begin rehashing if chains have become too long on average.
+// Caller must hold the table lock exclusively.
+func (ht *HashTable) stepRehash() {
+	if ht.rehash == nil {
+		if ht.headerSize > 0 && ht.hashBits < MAX_HASH_BITS && ht.numBuckets > RehashChainLength*ht.numHeads() {
+			ht.startRehash()
+		}
+		return
+	}
+	for i := 0; i < rehashStepHeads && ht.rehashNext < ht.numHeads(); i++ {
+		ht.moveHead(ht.rehashNext)
+	}
+	if ht.rehashNext == ht.numHeads() {
+		ht.finishRehash()
+	}
+}
+
+// Create the rehash table with twice as many head buckets.
+func (ht *HashTable) startRehash() {
+	path := ht.Path + REHASH_FILE_SUFFIX
+	os.Remove(path)
+	rehash, err := ht.openHashTable(path, ht.hashBits+1, ht.baseBits, ht.Lock)
+	if err != nil {
+		tdlog.CritNoRepeat("Failed to begin rehashing %s: %v", ht.Path, err)
+		return
+	}
+	ht.rehash, ht.rehashNext = rehash, 0
+	ht.writeHeader()
+	tdlog.Infof("%s: rehashing %d buckets into %d head buckets", ht.Path, ht.numBuckets, rehash.numHeads())
+}
+
+// Open the rehash table of an unfinished rehashing.
+func (ht *HashTable) resumeRehash() (err error) {
+	path := ht.Path + REHASH_FILE_SUFFIX
+	if _, statErr := os.Stat(path); statErr != nil && ht.ReadOnly {
+		return fmt.Errorf("Rehash file %s is missing", path)
+	} else if statErr != nil {
+		tdlog.CritNoRepeat("Rehash file %s is missing, rehashing starts over and may have lost entries - repair ASAP", path)
+		ht.rehashNext = 0
+	}
+	if ht.rehash, err = ht.openHashTable(path, ht.hashBits+1, ht.baseBits, ht.Lock); err != nil {
+		return
+	} else if ht.rehash.hashBits != ht.hashBits+1 {
+		return fmt.Errorf("Rehash file %s has %d hash bits, expecting %d", path, ht.rehash.hashBits, ht.hashBits+1)
+	}
+	tdlog.Infof("%s: resume rehashing from head bucket %d of %d", ht.Path, ht.rehashNext, ht.numHeads())
+	if ht.rehashNext < ht.numHeads() {
+		// The head bucket may have been moved partially, a read-only table only clears it from memory
+		ht.rehash.clearChain(ht.rehashNext)
+		ht.rehash.clearChain(ht.rehashNext + ht.numHeads())
+	}
+	if ht.ReadOnly {
+		return
+	}
+	ht.writeHeader()
+	ht.stepRehash()
+	return
+}
+
+// Copy all entries of the head bucket chain into the rehash table.
+func (ht *HashTable) moveHead(head int) {
+	keys, vals := ht.collectEntries(head)
+	for i, key := range keys {
+		ht.rehash.put(key, vals[i])
+	}
+	ht.rehashNext = head + 1
+	ht.writeHeader()
+}
+
+// Replace the original file with the rehash table, after all head buckets have been moved.
+func (ht *HashTable) finishRehash() {
+	rehash := ht.rehash
+	if err := os.Rename(rehash.Path, ht.Path); err != nil {
+		tdlog.CritNoRepeat("Failed to replace %s with its rehash table: %v", ht.Path, err)
+		return
+	}
+	if err := ht.DataFile.Close(); err != nil {
+		tdlog.CritNoRepeat("Failed to close %s after rehashing: %v", ht.Path, err)
+	}
+	tdlog.Infof("%s: rehashed into %d head buckets", ht.Path, rehash.numHeads())
+	rehash.Path = ht.Path
+	*ht = *rehash
+}
+
+// Move all remaining head buckets into the rehash table and replace the original file.
+func (ht *HashTable) completeRehash() (err error) {
+	if ht.rehash == nil {
+		return
+	}
+	for ht.rehashNext < ht.numHeads() {
+		ht.moveHead(ht.rehashNext)
+	}
+	if ht.finishRehash(); ht.rehash != nil {
+		return fmt.Errorf("Failed to finish rehashing %s", ht.Path)
+	}
+	return
+}
+
+// Discard the rehash table and its file.
+func (ht *HashTable) abandonRehash() {
+	if err := ht.rehash.Close(); err != nil {
+		tdlog.CritNoRepeat("Failed to close %s: %v", ht.rehash.Path, err)
+	}
+	os.Remove(ht.rehash.Path)
+	ht.rehash, ht.rehashNext = nil, 0
+}
+
+// Zero all entries in the chain of the head bucket.
+func (ht *HashTable) clearChain(head int) {
+	for bucket := head; ; {
+		entriesAddr := ht.bucketAddr(bucket) + BucketHeader
+		for i := entriesAddr; i < entriesAddr+ht.PerBucket*EntrySize; i++ {
+			ht.Buf[i] = 0
+		}
+		if bucket = ht.nextBucket(bucket); bucket == 0 {
+			return
+		}
+	}
+}
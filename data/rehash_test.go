@@ -0,0 +1,147 @@
+package data
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRehash(t *testing.T) {
+	tmp := "/tmp/tiedot_test_hash"
+	os.Remove(tmp)
+	os.Remove(tmp + REHASH_FILE_SUFFIX)
+	defer os.Remove(tmp)
+	d := defaultConfig()
+	d.HashBits = 4
+	d.PerBucket = 4
+	d.HTFileGrowth = 4096
+	ht, err := d.OpenHashTable(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := func(upTo int) {
+		for i := 0; i < upTo; i++ {
+			if vals := ht.Get(i, 0); len(vals) != 2 || vals[0]+vals[1] != 4*i+1 {
+				t.Fatal("Get failed on key", i, vals, ht.hashBits, ht.rehash != nil, ht.rehashNext)
+			}
+		}
+		allKV := make(map[int]int)
+		for part := 0; part < 5; part++ {
+			keys, vals := ht.GetPartition(part, 5)
+			for i, key := range keys {
+				allKV[key] += vals[i]
+			}
+		}
+		if len(allKV) != upTo {
+			t.Fatal("Wrong number of keys in partitions", len(allKV), upTo)
+		}
+		for key, sum := range allKV {
+			if sum != 4*key+1 {
+				t.Fatal("Wrong partition entries of key", key, sum)
+			}
+		}
+	}
+	// Grow the table while reading it back, and interrupt rehashing by reopening the table
+	reopened := false
+	for i := 0; i < 5000; i++ {
+		ht.Put(i, 2*i)
+		ht.Put(i, 2*i+1)
+		ht.Put(i, -1)
+		ht.Remove(i, -1)
+		if i%97 == 0 {
+			verify(i + 1)
+		}
+		if ht.rehash != nil && ht.rehashNext > 3 && !reopened {
+			if err = ht.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// A read-only table does not resume rehashing in its files
+			before, _ := ioutil.ReadFile(tmp)
+			beforeRehash, _ := ioutil.ReadFile(tmp + REHASH_FILE_SUFFIX)
+			readOnly := *d
+			readOnly.ReadOnly = true
+			if ht, err = readOnly.OpenHashTable(tmp); err != nil {
+				t.Fatal(err)
+			}
+			verify(i + 1)
+			if err = ht.Close(); err != nil {
+				t.Fatal(err)
+			}
+			after, _ := ioutil.ReadFile(tmp)
+			afterRehash, _ := ioutil.ReadFile(tmp + REHASH_FILE_SUFFIX)
+			if !bytes.Equal(before, after) || !bytes.Equal(beforeRehash, afterRehash) {
+				t.Fatal("Read-only table changed its files")
+			}
+			if ht, err = d.OpenHashTable(tmp); err != nil {
+				t.Fatal(err)
+			}
+			if ht.rehash == nil {
+				t.Fatal("Did not resume rehashing")
+			}
+			verify(i + 1)
+			reopened = true
+		}
+	}
+	if !reopened || ht.hashBits < 8 || ht.baseBits != 4 {
+		t.Fatal("Did not rehash", reopened, ht.hashBits, ht.baseBits)
+	}
+	if ht.numBuckets > RehashChainLength*ht.numHeads()+ht.numHeads() {
+		t.Fatal("Chains are too long", ht.numBuckets, ht.numHeads())
+	}
+	ht.completeRehash()
+	if _, err := os.Stat(tmp + REHASH_FILE_SUFFIX); !os.IsNotExist(err) {
+		t.Fatal("Rehash file is left behind", err)
+	}
+	verify(5000)
+	// Geometry is persisted in file header
+	hashBits := ht.hashBits
+	if err = ht.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ht, err = d.OpenHashTable(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if ht.hashBits != hashBits || ht.numBuckets < ht.numHeads() {
+		t.Fatal("Did not persist geometry", ht.hashBits, hashBits)
+	}
+	verify(5000)
+	// Clear shrinks the table back to initial geometry
+	if err = ht.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if ht.hashBits != 4 || ht.numBuckets != 16 {
+		t.Fatal("Did not clear", ht.hashBits, ht.numBuckets)
+	}
+	verify(0)
+	if err = ht.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyFormatWithoutRehash(t *testing.T) {
+	tmp := "/tmp/tiedot_test_hash"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	d := defaultConfig()
+	d.HashBits = 4
+	d.PerBucket = 4
+	d.HTFileGrowth = 4096
+	d.FormatVersion = FormatChecksum
+	ht, err := d.OpenHashTable(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ht.Close()
+	for i := 0; i < 1000; i++ {
+		ht.Put(i, i)
+	}
+	if ht.rehash != nil || ht.hashBits != 4 || ht.Used != ht.numBuckets*ht.BucketSize {
+		t.Fatal("Legacy hash table should not have a header or rehash", ht.hashBits, ht.Used)
+	}
+	for i := 0; i < 1000; i++ {
+		if vals := ht.Get(i, 0); len(vals) != 1 || vals[0] != i {
+			t.Fatal(i, vals)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Verification of data files, which reports the first problem found, and consistency check, which reports all
+// problems of a partition and optionally repairs them.
+
+package data
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// PartitionReport describes the problems of a partition found by consistency check.
+type PartitionReport struct {
+	CorruptHeaders int    // Number of regions in data file where document headers are corrupted.
+	Orphans        int    // Number of intact documents that are not addressed by any ID (e.g. left behind by a crash).
+	CorruptIDs     []int  // IDs that address documents not matching their checksum.
+	DanglingIDs    []int  // IDs that address no document.
+	DuplicateIDs   []int  // IDs that address more than one document.
+	BadLookup      string // Structural problem of ID lookup table, if any.
+}
+
+// Return true if the report has any problem.
+func (report PartitionReport) HasProblem() bool {
+	return report.CorruptHeaders > 0 || report.Orphans > 0 || len(report.CorruptIDs) > 0 ||
+		len(report.DanglingIDs) > 0 || len(report.DuplicateIDs) > 0 || report.BadLookup != ""
+}
+
+// Check the file header, every bucket chain and every entry of the hash table, return the number of entries.
+func (ht *HashTable) Verify() (entries int, err error) {
+	if ht.headerSize > 0 {
+		hashBits, _ := binary.Varint(ht.Buf[0:10])
+		baseBits, _ := binary.Varint(ht.Buf[10:20])
+		if hashBits < baseBits || baseBits < 1 || hashBits > MAX_HASH_BITS {
+			return 0, fmt.Errorf("%s: file header is corrupted", ht.Path)
+		}
+	}
+	for head := 0; head < ht.numHeads(); head++ {
+		for bucket := head; ; {
+			bucketAddr := ht.bucketAddr(bucket)
+			for entry := 0; entry < ht.PerBucket; entry++ {
+				entryAddr := bucketAddr + BucketHeader + entry*EntrySize
+				if validity := ht.Buf[entryAddr]; validity > 1 {
+					return 0, fmt.Errorf("%s: entry %d of bucket %d is corrupted", ht.Path, entry, bucket)
+				} else if validity == 1 {
+					if key, _ := binary.Varint(ht.Buf[entryAddr+1 : entryAddr+11]); ht.HashKey(int(key)) != head {
+						return 0, fmt.Errorf("%s: entry of key %d is in the chain of bucket %d", ht.Path, key, head)
+					}
+					entries++
+				}
+			}
+			next, n := binary.Varint(ht.Buf[bucketAddr : bucketAddr+10])
+			if next == 0 {
+				break
+			} else if n <= 0 || int(next) <= bucket || int(next) >= ht.numBuckets || int(next) < ht.numHeads() {
+				return 0, fmt.Errorf("%s: bucket %d is chained to invalid bucket %d", ht.Path, bucket, next)
+			}
+			bucket = int(next)
+		}
+	}
+	if ht.rehash != nil {
+		moved, err := ht.rehash.Verify()
+		return entries + moved, err
+	}
+	return
+}
+
+// Check every document header and checksum of the collection file, return the number of documents.
+func (col *Collection) Verify() (docs int, err error) {
+	for id := 0; id < col.Used-col.DocHeaderSize; {
+		validity := col.Buf[id]
+		room, _ := binary.Varint(col.Buf[id+1 : id+11])
+		docEnd := id + col.DocHeaderSize + int(room)
+		if validity > 1 || room < 0 || room > int64(col.DocMaxRoom) || docEnd > col.Used {
+			return docs, fmt.Errorf("%s: document header at %d is corrupted", col.Path, id)
+		} else if validity == 1 {
+			if !col.checksumMatches(id, docEnd) {
+				return docs, fmt.Errorf("%s: document at %d does not match its checksum", col.Path, id)
+			}
+			docs++
+		}
+		id = docEnd
+	}
+	return
+}
+
+// Check the collection file and ID lookup table, and that every ID addresses a readable document.
+// Return the number of documents addressed by ID.
+func (part *Partition) Verify() (docs int, err error) {
+	if _, err = part.col.Verify(); err != nil {
+		return
+	} else if _, err = part.lookup.Verify(); err != nil {
+		return
+	}
+	ids, physIDs := part.lookup.GetPartition(0, 1)
+	seen := make(map[int]struct{}, len(ids))
+	for i, id := range ids {
+		if _, duplicated := seen[id]; duplicated {
+			return 0, fmt.Errorf("%s: ID %d addresses more than one document", part.lookup.Path, id)
+		} else if _, err = part.col.ReadDoc(physIDs[i]); err != nil {
+			return 0, fmt.Errorf("%s: ID %d addresses document at %d that cannot be read - %v", part.lookup.Path, id, physIDs[i], err)
+		}
+		seen[id] = struct{}{}
+	}
+	return len(ids), nil
+}
+
+// Check that data file, ID lookup table and documents agree with each other, and report all problems found.
+// To repair, IDs of corrupted and missing documents and duplicated IDs are removed from the lookup table, and the
+// partition is compacted to rebuild the lookup table and leave out orphans and corrupted regions. Caller must not
+// hold DataLock.
+func (part *Partition) Check(repair bool) (report PartitionReport, err error) {
+	part.DataLock.Lock()
+	col := part.col
+	// Walk data file and skip over corrupted headers, until an intact document is found
+	intact := make(map[int]struct{})
+	inCorruptRegion := false
+	for id := 0; id < col.Used-col.DocHeaderSize; {
+		validity := col.Buf[id]
+		room, _ := binary.Varint(col.Buf[id+1 : id+11])
+		docEnd := id + col.DocHeaderSize + int(room)
+		validHeader := validity <= 1 && room >= 0 && room <= int64(col.DocMaxRoom) && docEnd <= col.Used
+		if inCorruptRegion && validHeader && validity == 1 && room > 0 && col.checksumMatches(id, docEnd) {
+			inCorruptRegion = false
+		} else if inCorruptRegion || !validHeader {
+			if !inCorruptRegion {
+				report.CorruptHeaders++
+				inCorruptRegion = true
+			}
+			id++
+			continue
+		}
+		if validity == 1 && col.checksumMatches(id, docEnd) {
+			intact[id] = struct{}{}
+		}
+		id = docEnd
+	}
+	if _, structErr := part.lookup.Verify(); structErr != nil {
+		report.BadLookup = structErr.Error()
+	}
+	// Every ID must address exactly one intact document
+	ids, physIDs := part.lookup.GetPartition(0, 1)
+	seen := make(map[int]struct{}, len(ids))
+	addressed := make(map[int]struct{}, len(ids))
+	var removeIDs, removePhysIDs []int
+	for i, id := range ids {
+		if _, duplicated := seen[id]; duplicated {
+			report.DuplicateIDs = append(report.DuplicateIDs, id)
+		} else if _, readErr := col.ReadDoc(physIDs[i]); dberr.Type(readErr) == dberr.ErrorDocCorrupted {
+			report.CorruptIDs = append(report.CorruptIDs, id)
+		} else if readErr != nil {
+			report.DanglingIDs = append(report.DanglingIDs, id)
+		} else {
+			seen[id] = struct{}{}
+			addressed[physIDs[i]] = struct{}{}
+			continue
+		}
+		removeIDs, removePhysIDs = append(removeIDs, id), append(removePhysIDs, physIDs[i])
+	}
+	for physID := range intact {
+		if _, isAddressed := addressed[physID]; !isAddressed {
+			report.Orphans++
+		}
+	}
+	if repair {
+		for i, id := range removeIDs {
+			part.lookup.Remove(id, removePhysIDs[i])
+		}
+	}
+	part.DataLock.Unlock()
+	if repair && (report.CorruptHeaders > 0 || report.Orphans > 0 || len(report.DuplicateIDs) > 0 || report.BadLookup != "") {
+		err = part.Compact()
+	}
+	return
+}
@@ -0,0 +1,119 @@
+package data
+
+import (
+	"encoding/binary"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPartitionVerify(t *testing.T) {
+	colPath, htPath := "/tmp/tiedot_test_col", "/tmp/tiedot_test_ht"
+	os.Remove(colPath)
+	os.Remove(htPath)
+	defer os.Remove(colPath)
+	defer os.Remove(htPath)
+	d := defaultConfig()
+	part, err := d.OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.Close()
+	for i := 0; i < 1000; i++ {
+		if _, err = part.Insert(i, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = part.Delete(10); err != nil {
+		t.Fatal(err)
+	} else if err = part.Update(20, []byte(strings.Repeat("x", 100))); err != nil {
+		t.Fatal(err)
+	}
+	if docs, err := part.Verify(); err != nil || docs != 999 {
+		t.Fatal(docs, err)
+	}
+	// Document content does not match checksum
+	physID := part.lookup.Get(30, 1)[0]
+	part.col.Buf[physID+part.col.DocHeaderSize] = 'x'
+	if _, err = part.Verify(); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatal(err)
+	}
+	part.col.Buf[physID+part.col.DocHeaderSize] = '3'
+	if _, err = part.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupted document header
+	part.col.Buf[physID] = 7
+	if _, err = part.Verify(); err == nil || !strings.Contains(err.Error(), "header") {
+		t.Fatal(err)
+	}
+	part.col.Buf[physID] = 1
+	// ID addresses a document that does not exist
+	part.lookup.Remove(40, part.lookup.Get(40, 1)[0])
+	part.lookup.Put(40, part.col.Used+1000)
+	if _, err = part.Verify(); err == nil || !strings.Contains(err.Error(), "ID 40") {
+		t.Fatal(err)
+	}
+	// Entry in the wrong bucket chain
+	part.lookup.Remove(40, part.col.Used+1000)
+	head := part.lookup.HashKey(50)
+	entryAddr := part.lookup.bucketAddr(head) + BucketHeader
+	binary.PutVarint(part.lookup.Buf[entryAddr+1:entryAddr+11], int64(51))
+	if _, err = part.lookup.Verify(); err == nil || !strings.Contains(err.Error(), "chain") {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionCheck(t *testing.T) {
+	colPath, htPath := "/tmp/tiedot_test_col", "/tmp/tiedot_test_ht"
+	os.Remove(colPath)
+	os.Remove(htPath)
+	defer os.Remove(colPath)
+	defer os.Remove(htPath)
+	d := defaultConfig()
+	part, err := d.OpenPartition(colPath, htPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.Close()
+	for i := 0; i < 100; i++ {
+		if _, err = part.Insert(i, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if report, err := part.Check(false); err != nil || report.HasProblem() {
+		t.Fatal(report, err)
+	}
+	// Corrupted header of a deleted document
+	deletedPhysID := part.lookup.Get(10, 1)[0]
+	if err = part.Delete(10); err != nil {
+		t.Fatal(err)
+	}
+	part.col.Buf[deletedPhysID] = 9
+	// Document not matching checksum
+	part.col.Buf[part.lookup.Get(20, 1)[0]+part.col.DocHeaderSize] = 'x'
+	// ID addressing nothing, and ID addressing two documents
+	part.lookup.Put(1000, part.col.Used+1000)
+	part.lookup.Put(30, part.lookup.Get(31, 1)[0])
+	// Document not addressed by any ID
+	if _, err = part.col.Insert([]byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+	report, err := part.Check(true)
+	if err != nil {
+		t.Fatal(err)
+	} else if report.CorruptHeaders != 1 || report.Orphans != 1 || len(report.CorruptIDs) != 1 || report.CorruptIDs[0] != 20 ||
+		len(report.DanglingIDs) != 1 || report.DanglingIDs[0] != 1000 || len(report.DuplicateIDs) != 1 || report.DuplicateIDs[0] != 30 {
+		t.Fatalf("%+v", report)
+	}
+	// All problems are repaired
+	if report, err = part.Check(false); err != nil || report.HasProblem() {
+		t.Fatalf("%+v %v", report, err)
+	} else if docs, err := part.Verify(); err != nil || docs != 98 {
+		t.Fatal(docs, err)
+	}
+	if doc, err := part.Read(31); err != nil || strings.TrimSpace(string(doc)) != "31" {
+		t.Fatal(string(doc), err)
+	}
+}
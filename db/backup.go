@@ -0,0 +1,506 @@
+// Online backup of the database.
+
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	BACKUP_INFO_FILE    = "backup.json"    // Name of the file in backup directory that describes the backup.
+	BACKUP_CHANGES_FILE = "changes.ndjson" // Name of the file in incremental backup directory that has the changes.
+)
+
+// BackupInfo describes a full or incremental backup, and tells which changes from change log are in it.
+type BackupInfo struct {
+	Incremental bool  // The backup only has the changes made since the previous backup.
+	ChangeLog   bool  // Change log was enabled, so that incremental backups may follow this one.
+	FromSeq     int   // Sequence number of the last change in the previous backup, if the backup is incremental.
+	Seq         int   // Sequence number of the last change in the backup.
+	Time        int64 // Time of the backup, in nanoseconds since Unix epoch.
+}
+
+// Read the description of the backup in the directory.
+func ReadBackupInfo(dir string) (info BackupInfo, err error) {
+	content, err := ioutil.ReadFile(path.Join(dir, BACKUP_INFO_FILE))
+	if err != nil {
+		return info, fmt.Errorf("%s is not a backup - %v", dir, err)
+	}
+	err = json.Unmarshal(content, &info)
+	return
+}
+
+// Write the description of the backup in the directory.
+func writeBackupInfo(dir string, info BackupInfo) error {
+	content, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, BACKUP_INFO_FILE), content, 0600)
+}
+
+// BackupProgress tells how far an online backup has come.
+type BackupProgress struct {
+	Collection string // Collection of the partition that has just been copied.
+	Copied     int    // Number of partitions copied so far.
+	Total      int    // Number of partitions of all collections.
+	Done       bool   // The backup is complete.
+	Changes    int    `json:",omitempty"` // Number of changes saved by an incremental backup.
+}
+
+// Copy a file, fail if the destination file already exists.
+func copyFile(src, dest string) error {
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("Destination file %s already exists", dest)
+	}
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(destFile, srcFile)
+	if closeErr := destFile.Close(); err == nil {
+		err = closeErr
+	}
+	tdlog.Noticef("Backup: copied file %s, size is %d", dest, written)
+	return err
+}
+
+// Copy the regular files in the directory that the filter accepts.
+func copyFiles(srcDir, destDir string, accept func(name string) bool) error {
+	content, err := ioutil.ReadDir(srcDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range content {
+		if file.Mode().IsRegular() && accept(file.Name()) {
+			if err = copyFile(path.Join(srcDir, file.Name()), path.Join(destDir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Copy the small files that describe the collection and its indexes (everything but data and index partitions).
+// Caller must hold the ID generator lock to prevent ID sequence files from changing.
+func (col *Col) backupMeta(destDir string) error {
+	return copyFiles(path.Join(col.db.path, col.name), destDir, func(name string) bool {
+		return !strings.HasPrefix(name, DOC_DATA_FILE) && !strings.HasPrefix(name, DOC_LOOKUP_FILE) && name != LOAD_MARKER_FILE
+	})
+}
+
+// Copy this database into destination directory while it remains available for reads and writes.
+// Partitions are copied one at a time in small batches; at the end, all partitions are briefly locked to catch up
+// with concurrent changes, so that the backup is a consistent snapshot of all collections at that moment.
+// Collection and index management wait until the backup is complete, without holding up reads and writes. Indexes
+// are not copied, they are rebuilt when the backup is opened for the first time. The optional progress function is
+// called after each partition is copied.
+func (db *DB) Backup(dest string, progress func(BackupProgress)) (err error) {
+	// Collections stay open and unchanged until the backup is complete
+	db.backupLock.RLock()
+	defer db.backupLock.RUnlock()
+	if err = os.MkdirAll(dest, 0700); err != nil {
+		return
+	} else if err = copyFiles(db.path, dest, func(name string) bool { return name != BACKUP_INFO_FILE }); err != nil {
+		return
+	}
+	names := make([]string, 0, len(db.cols))
+	for name := range db.cols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	backups := make([]*data.PartitionBackup, 0, len(names)*db.numParts)
+	// Clean up after failure
+	finished := false
+	defer func() {
+		if !finished {
+			for _, backup := range backups {
+				backup.Abort()
+			}
+		}
+	}()
+	// Copy partitions one at a time
+	for _, name := range names {
+		col := db.cols[name]
+		colDest := path.Join(dest, name)
+		if err = os.MkdirAll(colDest, 0700); err != nil {
+			return
+		}
+		for i, part := range col.parts {
+			backup, err := part.BeginBackup(
+				path.Join(colDest, DOC_DATA_FILE+strconv.Itoa(i)),
+				path.Join(colDest, DOC_LOOKUP_FILE+strconv.Itoa(i)))
+			if err != nil {
+				return err
+			}
+			backups = append(backups, backup)
+			if err = backup.Copy(); err != nil {
+				return err
+			}
+			if progress != nil {
+				progress(BackupProgress{Collection: name, Copied: len(backups), Total: len(names) * db.numParts})
+			}
+		}
+	}
+	// Catch up with concurrent changes of all partitions at once
+	for _, name := range names {
+		db.cols[name].ids.lock.Lock()
+		for _, part := range db.cols[name].parts {
+			part.DataLock.Lock()
+		}
+	}
+	for _, backup := range backups {
+		if finishErr := backup.Finish(); err == nil {
+			err = finishErr
+		}
+	}
+	finished = true
+	// No document changes while all partitions are locked, the backup has exactly the changes logged so far
+	info := BackupInfo{Time: time.Now().UnixNano()}
+	if db.log != nil {
+		info.ChangeLog = true
+		_, info.Seq = db.log.seqRange()
+	}
+	for _, name := range names {
+		if err == nil {
+			err = db.cols[name].backupMeta(path.Join(dest, name))
+		}
+	}
+	for _, name := range names {
+		for _, part := range db.cols[name].parts {
+			part.DataLock.Unlock()
+		}
+		db.cols[name].ids.lock.Unlock()
+	}
+	if err != nil {
+		return
+	}
+	// Have the indexes rebuilt when the backup is opened
+	for _, name := range names {
+		if err = ioutil.WriteFile(path.Join(dest, name, LOAD_MARKER_FILE), nil, 0600); err != nil {
+			return
+		}
+	}
+	if err = writeBackupInfo(dest, info); err != nil {
+		return
+	}
+	if progress != nil {
+		progress(BackupProgress{Copied: len(backups), Total: len(backups), Done: true})
+	}
+	return
+}
+
+// Save the changes made since the previous (full or incremental) backup into destination directory, return number
+// of saved changes. Change log must have been enabled since the previous backup was taken, and must still have
+// all changes made since then (see PurgeChangeLog).
+func (db *DB) IncrementalBackup(prev, dest string) (count int, err error) {
+	db.backupLock.RLock()
+	defer db.backupLock.RUnlock()
+	if db.log == nil {
+		return 0, fmt.Errorf("Incremental backup requires change log to be enabled")
+	}
+	prevInfo, err := ReadBackupInfo(prev)
+	if err != nil {
+		return
+	} else if !prevInfo.ChangeLog {
+		return 0, fmt.Errorf("Backup %s was taken while change log was disabled", prev)
+	}
+	info := BackupInfo{Incremental: true, ChangeLog: true, FromSeq: prevInfo.Seq, Time: time.Now().UnixNano()}
+	first, last := db.log.seqRange()
+	if prevInfo.Seq+1 < first {
+		return 0, fmt.Errorf("Change log no longer has the changes after backup %s", prev)
+	} else if prevInfo.Seq > last {
+		return 0, fmt.Errorf("Backup %s is not a backup of this database", prev)
+	}
+	info.Seq = last
+	if err = os.MkdirAll(dest, 0700); err != nil {
+		return
+	} else if _, err = os.Stat(path.Join(dest, BACKUP_INFO_FILE)); err == nil {
+		return 0, fmt.Errorf("Destination %s already has a backup", dest)
+	}
+	file, err := os.OpenFile(path.Join(dest, BACKUP_CHANGES_FILE), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	out := bufio.NewWriter(file)
+	err = db.log.forEach(prevInfo.Seq, func(change Change) (bool, error) {
+		if change.Seq > last {
+			return false, nil
+		} else if change.Op == ChangeLoad {
+			return false, fmt.Errorf("Collection %s was bulk loaded after backup %s, take a full backup instead", change.Col, prev)
+		} else if change.Op == ChangeRepair {
+			return false, fmt.Errorf("Collection %s was repaired after backup %s, take a full backup instead", change.Col, prev)
+		}
+		line, err := json.Marshal(change)
+		if err != nil {
+			return false, err
+		}
+		out.Write(line)
+		_, err = out.WriteString("\n")
+		count++
+		return err == nil, err
+	})
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && count != last-prevInfo.Seq {
+		err = fmt.Errorf("Change log is missing %d changes after backup %s", last-prevInfo.Seq-count, prev)
+	}
+	if err != nil {
+		return
+	}
+	tdlog.Noticef("Backup: saved %d changes since backup %s", count, prev)
+	return count, writeBackupInfo(dest, info)
+}
+
+// Copy the directory and everything in it, except the backup description.
+func copyBackupDir(src, dest string) error {
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return err
+	} else if err := copyFiles(src, dest, func(name string) bool { return name != BACKUP_INFO_FILE }); err != nil {
+		return err
+	}
+	content, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, file := range content {
+		if file.IsDir() {
+			if err = copyBackupDir(path.Join(src, file.Name()), path.Join(dest, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Restore a full backup followed by a chain of incremental backups into a new database directory, replaying the
+// changes made up to (and including) the time, or all changes if the time is zero. Each incremental backup must be
+// taken on top of the backup before it.
+func RestoreBackups(dest string, backups []string, until time.Time) (err error) {
+	if len(backups) == 0 {
+		return fmt.Errorf("Restore requires a full backup")
+	}
+	infos := make([]BackupInfo, len(backups))
+	for i, dir := range backups {
+		if infos[i], err = ReadBackupInfo(dir); err != nil {
+			return
+		} else if i == 0 && infos[i].Incremental {
+			return fmt.Errorf("Backup %s is incremental, restore must start with a full backup", dir)
+		} else if i > 0 && (!infos[i].Incremental || infos[i].FromSeq != infos[i-1].Seq) {
+			return fmt.Errorf("Backup %s was not taken on top of backup %s", dir, backups[i-1])
+		}
+	}
+	if !until.IsZero() && infos[0].Time > until.UnixNano() {
+		return fmt.Errorf("Backup %s was taken after %v", backups[0], until)
+	}
+	for _, dir := range backups {
+		if err = Verify(dir); err != nil {
+			return fmt.Errorf("Backup %s is not intact - %v", dir, err)
+		}
+	}
+	if _, err = os.Stat(dest); err == nil {
+		return fmt.Errorf("Destination %s already exists", dest)
+	} else if err = copyBackupDir(backups[0], dest); err != nil {
+		return
+	}
+	db, err := OpenDB(dest)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	count := 0
+	for _, dir := range backups[1:] {
+		_, _, err = readChangeFile(path.Join(dir, BACKUP_CHANGES_FILE), func(change Change) (bool, error) {
+			if !until.IsZero() && change.Time > until.UnixNano() {
+				return false, nil
+			} else if err := db.replayChange(change); err != nil {
+				return false, fmt.Errorf("Cannot replay change %d from backup %s - %v", change.Seq, dir, err)
+			}
+			count++
+			return true, nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	tdlog.Noticef("Restore: replayed %d changes on top of backup %s", count, backups[0])
+	return
+}
+
+// Make the change again, as recorded in change log.
+func (db *DB) replayChange(change Change) error {
+	switch change.Op {
+	case ChangeCreate:
+		opts := ColOptions{IDStrategy: DefaultIDStrategy}
+		if change.Options != nil {
+			opts = *change.Options
+		}
+		return db.CreateWith(change.Col, opts)
+	case ChangeDrop:
+		return db.Drop(change.Col)
+	case ChangeRename:
+		return db.Rename(change.Col, change.NewName)
+	case ChangeTruncate:
+		return db.Truncate(change.Col)
+	}
+	col := db.Use(change.Col)
+	if col == nil {
+		return fmt.Errorf("Collection %s does not exist", change.Col)
+	}
+	switch change.Op {
+	case ChangeInsert, ChangeUpdate:
+		var doc map[string]interface{}
+		if err := json.Unmarshal(change.Doc, &doc); err != nil {
+			return err
+		}
+		return col.restoreDoc(change.ID, change.Rev, doc)
+	case ChangeDelete:
+		if err := col.Delete(change.ID); err != nil && dberr.Type(err) != dberr.ErrorNoDoc {
+			return err
+		}
+		return nil
+	case ChangeIndex, ChangeUnindex:
+		if change.Index == nil {
+			return fmt.Errorf("Change of index does not have index path")
+		} else if change.Op == ChangeUnindex {
+			return col.Unindex(change.Index.Path)
+		}
+		hash, err := NewIndexHash(change.Index.Hash.Func)
+		if err != nil {
+			return err
+		} else if hash.Collation, err = parseCollation(change.Index.Hash.Collation); err != nil {
+			return err
+		}
+		if _, err = col.IndexHash(change.Index.Path); err == nil {
+			db.lockSchema()
+			defer db.unlockSchema()
+			return col.reindex(change.Index.Path, hash)
+		}
+		return col.index(change.Index.Path, hash)
+	case ChangeSchema:
+		var schema *docSchema
+		if len(change.Schema) > 0 {
+			var err error
+			if schema, err = parseSchema(change.Schema); err != nil {
+				return err
+			}
+		}
+		db.lockSchema()
+		defer db.unlockSchema()
+		return col.setSchema(schema)
+	case ChangeTTL:
+		db.lockSchema()
+		defer db.unlockSchema()
+		return col.setTTL(change.TTL)
+	}
+	return fmt.Errorf("Change kind %s is unknown", change.Op)
+}
+
+// Put the document under the ID at the revision, replacing the existing document.
+func (col *Col) restoreDoc(id, rev int, doc map[string]interface{}) error {
+	if err := col.Delete(id); err != nil && dberr.Type(err) != dberr.ErrorNoDoc {
+		return err
+	}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if err := col.ids.observe(id); err != nil {
+		return err
+	}
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	part := col.parts[id%col.db.numParts]
+	part.DataLock.Lock()
+	if _, err = part.InsertRev(id, docJS, rev); err == nil {
+		col.trackDocChange(ChangeInsert, id, docJS)
+	}
+	part.DataLock.Unlock()
+	if err != nil {
+		return err
+	}
+	part.LockUpdate(id)
+	col.indexDoc(id, doc)
+	part.UnlockUpdate(id)
+	return nil
+}
+
+// Replace all collections of this database with the dump (full backup) in source directory, after verifying that the
+// dump is intact. Operations on the database wait until the restore is complete, watchers are stopped with an error.
+// Change log is not carried over, take a full backup before the next incremental backup.
+func (db *DB) Restore(src string) (err error) {
+	if err = Verify(src); err != nil {
+		return fmt.Errorf("Dump %s is not intact - %v", src, err)
+	} else if info, infoErr := ReadBackupInfo(src); infoErr == nil && info.Incremental {
+		return fmt.Errorf("Backup %s is incremental, restore it along with a full backup using RestoreBackups", src)
+	}
+	// Pause the reaper, its collections are about to be closed
+	if db.reaper != nil {
+		db.reaper.run.Lock()
+		defer db.reaper.run.Unlock()
+	}
+	db.lockSchema()
+	defer db.unlockSchema()
+	dbDir := path.Clean(db.path)
+	restoring, replaced := dbDir+".restoring", fmt.Sprintf("%s.replaced-%d", dbDir, time.Now().UnixNano())
+	if _, err = os.Stat(restoring); err == nil {
+		return fmt.Errorf("Directory %s is in the way of restore", restoring)
+	} else if err = copyBackupDir(src, restoring); err != nil {
+		os.RemoveAll(restoring)
+		return
+	}
+	// Watchers must not see collections of the dump
+	if db.log != nil {
+		db.log.stopWatchers(fmt.Errorf("Database is restored from dump %s", src))
+	}
+	if err = db.close(); err != nil {
+		os.RemoveAll(restoring)
+		db.reopen()
+		return
+	}
+	// Swap the dump into place, and swap the original back should the dump fail to open
+	if err = os.Rename(dbDir, replaced); err != nil {
+		db.reopen()
+		return
+	} else if err = os.Rename(restoring, dbDir); err != nil {
+		os.Rename(replaced, dbDir)
+		db.reopen()
+		return
+	}
+	if err = db.reopen(); err != nil {
+		db.close()
+		os.Rename(dbDir, restoring)
+		os.Rename(replaced, dbDir)
+		db.reopen()
+		return
+	}
+	tdlog.Noticef("Restore: replaced database %s with dump %s", dbDir, src)
+	return os.RemoveAll(replaced)
+}
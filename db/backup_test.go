@@ -0,0 +1,267 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOnlineBackup(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	os.RemoveAll(TEST_DATA_DIR + "bak")
+	defer os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR + "bak")
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.CreateWith("a", ColOptions{IDStrategy: IDMonotonic}); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("b"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("a")
+	if err = col.IndexWithCollation([]string{"n"}, CollationNoCase); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 1000)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reads and writes continue during the backup
+	var progress []BackupProgress
+	stop := make(chan struct{})
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := col.Read(ids[i%len(ids)]); err != nil {
+				t.Error(err)
+			} else if _, err = col.Insert(map[string]interface{}{"n": "new"}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	created := make(chan error, 1)
+	err = db.Backup(TEST_DATA_DIR+"bak", func(p BackupProgress) {
+		progress = append(progress, p)
+		if len(progress) == 1 {
+			// Schema changes wait for the backup, and do not hold up reads and writes while they wait
+			go func() {
+				created <- db.Create("c")
+			}()
+			time.Sleep(100 * time.Millisecond)
+		}
+		id, updated := ids[len(progress)], make(chan error, 1)
+		go func() {
+			updated <- col.Update(id, map[string]interface{}{"n": "updated"})
+		}()
+		select {
+		case err := <-updated:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("update waits for schema change")
+		}
+	})
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	} else if err = <-created; err != nil {
+		t.Fatal(err)
+	}
+	if len(progress) != 5 || progress[0].Collection != "a" || progress[3].Copied != 4 || progress[3].Total != 4 || !progress[4].Done {
+		t.Fatal(progress)
+	}
+	// The backup has all updates made during the backup, and its indexes are rebuilt upon opening
+	bak, err := OpenDB(TEST_DATA_DIR + "bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bak.Close()
+	bakCol := bak.Use("a")
+	if bakCol.Options().IDStrategy != IDMonotonic || bak.Use("b") == nil || bak.Use("c") != nil {
+		t.Fatal("collections are not backed up")
+	}
+	if hash, err := bakCol.IndexHash([]string{"n"}); err != nil || hash.Collation != CollationNoCase {
+		t.Fatal(hash, err)
+	}
+	for i := 1; i <= 4; i++ {
+		if doc, err := bakCol.Read(ids[i]); err != nil || doc["n"] != "updated" {
+			t.Fatal(doc, err)
+		}
+	}
+	updated, err := runQuery(`{"eq": "UPDATED", "in": ["n"]}`, bakCol)
+	if err != nil || !ensureMapHasKeys(updated, ids[1], ids[2], ids[3], ids[4]) {
+		t.Fatal(updated, err)
+	}
+	all, err := runQuery(`"all"`, bakCol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inserted, err := runQuery(`{"eq": "new", "in": ["n"]}`, bakCol)
+	if err != nil || len(inserted)+len(ids) != len(all) {
+		t.Fatal(len(inserted), len(all), err)
+	}
+	// Monotonic IDs carry on after the backed up documents
+	if id, err := bakCol.Insert(map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	} else if _, exists := all[id]; exists {
+		t.Fatal("ID is reused", id)
+	}
+	// Destination must not have a database already
+	if err = db.Backup(TEST_DATA_DIR+"bak", nil); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	bak := TEST_DATA_DIR + "bak"
+	os.RemoveAll(TEST_DATA_DIR)
+	os.RemoveAll(bak)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(bak)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.CreateWith("a", ColOptions{IDStrategy: IDMonotonic}); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("a")
+	if err = col.Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 3)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Incremental backups require change log
+	if err = db.Backup(bak+"/full0", nil); err != nil {
+		t.Fatal(err)
+	} else if _, err = db.IncrementalBackup(bak+"/full0", bak+"/inc0"); err == nil {
+		t.Fatal("did not error")
+	}
+	if err = db.EnableChangeLog(); err != nil {
+		t.Fatal(err)
+	} else if _, err = db.IncrementalBackup(bak+"/full0", bak+"/inc0"); err == nil {
+		t.Fatal("did not error")
+	} else if err = db.Create(CHANGE_LOG_DIR); err == nil {
+		t.Fatal("did not error")
+	}
+	if err = db.Backup(bak+"/full", nil); err != nil {
+		t.Fatal(err)
+	}
+	// First increment
+	if err = col.Update(ids[0], map[string]interface{}{"n": "updated"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"n": 3})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("b"); err != nil {
+		t.Fatal(err)
+	}
+	ids = append(ids, id)
+	_, updatedRev, _ := col.ReadRev(ids[0])
+	if count, err := db.IncrementalBackup(bak+"/full", bak+"/inc1"); err != nil || count != 4 {
+		t.Fatal(count, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	pointInTime := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	// Second increment
+	if err = col.Update(ids[0], map[string]interface{}{"n": "later"}); err != nil {
+		t.Fatal(err)
+	} else if err = db.Rename("b", "c"); err != nil {
+		t.Fatal(err)
+	} else if err = col.Unindex([]string{"n"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.IndexWithCollation([]string{"n"}, CollationNoCase); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := db.IncrementalBackup(bak+"/inc1", bak+"/inc2"); err != nil || count != 4 {
+		t.Fatal(count, err)
+	}
+	// Increments must form a chain
+	if err = RestoreBackups(bak+"/restored", []string{bak + "/full", bak + "/inc2"}, time.Time{}); err == nil {
+		t.Fatal("did not error")
+	} else if err = RestoreBackups(bak+"/restored", []string{bak + "/inc1"}, time.Time{}); err == nil {
+		t.Fatal("did not error")
+	}
+	// Restore all changes
+	if err = RestoreBackups(bak+"/restored", []string{bak + "/full", bak + "/inc1", bak + "/inc2"}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := OpenDB(bak + "/restored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	restoredCol := restored.Use("a")
+	if restored.Use("c") == nil || restored.Use("b") != nil {
+		t.Fatal(restored.AllCols())
+	} else if doc, err := restoredCol.Read(ids[0]); err != nil || doc["n"] != "later" {
+		t.Fatal(doc, err)
+	} else if _, err = restoredCol.Read(ids[1]); err == nil {
+		t.Fatal("did not delete")
+	} else if q, err := runQuery(`{"eq": "LATER", "in": ["n"]}`, restoredCol); err != nil || !ensureMapHasKeys(q, ids[0]) {
+		t.Fatal(q, err)
+	} else if q, err = runQuery(`{"eq": 3, "in": ["n"]}`, restoredCol); err != nil || !ensureMapHasKeys(q, ids[3]) {
+		t.Fatal(q, err)
+	}
+	// Monotonic IDs carry on after the replayed documents
+	if id, err := restoredCol.Insert(map[string]interface{}{}); err != nil || id <= ids[3] {
+		t.Fatal(id, err)
+	}
+	// Restore up to a point in time
+	if err = RestoreBackups(bak+"/pitr", []string{bak + "/full", bak + "/inc1", bak + "/inc2"}, pointInTime); err != nil {
+		t.Fatal(err)
+	}
+	pitr, err := OpenDB(bak + "/pitr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pitr.Close()
+	if pitr.Use("b") == nil || pitr.Use("c") != nil {
+		t.Fatal(pitr.AllCols())
+	} else if doc, rev, err := pitr.Use("a").ReadRev(ids[0]); err != nil || doc["n"] != "updated" || rev != updatedRev {
+		t.Fatal(doc, rev, err)
+	} else if hash, err := pitr.Use("a").IndexHash([]string{"n"}); err != nil || hash.Collation != CollationBinary {
+		t.Fatal(hash, err)
+	}
+	// Destination must not exist
+	if err = RestoreBackups(bak+"/pitr", []string{bak + "/full"}, time.Time{}); err == nil {
+		t.Fatal("did not error")
+	}
+}
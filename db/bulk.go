@@ -0,0 +1,219 @@
+// Bulk insert, update and delete with batched index maintenance.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	BulkInsert = "insert" // Insert the document under a new ID.
+	BulkUpdate = "update" // Update the document under the ID.
+	BulkDelete = "delete" // Delete the document under the ID.
+)
+
+// BulkOp is an operation in a bulk request.
+type BulkOp struct {
+	Op  string                 // One of BulkInsert, BulkUpdate or BulkDelete.
+	ID  int                    // ID of the document to update or delete.
+	Doc map[string]interface{} // Document to insert or update.
+}
+
+// BulkResult is the outcome of an operation in a bulk request.
+type BulkResult struct {
+	ID    int    // ID of the inserted, updated or deleted document.
+	Error string `json:",omitempty"` // Reason why the operation failed.
+}
+
+// A change to make on an index hash table.
+type idxChange struct {
+	put     bool
+	key, id int
+}
+
+// Collect the changes to make on index hash tables in a bulk request.
+type idxBatch map[int]map[string][]idxChange // Hash table partition number and index name to changes
+
+// Add the changes that put a document on (or remove it from) all user-created indexes.
+func (col *Col) batchIndexDoc(batch idxBatch, id int, doc map[string]interface{}, put bool) {
+	if col.loading {
+		return
+	}
+	for idxName, idxPath := range col.indexPaths {
+		for _, idxVal := range GetIn(doc, idxPath) {
+			if idxVal != nil {
+				hashKey := col.indexHash[idxName].Key(idxVal)
+				partNum := hashKey % col.db.numParts
+				if batch[partNum] == nil {
+					batch[partNum] = make(map[string][]idxChange)
+				}
+				batch[partNum][idxName] = append(batch[partNum][idxName], idxChange{put: put, key: hashKey, id: id})
+			}
+		}
+	}
+}
+
+// Make the changes on index hash tables, each hash table is locked once.
+func (col *Col) applyIndexBatch(batch idxBatch) {
+	for partNum, changesByIdx := range batch {
+		for idxName, changes := range changesByIdx {
+			ht := col.hts[partNum][idxName]
+			ht.Lock.Lock()
+			for _, change := range changes {
+				if change.put {
+					ht.Put(change.key, change.id)
+				} else {
+					ht.Remove(change.key, change.id)
+				}
+			}
+			ht.Lock.Unlock()
+		}
+	}
+}
+
+// Carry out the operations and return their outcome in the same order. Operations are grouped by partition and by
+// index hash table, so that each lock is placed once per bulk request rather than once per document. Operations on
+// the same document are carried out in the order they are given; a failed operation does not stop the others.
+func (col *Col) Bulk(ops []BulkOp) (results []BulkResult) {
+	results, originals := col.bulk(ops)
+	for i, op := range ops {
+		if results[i].Error != "" {
+			continue
+		} else if op.Op == BulkDelete {
+			col.runPostHooks(ChangeDelete, results[i].ID, originals[i], nil)
+		} else {
+			col.runPostHooks(op.Op, results[i].ID, originals[i], op.Doc)
+		}
+	}
+	col.evict()
+	return
+}
+
+// Carry out the operations (see Bulk) without running post hooks, return their outcome and the original documents of
+// updates and deletes.
+func (col *Col) bulk(ops []BulkOp) (results []BulkResult, originals []map[string]interface{}) {
+	results = make([]BulkResult, len(ops))
+	originals = make([]map[string]interface{}, len(ops))
+	docJS := make([][]byte, len(ops))
+	byPart := make([][]int, col.db.numParts) // Partition number to indexes of its operations
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case BulkInsert, BulkUpdate:
+			if op.Doc == nil {
+				err = fmt.Errorf("Operation %s requires a document", op.Op)
+			} else if docJS[i], err = json.Marshal(op.Doc); err == nil && op.Op == BulkInsert {
+				op.ID, err = col.ids.nextID()
+			}
+		case BulkDelete:
+		default:
+			err = fmt.Errorf("Operation %s is not supported", op.Op)
+		}
+		if err == nil && op.ID < 0 {
+			err = dberr.New(dberr.ErrorBadDocID, op.ID)
+		}
+		results[i].ID = op.ID
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		partNum := op.ID % col.db.numParts
+		byPart[partNum] = append(byPart[partNum], i)
+	}
+	// Lock the documents in order of partition and ID, concurrent bulk requests cannot deadlock.
+	locked := make([][]int, col.db.numParts)
+	for partNum, opIdx := range byPart {
+		seen := make(map[int]struct{})
+		for _, i := range opIdx {
+			if _, dup := seen[results[i].ID]; !dup {
+				seen[results[i].ID] = struct{}{}
+				locked[partNum] = append(locked[partNum], results[i].ID)
+			}
+		}
+		sort.Ints(locked[partNum])
+		for _, id := range locked[partNum] {
+			col.parts[partNum].LockUpdate(id)
+		}
+	}
+	batch := make(idxBatch)
+	var collided []int // Inserts whose new ID collides with a caller-supplied ID
+	for partNum, opIdx := range byPart {
+		if len(opIdx) == 0 {
+			continue
+		}
+		part := col.parts[partNum]
+		part.DataLock.Lock()
+		for _, i := range opIdx {
+			id := results[i].ID
+			var err error
+			switch ops[i].Op {
+			case BulkInsert:
+				if part.Exists(id) {
+					collided = append(collided, i)
+					continue
+				} else if docJS[i], err = col.runPreHooks(ChangeInsert, id, nil, ops[i].Doc, docJS[i]); err != nil {
+					break
+				} else if _, err = part.Insert(id, docJS[i]); err == nil {
+					col.logDocChange(part, ChangeInsert, id, docJS[i], nil)
+					col.trackDocChange(ChangeInsert, id, docJS[i])
+					col.batchIndexDoc(batch, id, ops[i].Doc, true)
+				}
+			case BulkUpdate, BulkDelete:
+				var originalB []byte
+				if originalB, err = part.Read(id); err != nil {
+					break
+				}
+				json.Unmarshal(originalB, &originals[i])
+				if ops[i].Op == BulkUpdate {
+					if docJS[i], err = col.runPreHooks(ChangeUpdate, id, originals[i], ops[i].Doc, docJS[i]); err == nil {
+						err = part.Update(id, docJS[i])
+					}
+				} else if _, err = col.runPreHooks(ChangeDelete, id, originals[i], nil, nil); err == nil {
+					err = part.Delete(id)
+				}
+				if err != nil {
+					break
+				}
+				col.logDocChange(part, ops[i].Op, id, docJS[i], originalB)
+				col.trackDocChange(ops[i].Op, id, docJS[i])
+				col.batchIndexDoc(batch, id, originals[i], false)
+				if ops[i].Op == BulkUpdate {
+					col.batchIndexDoc(batch, id, ops[i].Doc, true)
+				}
+			}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}
+		part.DataLock.Unlock()
+	}
+	col.applyIndexBatch(batch)
+	for partNum, ids := range locked {
+		for _, id := range ids {
+			col.parts[partNum].UnlockUpdate(id)
+		}
+	}
+	// Insert the few collided documents one by one under another new ID
+	for _, i := range collided {
+		for {
+			id, err := col.ids.nextID()
+			if err == nil {
+				if err = col.insert(id, ops[i].Doc, docJS[i]); dberr.Type(err) == dberr.ErrorDocExists {
+					continue
+				}
+			}
+			results[i].ID = id
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+			break
+		}
+	}
+	return
+}
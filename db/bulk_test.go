@@ -0,0 +1,88 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBulk(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	// Insert many documents at once
+	ops := make([]BulkOp, 100)
+	for i := range ops {
+		ops[i] = BulkOp{Op: BulkInsert, Doc: map[string]interface{}{"a": i}}
+	}
+	results := col.Bulk(ops)
+	if len(results) != len(ops) {
+		t.Fatal(results)
+	}
+	for i, result := range results {
+		if result.Error != "" {
+			t.Fatal(result)
+		} else if doc, err := col.Read(result.ID); err != nil || doc["a"].(float64) != float64(i) {
+			t.Fatal(doc, err)
+		} else if err = idxHas(col, []string{"a"}, i, result.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Mix of operations, including ones that fail
+	ids := []int{results[0].ID, results[1].ID, results[2].ID}
+	results = col.Bulk([]BulkOp{
+		{Op: BulkUpdate, ID: ids[0], Doc: map[string]interface{}{"a": 1000}},
+		{Op: BulkDelete, ID: ids[1]},
+		{Op: BulkDelete, ID: ids[1]},
+		{Op: BulkUpdate, ID: ids[2], Doc: map[string]interface{}{"a": 2000}},
+		{Op: BulkUpdate, ID: ids[2], Doc: map[string]interface{}{"a": 3000}},
+		{Op: BulkUpdate, ID: ids[0]},
+		{Op: "replace", ID: ids[0]},
+		{Op: BulkInsert, Doc: map[string]interface{}{"a": 4000}},
+	})
+	for i, failed := range []bool{false, false, true, false, false, true, true, false} {
+		if failed != (results[i].Error != "") {
+			t.Fatal(i, results[i])
+		}
+	}
+	if doc, err := col.Read(ids[0]); err != nil || doc["a"].(float64) != 1000 {
+		t.Fatal(doc, err)
+	} else if _, err = col.Read(ids[1]); err == nil {
+		t.Fatal("did not delete")
+	} else if doc, err = col.Read(ids[2]); err != nil || doc["a"].(float64) != 3000 {
+		t.Fatal(doc, err)
+	} else if doc, err = col.Read(results[7].ID); err != nil || doc["a"].(float64) != 4000 {
+		t.Fatal(doc, err)
+	}
+	if err = idxHas(col, []string{"a"}, 1000, ids[0]); err != nil {
+		t.Fatal(err)
+	} else if err = idxHasNot(col, []string{"a"}, 0, ids[0]); err != nil {
+		t.Fatal(err)
+	} else if err = idxHasNot(col, []string{"a"}, 1, ids[1]); err != nil {
+		t.Fatal(err)
+	} else if err = idxHasNot(col, []string{"a"}, 2000, ids[2]); err != nil {
+		t.Fatal(err)
+	} else if err = idxHas(col, []string{"a"}, 3000, ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, rev, err := col.ReadRev(ids[2]); err != nil || rev != 3 {
+		t.Fatal(rev, err)
+	}
+}
@@ -0,0 +1,142 @@
+// Capped collections keep only the newest documents, up to a number of documents or bytes.
+
+package db
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+// Insertion order and sizes of the documents in a capped collection. Document IDs of capped collections increase in
+// insertion order, so the oldest document has the lowest ID.
+type capTracker struct {
+	lock  *sync.Mutex
+	order []int       // Document IDs in ascending order, including some of the deleted ones
+	sizes map[int]int // Size of each document in JSON
+	bytes int         // Total size of documents
+}
+
+// Return true if the collection has a maximum number of documents or bytes.
+func (opts ColOptions) capped() bool {
+	return opts.MaxDocs > 0 || opts.MaxBytes > 0
+}
+
+// Prepare to track the documents of a capped collection, read the size of all documents. Caller must hold schema
+// lock exclusively.
+func (col *Col) openCapTracker() {
+	col.capped = &capTracker{lock: new(sync.Mutex), sizes: make(map[int]int)}
+	for _, part := range col.parts {
+		part.ForEachDoc(0, 1, func(id int, doc []byte) bool {
+			col.capped.put(id, len(bytes.TrimRight(doc, " ")))
+			return true
+		})
+	}
+}
+
+// Record the size of an inserted or updated document.
+func (capped *capTracker) put(id, size int) {
+	capped.lock.Lock()
+	defer capped.lock.Unlock()
+	if oldSize, exists := capped.sizes[id]; exists {
+		capped.bytes += size - oldSize
+		capped.sizes[id] = size
+		return
+	}
+	capped.sizes[id] = size
+	capped.bytes += size
+	if last := len(capped.order) - 1; last >= 0 && id < capped.order[last] {
+		// A caller-supplied ID, or an ID of a deleted document that is still in order
+		pos := sort.SearchInts(capped.order, id)
+		if capped.order[pos] != id {
+			capped.order = append(capped.order, 0)
+			copy(capped.order[pos+1:], capped.order[pos:])
+			capped.order[pos] = id
+		}
+		return
+	}
+	capped.order = append(capped.order, id)
+}
+
+// Forget a deleted document.
+func (capped *capTracker) remove(id int) {
+	capped.lock.Lock()
+	defer capped.lock.Unlock()
+	size, exists := capped.sizes[id]
+	if !exists {
+		return
+	}
+	delete(capped.sizes, id)
+	capped.bytes -= size
+	// Deleted documents in the middle of the order are skipped, until they are too many
+	if len(capped.order) > 2*len(capped.sizes)+1024 {
+		live := make([]int, 0, len(capped.sizes))
+		for _, orderID := range capped.order {
+			if _, exists := capped.sizes[orderID]; exists {
+				live = append(live, orderID)
+			}
+		}
+		capped.order = live
+	}
+}
+
+// Forget all documents.
+func (capped *capTracker) clear() {
+	capped.lock.Lock()
+	defer capped.lock.Unlock()
+	capped.order, capped.sizes, capped.bytes = nil, make(map[int]int), 0
+}
+
+// Return the oldest document if there are more documents or bytes than allowed.
+func (capped *capTracker) oldestOver(maxDocs, maxBytes int) (id int, over bool) {
+	capped.lock.Lock()
+	defer capped.lock.Unlock()
+	if (maxDocs == 0 || len(capped.sizes) <= maxDocs) && (maxBytes == 0 || capped.bytes <= maxBytes) {
+		return 0, false
+	}
+	for len(capped.order) > 0 {
+		if _, exists := capped.sizes[capped.order[0]]; exists {
+			return capped.order[0], true
+		}
+		capped.order = capped.order[1:]
+	}
+	return 0, false
+}
+
+// Track the inserted, updated or deleted document of a capped collection. Caller must hold the partition lock.
+func (col *Col) trackDocChange(op string, id int, docJS []byte) {
+	if col.capped == nil {
+		return
+	} else if op == ChangeDelete {
+		col.capped.remove(id)
+	} else {
+		col.capped.put(id, len(docJS))
+	}
+}
+
+// Delete the oldest documents until the capped collection is within its maximum number of documents and bytes.
+// Evicted documents are deleted like any other, they are removed from indexes and recorded in change log.
+// Caller must not hold any lock.
+func (col *Col) evict() {
+	if col.capped == nil {
+		return
+	}
+	for {
+		id, over := col.capped.oldestOver(col.opts.MaxDocs, col.opts.MaxBytes)
+		if !over {
+			return
+		}
+		switch err := col.Delete(id); dberr.Type(err) {
+		case dberr.ErrorNil:
+		case dberr.ErrorNoDoc:
+			// Deleted in the meantime
+			col.capped.remove(id)
+		default:
+			tdlog.Noticef("Collection %s: failed to evict document %d - %v", col.name, id, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestCappedOptions(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.CreateWith("a", ColOptions{MaxDocs: -1}); err == nil {
+		t.Fatal("did not error")
+	} else if err = db.CreateWith("a", ColOptions{IDStrategy: IDRandom, MaxDocs: 10}); err == nil {
+		t.Fatal("did not error")
+	} else if err = db.CreateWith("a", ColOptions{MaxDocs: 10}); err != nil {
+		t.Fatal(err)
+	} else if opts := db.Use("a").Options(); opts.IDStrategy != IDMonotonic || opts.MaxDocs != 10 {
+		t.Fatal(opts)
+	} else if err = db.CreateWith("b", ColOptions{IDStrategy: IDTimeOrdered, MaxBytes: 100}); err != nil {
+		t.Fatal(err)
+	} else if err = db.CreateWith("c", ColOptions{}); err != nil {
+		t.Fatal(err)
+	} else if opts := db.Use("c").Options(); opts.IDStrategy != DefaultIDStrategy {
+		t.Fatal(opts)
+	}
+}
+
+func TestCapped(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.CreateWith("logs", ColOptions{MaxDocs: 5}); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("logs")
+	if err = col.Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 0)
+	for n := 0; n < 8; n++ {
+		id, err := col.Insert(map[string]interface{}{"n": n})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// The oldest documents are evicted from the collection and its indexes
+	expectDocs := func(live []int) {
+		count := 0
+		col.ForEachDoc(func(id int, doc []byte) bool {
+			count++
+			return true
+		})
+		if count != len(live) {
+			t.Fatal(count, live)
+		}
+		for _, id := range live {
+			if _, err := col.Read(id); err != nil {
+				t.Fatal(id, err)
+			}
+		}
+	}
+	expectDocs(ids[3:])
+	for n := 0; n < 8; n++ {
+		matches := make(map[int]struct{})
+		if err = EvalQuery(map[string]interface{}{"eq": n, "in": []interface{}{"n"}}, col, &matches); err != nil {
+			t.Fatal(err)
+		} else if _, found := matches[ids[n]]; found != (n >= 3) {
+			t.Fatal(n, matches)
+		}
+	}
+	// Deleted documents make room for new ones
+	if err = col.Delete(ids[5]); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"n": 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDocs([]int{ids[3], ids[4], ids[6], ids[7], id})
+	results := col.Bulk([]BulkOp{
+		{Op: BulkInsert, Doc: map[string]interface{}{"n": 9}},
+		{Op: BulkInsert, Doc: map[string]interface{}{"n": 10}},
+	})
+	expectDocs([]int{ids[6], ids[7], id, results[0].ID, results[1].ID})
+	// Insertion order is kept when the database is opened again
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("logs")
+	newID, err := col.Insert(map[string]interface{}{"n": 11})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDocs([]int{ids[7], id, results[0].ID, results[1].ID, newID})
+	if err = db.Truncate("logs"); err != nil {
+		t.Fatal(err)
+	}
+	expectDocs([]int{})
+	// Collection capped by size keeps the newest documents within the total size of documents in JSON
+	if err = db.CreateWith("bytes", ColOptions{MaxBytes: 50}); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("bytes")
+	if _, err = col.Insert(map[string]interface{}{"s": strings.Repeat("x", 50)}); dberr.Type(err) != dberr.ErrorDocTooLarge {
+		t.Fatal(err)
+	}
+	ids = ids[:0]
+	for n := 0; n < 4; n++ {
+		id, err := col.Insert(map[string]interface{}{"s": strings.Repeat("x", 10)}) // 18 bytes
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	expectDocs(ids[2:])
+	// Growing a document evicts older ones
+	if err = col.Update(ids[3], map[string]interface{}{"s": strings.Repeat("x", 30)}); err != nil {
+		t.Fatal(err)
+	}
+	expectDocs(ids[3:])
+}
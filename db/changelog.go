@@ -0,0 +1,356 @@
+// Change log records every change made to the database, for incremental backup and point-in-time restore.
+
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	CHANGE_LOG_DIR     = ".changelog" // Name of the directory in database directory that holds change log segments.
+	changeLogExt       = ".ndjson"    // Extension of change log segment file name, which is the first sequence number in it.
+	changeLogSegSize   = 64 << 20     // A new segment is started when the current one grows beyond this size.
+	changeLogSeqDigits = 20           // Segment file names are zero-padded to sort in sequence order.
+	changeLogRecent    = 1024         // Number of the latest changes kept in memory for change feed.
+
+	ChangeInsert   = "insert"   // A document is inserted.
+	ChangeUpdate   = "update"   // A document is updated.
+	ChangeDelete   = "delete"   // A document is deleted.
+	ChangeCreate   = "create"   // A collection is created.
+	ChangeDrop     = "drop"     // A collection is dropped.
+	ChangeRename   = "rename"   // A collection is renamed.
+	ChangeTruncate = "truncate" // All documents of a collection are deleted.
+	ChangeIndex    = "index"    // An index is created or rebuilt.
+	ChangeUnindex  = "unindex"  // An index is removed.
+	ChangeSchema   = "schema"   // Collection schema is set, or removed if the change does not have one.
+	ChangeTTL      = "ttl"      // Collection TTL is set, or removed if the change does not have one.
+	ChangeLoad     = "load"     // A bulk load begins, the documents it loads are not recorded.
+	ChangeRepair   = "repair"   // Documents of a collection are repaired by fsck or scrub, the repairs are not recorded.
+)
+
+// Change is a change made to the database.
+type Change struct {
+	Seq     int             // Sequence number, it increases by one for each change.
+	Time    int64           // Time of the change, in nanoseconds since Unix epoch.
+	Op      string          // Kind of the change, e.g. ChangeInsert.
+	Col     string          // Collection name.
+	ID      int             // Document ID of insert, update and delete.
+	Rev     int             `json:",omitempty"` // Document revision after insert and update.
+	Doc     json.RawMessage `json:",omitempty"` // Document content after insert and update.
+	OldDoc  json.RawMessage `json:",omitempty"` // Document content before update and delete.
+	NewName string          `json:",omitempty"` // New collection name of rename.
+	Options *ColOptions     `json:",omitempty"` // Options of the created collection.
+	Index   *ExportIndex    `json:",omitempty"` // Path and hash function of index and unindex.
+	Schema  json.RawMessage `json:",omitempty"` // Collection schema that is set.
+	TTL     *TTL            `json:",omitempty"` // Collection TTL that is set.
+}
+
+// Append-only log of changes, divided into segment files.
+type changeLog struct {
+	lock     *sync.Mutex
+	dir      string
+	file     *os.File      // Current segment
+	size     int64         // Size of current segment
+	firstSeq int           // Sequence number of the oldest change in log
+	lastSeq  int           // Sequence number of the latest change
+	recent   []Change      // The latest changes in order, at most changeLogRecent of them
+	appended chan struct{} // Closed and replaced when a change is appended or the log is closed
+	closed   bool
+	watchers map[*Watcher]struct{} // Watchers that have not stopped
+}
+
+// Return the first sequence numbers of all segments in order.
+func changeLogSegments(dir string) (segs []int, err error) {
+	content, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, file := range content {
+		if !strings.HasSuffix(file.Name(), changeLogExt) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(file.Name(), changeLogExt))
+		if err != nil {
+			return nil, fmt.Errorf("Change log segment name %s is invalid", file.Name())
+		}
+		segs = append(segs, seq)
+	}
+	sort.Ints(segs)
+	return
+}
+
+// Return the path of the segment that starts with the sequence number.
+func changeLogSegPath(dir string, firstSeq int) string {
+	return path.Join(dir, fmt.Sprintf("%0*d%s", changeLogSeqDigits, firstSeq, changeLogExt))
+}
+
+// Read changes from the file and run the function on each, stop at the first incomplete line.
+func readChangeFile(filePath string, fun func(change Change) (moveOn bool, err error)) (moveOn bool, validSize int64, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	in := bufio.NewReader(file)
+	for {
+		line, readErr := in.ReadBytes('\n')
+		if readErr == io.EOF {
+			// A change is only complete with its line break
+			return true, validSize, nil
+		} else if readErr != nil {
+			return false, validSize, readErr
+		}
+		var change Change
+		if err = json.Unmarshal(line, &change); err != nil {
+			return false, validSize, fmt.Errorf("Change log %s is corrupted after %d bytes - %v", filePath, validSize, err)
+		}
+		validSize += int64(len(line))
+		if moveOn, err = fun(change); !moveOn || err != nil {
+			return
+		}
+	}
+}
+
+// Open the change log in the directory, create the directory if it does not yet exist.
+func openChangeLog(dir string) (log *changeLog, err error) {
+	// Older versions allowed a collection to have the name of change log directory
+	for _, colFile := range []string{COL_META_FILE, DOC_DATA_FILE + "0"} {
+		if _, err = os.Stat(path.Join(dir, colFile)); err == nil {
+			return nil, fmt.Errorf("Collection %s uses the name of change log directory, please rename the directory", dir)
+		}
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	log = &changeLog{lock: new(sync.Mutex), dir: dir, firstSeq: 1, appended: make(chan struct{}), watchers: make(map[*Watcher]struct{})}
+	segs, err := changeLogSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segs) == 0 {
+		return log, log.startSegment(1)
+	}
+	log.firstSeq, log.lastSeq = segs[0], segs[len(segs)-1]-1
+	lastPath := changeLogSegPath(dir, segs[len(segs)-1])
+	_, validSize, err := readChangeFile(lastPath, func(change Change) (bool, error) {
+		log.lastSeq = change.Seq
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Discard the incomplete change written during a crash
+	if log.file, err = os.OpenFile(lastPath, os.O_WRONLY, 0600); err != nil {
+		return nil, err
+	} else if err = log.file.Truncate(validSize); err != nil {
+		return nil, err
+	} else if _, err = log.file.Seek(validSize, 0); err != nil {
+		return nil, err
+	}
+	log.size = validSize
+	return
+}
+
+// Close the current segment and start a new one. Caller must hold the lock.
+func (log *changeLog) startSegment(firstSeq int) (err error) {
+	if log.file != nil {
+		if err = log.file.Close(); err != nil {
+			return
+		}
+	}
+	log.file, err = os.OpenFile(changeLogSegPath(log.dir, firstSeq), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	log.size = 0
+	return
+}
+
+// Assign the next sequence number to the change and append it to the log.
+func (log *changeLog) append(change Change) (err error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	change.Seq, change.Time = log.lastSeq+1, time.Now().UnixNano()
+	line, err := json.Marshal(change)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if log.size > 0 && log.size+int64(len(line)) > changeLogSegSize {
+		if err = log.startSegment(change.Seq); err != nil {
+			return
+		}
+	}
+	written, err := log.file.Write(line)
+	log.size += int64(written)
+	if err != nil {
+		return
+	}
+	log.lastSeq = change.Seq
+	// Keep a copy for change feed, caller may reuse the document buffers
+	change.Doc = append(json.RawMessage(nil), change.Doc...)
+	change.OldDoc = append(json.RawMessage(nil), change.OldDoc...)
+	if len(log.recent) == 2*changeLogRecent {
+		// Watchers may still be reading the changes returned by recentAfter, never overwrite them
+		log.recent = append(make([]Change, 0, 2*changeLogRecent), log.recent[changeLogRecent:]...)
+	}
+	log.recent = append(log.recent, change)
+	close(log.appended)
+	log.appended = make(chan struct{})
+	return
+}
+
+// Return the changes after the sequence number that are kept in memory, and a channel that is closed when the next
+// change is appended. If changes after the sequence number are no longer kept in memory, inMemory is false.
+// The returned changes are never modified by the log, they may be read after the lock is released.
+func (log *changeLog) recentAfter(afterSeq int) (changes []Change, inMemory bool, appended <-chan struct{}, closed bool) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if afterSeq >= log.lastSeq {
+		return nil, true, log.appended, log.closed
+	} else if len(log.recent) == 0 || log.recent[0].Seq > afterSeq+1 {
+		return nil, false, log.appended, log.closed
+	}
+	changes = log.recent[afterSeq+1-log.recent[0].Seq:]
+	return changes[:len(changes):len(changes)], true, log.appended, log.closed
+}
+
+// Return the range of sequence numbers in the log.
+func (log *changeLog) seqRange() (first, last int) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	return log.firstSeq, log.lastSeq
+}
+
+// Run the function on each change after the sequence number, in order, until the function returns false.
+func (log *changeLog) forEach(afterSeq int, fun func(change Change) (moveOn bool, err error)) error {
+	segs, err := changeLogSegments(log.dir)
+	if err != nil {
+		return err
+	}
+	for i, seg := range segs {
+		if i+1 < len(segs) && segs[i+1] <= afterSeq+1 {
+			// All changes in the segment are not after the sequence number
+			continue
+		}
+		moveOn, _, err := readChangeFile(changeLogSegPath(log.dir, seg), func(change Change) (bool, error) {
+			if change.Seq <= afterSeq {
+				return true, nil
+			}
+			return fun(change)
+		})
+		if !moveOn || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the segments that only have changes before the sequence number.
+func (log *changeLog) purge(beforeSeq int) error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	segs, err := changeLogSegments(log.dir)
+	if err != nil {
+		return err
+	}
+	// The current segment is never removed
+	for i := 0; i+1 < len(segs) && segs[i+1] <= beforeSeq; i++ {
+		if err = os.Remove(changeLogSegPath(log.dir, segs[i])); err != nil {
+			return err
+		}
+		log.firstSeq = segs[i+1]
+	}
+	return nil
+}
+
+// Close the current segment, and stop the change feeds.
+func (log *changeLog) close() error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if !log.closed {
+		log.closed = true
+		close(log.appended)
+	}
+	return log.file.Close()
+}
+
+// Record a change in the change log if it is enabled. A change that cannot be recorded is logged as critical error,
+// incremental backups taken afterwards will miss it.
+func (db *DB) logChange(change Change) {
+	if db.log == nil {
+		return
+	}
+	if err := db.log.append(change); err != nil {
+		tdlog.CritNoRepeat("Failed to record %s of %s in change log - %v", change.Op, change.Col, err)
+	}
+}
+
+// Record a document change in the change log if it is enabled. Caller must hold the partition lock.
+func (col *Col) logDocChange(part *data.Partition, op string, id int, docJS, oldJS []byte) {
+	if col.db.log == nil {
+		return
+	}
+	change := Change{Op: op, Col: col.name, ID: id}
+	if oldJS = bytes.TrimRight(oldJS, " "); json.Valid(oldJS) {
+		change.OldDoc = oldJS
+	}
+	if op != ChangeDelete {
+		change.Doc = docJS
+		change.Rev, _ = part.Revision(id)
+	}
+	col.db.logChange(change)
+}
+
+// Start recording all changes made to the database in the change log, which is required by incremental backups.
+// The change log remains enabled when the database is opened again.
+func (db *DB) EnableChangeLog() (err error) {
+	db.lockSchema()
+	defer db.unlockSchema()
+	if db.log != nil {
+		return nil
+	}
+	db.log, err = openChangeLog(path.Join(db.path, CHANGE_LOG_DIR))
+	return
+}
+
+// Return true if the change log is enabled.
+func (db *DB) ChangeLogEnabled() bool {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	return db.log != nil
+}
+
+// Return the sequence number of the latest change in change log.
+func (db *DB) LastChangeSeq() (int, error) {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	if db.log == nil {
+		return 0, fmt.Errorf("Change log is not enabled")
+	}
+	_, last := db.log.seqRange()
+	return last, nil
+}
+
+// Remove the oldest changes from change log, keeping at least the changes from the sequence number onward.
+// Incremental backups may not be taken on top of a backup whose changes have been removed.
+func (db *DB) PurgeChangeLog(beforeSeq int) error {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	if db.log == nil {
+		return fmt.Errorf("Change log is not enabled")
+	}
+	return db.log.purge(beforeSeq)
+}
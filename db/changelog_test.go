@@ -0,0 +1,124 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestChangeLog(t *testing.T) {
+	dir := TEST_DATA_DIR + "/changelog"
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	log, err := openChangeLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = log.append(Change{Op: ChangeInsert, Col: "a", ID: i, Rev: 1, Doc: []byte(`{"a":1}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Start another segment
+	log.lock.Lock()
+	if err = log.startSegment(log.lastSeq + 1); err != nil {
+		t.Fatal(err)
+	}
+	log.lock.Unlock()
+	if err = log.append(Change{Op: ChangeDelete, Col: "a", ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash in the middle of writing a change
+	if _, err = log.file.Write([]byte(`{"Seq":5,"Op":"ins`)); err != nil {
+		t.Fatal(err)
+	} else if err = log.close(); err != nil {
+		t.Fatal(err)
+	}
+	if log, err = openChangeLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer log.close()
+	if first, last := log.seqRange(); first != 1 || last != 4 {
+		t.Fatal(first, last)
+	}
+	if err = log.append(Change{Op: ChangeDrop, Col: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	var changes []Change
+	if err = log.forEach(2, func(change Change) (bool, error) {
+		changes = append(changes, change)
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 || changes[0].Seq != 3 || changes[0].ID != 2 || string(changes[0].Doc) != `{"a":1}` ||
+		changes[1].Op != ChangeDelete || changes[2].Seq != 5 || changes[2].Op != ChangeDrop || changes[2].Time == 0 {
+		t.Fatal(changes)
+	}
+	// Only whole segments are purged
+	if err = log.purge(3); err != nil {
+		t.Fatal(err)
+	} else if first, _ := log.seqRange(); first != 1 {
+		t.Fatal(first)
+	} else if err = log.purge(5); err != nil {
+		t.Fatal(err)
+	} else if first, _ := log.seqRange(); first != 4 {
+		t.Fatal(first)
+	}
+	changes = nil
+	log.forEach(0, func(change Change) (bool, error) {
+		changes = append(changes, change)
+		return true, nil
+	})
+	if len(changes) != 2 || changes[0].Seq != 4 {
+		t.Fatal(changes)
+	}
+}
+
+func TestChangeLogDirName(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A collection may be called "changelog"
+	if err = db.Create("changelog"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.Use("changelog").Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = db.EnableChangeLog(); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create(CHANGE_LOG_DIR); err == nil {
+		t.Fatal("did not error")
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	} else if !db.ChangeLogEnabled() || db.Use("changelog") == nil {
+		t.Fatal(db.AllCols())
+	} else if _, err = db.Use("changelog").Read(id); err != nil {
+		t.Fatal(err)
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A collection created by older versions under the name of change log directory is not mistaken for change log
+	if err = os.RemoveAll(TEST_DATA_DIR + "/" + CHANGE_LOG_DIR); err != nil {
+		t.Fatal(err)
+	} else if err = os.Rename(TEST_DATA_DIR+"/changelog", TEST_DATA_DIR+"/"+CHANGE_LOG_DIR); err != nil {
+		t.Fatal(err)
+	} else if _, err = OpenDB(TEST_DATA_DIR); err == nil {
+		t.Fatal("did not error")
+	} else if _, err = os.Stat(TEST_DATA_DIR + "/" + CHANGE_LOG_DIR + "/" + COL_META_FILE); err != nil {
+		t.Fatal(err)
+	}
+}
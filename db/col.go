@@ -5,19 +5,19 @@ package db
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
-	"strings"
+	"sync"
 
 	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/tdlog"
 )
 
 const (
 	DOC_DATA_FILE   = "dat_" // Prefix of partition collection data file name.
 	DOC_LOOKUP_FILE = "id_"  // Prefix of partition hash table (ID lookup) file name.
-	INDEX_PATH_SEP  = "!"    // Separator between index keys in index directory name.
+	INDEX_PATH_SEP  = "!"    // Separator between index keys in index name.
 )
 
 // Collection has data partitions and some index meta information.
@@ -27,57 +27,112 @@ type Col struct {
 	parts      []*data.Partition            // Collection partitions
 	hts        []map[string]*data.HashTable // Index partitions
 	indexPaths map[string][]string          // Index names and paths
+	indexHash  map[string]IndexHash         // Index names and hash functions
+	indexDirs  map[string]string            // Index names and directory names
+	upsertLock *sync.Mutex                  // Serialise upserts by indexed value
+	opts       ColOptions                   // Options chosen upon creation
+	ids        *idGen                       // Document ID generator
+	loading    bool                         // Bulk load is in progress, indexes are not maintained
+	hooks      *colHooks                    // Pre and post hooks of document writes
+	schema     *docSchema                   // Schema that documents must match, nil if there is none
+	ttl        *TTL                         // Expiry of documents, nil if they do not expire
+	capped     *capTracker                  // Insertion order and sizes of documents, nil unless the collection is capped
+	created    int64                        // Creation time in nanoseconds since Unix epoch
 }
 
 // Open a collection and load all indexes.
 func OpenCol(db *DB, name string) (*Col, error) {
-	col := &Col{db: db, name: name}
+	col := &Col{db: db, name: name, upsertLock: new(sync.Mutex), hooks: &colHooks{lock: new(sync.RWMutex)}}
 	return col, col.load()
 }
 
 // Load collection schema including index schema.
 func (col *Col) load() error {
-	if err := os.MkdirAll(path.Join(col.db.path, col.name), 0700); err != nil {
+	colDir := path.Join(col.db.path, col.name)
+	readOnly := col.db.Config.ReadOnly
+	if !readOnly {
+		if err := os.MkdirAll(colDir, 0700); err != nil {
+			return err
+		}
+	}
+	meta, legacy, err := readColMeta(colDir)
+	if err != nil {
+		return fmt.Errorf("Collection %s: metadata is corrupted - %v", col.name, err)
+	} else if legacy && !readOnly {
+		if err = migrateColMeta(colDir, meta); err != nil {
+			return err
+		}
+	}
+	col.opts, col.ttl, col.created = meta.Options, meta.TTL, meta.Created
+	if col.ids, err = openIDGen(colDir, col.opts.IDStrategy, col.db.numParts); err != nil {
 		return err
 	}
+	col.schema = nil
+	if len(meta.Schema) > 0 {
+		if col.schema, err = parseSchema(meta.Schema); err != nil {
+			return err
+		}
+	}
 	col.parts = make([]*data.Partition, col.db.numParts)
 	col.hts = make([]map[string]*data.HashTable, col.db.numParts)
 	for i := 0; i < col.db.numParts; i++ {
 		col.hts[i] = make(map[string]*data.HashTable)
 	}
 	col.indexPaths = make(map[string][]string)
+	col.indexHash = make(map[string]IndexHash)
+	col.indexDirs = make(map[string]string)
 	// Open collection document partitions
 	for i := 0; i < col.db.numParts; i++ {
-		var err error
 		if col.parts[i], err = col.db.Config.OpenPartition(
 			path.Join(col.db.path, col.name, DOC_DATA_FILE+strconv.Itoa(i)),
 			path.Join(col.db.path, col.name, DOC_LOOKUP_FILE+strconv.Itoa(i))); err != nil {
 			return err
 		}
 	}
-	// Look for index directories
-	colDirContent, err := ioutil.ReadDir(path.Join(col.db.path, col.name))
-	if err != nil {
-		return err
+	if col.opts.capped() {
+		col.openCapTracker()
 	}
-	for _, htDir := range colDirContent {
-		if !htDir.IsDir() {
+	// A bulk load did not finish, its documents are not indexed
+	_, loadErr := os.Stat(path.Join(colDir, LOAD_MARKER_FILE))
+	col.loading = loadErr == nil && readOnly
+	// Open index partitions
+	for _, idx := range meta.Indexes {
+		idxName := indexName(idx.Path)
+		col.indexPaths[idxName] = idx.Path
+		col.indexHash[idxName] = idx.Hash
+		col.indexDirs[idxName] = idx.Dir
+		if !idx.Hash.IsCurrent() {
+			tdlog.Noticef("Collection %s: index %v uses hash function %s, rebuild it with Reindex or MigrateIndexes for faster and stricter lookups", col.name, idx.Path, idx.Hash.Func)
+		}
+		if col.loading {
 			continue
+		} else if !readOnly {
+			if err = os.MkdirAll(path.Join(colDir, idx.Dir), 0700); err != nil {
+				return err
+			}
 		}
-		// Open index partitions
-		idxName := htDir.Name()
-		idxPath := strings.Split(idxName, INDEX_PATH_SEP)
-		col.indexPaths[idxName] = idxPath
 		for i := 0; i < col.db.numParts; i++ {
 			if col.hts[i][idxName], err = col.db.Config.OpenHashTable(
-				path.Join(col.db.path, col.name, idxName, strconv.Itoa(i))); err != nil {
+				path.Join(colDir, idx.Dir, strconv.Itoa(i))); err != nil {
 				return err
 			}
 		}
 	}
+	if loadErr == nil && !readOnly {
+		tdlog.Noticef("Collection %s: bulk load was not committed, rebuilding indexes", col.name)
+		if err = col.rebuildIndexes(); err != nil {
+			return err
+		}
+		return os.Remove(path.Join(colDir, LOAD_MARKER_FILE))
+	}
 	return nil
 }
 
+// Return the options chosen upon creation of the collection.
+func (col *Col) Options() ColOptions {
+	return col.opts
+}
+
 // Close all collection files. Do not use the collection afterwards!
 func (col *Col) close() error {
 	errs := make([]error, 0, 0)
@@ -129,23 +184,79 @@ func (col *Col) ForEachDoc(fun func(id int, doc []byte) (moveOn bool)) {
 
 // Create an index on the path.
 func (col *Col) Index(idxPath []string) (err error) {
-	col.db.schemaLock.Lock()
-	defer col.db.schemaLock.Unlock()
-	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	return col.IndexWithHash(idxPath, DefaultIndexHash)
+}
+
+// Create an index on the path, index values are hashed using the named hash function.
+func (col *Col) IndexWithHash(idxPath []string, hashFunc string) (err error) {
+	hash, err := NewIndexHash(hashFunc)
+	if err != nil {
+		return
+	}
+	return col.index(idxPath, hash)
+}
+
+// Create an index on the path, indexed strings are compared under the collation (e.g. case-insensitive).
+func (col *Col) IndexWithCollation(idxPath []string, collation string) (err error) {
+	hash, err := NewIndexHash(DefaultIndexHash)
+	if err != nil {
+		return
+	} else if hash.Collation, err = parseCollation(collation); err != nil {
+		return
+	}
+	return col.index(idxPath, hash)
+}
+
+// Create an index on the path and put all documents on it.
+func (col *Col) index(idxPath []string, hash IndexHash) (err error) {
+	col.db.lockSchema()
+	defer col.db.unlockSchema()
+	idxName := indexName(idxPath)
 	if _, exists := col.indexPaths[idxName]; exists {
 		return fmt.Errorf("Path %v is already indexed", idxPath)
 	}
-	col.indexPaths[idxName] = idxPath
-	idxDir := path.Join(col.db.path, col.name, idxName)
-	if err = os.MkdirAll(idxDir, 0700); err != nil {
+	idxDir := col.newIndexDir()
+	idxDirPath := path.Join(col.db.path, col.name, idxDir)
+	if err = os.MkdirAll(idxDirPath, 0700); err != nil {
 		return err
 	}
+	// Leave no trace of the index if it cannot be created
+	defer func() {
+		if err == nil {
+			return
+		}
+		delete(col.indexPaths, idxName)
+		delete(col.indexHash, idxName)
+		delete(col.indexDirs, idxName)
+		for i := 0; i < col.db.numParts; i++ {
+			if ht := col.hts[i][idxName]; ht != nil {
+				ht.Close()
+			}
+			delete(col.hts[i], idxName)
+		}
+		if removeErr := os.RemoveAll(idxDirPath); removeErr != nil {
+			tdlog.Noticef("Collection %s: failed to remove directory %s of index %v - %v", col.name, idxDir, idxPath, removeErr)
+		}
+	}()
 	for i := 0; i < col.db.numParts; i++ {
-		if col.hts[i][idxName], err = col.db.Config.OpenHashTable(path.Join(idxDir, strconv.Itoa(i))); err != nil {
+		if col.hts[i][idxName], err = col.db.Config.OpenHashTable(path.Join(idxDirPath, strconv.Itoa(i))); err != nil {
 			return err
 		}
 	}
-	// Put all documents on the new index
+	col.indexPaths[idxName] = append([]string{}, idxPath...)
+	col.indexHash[idxName] = hash
+	col.indexDirs[idxName] = idxDir
+	col.fillIndex(idxName)
+	if err = col.saveMeta(); err != nil {
+		return err
+	}
+	col.db.logChange(Change{Op: ChangeIndex, Col: col.name, Index: &ExportIndex{Path: idxPath, Hash: hash}})
+	return
+}
+
+// Put all documents on the index. Caller must hold schema lock exclusively.
+func (col *Col) fillIndex(idxName string) {
+	idxPath, hash := col.indexPaths[idxName], col.indexHash[idxName]
 	col.forEachDoc(func(id int, doc []byte) (moveOn bool) {
 		var docObj map[string]interface{}
 		if err := json.Unmarshal(doc, &docObj); err != nil {
@@ -154,12 +265,78 @@ func (col *Col) Index(idxPath []string) (err error) {
 		}
 		for _, idxVal := range GetIn(docObj, idxPath) {
 			if idxVal != nil {
-				hashKey := StrHash(fmt.Sprint(idxVal))
+				hashKey := hash.Key(idxVal)
 				col.hts[hashKey%col.db.numParts][idxName].Put(hashKey, id)
 			}
 		}
 		return true
 	}, false)
+}
+
+// Rebuild an index from scratch, index values are hashed using the named hash function.
+func (col *Col) Reindex(idxPath []string, hashFunc string) (err error) {
+	hash, err := NewIndexHash(hashFunc)
+	if err != nil {
+		return
+	}
+	col.db.lockSchema()
+	defer col.db.unlockSchema()
+	hash.Collation = col.indexHash[indexName(idxPath)].Collation
+	return col.reindex(idxPath, hash)
+}
+
+// Clear and rebuild the index on the path. Caller must hold schema lock exclusively.
+func (col *Col) reindex(idxPath []string, hash IndexHash) error {
+	idxName := indexName(idxPath)
+	if _, exists := col.indexPaths[idxName]; !exists {
+		return fmt.Errorf("Path %v is not indexed", idxPath)
+	} else if hash.Collation != CollationBinary && !hash.typed() {
+		return fmt.Errorf("Hash function %s does not support collation %s", hash.Func, hash.Collation)
+	}
+	for i := 0; i < col.db.numParts; i++ {
+		if err := col.hts[i][idxName].Clear(); err != nil {
+			return err
+		}
+	}
+	col.indexHash[idxName] = hash
+	col.fillIndex(idxName)
+	if err := col.saveMeta(); err != nil {
+		return err
+	}
+	col.db.logChange(Change{Op: ChangeIndex, Col: col.name, Index: &ExportIndex{Path: col.indexPaths[idxName], Hash: hash}})
+	tdlog.Infof("Collection %s: rebuilt index %v using hash function %s version %d", col.name, col.indexPaths[idxName], hash.Func, hash.Version)
+	return nil
+}
+
+// Rebuild all indexes that do not use the current version of default hash function, return the rebuilt index paths.
+func (col *Col) MigrateIndexes() (migrated [][]string, err error) {
+	col.db.lockSchema()
+	defer col.db.unlockSchema()
+	hash, err := NewIndexHash(DefaultIndexHash)
+	if err != nil {
+		return
+	}
+	for idxName, idxPath := range col.indexPaths {
+		if col.indexHash[idxName].IsCurrent() {
+			continue
+		}
+		hash.Collation = col.indexHash[idxName].Collation
+		if err = col.reindex(idxPath, hash); err != nil {
+			return
+		}
+		migrated = append(migrated, idxPath)
+	}
+	return
+}
+
+// Return the hash function of the index on the path.
+func (col *Col) IndexHash(idxPath []string) (hash IndexHash, err error) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	hash, exists := col.indexHash[indexName(idxPath)]
+	if !exists {
+		return hash, fmt.Errorf("Path %v is not indexed", idxPath)
+	}
 	return
 }
 
@@ -180,20 +357,26 @@ func (col *Col) AllIndexes() (ret [][]string) {
 
 // Remove an index.
 func (col *Col) Unindex(idxPath []string) error {
-	col.db.schemaLock.Lock()
-	defer col.db.schemaLock.Unlock()
-	idxName := strings.Join(idxPath, INDEX_PATH_SEP)
+	col.db.lockSchema()
+	defer col.db.unlockSchema()
+	idxName := indexName(idxPath)
 	if _, exists := col.indexPaths[idxName]; !exists {
 		return fmt.Errorf("Path %v is not indexed", idxPath)
 	}
+	idxDir := col.indexDirs[idxName]
 	delete(col.indexPaths, idxName)
+	delete(col.indexHash, idxName)
+	delete(col.indexDirs, idxName)
 	for i := 0; i < col.db.numParts; i++ {
 		col.hts[i][idxName].Close()
 		delete(col.hts[i], idxName)
 	}
-	if err := os.RemoveAll(path.Join(col.db.path, col.name, idxName)); err != nil {
+	if err := col.saveMeta(); err != nil {
+		return err
+	} else if err := os.RemoveAll(path.Join(col.db.path, col.name, idxDir)); err != nil {
 		return err
 	}
+	col.db.logChange(Change{Op: ChangeUnindex, Col: col.name, Index: &ExportIndex{Path: idxPath}})
 	return nil
 }
 
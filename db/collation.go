@@ -0,0 +1,74 @@
+// String collation and equality semantics of lookups.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	CollationBinary          = ""                 // Strings are equal only if they are identical.
+	CollationNoCase          = "nocase"           // Strings are equal regardless of letter case (Unicode simple case folding).
+	CollationNormalize       = "normalize"        // Canonically equivalent strings (by Unicode normalisation form D) are equal.
+	CollationNormalizeNoCase = "normalize-nocase" // Canonically equivalent strings are equal regardless of letter case.
+)
+
+// Return the collation by name, "binary" is an alias of the default binary collation.
+func parseCollation(name string) (string, error) {
+	switch name {
+	case "binary", CollationBinary:
+		return CollationBinary, nil
+	case CollationNoCase, CollationNormalize, CollationNormalizeNoCase:
+		return name, nil
+	}
+	return "", fmt.Errorf("Collation %s is not supported", name)
+}
+
+// Return the string converted into its collation key - strings that are equal under the collation have identical keys.
+func collate(collation, str string) string {
+	switch collation {
+	case CollationNoCase:
+		return foldCase(str)
+	case CollationNormalize:
+		return norm.NFD.String(str)
+	case CollationNormalizeNoCase:
+		return foldCase(norm.NFD.String(str))
+	}
+	return str
+}
+
+// If the value is a string, return its collation key; otherwise return the value as-is.
+func collateValue(collation string, val interface{}) interface{} {
+	if str, isStr := val.(string); isStr && collation != CollationBinary {
+		return collate(collation, str)
+	}
+	return val
+}
+
+// Return true if both values have the same JSON type and canonical value, strings are compared under the collation.
+func strictEqual(collation string, a, b interface{}) bool {
+	return bytes.Equal(typedRepr(collateValue(collation, a)), typedRepr(collateValue(collation, b)))
+}
+
+// Return true if both values have the same string representation, strings are compared under the collation.
+func looseEqual(collation string, a, b interface{}) bool {
+	return fmt.Sprint(collateValue(collation, a)) == fmt.Sprint(collateValue(collation, b))
+}
+
+// Replace every letter with the smallest letter among its case variations.
+func foldCase(str string) string {
+	return strings.Map(func(r rune) rune {
+		min := r
+		for fold := unicode.SimpleFold(r); fold != r; fold = unicode.SimpleFold(fold) {
+			if fold < min {
+				min = fold
+			}
+		}
+		return min
+	}, str)
+}
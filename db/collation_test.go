@@ -0,0 +1,49 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestCollate(t *testing.T) {
+	if _, err := parseCollation("doesNotExist"); err == nil {
+		t.Fatal("did not error")
+	}
+	if coll, err := parseCollation("binary"); err != nil || coll != CollationBinary {
+		t.Fatal(coll, err)
+	}
+	equal := [][3]string{
+		{CollationNoCase, "École", "éCOLE"},
+		{CollationNoCase, "ΣΊΣΥΦΟΣ", "σίσυφος"},
+		{CollationNormalize, "é", "e\u0301"},
+		{CollationNormalize, "ṩ", "s\u0307\u0323"},      // canonical ordering of combining marks
+		{CollationNormalize, "\u1100\u1161\u11a8", "각"}, // Hangul syllable
+		{CollationNormalize, "\u212b", "Å"},             // Angstrom sign
+		{CollationNormalizeNoCase, "École", "e\u0301COLE"},
+	}
+	for _, c := range equal {
+		if collate(c[0], c[1]) != collate(c[0], c[2]) {
+			t.Fatalf("%q and %q should be equal under %s, got %q and %q", c[1], c[2], c[0], collate(c[0], c[1]), collate(c[0], c[2]))
+		}
+	}
+	notEqual := [][3]string{
+		{CollationBinary, "École", "école"},
+		{CollationNoCase, "é", "e\u0301"},
+		{CollationNormalize, "École", "école"},
+		{CollationNormalizeNoCase, "é", "e"},
+	}
+	for _, c := range notEqual {
+		if collate(c[0], c[1]) == collate(c[0], c[2]) {
+			t.Fatalf("%q and %q should not be equal under %s", c[1], c[2], c[0])
+		}
+	}
+	// Strict and loose equality
+	if !strictEqual(CollationBinary, 1, float64(1)) || strictEqual(CollationBinary, 1, "1") || strictEqual(CollationBinary, true, "true") {
+		t.Fatal("wrong strict equality")
+	}
+	if !looseEqual(CollationBinary, 1, "1") || !looseEqual(CollationBinary, true, "true") || looseEqual(CollationBinary, "A", "a") {
+		t.Fatal("wrong loose equality")
+	}
+	if !strictEqual(CollationNoCase, "A", "a") || strictEqual(CollationNoCase, []interface{}{"A"}, []interface{}{"b"}) {
+		t.Fatal("wrong strict equality under collation")
+	}
+}
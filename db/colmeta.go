@@ -0,0 +1,213 @@
+// Collection metadata file, which records collection options, indexes, schema and TTL.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	COL_META_FILE  = "meta.json" // Name of the file in collection directory that records collection metadata.
+	colMetaVersion = 1           // Current version of collection metadata file format.
+	indexDirPrefix = "idx_"      // Prefix of index directory names.
+)
+
+// ColMeta describes a collection: the options chosen upon creation, its indexes, schema and TTL.
+type ColMeta struct {
+	Version int             // Version of metadata file format.
+	Created int64           // Creation time in nanoseconds since Unix epoch, 0 if created by an older version of tiedot.
+	Options ColOptions      // Options chosen upon creation.
+	Indexes []IndexMeta     // Indexes in order of their names.
+	Schema  json.RawMessage `json:",omitempty"` // JSON Schema that documents must match.
+	TTL     *TTL            `json:",omitempty"` // Expiry of documents.
+}
+
+// IndexMeta describes an index and where its hash tables are.
+type IndexMeta struct {
+	Path []string  // Indexed path.
+	Dir  string    // Name of the index directory in collection directory.
+	Hash IndexHash // Hash function and collation.
+}
+
+// Return the name that identifies the index on the path. Separators in path segments are escaped, so that different
+// paths never share a name.
+func indexName(idxPath []string) string {
+	escaped := make([]string, len(idxPath))
+	for i, segment := range idxPath {
+		escaped[i] = strings.Replace(strings.Replace(segment, `\`, `\\`, -1), INDEX_PATH_SEP, `\`+INDEX_PATH_SEP, -1)
+	}
+	return strings.Join(escaped, INDEX_PATH_SEP)
+}
+
+// Return an error if the metadata is not supported or not valid.
+func (meta ColMeta) validate() error {
+	if meta.Version < 1 || meta.Version > colMetaVersion {
+		return fmt.Errorf("Collection metadata version %d is not supported by this version of tiedot", meta.Version)
+	} else if err := meta.Options.validate(); err != nil {
+		return err
+	} else if len(meta.Schema) > 0 {
+		if _, err := parseSchema(meta.Schema); err != nil {
+			return err
+		}
+	}
+	if meta.TTL != nil {
+		if err := meta.TTL.validate(); err != nil {
+			return err
+		}
+	}
+	names, dirs := make(map[string]struct{}), make(map[string]struct{})
+	for _, idx := range meta.Indexes {
+		name := indexName(idx.Path)
+		if _, dup := names[name]; dup {
+			return fmt.Errorf("Path %v is indexed more than once", idx.Path)
+		} else if _, dup := dirs[idx.Dir]; dup || idx.Dir == "" || idx.Dir == "." || idx.Dir == ".." || strings.ContainsAny(idx.Dir, "/\x00") {
+			return fmt.Errorf("Index %v has invalid directory name '%s'", idx.Path, idx.Dir)
+		} else if version, supported := indexHashVersions[idx.Hash.Func]; !supported || idx.Hash.Version > version {
+			return fmt.Errorf("Index %v uses hash function %s version %d, which is not supported by this version of tiedot", idx.Path, idx.Hash.Func, idx.Hash.Version)
+		} else if _, err := parseCollation(idx.Hash.Collation); err != nil {
+			return err
+		}
+		names[name], dirs[idx.Dir] = struct{}{}, struct{}{}
+	}
+	return nil
+}
+
+// Read collection metadata from its directory. Collections created by older versions of tiedot do not have the
+// metadata file, their metadata is gathered from the options, schema and TTL files and the index directories.
+// Return true if the metadata comes from the older files.
+func readColMeta(colDir string) (meta ColMeta, legacy bool, err error) {
+	content, err := ioutil.ReadFile(path.Join(colDir, COL_META_FILE))
+	if os.IsNotExist(err) {
+		meta, err = readLegacyColMeta(colDir)
+		return meta, true, err
+	} else if err != nil {
+		return
+	} else if err = json.Unmarshal(content, &meta); err != nil {
+		return
+	}
+	meta.Options = meta.Options.withDefaults()
+	err = meta.validate()
+	return
+}
+
+// Gather collection metadata from the files and index directories of an older version of tiedot, index directories
+// are named after index paths.
+func readLegacyColMeta(colDir string) (meta ColMeta, err error) {
+	meta.Version = colMetaVersion
+	if meta.Options, err = readColOptions(colDir); err != nil {
+		return
+	} else if meta.TTL, err = readColTTL(colDir); err != nil {
+		return
+	}
+	schema, err := readColSchema(colDir)
+	if err != nil {
+		return
+	} else if schema != nil {
+		meta.Schema = schema.raw
+	}
+	colDirContent, err := ioutil.ReadDir(colDir)
+	if err != nil {
+		return
+	}
+	meta.Indexes = make([]IndexMeta, 0)
+	for _, htDir := range colDirContent {
+		if !htDir.IsDir() {
+			continue
+		}
+		idx := IndexMeta{Path: strings.Split(htDir.Name(), INDEX_PATH_SEP), Dir: htDir.Name()}
+		if idx.Hash, err = readIndexHash(path.Join(colDir, htDir.Name())); err != nil {
+			return
+		}
+		meta.Indexes = append(meta.Indexes, idx)
+	}
+	return
+}
+
+// Record collection metadata in its directory, replacing the metadata file at once.
+func writeColMeta(colDir string, meta ColMeta) error {
+	content, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := path.Join(colDir, COL_META_FILE+".tmp")
+	if err = ioutil.WriteFile(tmpFile, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, path.Join(colDir, COL_META_FILE))
+}
+
+// Write the metadata gathered from the files of an older version of tiedot into metadata file, then remove the
+// older files.
+func migrateColMeta(colDir string, meta ColMeta) error {
+	if err := writeColMeta(colDir, meta); err != nil {
+		return err
+	}
+	legacyFiles := []string{path.Join(colDir, COL_OPTIONS_FILE), path.Join(colDir, COL_SCHEMA_FILE), path.Join(colDir, COL_TTL_FILE)}
+	for _, idx := range meta.Indexes {
+		legacyFiles = append(legacyFiles, path.Join(colDir, idx.Dir, INDEX_HASH_FILE))
+	}
+	for _, legacyFile := range legacyFiles {
+		if err := os.Remove(legacyFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	tdlog.Noticef("Collection %s: migrated collection options, indexes, schema and TTL into %s", path.Base(colDir), COL_META_FILE)
+	return nil
+}
+
+// Return the metadata of the collection. Caller must hold schema lock.
+func (col *Col) meta() ColMeta {
+	meta := ColMeta{Version: colMetaVersion, Created: col.created, Options: col.opts, Indexes: make([]IndexMeta, 0, len(col.indexPaths)), TTL: col.ttl}
+	idxNames := make([]string, 0, len(col.indexPaths))
+	for idxName := range col.indexPaths {
+		idxNames = append(idxNames, idxName)
+	}
+	sort.Strings(idxNames)
+	for _, idxName := range idxNames {
+		meta.Indexes = append(meta.Indexes, IndexMeta{Path: col.indexPaths[idxName], Dir: col.indexDirs[idxName], Hash: col.indexHash[idxName]})
+	}
+	if col.schema != nil {
+		meta.Schema = col.schema.raw
+	}
+	return meta
+}
+
+// Record the metadata of the collection in its directory. Caller must hold schema lock exclusively.
+func (col *Col) saveMeta() error {
+	return writeColMeta(path.Join(col.db.path, col.name), col.meta())
+}
+
+// Return an unused name for the directory of a new index. Index directories are numbered, because index paths may
+// not be valid directory names. Caller must hold schema lock exclusively.
+func (col *Col) newIndexDir() string {
+	taken := make(map[string]struct{})
+	for _, dir := range col.indexDirs {
+		taken[dir] = struct{}{}
+	}
+	for i := 0; ; i++ {
+		name := indexDirPrefix + strconv.Itoa(i)
+		if _, exists := taken[name]; exists {
+			continue
+		} else if _, err := os.Stat(path.Join(col.db.path, col.name, name)); os.IsNotExist(err) {
+			return name
+		}
+	}
+}
+
+// Return the time when the collection was created, or zero time if it was created by an older version of tiedot.
+func (col *Col) Created() time.Time {
+	if col.created == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, col.created)
+}
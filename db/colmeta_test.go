@@ -0,0 +1,251 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestColMetaMigration(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	// Collection files of an older version of tiedot
+	colDir := path.Join(TEST_DATA_DIR, "old")
+	for _, dir := range []string{"a!b", "c"} {
+		if err := os.MkdirAll(path.Join(colDir, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string]string{
+		PART_NUM_FILE:                "2",
+		"old/" + COL_OPTIONS_FILE:    `{"IDStrategy":"monotonic"}`,
+		"old/" + COL_SCHEMA_FILE:     `{"required":["a"]}`,
+		"old/" + COL_TTL_FILE:        `{"Path":["t"],"Seconds":60}`,
+		"old/a!b/" + INDEX_HASH_FILE: `{"Func":"fnv1a64","Version":1,"Collation":"nocase"}`,
+	} {
+		if err := ioutil.WriteFile(path.Join(TEST_DATA_DIR, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("old")
+	if col.Options().IDStrategy != IDMonotonic || col.Schema() == nil || col.TTL() == nil || !col.Created().IsZero() {
+		t.Fatal(col.Options(), col.Schema(), col.TTL(), col.Created())
+	} else if hash, err := col.IndexHash([]string{"a", "b"}); err != nil || hash.Collation != CollationNoCase {
+		t.Fatal(hash, err)
+	} else if hash, err := col.IndexHash([]string{"c"}); err != nil || hash.Func != HashSdbm {
+		t.Fatal(hash, err)
+	}
+	// Older files are replaced by metadata file
+	for _, name := range []string{COL_OPTIONS_FILE, COL_SCHEMA_FILE, COL_TTL_FILE, "a!b/" + INDEX_HASH_FILE} {
+		if _, err := os.Stat(path.Join(colDir, name)); !os.IsNotExist(err) {
+			t.Fatal(name, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(colDir, COL_META_FILE)); err != nil {
+		t.Fatal(err)
+	}
+	// Migrated collection works as before, after it is opened again
+	if _, err = col.Insert(map[string]interface{}{"a": map[string]interface{}{"b": "X"}}); err != nil {
+		t.Fatal(err)
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("old")
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": "x", "in": []interface{}{"a", "b"}}, col, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	} else if len(col.AllIndexes()) != 2 || col.Options().IDStrategy != IDMonotonic {
+		t.Fatal(col.AllIndexes(), col.Options())
+	}
+}
+
+func TestColMetaIndexPaths(t *testing.T) {
+	bak := TEST_DATA_DIR + "bak"
+	os.RemoveAll(TEST_DATA_DIR)
+	os.RemoveAll(bak)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(bak)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	if err = db.Create("a"); err != nil {
+		t.Fatal(err)
+	} else if created := db.Use("a").Created(); created.After(time.Now()) || created.Before(before.Add(-time.Second)) {
+		t.Fatal(created)
+	}
+	// Paths with separators are different indexes
+	idxPaths := [][]string{{"a!b"}, {"a", "b"}, {"x/y"}, {".."}, {`a\`, "b"}}
+	for _, idxPath := range idxPaths {
+		if err = db.Use("a").Index(idxPath); err != nil {
+			t.Fatal(idxPath, err)
+		}
+	}
+	if err = db.Use("a").Index([]string{"a", "b"}); err == nil {
+		t.Fatal("did not error")
+	}
+	docs := []map[string]interface{}{
+		{"a!b": 0},
+		{"a": map[string]interface{}{"b": 1}},
+		{"x/y": 2},
+		{"..": 3},
+		{`a\`: map[string]interface{}{"b": 4}},
+	}
+	for _, doc := range docs {
+		if _, err = db.Use("a").Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectIndexes := func(name string) {
+		col := db.Use(name)
+		if len(col.AllIndexes()) != len(idxPaths) {
+			t.Fatal(col.AllIndexes())
+		}
+		for n, idxPath := range idxPaths {
+			in := make([]interface{}, len(idxPath))
+			for i, segment := range idxPath {
+				in[i] = segment
+			}
+			result := make(map[int]struct{})
+			if err := EvalQuery(map[string]interface{}{"eq": n, "in": in}, col, &result); err != nil || len(result) != 1 {
+				t.Fatal(idxPath, result, err)
+			}
+		}
+	}
+	expectIndexes("a")
+	// Indexes survive reopening, scrubbing, renaming and backup
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	expectIndexes("a")
+	if err = db.Scrub("a"); err != nil {
+		t.Fatal(err)
+	}
+	expectIndexes("a")
+	if err = db.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	expectIndexes("b")
+	if report, err := db.Fsck(false); err != nil || len(report) != 0 {
+		t.Fatal(report, err)
+	} else if err = db.Dump(bak); err != nil {
+		t.Fatal(err)
+	} else if err = Verify(bak); err != nil {
+		t.Fatal(err)
+	}
+	bakDB, err := OpenDB(bak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bakDB.Close()
+	if col := bakDB.Use("b"); len(col.AllIndexes()) != len(idxPaths) {
+		t.Fatal(col.AllIndexes())
+	}
+	// Removed index leaves no directory behind
+	if err = db.Use("b").Unindex([]string{"x/y"}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadDir(path.Join(TEST_DATA_DIR, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := 0
+	for _, file := range content {
+		if file.IsDir() {
+			dirs++
+		}
+	}
+	if dirs != len(idxPaths)-1 {
+		t.Fatal(dirs)
+	}
+}
+
+func TestColMetaVersion(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("a"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	metaFile := path.Join(TEST_DATA_DIR, "a", COL_META_FILE)
+	content, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(metaFile, []byte(strings.Replace(string(content), `"Version": 1`, `"Version": 2`, 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = Verify(TEST_DATA_DIR); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Fatal(err)
+	}
+}
+
+func TestColMetaIndexRollback(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("a"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("a")
+	if _, err = col.Insert(map[string]interface{}{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	// Metadata file cannot be written while a directory is in the way
+	obstacle := path.Join(TEST_DATA_DIR, "a", COL_META_FILE+".tmp")
+	if err = os.MkdirAll(path.Join(obstacle, "obstacle"), 0700); err != nil {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"n"}); err == nil {
+		t.Fatal("did not error")
+	} else if len(col.AllIndexes()) != 0 {
+		t.Fatal(col.AllIndexes())
+	}
+	content, err := ioutil.ReadDir(path.Join(TEST_DATA_DIR, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range content {
+		if strings.HasPrefix(file.Name(), indexDirPrefix) {
+			t.Fatal("index directory is left behind", file.Name())
+		}
+	}
+	// The index can be created once metadata file can be written
+	if err = os.RemoveAll(obstacle); err != nil {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": 1, "in": []interface{}{"n"}}, col, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+}
@@ -5,13 +5,12 @@ package db
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path"
-	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,6 +31,9 @@ type DB struct {
 	numParts   int             // Total number of partitions
 	cols       map[string]*Col // All collections
 	schemaLock *sync.RWMutex   // Control access to collection instances.
+	backupLock *sync.RWMutex   // Held by online backups, schema changes wait for them to complete
+	log        *changeLog      // Change log, nil unless it is enabled
+	reaper     *ttlReaper      // Deletes expired documents in the background
 }
 
 // Open database and load all collections & indexes.
@@ -41,17 +43,62 @@ func OpenDB(dbPath string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	db := &DB{Config: d, path: dbPath, schemaLock: new(sync.RWMutex)}
+	db := &DB{Config: d, path: dbPath, schemaLock: new(sync.RWMutex), backupLock: new(sync.RWMutex)}
 	db.Config.CalculateConfigConstants()
+	if err = db.load(); err == nil {
+		db.startReaper()
+	}
+	return db, err
+}
+
+// Open database for reading, without changing any file: data files are mapped copy-on-write, and collection metadata
+// migration, recovery of interrupted compaction and rehash, rebuilding of indexes after an unfinished bulk load, and
+// expiry of documents are left for the next time the database is opened by OpenDB. Documents and collections of the
+// database must not be changed.
+func OpenDBReadOnly(dbPath string) (*DB, error) {
+	d, err := data.ReadConfig(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{Config: d, path: dbPath, schemaLock: new(sync.RWMutex), backupLock: new(sync.RWMutex)}
 	return db, db.load()
 }
 
+// Read data file configuration and load all collections again. Caller must hold schema lock exclusively.
+func (db *DB) reopen() (err error) {
+	if db.Config, err = data.CreateOrReadConfig(db.path); err != nil {
+		return
+	}
+	db.Config.CalculateConfigConstants()
+	db.log = nil
+	// Collections keep their hooks
+	hooks := make(map[string]*colHooks)
+	for name, col := range db.cols {
+		hooks[name] = col.hooks
+	}
+	err = db.load()
+	for name, col := range db.cols {
+		if hooks[name] != nil {
+			col.hooks = hooks[name]
+		}
+	}
+	return
+}
+
 // Load all collection schema.
 func (db *DB) load() error {
 	// Create DB directory and PART_NUM_FILE if necessary
 	var numPartsAssumed = false
 	numPartsFilePath := path.Join(db.path, PART_NUM_FILE)
-	if err := os.MkdirAll(db.path, 0700); err != nil {
+	readOnly := db.Config.ReadOnly
+	if readOnly {
+		db.cols = make(map[string]*Col)
+		// A new database has no collection
+		if _, err := os.Stat(numPartsFilePath); os.IsNotExist(err) {
+			db.numParts = runtime.NumCPU()
+			return nil
+		}
+	} else if err := os.MkdirAll(db.path, 0700); err != nil {
 		return err
 	}
 	if partNumFile, err := os.Stat(numPartsFilePath); err != nil {
@@ -78,6 +125,13 @@ func (db *DB) load() error {
 	for _, maybeColDir := range dirContent {
 		if !maybeColDir.IsDir() {
 			continue
+		} else if maybeColDir.Name() == CHANGE_LOG_DIR {
+			if readOnly {
+				continue
+			} else if db.log, err = openChangeLog(path.Join(db.path, CHANGE_LOG_DIR)); err != nil {
+				return err
+			}
+			continue
 		}
 		if numPartsAssumed {
 			return fmt.Errorf("Please manually repair database partition number config file %s", numPartsFilePath)
@@ -89,16 +143,42 @@ func (db *DB) load() error {
 	return err
 }
 
+// Lock the schema exclusively, after online backups are complete. Backups do not hold schema lock while copying
+// collections, so that reads and writes carry on even though a schema change is waiting.
+func (db *DB) lockSchema() {
+	db.backupLock.Lock()
+	db.schemaLock.Lock()
+}
+
+// Unlock the schema locked by lockSchema.
+func (db *DB) unlockSchema() {
+	db.schemaLock.Unlock()
+	db.backupLock.Unlock()
+}
+
 // Close all database files. Do not use the DB afterwards!
 func (db *DB) Close() error {
-	db.schemaLock.Lock()
-	defer db.schemaLock.Unlock()
+	if db.reaper != nil {
+		db.stopReaper()
+	}
+	db.lockSchema()
+	defer db.unlockSchema()
+	return db.close()
+}
+
+// Close all database files. Caller must hold schema lock exclusively.
+func (db *DB) close() error {
 	errs := make([]error, 0, 0)
 	for _, col := range db.cols {
 		if err := col.close(); err != nil {
 			errs = append(errs, err)
 		}
 	}
+	if db.log != nil {
+		if err := db.log.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	if len(errs) == 0 {
 		return nil
 	}
@@ -106,22 +186,35 @@ func (db *DB) Close() error {
 }
 
 // create creates collection files. The function does not place a schema lock.
-func (db *DB) create(name string) error {
+func (db *DB) create(name string, opts ColOptions) error {
+	opts = opts.withDefaults()
 	if _, exists := db.cols[name]; exists {
 		return fmt.Errorf("Collection %s already exists", name)
+	} else if name == CHANGE_LOG_DIR {
+		return fmt.Errorf("Collection name %s is reserved", name)
+	} else if err := opts.validate(); err != nil {
+		return err
 	} else if err := os.MkdirAll(path.Join(db.path, name), 0700); err != nil {
 		return err
+	} else if err := writeColMeta(path.Join(db.path, name), ColMeta{Version: colMetaVersion, Created: time.Now().UnixNano(), Options: opts, Indexes: []IndexMeta{}}); err != nil {
+		return err
 	} else if db.cols[name], err = OpenCol(db, name); err != nil {
 		return err
 	}
+	db.logChange(Change{Op: ChangeCreate, Col: name, Options: &opts})
 	return nil
 }
 
 // Create a new collection.
 func (db *DB) Create(name string) error {
-	db.schemaLock.Lock()
-	defer db.schemaLock.Unlock()
-	return db.create(name)
+	return db.CreateWith(name, ColOptions{IDStrategy: DefaultIDStrategy})
+}
+
+// Create a new collection with the options, such as document ID strategy.
+func (db *DB) CreateWith(name string, opts ColOptions) error {
+	db.lockSchema()
+	defer db.unlockSchema()
+	return db.create(name, opts)
 }
 
 // Return all collection names.
@@ -147,12 +240,14 @@ func (db *DB) Use(name string) *Col {
 
 // Rename a collection.
 func (db *DB) Rename(oldName, newName string) error {
-	db.schemaLock.Lock()
-	defer db.schemaLock.Unlock()
+	db.lockSchema()
+	defer db.unlockSchema()
 	if _, exists := db.cols[oldName]; !exists {
 		return fmt.Errorf("Collection %s does not exist", oldName)
 	} else if _, exists := db.cols[newName]; exists {
 		return fmt.Errorf("Collection %s already exists", newName)
+	} else if newName == CHANGE_LOG_DIR {
+		return fmt.Errorf("Collection name %s is reserved", newName)
 	} else if err := db.cols[oldName].close(); err != nil {
 		return err
 	} else if err := os.Rename(path.Join(db.path, oldName), path.Join(db.path, newName)); err != nil {
@@ -160,18 +255,23 @@ func (db *DB) Rename(oldName, newName string) error {
 	} else if db.cols[newName], err = OpenCol(db, newName); err != nil {
 		return err
 	}
+	db.cols[newName].hooks = db.cols[oldName].hooks
 	delete(db.cols, oldName)
+	db.logChange(Change{Op: ChangeRename, Col: oldName, NewName: newName})
 	return nil
 }
 
 // Truncate a collection - delete all documents and clear
 func (db *DB) Truncate(name string) error {
-	db.schemaLock.Lock()
-	defer db.schemaLock.Unlock()
+	db.lockSchema()
+	defer db.unlockSchema()
 	if _, exists := db.cols[name]; !exists {
 		return fmt.Errorf("Collection %s does not exist", name)
 	}
 	col := db.cols[name]
+	if col.capped != nil {
+		col.capped.clear()
+	}
 	for i := 0; i < db.numParts; i++ {
 		if err := col.parts[i].Clear(); err != nil {
 			return err
@@ -182,65 +282,128 @@ func (db *DB) Truncate(name string) error {
 			}
 		}
 	}
+	db.logChange(Change{Op: ChangeTruncate, Col: name})
 	return nil
 }
 
 // Scrub a collection - fix corrupted documents and de-fragment free space.
 func (db *DB) Scrub(name string) error {
-	db.schemaLock.Lock()
-	defer db.schemaLock.Unlock()
+	_, err := db.ScrubReport(name)
+	return err
+}
+
+// ScrubReport scrubs a collection (see Scrub) and returns IDs of the corrupted documents that could not be recovered.
+// Incremental backups cannot be taken across a scrub that removes documents.
+func (db *DB) ScrubReport(name string) (corrupted []int, err error) {
+	db.lockSchema()
+	defer db.unlockSchema()
 	if _, exists := db.cols[name]; !exists {
-		return fmt.Errorf("Collection %s does not exist", name)
+		return nil, fmt.Errorf("Collection %s does not exist", name)
 	}
 	// Prepare a temporary collection in file system
 	tmpColName := fmt.Sprintf("scrub-%s-%d", name, time.Now().UnixNano())
 	tmpColDir := path.Join(db.path, tmpColName)
 	if err := os.MkdirAll(tmpColDir, 0700); err != nil {
-		return err
+		return nil, err
 	}
-	// Mirror indexes from original collection
-	for _, idxPath := range db.cols[name].indexPaths {
-		if err := os.MkdirAll(path.Join(tmpColDir, strings.Join(idxPath, INDEX_PATH_SEP)), 0700); err != nil {
-			return err
+	// Carry over collection metadata (including indexes) and ID sequence
+	if err := writeColMeta(tmpColDir, db.cols[name].meta()); err != nil {
+		return nil, err
+	}
+	if db.cols[name].opts.IDStrategy == IDMonotonic {
+		mark := db.cols[name].ids.highWaterMark()
+		for i := 0; i < db.numParts; i++ {
+			if err := writeIDSeq(tmpColDir, i, mark); err != nil {
+				return nil, err
+			}
 		}
 	}
+	// Documents that cannot be read back are lost
+	for _, part := range db.cols[name].parts {
+		corrupted = append(corrupted, part.CorruptDocIDs()...)
+	}
 	// Iterate through all documents and put them into the temporary collection
 	tmpCol, err := OpenCol(db, tmpColName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	db.cols[name].forEachDoc(func(id int, doc []byte) bool {
 		var docObj map[string]interface{}
 		if err := json.Unmarshal([]byte(doc), &docObj); err != nil {
-			// Skip corrupted document
+			corrupted = append(corrupted, id)
 			return true
 		}
-		if err := tmpCol.InsertRecovery(id, docObj); err != nil {
+		// Keep the revision so that conditional updates based on an earlier read still detect changes
+		rev, _ := db.cols[name].parts[id%db.numParts].Revision(id)
+		if err := tmpCol.insertRecovery(id, rev, docObj); err != nil {
 			tdlog.Noticef("Scrub %s: failed to insert back document %v", name, docObj)
 		}
 		return true
 	}, false)
 	if err := tmpCol.close(); err != nil {
-		return err
+		return nil, err
+	}
+	sort.Ints(corrupted)
+	for _, id := range corrupted {
+		tdlog.Noticef("Scrub %s: document %d is corrupted and has been removed", name, id)
+	}
+	// Removed documents are not recorded in change log one by one
+	if len(corrupted) > 0 {
+		db.logChange(Change{Op: ChangeRepair, Col: name})
 	}
 	// Replace the original collection with the "temporary" one
 	db.cols[name].close()
 	if err := os.RemoveAll(path.Join(db.path, name)); err != nil {
-		return err
+		return nil, err
 	}
 	if err := os.Rename(path.Join(db.path, tmpColName), path.Join(db.path, name)); err != nil {
-		return err
+		return nil, err
 	}
 	if db.cols[name], err = OpenCol(db, name); err != nil {
-		return err
+		return nil, err
+	}
+	return corrupted, nil
+}
+
+// Compact a collection online - rewrite one partition at a time to reclaim the space of deleted documents.
+// Unlike Scrub, documents remain available for reads and writes during compaction.
+func (db *DB) Compact(name string) error {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	col, exists := db.cols[name]
+	if !exists {
+		return fmt.Errorf("Collection %s does not exist", name)
+	}
+	for _, part := range col.parts {
+		if err := part.Compact(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rebuild indexes of all collections that do not use the current version of default hash function.
+func (db *DB) MigrateIndexes() error {
+	for _, name := range db.AllCols() {
+		col := db.Use(name)
+		if col == nil {
+			continue
+		}
+		migrated, err := col.MigrateIndexes()
+		if err != nil {
+			return err
+		}
+		for _, idxPath := range migrated {
+			tdlog.Noticef("Migrated index %v of collection %s", idxPath, name)
+		}
 	}
 	return nil
 }
 
 // Drop a collection and lose all of its documents and indexes.
 func (db *DB) Drop(name string) error {
-	db.schemaLock.Lock()
-	defer db.schemaLock.Unlock()
+	db.lockSchema()
+	defer db.unlockSchema()
 	if _, exists := db.cols[name]; !exists {
 		return fmt.Errorf("Collection %s does not exist", name)
 	} else if err := db.cols[name].close(); err != nil {
@@ -249,55 +412,13 @@ func (db *DB) Drop(name string) error {
 		return err
 	}
 	delete(db.cols, name)
+	db.logChange(Change{Op: ChangeDrop, Col: name})
 	return nil
 }
 
-// Copy this database into destination directory (for backup).
+// Copy this database into destination directory (for backup), see Backup.
 func (db *DB) Dump(dest string) error {
-	db.schemaLock.Lock()
-	defer db.schemaLock.Unlock()
-	cpFun := func(currPath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			relPath, err := filepath.Rel(db.path, currPath)
-			if err != nil {
-				return err
-			}
-			destDir := path.Join(dest, relPath)
-			if err := os.MkdirAll(destDir, 0700); err != nil {
-				return err
-			}
-			tdlog.Noticef("Dump: created directory %s", destDir)
-		} else {
-			src, err := os.Open(currPath)
-			if err != nil {
-				return err
-			}
-			relPath, err := filepath.Rel(db.path, currPath)
-			if err != nil {
-				return err
-			}
-			destPath := path.Join(dest, relPath)
-			if _, fileExists := os.Open(destPath); fileExists == nil {
-				return fmt.Errorf("Destination file %s already exists", destPath)
-			}
-			destFile, err := os.Create(destPath)
-			if err != nil {
-				return err
-			}
-			written, err := io.Copy(destFile, src)
-			if err != nil {
-				return err
-			}
-			_ = destFile.Close()
-			_ = src.Close()
-			tdlog.Noticef("Dump: copied file %s, size is %d", destPath, written)
-		}
-		return nil
-	}
-	return filepath.Walk(db.path, cpFun)
+	return db.Backup(dest, nil)
 }
 
 // ForceUse creates a collection if one does not yet exist. Returns collection handle. Panics on error.
@@ -305,7 +426,7 @@ func (db *DB) ForceUse(name string) *Col {
 	db.schemaLock.RLock()
 	defer db.schemaLock.RUnlock()
 	if db.cols[name] == nil {
-		if err := db.create(name); err != nil {
+		if err := db.create(name, ColOptions{IDStrategy: DefaultIDStrategy}); err != nil {
 			tdlog.Panicf("ForceUse: failed to create collection - %v", err)
 		}
 	}
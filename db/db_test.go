@@ -301,3 +301,143 @@ func TestDropColNotExist(t *testing.T) {
 		t.Errorf("Expected error : collection not exist")
 	}
 }
+func TestCompact(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Compact("a") == nil {
+		t.Fatal("Did not error")
+	}
+	if err := db.Create("a"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("a")
+	if err := col.Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 0)
+	for i := 0; i < 100; i++ {
+		id, err := col.Insert(map[string]interface{}{"n": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			if err := col.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			ids = append(ids, id)
+		}
+	}
+	if err := db.Compact("a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if doc, err := col.Read(id); err != nil || int(doc["n"].(float64))%2 != 1 {
+			t.Fatal(doc, err)
+		}
+	}
+	result := make(map[int]struct{})
+	if err := EvalQuery(map[string]interface{}{"eq": 51, "in": []interface{}{"n"}}, col, &result); err != nil || len(result) != 1 {
+		t.Fatal(result, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIDStrategy(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.CreateWith("bad", ColOptions{IDStrategy: "whatever"}); err == nil || db.ColExists("bad") {
+		t.Fatal("did not error")
+	}
+	if err = db.Create("random"); err != nil {
+		t.Fatal(err)
+	} else if err = db.CreateWith("mono", ColOptions{IDStrategy: IDMonotonic}); err != nil {
+		t.Fatal(err)
+	} else if err = db.CreateWith("time", ColOptions{IDStrategy: IDTimeOrdered}); err != nil {
+		t.Fatal(err)
+	}
+	if db.Use("random").Options().IDStrategy != IDRandom || db.Use("mono").Options().IDStrategy != IDMonotonic {
+		t.Fatal(db.Use("random").Options(), db.Use("mono").Options())
+	}
+	// Monotonic IDs are consecutive and skip caller-supplied IDs
+	mono := db.Use("mono")
+	for i := 1; i <= 10; i++ {
+		if id, err := mono.Insert(map[string]interface{}{"n": i}); err != nil || id != i {
+			t.Fatal(id, err)
+		}
+	}
+	if err = mono.InsertWithID(11, map[string]interface{}{"n": 11}); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := mono.Insert(map[string]interface{}{"n": 12}); err != nil || id != 12 {
+		t.Fatal(id, err)
+	}
+	// Time-ordered IDs increase and spread among partitions
+	lastID, partsUsed := 0, make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		id, err := db.Use("time").Insert(map[string]interface{}{"n": i})
+		if err != nil || id <= lastID {
+			t.Fatal(id, lastID, err)
+		}
+		lastID = id
+		partsUsed[id%2] = true
+	}
+	if len(partsUsed) != 2 {
+		t.Fatal(partsUsed)
+	}
+	// Monotonic IDs carry on after reopening and scrubbing
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Use("mono").Options().IDStrategy != IDMonotonic || db.Use("time").Options().IDStrategy != IDTimeOrdered {
+		t.Fatal(db.Use("mono").Options(), db.Use("time").Options())
+	}
+	afterReopen, err := db.Use("mono").Insert(map[string]interface{}{"n": 13})
+	if err != nil || afterReopen <= 12 {
+		t.Fatal(afterReopen, err)
+	}
+	if err = db.Scrub("mono"); err != nil {
+		t.Fatal(err)
+	}
+	if db.Use("mono").Options().IDStrategy != IDMonotonic {
+		t.Fatal(db.Use("mono").Options())
+	}
+	if id, err := db.Use("mono").Insert(map[string]interface{}{"n": 14}); err != nil || id <= afterReopen {
+		t.Fatal(id, afterReopen, err)
+	}
+	if id, err := db.Use("time").Insert(map[string]interface{}{"n": 100}); err != nil || id <= lastID {
+		t.Fatal(id, lastID, err)
+	}
+	// Collections without metadata or options file use random IDs
+	if err = os.Remove(path.Join(TEST_DATA_DIR, "random", COL_META_FILE)); err != nil {
+		t.Fatal(err)
+	} else if meta, legacy, err := readColMeta(path.Join(TEST_DATA_DIR, "random")); err != nil || !legacy || meta.Options.IDStrategy != IDRandom {
+		t.Fatal(meta, err)
+	}
+}
@@ -5,11 +5,13 @@ package db
 import (
 	"encoding/json"
 	"fmt"
-	"math/rand"
 
+	"github.com/HouzuoGuo/tiedot/dberr"
 	"github.com/HouzuoGuo/tiedot/tdlog"
 )
 
+const anyRev = -1 // Expected revision of unconditional updates and deletes, document revisions are never negative.
+
 // Resolve the attribute(s) in the document structure along the given path.
 func GetIn(doc interface{}, path []string) (ret []interface{}) {
 	docMap, ok := doc.(map[string]interface{})
@@ -52,10 +54,13 @@ func StrHash(str string) int {
 
 // Put a document on all user-created indexes.
 func (col *Col) indexDoc(id int, doc map[string]interface{}) {
+	if col.loading {
+		return
+	}
 	for idxName, idxPath := range col.indexPaths {
 		for _, idxVal := range GetIn(doc, idxPath) {
 			if idxVal != nil {
-				hashKey := StrHash(fmt.Sprint(idxVal))
+				hashKey := col.indexHash[idxName].Key(idxVal)
 				partNum := hashKey % col.db.numParts
 				ht := col.hts[partNum][idxName]
 				ht.Lock.Lock()
@@ -68,10 +73,13 @@ func (col *Col) indexDoc(id int, doc map[string]interface{}) {
 
 // Remove a document from all user-created indexes.
 func (col *Col) unindexDoc(id int, doc map[string]interface{}) {
+	if col.loading {
+		return
+	}
 	for idxName, idxPath := range col.indexPaths {
 		for _, idxVal := range GetIn(doc, idxPath) {
 			if idxVal != nil {
-				hashKey := StrHash(fmt.Sprint(idxVal))
+				hashKey := col.indexHash[idxName].Key(idxVal)
 				partNum := hashKey % col.db.numParts
 				ht := col.hts[partNum][idxName]
 				ht.Lock.Lock()
@@ -84,6 +92,11 @@ func (col *Col) unindexDoc(id int, doc map[string]interface{}) {
 
 // Insert a document with the specified ID into the collection (incl. index). Does not place partition/schema lock.
 func (col *Col) InsertRecovery(id int, doc map[string]interface{}) (err error) {
+	return col.insertRecovery(id, 1, doc)
+}
+
+// Insert a document with the specified ID and revision into the collection (incl. index). Does not place partition/schema lock.
+func (col *Col) insertRecovery(id, rev int, doc map[string]interface{}) (err error) {
 	docJS, err := json.Marshal(doc)
 	if err != nil {
 		return
@@ -91,7 +104,7 @@ func (col *Col) InsertRecovery(id int, doc map[string]interface{}) (err error) {
 	partNum := id % col.db.numParts
 	part := col.parts[partNum]
 	// Put document data into collection
-	if _, err = part.Insert(id, []byte(docJS)); err != nil {
+	if _, err = part.InsertRev(id, []byte(docJS), rev); err != nil {
 		return
 	}
 	// Index the document
@@ -105,17 +118,63 @@ func (col *Col) Insert(doc map[string]interface{}) (id int, err error) {
 	if err != nil {
 		return
 	}
-	id = rand.Int()
-	partNum := id % col.db.numParts
 	col.db.schemaLock.RLock()
-	part := col.parts[partNum]
+	for {
+		// Pick another ID in case of collision with a caller-supplied ID
+		if id, err = col.ids.nextID(); err != nil {
+			break
+		} else if err = col.insert(id, doc, docJS); dberr.Type(err) != dberr.ErrorDocExists {
+			break
+		}
+	}
+	col.db.schemaLock.RUnlock()
+	if err == nil {
+		col.runPostHooks(ChangeInsert, id, nil, doc)
+		col.evict()
+	}
+	return
+}
+
+// Insert a document under the caller-supplied ID, fail if a document already exists under the ID.
+func (col *Col) InsertWithID(id int, doc map[string]interface{}) error {
+	if id < 0 {
+		return dberr.New(dberr.ErrorBadDocID, id)
+	}
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	col.db.schemaLock.RLock()
+	err = col.insert(id, doc, docJS)
+	col.db.schemaLock.RUnlock()
+	if err == nil {
+		col.runPostHooks(ChangeInsert, id, nil, doc)
+		col.evict()
+	}
+	return err
+}
+
+// Insert a document under the ID unless a document already exists under the ID, after running pre hooks.
+// Caller must hold schema lock.
+func (col *Col) insert(id int, doc map[string]interface{}, docJS []byte) (err error) {
+	part := col.parts[id%col.db.numParts]
 
 	// Put document data into collection
 	part.DataLock.Lock()
-	_, err = part.Insert(id, []byte(docJS))
+	if part.Exists(id) {
+		part.DataLock.Unlock()
+		return dberr.New(dberr.ErrorDocExists, id)
+	}
+	if docJS, err = col.runPreHooks(ChangeInsert, id, nil, doc, docJS); err != nil {
+		part.DataLock.Unlock()
+		return
+	}
+	if _, err = part.Insert(id, docJS); err == nil {
+		col.logDocChange(part, ChangeInsert, id, docJS, nil)
+		col.trackDocChange(ChangeInsert, id, docJS)
+	}
 	part.DataLock.Unlock()
 	if err != nil {
-		col.db.schemaLock.RUnlock()
 		return
 	}
 
@@ -123,19 +182,72 @@ func (col *Col) Insert(doc map[string]interface{}) (id int, err error) {
 	// Index the document
 	col.indexDoc(id, doc)
 	part.UnlockUpdate(id)
-
-	col.db.schemaLock.RUnlock()
 	return
 }
 
+// Insert the document under the caller-supplied ID, or update the document if it already exists.
+func (col *Col) Upsert(id int, doc map[string]interface{}) (inserted bool, err error) {
+	for {
+		if err = col.InsertWithID(id, doc); dberr.Type(err) != dberr.ErrorDocExists {
+			return err == nil, err
+		}
+		if err = col.Update(id, doc); dberr.Type(err) != dberr.ErrorNoDoc {
+			return false, err
+		}
+		// The document was deleted in the meantime
+	}
+}
+
+// Update the document that has the value in the indexed path, or insert the document if none has the value.
+// The document itself must have the value in the path. Return ID of the inserted or updated document.
+func (col *Col) UpsertByIndex(idxPath []string, val interface{}, doc map[string]interface{}) (id int, inserted bool, err error) {
+	hasVal := false
+	for _, docVal := range GetIn(doc, idxPath) {
+		if strictEqual(CollationBinary, docVal, val) {
+			hasVal = true
+			break
+		}
+	}
+	if !hasVal {
+		return 0, false, fmt.Errorf("Document does not have value %v in path %v", val, idxPath)
+	}
+	lookupPath := make([]interface{}, len(idxPath))
+	for i, seg := range idxPath {
+		lookupPath[i] = seg
+	}
+	// Prevent concurrent upserts from inserting the same value twice
+	col.upsertLock.Lock()
+	defer col.upsertLock.Unlock()
+	matches := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": val, "in": lookupPath, "strict": true}, col, &matches); err != nil {
+		return
+	}
+	switch len(matches) {
+	case 0:
+		id, err = col.Insert(doc)
+		return id, err == nil, err
+	case 1:
+		for id = range matches {
+			err = col.Update(id, doc)
+		}
+		return
+	}
+	return 0, false, fmt.Errorf("%d documents have value %v in path %v, expecting at most one", len(matches), val, idxPath)
+}
+
 func (col *Col) read(id int, placeSchemaLock bool) (doc map[string]interface{}, err error) {
+	doc, _, err = col.readRev(id, placeSchemaLock)
+	return
+}
+
+func (col *Col) readRev(id int, placeSchemaLock bool) (doc map[string]interface{}, rev int, err error) {
 	if placeSchemaLock {
 		col.db.schemaLock.RLock()
 	}
 	part := col.parts[id%col.db.numParts]
 
 	part.DataLock.RLock()
-	docB, err := part.Read(id)
+	docB, rev, err := part.ReadRev(id)
 	part.DataLock.RUnlock()
 	if err != nil {
 		if placeSchemaLock {
@@ -156,38 +268,71 @@ func (col *Col) Read(id int) (doc map[string]interface{}, err error) {
 	return col.read(id, true)
 }
 
+// Find and retrieve a document and its revision number by ID. The revision changes whenever the document is updated.
+func (col *Col) ReadRev(id int) (doc map[string]interface{}, rev int, err error) {
+	return col.readRev(id, true)
+}
+
 // Update a document.
 func (col *Col) Update(id int, doc map[string]interface{}) error {
+	_, err := col.update(id, anyRev, doc)
+	return err
+}
+
+// Update a document only if it is still at the revision, return the new revision.
+// If the document has been updated in the meantime, the returned error is of type dberr.ErrorRevMismatch.
+func (col *Col) UpdateIfRev(id, rev int, doc map[string]interface{}) (newRev int, err error) {
+	return col.update(id, rev, doc)
+}
+
+// Update a document if it is at the expected revision (or anyRev), return the new revision.
+func (col *Col) update(id, expectRev int, doc map[string]interface{}) (newRev int, err error) {
 	if doc == nil {
-		return fmt.Errorf("Updating %d: input doc may not be nil", id)
+		return 0, fmt.Errorf("Updating %d: input doc may not be nil", id)
 	}
 	docJS, err := json.Marshal(doc)
 	if err != nil {
-		return err
+		return
 	}
 	col.db.schemaLock.RLock()
 	part := col.parts[id%col.db.numParts]
 
 	// Place lock, read back original document and update
 	part.DataLock.Lock()
-	originalB, err := part.Read(id)
+	originalB, rev, err := part.ReadRev(id)
+	if err == nil && expectRev != anyRev && rev != expectRev {
+		err = dberr.New(dberr.ErrorRevMismatch, id, rev, expectRev)
+	}
+	var original map[string]interface{}
+	if err == nil {
+		if col.hasPreHooks() {
+			json.Unmarshal(originalB, &original)
+		}
+		docJS, err = col.runPreHooks(ChangeUpdate, id, original, doc, docJS)
+	}
 	if err != nil {
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
-		return err
+		return
 	}
 	err = part.Update(id, []byte(docJS))
+	if err == nil {
+		newRev, err = part.Revision(id)
+		col.logDocChange(part, ChangeUpdate, id, docJS, originalB)
+		col.trackDocChange(ChangeUpdate, id, docJS)
+	}
 	part.DataLock.Unlock()
 	if err != nil {
 		col.db.schemaLock.RUnlock()
-		return err
+		return
 	}
 
 	// Done with the collection data, next is to maintain indexed values
-	var original map[string]interface{}
-	if err = json.Unmarshal(originalB, &original); err != nil {
-		col.db.schemaLock.RUnlock()
-		return err
+	if original == nil {
+		if err = json.Unmarshal(originalB, &original); err != nil {
+			col.db.schemaLock.RUnlock()
+			return
+		}
 	}
 	part.LockUpdate(id)
 	if original != nil {
@@ -200,7 +345,9 @@ func (col *Col) Update(id int, doc map[string]interface{}) error {
 	part.UnlockUpdate(id)
 
 	col.db.schemaLock.RUnlock()
-	return nil
+	col.runPostHooks(ChangeUpdate, id, original, doc)
+	col.evict()
+	return
 }
 
 // UpdateBytesFunc will update a document bytes.
@@ -234,12 +381,18 @@ func (col *Col) UpdateBytesFunc(id int, update func(origDoc []byte) (newDoc []by
 		return err
 	}
 	var doc map[string]interface{} // check if docB are valid JSON before Update
-	if err = json.Unmarshal(docB, &doc); err != nil {
+	if err = json.Unmarshal(docB, &doc); err == nil {
+		docB, err = col.runPreHooks(ChangeUpdate, id, original, doc, docB)
+	}
+	if err != nil {
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
 		return err
 	}
-	err = part.Update(id, docB)
+	if err = part.Update(id, docB); err == nil {
+		col.logDocChange(part, ChangeUpdate, id, docB, originalB)
+		col.trackDocChange(ChangeUpdate, id, docB)
+	}
 	part.DataLock.Unlock()
 	if err != nil {
 		col.db.schemaLock.RUnlock()
@@ -258,6 +411,8 @@ func (col *Col) UpdateBytesFunc(id int, update func(origDoc []byte) (newDoc []by
 	part.UnlockUpdate(id)
 
 	col.db.schemaLock.RUnlock()
+	col.runPostHooks(ChangeUpdate, id, original, doc)
+	col.evict()
 	return nil
 }
 
@@ -291,12 +446,18 @@ func (col *Col) UpdateFunc(id int, update func(origDoc map[string]interface{}) (
 		return err
 	}
 	docJS, err := json.Marshal(doc)
+	if err == nil {
+		docJS, err = col.runPreHooks(ChangeUpdate, id, original, doc, docJS)
+	}
 	if err != nil {
 		part.DataLock.Unlock()
 		col.db.schemaLock.RUnlock()
 		return err
 	}
-	err = part.Update(id, []byte(docJS))
+	if err = part.Update(id, []byte(docJS)); err == nil {
+		col.logDocChange(part, ChangeUpdate, id, docJS, originalB)
+		col.trackDocChange(ChangeUpdate, id, docJS)
+	}
 	part.DataLock.Unlock()
 	if err != nil {
 		col.db.schemaLock.RUnlock()
@@ -311,32 +472,66 @@ func (col *Col) UpdateFunc(id int, update func(origDoc map[string]interface{}) (
 	part.UnlockUpdate(id)
 
 	col.db.schemaLock.RUnlock()
+	col.runPostHooks(ChangeUpdate, id, original, doc)
+	col.evict()
 	return nil
 }
 
 // Delete a document.
 func (col *Col) Delete(id int) error {
+	return col.delete(id, anyRev)
+}
+
+// Delete a document only if it is still at the revision.
+// If the document has been updated in the meantime, the returned error is of type dberr.ErrorRevMismatch.
+func (col *Col) DeleteIfRev(id, rev int) error {
+	return col.delete(id, rev)
+}
+
+// Delete a document if it is at the expected revision (or anyRev).
+func (col *Col) delete(id, expectRev int) error {
 	col.db.schemaLock.RLock()
+	original, err := col.deleteLocked(id, expectRev)
+	col.db.schemaLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	col.runPostHooks(ChangeDelete, id, original, nil)
+	return nil
+}
+
+// Delete a document if it is at the expected revision (or anyRev), return the deleted document for post hooks.
+// Caller must hold schema lock.
+func (col *Col) deleteLocked(id, expectRev int) (original map[string]interface{}, err error) {
 	part := col.parts[id%col.db.numParts]
 
 	// Place lock, read back original document and delete document
 	part.DataLock.Lock()
-	originalB, err := part.Read(id)
+	originalB, rev, err := part.ReadRev(id)
+	if err == nil && expectRev != anyRev && rev != expectRev {
+		err = dberr.New(dberr.ErrorRevMismatch, id, rev, expectRev)
+	}
+	if err == nil && col.hasPreHooks() {
+		json.Unmarshal(originalB, &original)
+		_, err = col.runPreHooks(ChangeDelete, id, original, nil, nil)
+	}
 	if err != nil {
 		part.DataLock.Unlock()
-		col.db.schemaLock.RUnlock()
-		return err
+		return nil, err
+	}
+	if err = part.Delete(id); err == nil {
+		col.logDocChange(part, ChangeDelete, id, nil, originalB)
+		col.trackDocChange(ChangeDelete, id, nil)
 	}
-	err = part.Delete(id)
 	part.DataLock.Unlock()
 	if err != nil {
-		col.db.schemaLock.RUnlock()
-		return err
+		return nil, err
 	}
 
 	// Done with the collection data, next is to remove indexed values
-	var original map[string]interface{}
-	err = json.Unmarshal(originalB, &original)
+	if original == nil {
+		err = json.Unmarshal(originalB, &original)
+	}
 	if err == nil {
 		part.LockUpdate(id)
 		col.unindexDoc(id, original)
@@ -344,7 +539,5 @@ func (col *Col) Delete(id int) error {
 	} else {
 		tdlog.Noticef("Will not attempt to unindex document %d during delete", id)
 	}
-
-	col.db.schemaLock.RUnlock()
-	return nil
+	return original, nil
 }
@@ -93,7 +93,7 @@ func GetInTest(t *testing.T) {
 }
 func idxHas(col *Col, path []string, idxVal interface{}, docID int) error {
 	idxName := strings.Join(path, INDEX_PATH_SEP)
-	hashKey := StrHash(fmt.Sprint(idxVal))
+	hashKey := col.indexHash[idxName].Key(idxVal)
 	vals := col.hts[hashKey%col.db.numParts][idxName].Get(hashKey, 0)
 	if len(vals) != 1 || vals[0] != docID {
 		return fmt.Errorf("Looking for %v (%v) docID %v in %v partition %d, but got result %v", idxVal, hashKey, docID, path, hashKey%col.db.numParts, vals)
@@ -102,7 +102,7 @@ func idxHas(col *Col, path []string, idxVal interface{}, docID int) error {
 }
 func idxHasNot(col *Col, path []string, idxVal, docID int) error {
 	idxName := strings.Join(path, INDEX_PATH_SEP)
-	hashKey := StrHash(fmt.Sprint(idxVal))
+	hashKey := col.indexHash[idxName].Key(idxVal)
 	vals := col.hts[hashKey%col.db.numParts][idxName].Get(hashKey, 0)
 	for _, v := range vals {
 		if v == docID {
@@ -458,3 +458,255 @@ func TestUpdateFuncUpdateError(t *testing.T) {
 		t.Errorf("Expected error: %s", errMessage)
 	}
 }
+func TestScrubReportCorruptedDoc(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	goodID, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	badID, err := col.Insert(map[string]interface{}{"a": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bak := TEST_DATA_DIR + "bak"
+	os.RemoveAll(bak)
+	defer os.RemoveAll(bak)
+	if err = db.EnableChangeLog(); err != nil {
+		t.Fatal(err)
+	} else if err = db.Backup(bak+"/full", nil); err != nil {
+		t.Fatal(err)
+	}
+	// Overwrite the document body behind the checksum's back
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	datFile := fmt.Sprintf("%s/col/%s%d", TEST_DATA_DIR, DOC_DATA_FILE, badID%2)
+	content, err := ioutil.ReadFile(datFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := bytes.Index(content, []byte(`{"a":2}`))
+	if pos == -1 {
+		t.Fatal("Cannot find document in data file")
+	}
+	content[pos+5] = '3'
+	if err := ioutil.WriteFile(datFile, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if _, err := col.Read(badID); dberr.Type(err) != dberr.ErrorDocCorrupted {
+		t.Fatal("Did not detect corruption", err)
+	}
+	corrupted, err := db.ScrubReport("col")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupted) != 1 || corrupted[0] != badID {
+		t.Fatal(corrupted)
+	}
+	// The removed document is in the way of incremental backups
+	if _, err = db.IncrementalBackup(bak+"/full", bak+"/inc"); err == nil || !strings.Contains(err.Error(), "repaired") {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if _, err := col.Read(badID); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	if doc, err := col.Read(goodID); err != nil || doc["a"].(float64) != 1 {
+		t.Fatal(doc, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInsertWithIDAndUpsert(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"email"}); err != nil {
+		t.Fatal(err)
+	}
+	// Caller-supplied IDs
+	if err = col.InsertWithID(-1, map[string]interface{}{"a": 1}); dberr.Type(err) != dberr.ErrorBadDocID {
+		t.Fatal(err)
+	}
+	if err = col.InsertWithID(123, map[string]interface{}{"email": "a@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.InsertWithID(123, map[string]interface{}{"email": "b@example.com"}); dberr.Type(err) != dberr.ErrorDocExists {
+		t.Fatal(err)
+	}
+	if doc, err := col.Read(123); err != nil || doc["email"] != "a@example.com" {
+		t.Fatal(doc, err)
+	}
+	if err = idxHas(col, []string{"email"}, "a@example.com", 123); err != nil {
+		t.Fatal(err)
+	}
+	// Upsert by ID
+	if inserted, err := col.Upsert(123, map[string]interface{}{"email": "c@example.com"}); inserted || err != nil {
+		t.Fatal(inserted, err)
+	}
+	if inserted, err := col.Upsert(124, map[string]interface{}{"email": "d@example.com"}); !inserted || err != nil {
+		t.Fatal(inserted, err)
+	}
+	if doc, err := col.Read(123); err != nil || doc["email"] != "c@example.com" {
+		t.Fatal(doc, err)
+	}
+	if err = idxHas(col, []string{"email"}, "c@example.com", 123); err != nil {
+		t.Fatal(err)
+	}
+	if err = idxHas(col, []string{"email"}, "d@example.com", 124); err != nil {
+		t.Fatal(err)
+	}
+	// Upsert by indexed value
+	if _, _, err := col.UpsertByIndex([]string{"email"}, "e@example.com", map[string]interface{}{"email": "f@example.com"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, _, err := col.UpsertByIndex([]string{"name"}, "e", map[string]interface{}{"name": "e"}); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	if id, inserted, err := col.UpsertByIndex([]string{"email"}, "c@example.com", map[string]interface{}{"email": "c@example.com", "n": 1}); id != 123 || inserted || err != nil {
+		t.Fatal(id, inserted, err)
+	}
+	newID, inserted, err := col.UpsertByIndex([]string{"email"}, "e@example.com", map[string]interface{}{"email": "e@example.com"})
+	if !inserted || err != nil {
+		t.Fatal(newID, inserted, err)
+	}
+	if id, inserted, err := col.UpsertByIndex([]string{"email"}, "e@example.com", map[string]interface{}{"email": "e@example.com", "n": 2}); id != newID || inserted || err != nil {
+		t.Fatal(id, inserted, err)
+	}
+	if doc, err := col.Read(newID); err != nil || doc["n"].(float64) != 2 {
+		t.Fatal(doc, err)
+	}
+	// Concurrent upserts of the same value insert only once
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := col.UpsertByIndex([]string{"email"}, "g@example.com", map[string]interface{}{"email": "g@example.com"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if q, err := runQuery(`{"eq": "g@example.com", "in": ["email"]}`, col); err != nil || len(q) != 1 {
+		t.Fatal(q, err)
+	}
+	// Ambiguous value
+	if err = col.InsertWithID(125, map[string]interface{}{"email": "g@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := col.UpsertByIndex([]string{"email"}, "g@example.com", map[string]interface{}{"email": "g@example.com"}); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestDocRevision(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, rev, err := col.ReadRev(id)
+	if err != nil || rev != 1 || doc["a"].(float64) != 1 {
+		t.Fatal(doc, rev, err)
+	}
+	// Conditional update succeeds only at the expected revision
+	newRev, err := col.UpdateIfRev(id, rev, map[string]interface{}{"a": 2})
+	if err != nil || newRev != 2 {
+		t.Fatal(newRev, err)
+	}
+	if _, err = col.UpdateIfRev(id, rev, map[string]interface{}{"a": 3}); dberr.Type(err) != dberr.ErrorRevMismatch {
+		t.Fatal(err)
+	}
+	if doc, rev, err = col.ReadRev(id); err != nil || rev != 2 || doc["a"].(float64) != 2 {
+		t.Fatal(doc, rev, err)
+	}
+	if err = idxHas(col, []string{"a"}, 2, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = col.UpdateIfRev(id+1, 1, map[string]interface{}{"a": 3}); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	// Unconditional update also increments revision
+	if err = col.Update(id, map[string]interface{}{"a": 3}); err != nil {
+		t.Fatal(err)
+	} else if _, rev, _ = col.ReadRev(id); rev != 3 {
+		t.Fatal(rev)
+	}
+	// Revision survives scrub
+	if err = db.Scrub("col"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if _, rev, err = col.ReadRev(id); err != nil || rev != 3 {
+		t.Fatal(rev, err)
+	}
+	// Conditional delete
+	if err = col.DeleteIfRev(id, 2); dberr.Type(err) != dberr.ErrorRevMismatch {
+		t.Fatal(err)
+	} else if _, err = col.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.DeleteIfRev(id, 3); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.Read(id); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+	if err = idxHasNot(col, []string{"a"}, 3, id); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,375 @@
+// Logical export and import of collections in NDJSON, JSON and CSV.
+
+package db
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	ExportNDJSON = "ndjson" // One JSON object per line, the header followed by documents.
+	ExportJSON   = "json"   // A JSON array of the header followed by documents.
+	ExportCSV    = "csv"    // Comma separated values of document ID and mapped document paths, after a row of column names.
+
+	CSVIDColumn = "_id" // Name of the CSV column of document ID.
+)
+
+// ExportHeader describes the exported collection, it precedes documents in NDJSON and JSON exports.
+type ExportHeader struct {
+	Collection string
+	Options    ColOptions
+	Indexes    []ExportIndex
+	Schema     json.RawMessage `json:",omitempty"`
+	TTL        *TTL            `json:",omitempty"`
+}
+
+// ExportIndex describes an index of the exported collection.
+type ExportIndex struct {
+	Path []string
+	Hash IndexHash
+}
+
+// ExportDoc is an exported document and its ID.
+type ExportDoc struct {
+	ID  int
+	Doc map[string]interface{}
+}
+
+// CSVColumn maps a CSV column to a document path.
+type CSVColumn struct {
+	Name string
+	Path []string
+}
+
+// Parse CSV column mapping such as "title=Title,author=Author.Name,year", in which a column without path is mapped
+// to the path of its name. Path segments are separated by dots.
+func ParseCSVColumns(spec string) (columns []CSVColumn, err error) {
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		name, path := item, item
+		if eq := strings.Index(item, "="); eq != -1 {
+			name, path = item[:eq], item[eq+1:]
+		}
+		if name == "" || path == "" || name == CSVIDColumn {
+			return nil, fmt.Errorf("CSV column mapping '%s' is invalid", item)
+		}
+		columns = append(columns, CSVColumn{Name: name, Path: strings.Split(path, ".")})
+	}
+	return
+}
+
+// ExportOptions control what and how to export.
+type ExportOptions struct {
+	Format  string      // ExportNDJSON (default), ExportJSON or ExportCSV.
+	Query   interface{} // Only export documents matched by the query, or all documents if nil.
+	Columns []CSVColumn // Document paths of CSV columns, required by CSV.
+}
+
+// ImportOptions control how to import.
+type ImportOptions struct {
+	Format  string      // ExportNDJSON (default), ExportJSON or ExportCSV.
+	Columns []CSVColumn // Document paths of CSV columns, by default each column is mapped to the path of its name.
+}
+
+// Return the header that describes the collection. Caller must hold schema lock.
+func (col *Col) exportHeader() ExportHeader {
+	header := ExportHeader{Collection: col.name, Options: col.opts, Indexes: make([]ExportIndex, 0, len(col.indexPaths))}
+	idxNames := make([]string, 0, len(col.indexPaths))
+	for idxName := range col.indexPaths {
+		idxNames = append(idxNames, idxName)
+	}
+	sort.Strings(idxNames)
+	for _, idxName := range idxNames {
+		header.Indexes = append(header.Indexes, ExportIndex{Path: col.indexPaths[idxName], Hash: col.indexHash[idxName]})
+	}
+	if col.schema != nil {
+		header.Schema = col.schema.raw
+	}
+	header.TTL = col.ttl
+	return header
+}
+
+// Stream the collection to the writer, return number of exported documents.
+// NDJSON and JSON exports carry document IDs, collection options and index definitions; CSV exports carry document IDs.
+func (db *DB) Export(name string, w io.Writer, opts ExportOptions) (count int, err error) {
+	col := db.Use(name)
+	if col == nil {
+		return 0, fmt.Errorf("Collection %s does not exist", name)
+	}
+	out := bufio.NewWriter(w)
+	var csvOut *csv.Writer
+	var writeDoc func(doc ExportDoc) error
+	db.schemaLock.RLock()
+	switch opts.Format {
+	case "", ExportNDJSON, ExportJSON:
+		sep := "\n"
+		if opts.Format == ExportJSON {
+			out.WriteString("[\n")
+			sep = ",\n"
+		}
+		var js []byte
+		if js, err = json.Marshal(col.exportHeader()); err != nil {
+			db.schemaLock.RUnlock()
+			return
+		}
+		out.Write(js)
+		writeDoc = func(doc ExportDoc) error {
+			js, err := json.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			out.WriteString(sep)
+			_, err = out.Write(js)
+			return err
+		}
+	case ExportCSV:
+		if len(opts.Columns) == 0 {
+			db.schemaLock.RUnlock()
+			return 0, fmt.Errorf("CSV export requires a column mapping")
+		}
+		csvOut = csv.NewWriter(out)
+		record := []string{CSVIDColumn}
+		for _, column := range opts.Columns {
+			record = append(record, column.Name)
+		}
+		csvOut.Write(record)
+		writeDoc = func(doc ExportDoc) error {
+			record := []string{strconv.Itoa(doc.ID)}
+			for _, column := range opts.Columns {
+				val, err := valueAt(doc.Doc, column.Path)
+				if str, isStr := val.(string); isStr {
+					record = append(record, str)
+				} else if err != nil || val == nil {
+					record = append(record, "")
+				} else if js, err := json.Marshal(val); err != nil {
+					return err
+				} else {
+					record = append(record, string(js))
+				}
+			}
+			return csvOut.Write(record)
+		}
+	default:
+		db.schemaLock.RUnlock()
+		return 0, fmt.Errorf("Export format %s is not supported", opts.Format)
+	}
+	db.schemaLock.RUnlock()
+
+	if opts.Query == nil {
+		col.ForEachDoc(func(id int, docB []byte) bool {
+			var doc map[string]interface{}
+			if json.Unmarshal(docB, &doc) != nil {
+				tdlog.Noticef("Export: skipped corrupted document %d in collection %s", id, name)
+				return true
+			} else if err = writeDoc(ExportDoc{ID: id, Doc: doc}); err != nil {
+				return false
+			}
+			count++
+			return true
+		})
+	} else {
+		matches := make(map[int]struct{})
+		if err = EvalQuery(opts.Query, col, &matches); err != nil {
+			return
+		}
+		ids := make([]int, 0, len(matches))
+		for id := range matches {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			doc, readErr := col.Read(id)
+			if readErr != nil {
+				// The document was deleted in the meantime
+				continue
+			} else if err = writeDoc(ExportDoc{ID: id, Doc: doc}); err != nil {
+				break
+			}
+			count++
+		}
+	}
+	if err != nil {
+		return
+	}
+	if csvOut != nil {
+		csvOut.Flush()
+		err = csvOut.Error()
+	} else if opts.Format == ExportJSON {
+		_, err = out.WriteString("\n]\n")
+	} else {
+		_, err = out.WriteString("\n")
+	}
+	if err != nil {
+		return
+	}
+	return count, out.Flush()
+}
+
+// Stream documents from the reader into the collection, return number of imported documents.
+// The collection and its indexes are created unless they already exist; documents keep their exported IDs, and
+// import fails if an ID is already taken. Indexes are built once after all documents are imported (see BeginLoad).
+func (db *DB) Import(name string, r io.Reader, opts ImportOptions) (count int, err error) {
+	var nextDoc func() (doc ExportDoc, hasID bool, err error) // Return io.EOF after the last document
+	switch opts.Format {
+	case "", ExportNDJSON, ExportJSON:
+		dec := json.NewDecoder(bufio.NewReader(r))
+		if opts.Format == ExportJSON {
+			if tok, err := dec.Token(); err != nil {
+				return 0, err
+			} else if tok != json.Delim('[') {
+				return 0, fmt.Errorf("Expecting a JSON array, but got %v", tok)
+			}
+		}
+		var header ExportHeader
+		if err = dec.Decode(&header); err != nil {
+			return 0, fmt.Errorf("Cannot read export header - %v", err)
+		} else if err = db.importSchema(name, header); err != nil {
+			return
+		}
+		nextDoc = func() (doc ExportDoc, hasID bool, err error) {
+			if opts.Format == ExportJSON && !dec.More() {
+				return doc, true, io.EOF
+			}
+			err = dec.Decode(&doc)
+			if err == nil && doc.Doc == nil {
+				err = fmt.Errorf("Document %d has no content", doc.ID)
+			}
+			return doc, true, err
+		}
+	case ExportCSV:
+		csvIn := csv.NewReader(bufio.NewReader(r))
+		names, err := csvIn.Read()
+		if err != nil {
+			return 0, fmt.Errorf("Cannot read CSV header - %v", err)
+		}
+		// Map column numbers to document paths
+		idColumn := -1
+		paths := make([][]string, len(names))
+		for i, heading := range names {
+			if heading == CSVIDColumn {
+				idColumn = i
+			} else if opts.Columns == nil {
+				paths[i] = strings.Split(heading, ".")
+			}
+			for _, column := range opts.Columns {
+				if column.Name == heading {
+					paths[i] = column.Path
+				}
+			}
+		}
+		if !db.ColExists(name) {
+			if err = db.Create(name); err != nil {
+				return 0, err
+			}
+		}
+		nextDoc = func() (doc ExportDoc, hasID bool, err error) {
+			record, err := csvIn.Read()
+			if err != nil {
+				return
+			}
+			doc.Doc = make(map[string]interface{})
+			for i, cell := range record {
+				if i == idColumn {
+					if doc.ID, err = strconv.Atoi(cell); err != nil {
+						return doc, true, fmt.Errorf("Invalid document ID '%s'", cell)
+					}
+					hasID = true
+				} else if paths[i] != nil && cell != "" {
+					// Cells are JSON values, or otherwise strings
+					var val interface{}
+					if json.Unmarshal([]byte(cell), &val) != nil {
+						val = cell
+					}
+					if _, err = patchAt(doc.Doc, paths[i], true, func(container interface{}, token string) (interface{}, error) {
+						return setField(container, token, val)
+					}); err != nil {
+						return doc, hasID, fmt.Errorf("Cannot set %s of document - %v", strings.Join(paths[i], "."), err)
+					}
+				}
+			}
+			return
+		}
+	default:
+		return 0, fmt.Errorf("Import format %s is not supported", opts.Format)
+	}
+
+	load, err := db.Use(name).BeginLoad()
+	if err != nil {
+		return
+	}
+	for {
+		doc, hasID, readErr := nextDoc()
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			err = fmt.Errorf("Cannot read document after %d imported documents - %v", count, readErr)
+			break
+		}
+		if hasID {
+			err = load.InsertWithID(doc.ID, doc.Doc)
+		} else {
+			_, err = load.Insert(doc.Doc)
+		}
+		if err != nil {
+			break
+		}
+		count++
+	}
+	if commitErr := load.Commit(); err == nil {
+		err = commitErr
+	}
+	return
+}
+
+// Create the collection and indexes described by the export header, unless they already exist.
+func (db *DB) importSchema(name string, header ExportHeader) error {
+	if !db.ColExists(name) {
+		if err := db.CreateWith(name, header.Options); err != nil {
+			return err
+		}
+	}
+	col := db.Use(name)
+	existing := make(map[string]struct{})
+	for _, idxPath := range col.AllIndexes() {
+		existing[indexName(idxPath)] = struct{}{}
+	}
+	for _, idx := range header.Indexes {
+		if _, exists := existing[indexName(idx.Path)]; exists {
+			continue
+		}
+		hash, err := NewIndexHash(idx.Hash.Func)
+		if err != nil {
+			return err
+		} else if hash.Collation, err = parseCollation(idx.Hash.Collation); err != nil {
+			return err
+		} else if err = col.index(idx.Path, hash); err != nil {
+			return err
+		}
+	}
+	if header.TTL != nil && col.TTL() == nil {
+		if err := col.SetTTL(header.TTL.Path, header.TTL.Seconds); err != nil {
+			return err
+		}
+	}
+	if len(header.Schema) > 0 && col.Schema() == nil {
+		schema, err := parseSchema(header.Schema)
+		if err != nil {
+			return err
+		}
+		db.lockSchema()
+		defer db.unlockSchema()
+		return col.setSchema(schema)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.CreateWith("col", ColOptions{IDStrategy: IDMonotonic}); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.IndexWithCollation([]string{"a"}, CollationNoCase); err != nil {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	docs := []map[string]interface{}{
+		{"a": "Hello", "b": map[string]interface{}{"c": 1.0}},
+		{"a": "world, \"quoted\"", "b": map[string]interface{}{"c": []interface{}{2.0, 3.0}}},
+		{"a": "x"},
+	}
+	ids := make([]int, len(docs))
+	for i, doc := range docs {
+		if ids[i], err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// NDJSON and JSON round trip keeps IDs, options and indexes
+	for _, format := range []string{ExportNDJSON, ExportJSON} {
+		out := new(bytes.Buffer)
+		if count, err := db.Export("col", out, ExportOptions{Format: format}); err != nil || count != 3 {
+			t.Fatal(format, count, err)
+		}
+		target := "col_" + format
+		if count, err := db.Import(target, out, ImportOptions{Format: format}); err != nil || count != 3 {
+			t.Fatal(format, count, err, out.String())
+		}
+		imported := db.Use(target)
+		if imported.Options().IDStrategy != IDMonotonic {
+			t.Fatal(imported.Options())
+		} else if hash, err := imported.IndexHash([]string{"a"}); err != nil || hash.Collation != CollationNoCase {
+			t.Fatal(hash, err)
+		}
+		for i, id := range ids {
+			if doc, err := imported.Read(id); err != nil || !strictEqual(CollationBinary, doc, docs[i]) {
+				t.Fatal(format, doc, err)
+			}
+		}
+		if q, err := runQuery(`{"eq": "HELLO", "in": ["a"]}`, imported); err != nil || !ensureMapHasKeys(q, ids[0]) {
+			t.Fatal(q, err)
+		} else if q, err = runQuery(`{"eq": 3, "in": ["b", "c"]}`, imported); err != nil || !ensureMapHasKeys(q, ids[1]) {
+			t.Fatal(q, err)
+		}
+		// IDs are already taken
+		out.Reset()
+		db.Export("col", out, ExportOptions{Format: format})
+		if count, err := db.Import(target, out, ImportOptions{Format: format}); err == nil || count != 0 {
+			t.Fatal(count, err)
+		}
+	}
+	// Export documents matched by a query
+	out := new(bytes.Buffer)
+	query := map[string]interface{}{"eq": "x", "in": []interface{}{"a"}}
+	if count, err := db.Export("col", out, ExportOptions{Query: query}); err != nil || count != 1 {
+		t.Fatal(count, err)
+	} else if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 || !strings.Contains(lines[1], `"a":"x"`) {
+		t.Fatal(lines)
+	}
+	// CSV round trip with column mapping
+	columns, err := ParseCSVColumns("title=a,c=b.c")
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = ParseCSVColumns("_id=a"); err == nil {
+		t.Fatal("did not error")
+	}
+	out.Reset()
+	if _, err = db.Export("col", out, ExportOptions{Format: ExportCSV}); err == nil {
+		t.Fatal("did not error")
+	} else if count, err := db.Export("col", out, ExportOptions{Format: ExportCSV, Query: "all", Columns: columns}); err != nil || count != 3 {
+		t.Fatal(count, err)
+	}
+	expected := "_id,title,c\n" +
+		"1,Hello,1\n" +
+		"2,\"world, \"\"quoted\"\"\",\"[2,3]\"\n" +
+		"3,x,\n"
+	if out.String() != expected {
+		t.Fatalf("got %q", out.String())
+	}
+	if count, err := db.Import("col_csv", out, ImportOptions{Format: ExportCSV, Columns: columns}); err != nil || count != 3 {
+		t.Fatal(count, err)
+	}
+	for i, id := range ids {
+		if doc, err := db.Use("col_csv").Read(id); err != nil || !strictEqual(CollationBinary, doc, docs[i]) {
+			t.Fatal(doc, err)
+		}
+	}
+	// CSV without ID column and mapping
+	if count, err := db.Import("col_csv2", strings.NewReader("a,b.c\nx,1\n"), ImportOptions{Format: ExportCSV}); err != nil || count != 1 {
+		t.Fatal(count, err)
+	}
+	var imported []string
+	db.Use("col_csv2").ForEachDoc(func(id int, doc []byte) bool {
+		imported = append(imported, strings.TrimSpace(string(doc)))
+		return true
+	})
+	if len(imported) != 1 || imported[0] != `{"a":"x","b":{"c":1}}` {
+		t.Fatal(imported)
+	}
+}
@@ -0,0 +1,270 @@
+// Consistency check (fsck) of documents, ID lookup tables and indexes.
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/HouzuoGuo/tiedot/data"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	FsckCorruptHeader  = "corrupt-header"      // Document headers in a region of data file are corrupted.
+	FsckOrphanDoc      = "orphan-doc"          // Intact documents are not addressed by any ID.
+	FsckCorruptDoc     = "corrupt-doc"         // Documents do not match their checksum.
+	FsckDanglingID     = "dangling-id"         // IDs address no document.
+	FsckDuplicateID    = "duplicate-id"        // IDs address more than one document.
+	FsckBadLookup      = "bad-lookup"          // ID lookup table is structurally damaged.
+	FsckMisplacedDoc   = "misplaced-doc"       // Documents are in a partition other than the one of their ID.
+	FsckInvalidJSON    = "invalid-json"        // Documents are not JSON objects.
+	FsckBadIndex       = "bad-index"           // Index hash table is structurally damaged.
+	FsckStaleEntry     = "stale-index-entry"   // Index entries point at documents that do not have the indexed value.
+	FsckMissingEntry   = "missing-index-entry" // Indexed values of documents are not on the index.
+	fsckMaxReportedIDs = 100                   // Report at most this many IDs of each problem.
+)
+
+// FsckProblem is a kind of problem found in a collection partition or index.
+type FsckProblem struct {
+	Collection string
+	Partition  int
+	Index      []string `json:",omitempty"` // Path of the index that has the problem.
+	Kind       string   // e.g. FsckDanglingID
+	Count      int      // Number of occurrences.
+	IDs        []int    `json:",omitempty"` // Affected document IDs, if known (up to fsckMaxReportedIDs).
+	Detail     string   `json:",omitempty"`
+}
+
+// Describe the problem in a line of text.
+func (problem FsckProblem) String() string {
+	where := fmt.Sprintf("%s partition %d", problem.Collection, problem.Partition)
+	if problem.Index != nil {
+		where = fmt.Sprintf("%s index %v", where, problem.Index)
+	}
+	line := fmt.Sprintf("%s: %d %s", where, problem.Count, problem.Kind)
+	if len(problem.IDs) > 0 {
+		line += fmt.Sprintf(" %v", problem.IDs)
+	}
+	if problem.Detail != "" {
+		line += " - " + problem.Detail
+	}
+	return line
+}
+
+// Collect a problem of the IDs into the report, unless there is none.
+func addFsckProblem(report *[]FsckProblem, problem FsckProblem, ids []int) {
+	if problem.Count == 0 {
+		problem.Count = len(ids)
+	}
+	if problem.Count == 0 {
+		return
+	}
+	sort.Ints(ids)
+	if len(ids) > fsckMaxReportedIDs {
+		ids = ids[:fsckMaxReportedIDs]
+	}
+	problem.IDs = ids
+	*report = append(*report, problem)
+}
+
+// Check that documents, ID lookup tables and indexes of all collections agree with each other, and return the
+// problems found. To repair:
+// - IDs of missing or corrupted documents are removed, and damaged partitions are compacted (see Partition.Check);
+// - documents that are not JSON objects are deleted, misplaced documents are moved into their partition;
+// - stale index entries are removed and missing ones are added, damaged indexes are rebuilt.
+// Repaired documents are not recorded in change log one by one, incremental backups cannot be taken across the repair.
+// The database is unavailable during the check, which keeps the index entries of a collection in memory.
+func (db *DB) Fsck(repair bool) (report []FsckProblem, err error) {
+	if repair && db.Config.ReadOnly {
+		return nil, fmt.Errorf("Database %s is opened read-only and cannot be repaired", db.path)
+	}
+	db.lockSchema()
+	defer db.unlockSchema()
+	names := make([]string, 0, len(db.cols))
+	for name := range db.cols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = db.cols[name].fsck(repair, &report); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// A document and index hash table key pair that is expected on an index.
+type fsckEntry struct {
+	key, id int
+}
+
+// Check and optionally repair the collection. Caller must hold schema lock exclusively.
+func (col *Col) fsck(repair bool, report *[]FsckProblem) error {
+	numParts := col.db.numParts
+	// Change log is told about the repair before any document is changed
+	repaired := false
+	logRepair := func() {
+		if !repaired {
+			col.db.logChange(Change{Op: ChangeRepair, Col: col.name})
+			repaired = true
+		}
+	}
+	for i, part := range col.parts {
+		partReport, err := part.Check(false)
+		if err == nil && repair && partReport.HasProblem() {
+			logRepair()
+			partReport, err = part.Check(true)
+		}
+		if err != nil {
+			return err
+		}
+		problem := FsckProblem{Collection: col.name, Partition: i}
+		problem.Kind, problem.Count = FsckCorruptHeader, partReport.CorruptHeaders
+		addFsckProblem(report, problem, nil)
+		problem.Kind, problem.Count = FsckOrphanDoc, partReport.Orphans
+		addFsckProblem(report, problem, nil)
+		problem.Count = 0
+		problem.Kind = FsckCorruptDoc
+		addFsckProblem(report, problem, partReport.CorruptIDs)
+		problem.Kind = FsckDanglingID
+		addFsckProblem(report, problem, partReport.DanglingIDs)
+		problem.Kind = FsckDuplicateID
+		addFsckProblem(report, problem, partReport.DuplicateIDs)
+		if partReport.BadLookup != "" {
+			problem.Kind, problem.Count, problem.Detail = FsckBadLookup, 1, partReport.BadLookup
+			addFsckProblem(report, problem, nil)
+		}
+		// Documents must be JSON objects in the partition of their ID
+		var misplaced, invalid []int
+		part.ForEachDoc(0, 1, func(id int, doc []byte) bool {
+			var docObj map[string]interface{}
+			if json.Unmarshal(doc, &docObj) != nil {
+				invalid = append(invalid, id)
+			} else if id%numParts != i {
+				misplaced = append(misplaced, id)
+			}
+			return true
+		})
+		problem = FsckProblem{Collection: col.name, Partition: i, Kind: FsckInvalidJSON}
+		addFsckProblem(report, problem, invalid)
+		problem.Kind = FsckMisplacedDoc
+		addFsckProblem(report, problem, misplaced)
+		if repair && (len(invalid) > 0 || len(misplaced) > 0) {
+			logRepair()
+			for _, id := range invalid {
+				part.Delete(id)
+			}
+			if err = col.moveDocs(part, misplaced); err != nil {
+				return err
+			}
+		}
+	}
+	if col.loading {
+		tdlog.Noticef("Fsck %s: skipped indexes, they are rebuilt when bulk load is committed", col.name)
+		return nil
+	}
+	idxNames := make([]string, 0, len(col.indexPaths))
+	for idxName := range col.indexPaths {
+		idxNames = append(idxNames, idxName)
+	}
+	sort.Strings(idxNames)
+	// Number of times each entry is expected on each index
+	expected := make(map[string]map[fsckEntry]int)
+	for _, idxName := range idxNames {
+		expected[idxName] = make(map[fsckEntry]int)
+	}
+	for _, part := range col.parts {
+		part.ForEachDoc(0, 1, func(id int, doc []byte) bool {
+			var docObj map[string]interface{}
+			if json.Unmarshal(doc, &docObj) != nil {
+				return true
+			}
+			for idxName, idxPath := range col.indexPaths {
+				for _, idxVal := range GetIn(docObj, idxPath) {
+					if idxVal != nil {
+						expected[idxName][fsckEntry{key: col.indexHash[idxName].Key(idxVal), id: id}]++
+					}
+				}
+			}
+			return true
+		})
+	}
+	for _, idxName := range idxNames {
+		if err := col.fsckIndex(idxName, expected[idxName], repair, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move misplaced documents into the partition of their ID, unless a document already exists under the ID there.
+// Caller must hold schema lock exclusively.
+func (col *Col) moveDocs(from *data.Partition, ids []int) error {
+	for _, id := range ids {
+		doc, rev, err := from.ReadRev(id)
+		if err != nil {
+			return err
+		}
+		if to := col.parts[id%col.db.numParts]; !to.Exists(id) {
+			if _, err = to.InsertRev(id, bytes.TrimRight(doc, " "), rev); err != nil {
+				return err
+			}
+		} else {
+			tdlog.Noticef("Fsck %s: dropped misplaced document %d, its ID is taken", col.name, id)
+		}
+		if err = from.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check that the index has exactly the expected entries, and optionally repair it. Caller must hold schema lock
+// exclusively.
+func (col *Col) fsckIndex(idxName string, expected map[fsckEntry]int, repair bool, report *[]FsckProblem) error {
+	idxPath := col.indexPaths[idxName]
+	damaged := false
+	for i := range col.parts {
+		if _, err := col.hts[i][idxName].Verify(); err != nil {
+			addFsckProblem(report, FsckProblem{Collection: col.name, Partition: i, Index: idxPath, Kind: FsckBadIndex, Count: 1, Detail: err.Error()}, nil)
+			damaged = true
+		}
+	}
+	if damaged && repair {
+		return col.reindex(idxPath, col.indexHash[idxName])
+	}
+	stale := make([][]int, len(col.parts))
+	for i := range col.parts {
+		ht := col.hts[i][idxName]
+		keys, ids := ht.GetPartition(0, 1)
+		for j, key := range keys {
+			entry := fsckEntry{key: key, id: ids[j]}
+			if expected[entry] > 0 && key%col.db.numParts == i {
+				expected[entry]--
+				continue
+			}
+			stale[i] = append(stale[i], ids[j])
+			if repair {
+				ht.Remove(key, ids[j])
+			}
+		}
+		addFsckProblem(report, FsckProblem{Collection: col.name, Partition: i, Index: idxPath, Kind: FsckStaleEntry}, stale[i])
+	}
+	missing := make([][]int, len(col.parts))
+	for entry, count := range expected {
+		partNum := entry.key % col.db.numParts
+		for ; count > 0; count-- {
+			missing[partNum] = append(missing[partNum], entry.id)
+			if repair {
+				col.hts[partNum][idxName].Put(entry.key, entry.id)
+			}
+		}
+	}
+	for i := range col.parts {
+		addFsckProblem(report, FsckProblem{Collection: col.name, Partition: i, Index: idxPath, Kind: FsckMissingEntry}, missing[i])
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package db
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.CreateWith("a", ColOptions{IDStrategy: IDMonotonic}); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("a")
+	if err = col.Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 10)
+	for i := range ids {
+		if ids[i], err = col.Insert(map[string]interface{}{"n": []interface{}{i, i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if report, err := db.Fsck(false); err != nil || len(report) != 0 {
+		t.Fatal(report, err)
+	}
+	// Nothing to repair, incremental backups carry on
+	bak := TEST_DATA_DIR + "bak"
+	os.RemoveAll(bak)
+	defer os.RemoveAll(bak)
+	if err = db.EnableChangeLog(); err != nil {
+		t.Fatal(err)
+	} else if err = db.Backup(bak+"/full", nil); err != nil {
+		t.Fatal(err)
+	} else if report, err := db.Fsck(true); err != nil || len(report) != 0 {
+		t.Fatal(report, err)
+	} else if _, err = db.IncrementalBackup(bak+"/full", bak+"/inc0"); err != nil {
+		t.Fatal(err)
+	}
+	// Stale and missing index entries
+	hash := col.indexHash["n"]
+	staleKey, missingKey := hash.Key(100.0), hash.Key(3.0)
+	col.hts[staleKey%2]["n"].Put(staleKey, ids[0])
+	col.hts[missingKey%2]["n"].Remove(missingKey, ids[3])
+	// A document in the wrong partition, and a document that is not JSON
+	if _, err = col.parts[0].Insert(101, []byte(`{"n": 101}`)); err != nil {
+		t.Fatal(err)
+	} else if _, err = col.parts[0].Insert(102, []byte(`not json`)); err != nil {
+		t.Fatal(err)
+	}
+	report, err := db.Fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The misplaced document was not on the index either
+	kinds := make(map[string][]int)
+	for _, problem := range report {
+		kinds[problem.Kind] = append(kinds[problem.Kind], problem.IDs...)
+	}
+	sort.Ints(kinds[FsckMissingEntry])
+	if len(kinds) != 4 || fmt.Sprint(kinds[FsckStaleEntry]) != fmt.Sprint([]int{ids[0]}) ||
+		fmt.Sprint(kinds[FsckMissingEntry]) != fmt.Sprint([]int{ids[3], 101}) ||
+		fmt.Sprint(kinds[FsckMisplacedDoc]) != "[101]" || fmt.Sprint(kinds[FsckInvalidJSON]) != "[102]" {
+		t.Fatal(report)
+	} else if line := report[0].String(); line != "a partition 0: 1 invalid-json [102]" {
+		t.Fatal(line)
+	}
+	// All problems are repaired, and the repair is in the way of incremental backups
+	if report, err = db.Fsck(false); err != nil || len(report) != 0 {
+		t.Fatal(report, err)
+	} else if _, err = db.IncrementalBackup(bak+"/inc0", bak+"/inc1"); err == nil || !strings.Contains(err.Error(), "repaired") {
+		t.Fatal(err)
+	}
+	if doc, err := col.Read(101); err != nil || doc["n"] != 101.0 {
+		t.Fatal(doc, err)
+	} else if _, err = col.Read(102); err == nil {
+		t.Fatal("did not delete")
+	}
+	if q, err := runQuery(`{"eq": 3, "in": ["n"]}`, col); err != nil || !ensureMapHasKeys(q, ids[3]) || len(q) != 1 {
+		t.Fatal(q, err)
+	} else if q, err = runQuery(`{"eq": 101, "in": ["n"]}`, col); err != nil || !ensureMapHasKeys(q, 101) {
+		t.Fatal(q, err)
+	} else if q, err = runQuery(`{"eq": 100, "in": ["n"]}`, col); err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	}
+}
+
+// Return the checksum of every file in the directory.
+func dirChecksums(t *testing.T, dir string) map[string][sha256.Size]byte {
+	sums := make(map[string][sha256.Size]byte)
+	if err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(filePath)
+		sums[filePath] = sha256.Sum256(content)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return sums
+}
+
+func TestFsckReadOnly(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	// A new database is not created
+	db, err := OpenDBReadOnly(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	} else if report, err := db.Fsck(false); err != nil || len(report) != 0 || len(db.AllCols()) != 0 {
+		t.Fatal(report, err)
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(TEST_DATA_DIR); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("a"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("b"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Use("b").Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("a")
+	if err = col.Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleKey := col.indexHash["n"].Key(100.0)
+	col.hts[staleKey%2]["n"].Put(staleKey, id)
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A bulk load did not finish in another collection
+	if err = ioutil.WriteFile(TEST_DATA_DIR+"/b/"+LOAD_MARKER_FILE, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	before := dirChecksums(t, TEST_DATA_DIR)
+	if db, err = OpenDBReadOnly(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	} else if db.reaper != nil {
+		t.Fatal("started reaper")
+	} else if _, err = db.Fsck(true); err == nil {
+		t.Fatal("did not error")
+	}
+	report, err := db.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(report) != 1 || report[0].Kind != FsckStaleEntry || fmt.Sprint(report[0].IDs) != fmt.Sprint([]int{id}) {
+		t.Fatal(report)
+	} else if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after := dirChecksums(t, TEST_DATA_DIR); fmt.Sprint(before) != fmt.Sprint(after) {
+		t.Fatal("read-only database changed its files")
+	}
+}
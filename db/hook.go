@@ -0,0 +1,97 @@
+// Hooks run by document inserts, updates and deletes.
+
+package db
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// PreHook runs before a document is inserted (op is ChangeInsert), updated (ChangeUpdate) or deleted (ChangeDelete),
+// given the document before the write (nil for insert) and the document to be written (nil for delete). It may modify
+// the document to be written in place but not the document before the write, or reject the write by returning an
+// error - the write then fails with an error of type dberr.ErrorRejected. Pre hooks run while the document's partition
+// is locked, they must not use the database.
+type PreHook func(op string, id int, oldDoc, newDoc map[string]interface{}) error
+
+// PostHook runs after a document has been inserted, updated or deleted and its indexes are maintained, given the
+// documents before and after the write. No lock is held, it may use the database (writes made by it run hooks too).
+type PostHook func(op string, id int, oldDoc, newDoc map[string]interface{})
+
+// Hooks registered on a collection, they are kept when the collection is renamed.
+type colHooks struct {
+	lock *sync.RWMutex
+	pre  []PreHook
+	post []PostHook
+}
+
+// Register a hook that runs before each document write, after the hooks already registered.
+func (col *Col) AddPreHook(hook PreHook) {
+	col.hooks.lock.Lock()
+	col.hooks.pre = append(col.hooks.pre, hook)
+	col.hooks.lock.Unlock()
+}
+
+// Register a hook that runs after each document write, after the hooks already registered.
+func (col *Col) AddPostHook(hook PostHook) {
+	col.hooks.lock.Lock()
+	col.hooks.post = append(col.hooks.post, hook)
+	col.hooks.lock.Unlock()
+}
+
+// Remove all hooks of the collection.
+func (col *Col) RemoveHooks() {
+	col.hooks.lock.Lock()
+	col.hooks.pre, col.hooks.post = nil, nil
+	col.hooks.lock.Unlock()
+}
+
+// Return true if there are pre hooks to run.
+func (col *Col) hasPreHooks() bool {
+	col.hooks.lock.RLock()
+	defer col.hooks.lock.RUnlock()
+	return len(col.hooks.pre) > 0
+}
+
+// Run pre hooks on the write and check the document to be written against collection schema and maximum size of
+// capped collection, return the document in JSON, which is marshaled again if there are hooks. Caller must hold schema
+// lock and the partition lock.
+func (col *Col) runPreHooks(op string, id int, oldDoc, newDoc map[string]interface{}, newJS []byte) ([]byte, error) {
+	col.hooks.lock.RLock()
+	hooks := col.hooks.pre
+	col.hooks.lock.RUnlock()
+	for _, hook := range hooks {
+		if err := hook(op, id, oldDoc, newDoc); err != nil {
+			return nil, dberr.New(dberr.ErrorRejected, id, err)
+		}
+	}
+	if newDoc == nil {
+		return nil, nil
+	} else if len(hooks) > 0 {
+		var err error
+		if newJS, err = json.Marshal(newDoc); err != nil {
+			return nil, err
+		}
+	}
+	if col.schema != nil {
+		if err := col.schema.validateJSON(newJS); err != nil {
+			return nil, dberr.New(dberr.ErrorInvalidDoc, id, err)
+		}
+	}
+	if col.opts.MaxBytes > 0 && len(newJS) > col.opts.MaxBytes {
+		return nil, dberr.New(dberr.ErrorDocTooLarge, col.opts.MaxBytes, len(newJS))
+	}
+	return newJS, nil
+}
+
+// Run post hooks on the write. Caller must not hold any lock.
+func (col *Col) runPostHooks(op string, id int, oldDoc, newDoc map[string]interface{}) {
+	col.hooks.lock.RLock()
+	hooks := col.hooks.post
+	col.hooks.lock.RUnlock()
+	for _, hook := range hooks {
+		hook(op, id, oldDoc, newDoc)
+	}
+}
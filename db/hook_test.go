@@ -0,0 +1,99 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestHooks(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("a"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("a")
+	if err = col.Index([]string{"tag"}); err != nil {
+		t.Fatal(err)
+	}
+	// Pre hook validates and enriches documents, post hook audits writes
+	col.AddPreHook(func(op string, id int, oldDoc, newDoc map[string]interface{}) error {
+		if op == ChangeDelete {
+			if oldDoc["locked"] == true {
+				return fmt.Errorf("document is locked")
+			}
+			return nil
+		} else if _, hasName := newDoc["name"]; !hasName {
+			return fmt.Errorf("name is required")
+		}
+		newDoc["tag"] = fmt.Sprintf("%s-%v", op, newDoc["name"])
+		return nil
+	})
+	var audit []string
+	col.AddPostHook(func(op string, id int, oldDoc, newDoc map[string]interface{}) {
+		audit = append(audit, fmt.Sprintf("%s %v %v", op, oldDoc["tag"], newDoc["tag"]))
+	})
+	if _, err = col.Insert(map[string]interface{}{}); dberr.Type(err) != dberr.ErrorRejected {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"name": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = col.Update(id, map[string]interface{}{"name": "y"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Update(id, map[string]interface{}{}); dberr.Type(err) != dberr.ErrorRejected {
+		t.Fatal(err)
+	} else if err = col.Patch(id, PatchMerge, map[string]interface{}{"locked": true}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(id); dberr.Type(err) != dberr.ErrorRejected {
+		t.Fatal(err)
+	}
+	// Transformed documents are written and indexed
+	if doc, err := col.Read(id); err != nil || doc["tag"] != "update-y" || doc["locked"] != true {
+		t.Fatal(doc, err)
+	} else if q, err := runQuery(`{"eq": "update-y", "in": ["tag"]}`, col); err != nil || !ensureMapHasKeys(q, id) {
+		t.Fatal(q, err)
+	} else if q, err = runQuery(`{"eq": "insert-x", "in": ["tag"]}`, col); err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	}
+	// Bulk operations run hooks too
+	results := col.Bulk([]BulkOp{{Op: BulkInsert, Doc: map[string]interface{}{"name": "z"}}, {Op: BulkInsert, Doc: map[string]interface{}{}},
+		{Op: BulkUpdate, ID: id, Doc: map[string]interface{}{"name": "w"}}})
+	if results[0].Error != "" || results[1].Error == "" || results[2].Error != "" {
+		t.Fatal(results)
+	} else if err = col.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"insert <nil> insert-x", "update insert-x update-y", "update update-y update-y",
+		"insert <nil> insert-z", "update update-y update-w", "delete update-w <nil>"}
+	if fmt.Sprint(audit) != fmt.Sprint(expected) {
+		t.Fatal(audit)
+	}
+	// Hooks are kept when the collection is renamed, until they are removed
+	if err = db.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("b")
+	if _, err = col.Insert(map[string]interface{}{}); dberr.Type(err) != dberr.ErrorRejected {
+		t.Fatal(err)
+	}
+	col.RemoveHooks()
+	if _, err = col.Insert(map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,180 @@
+// Document ID generation strategies.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	COL_OPTIONS_FILE = "options.json" // Name of the file that recorded collection options before collection metadata file.
+	ID_SEQ_FILE      = "seq_"         // Prefix of partition ID sequence file name (monotonic IDs).
+
+	IDRandom      = "random"    // Document IDs are random, they do not reflect insertion order.
+	IDMonotonic   = "monotonic" // Document IDs are consecutive integers in insertion order.
+	IDTimeOrdered = "time"      // Document IDs embed the insertion time in milliseconds, followed by a sequence number.
+
+	DefaultIDStrategy = IDRandom // ID strategy of collections created without options.
+
+	idSeqBlock    = 1024          // Number of monotonic IDs reserved for a partition by each write to its sequence file.
+	idTimeEpoch   = 1388534400000 // Time-ordered IDs count milliseconds since 2014-01-01 UTC.
+	idTimeSeqBits = 22            // Number of low bits of time-ordered IDs reserved for sequence number.
+)
+
+// ColOptions are collection properties chosen upon creation.
+type ColOptions struct {
+	IDStrategy string `json:",omitempty"` // Document ID strategy, the default is random, or monotonic if capped.
+	MaxDocs    int    `json:",omitempty"` // Capped collection keeps at most this many of the newest documents.
+	MaxBytes   int    `json:",omitempty"` // Capped collection keeps the newest documents within this total size in JSON.
+}
+
+// Return the options with default ID strategy if it is not chosen.
+func (opts ColOptions) withDefaults() ColOptions {
+	if opts.IDStrategy == "" && opts.capped() {
+		opts.IDStrategy = IDMonotonic
+	} else if opts.IDStrategy == "" {
+		opts.IDStrategy = DefaultIDStrategy
+	}
+	return opts
+}
+
+// Return an error if the options are not supported.
+func (opts ColOptions) validate() error {
+	switch opts.IDStrategy {
+	case "", IDRandom, IDMonotonic:
+	case IDTimeOrdered:
+		if strconv.IntSize < 64 {
+			return fmt.Errorf("ID strategy %s requires a 64-bit platform", opts.IDStrategy)
+		}
+	default:
+		return fmt.Errorf("ID strategy %s is not supported", opts.IDStrategy)
+	}
+	if opts.MaxDocs < 0 || opts.MaxBytes < 0 {
+		return fmt.Errorf("Maximum number of documents and bytes of capped collection must not be negative")
+	} else if opts.capped() && opts.IDStrategy != IDMonotonic && opts.IDStrategy != IDTimeOrdered {
+		return fmt.Errorf("Capped collection requires monotonic or time-ordered document IDs, not %s", opts.IDStrategy)
+	}
+	return nil
+}
+
+// Read collection options from the file of an older version of tiedot. Collections created by even older versions
+// do not have the file, they use default options.
+func readColOptions(colDir string) (opts ColOptions, err error) {
+	content, err := ioutil.ReadFile(path.Join(colDir, COL_OPTIONS_FILE))
+	if os.IsNotExist(err) {
+		return ColOptions{IDStrategy: DefaultIDStrategy}, nil
+	} else if err != nil {
+		return
+	} else if err = json.Unmarshal(content, &opts); err != nil {
+		return
+	}
+	opts = opts.withDefaults()
+	err = opts.validate()
+	return
+}
+
+// Generate document IDs of a collection.
+type idGen struct {
+	lock     *sync.Mutex
+	strategy string
+	dir      string // collection directory
+	next     int    // monotonic: the next ID; time-ordered: one more than the last ID
+	marks    []int  // monotonic: IDs of each partition are below its mark, which is persisted in sequence file
+}
+
+// Prepare ID generation of a collection, read the sequence files of monotonic IDs.
+func openIDGen(colDir, strategy string, numParts int) (gen *idGen, err error) {
+	gen = &idGen{lock: new(sync.Mutex), strategy: strategy, dir: colDir, next: 1}
+	if strategy != IDMonotonic {
+		return
+	}
+	gen.marks = make([]int, numParts)
+	for i := range gen.marks {
+		content, readErr := ioutil.ReadFile(path.Join(colDir, ID_SEQ_FILE+strconv.Itoa(i)))
+		if os.IsNotExist(readErr) {
+			continue
+		} else if readErr != nil {
+			return nil, readErr
+		} else if gen.marks[i], err = strconv.Atoi(strings.TrimSpace(string(content))); err != nil {
+			return nil, fmt.Errorf("ID sequence file %s is corrupted - %v", path.Join(colDir, ID_SEQ_FILE+strconv.Itoa(i)), err)
+		}
+		// IDs below the mark may have been handed out before the collection was closed
+		if gen.marks[i] > gen.next {
+			gen.next = gen.marks[i]
+		}
+	}
+	return
+}
+
+// Return a new document ID. The ID may already be taken by a caller-supplied ID, in which case caller asks for another.
+func (gen *idGen) nextID() (id int, err error) {
+	switch gen.strategy {
+	case IDMonotonic:
+		gen.lock.Lock()
+		defer gen.lock.Unlock()
+		id = gen.next
+		// Reserve a block of IDs for the partition before handing out the first of them
+		if partNum := id % len(gen.marks); id >= gen.marks[partNum] {
+			mark := id + idSeqBlock*len(gen.marks)
+			if err = writeIDSeq(gen.dir, partNum, mark); err != nil {
+				return
+			}
+			gen.marks[partNum] = mark
+		}
+		gen.next++
+		return
+	case IDTimeOrdered:
+		gen.lock.Lock()
+		defer gen.lock.Unlock()
+		// The sequence starts at a random number to spread documents among partitions.
+		// Within the same millisecond (or if clock goes backward), carry on with the sequence.
+		id = int(time.Now().UnixNano()/int64(time.Millisecond)-idTimeEpoch)<<idTimeSeqBits + rand.Intn(1<<(idTimeSeqBits-1))
+		if id < gen.next {
+			id = gen.next
+		}
+		gen.next = id + 1
+		return
+	}
+	return rand.Int(), nil
+}
+
+// Make sure that monotonic IDs handed out from now on are above the ID, which has been taken elsewhere.
+func (gen *idGen) observe(id int) error {
+	if gen.strategy != IDMonotonic {
+		return nil
+	}
+	gen.lock.Lock()
+	defer gen.lock.Unlock()
+	if id < gen.next {
+		return nil
+	}
+	gen.next = id + 1
+	if partNum := id % len(gen.marks); gen.next > gen.marks[partNum] {
+		if err := writeIDSeq(gen.dir, partNum, gen.next); err != nil {
+			return err
+		}
+		gen.marks[partNum] = gen.next
+	}
+	return nil
+}
+
+// Return the lowest ID that has not been handed out, all monotonic IDs issued so far are below it.
+func (gen *idGen) highWaterMark() int {
+	gen.lock.Lock()
+	defer gen.lock.Unlock()
+	return gen.next
+}
+
+// Record in the partition's sequence file that all of its monotonic IDs are below the mark.
+func writeIDSeq(colDir string, partNum, mark int) error {
+	return ioutil.WriteFile(path.Join(colDir, ID_SEQ_FILE+strconv.Itoa(partNum)), []byte(strconv.Itoa(mark)), 0600)
+}
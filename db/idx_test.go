@@ -1,6 +1,7 @@
 package db
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -66,3 +67,117 @@ func TestIdxCRUD(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestIndexHash(t *testing.T) {
+	hash, err := NewIndexHash(HashFNV1a64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewIndexHash("doesNotExist"); err == nil {
+		t.Fatal("did not error")
+	}
+	if hash.Key(1) == hash.Key("1") || hash.Key(true) == hash.Key("true") || hash.Key(1) != hash.Key(float64(1)) {
+		t.Fatal("typed hash does not tell apart JSON types")
+	}
+	if hash.Key(map[string]interface{}{"a": 1, "b": 2}) != hash.Key(map[string]interface{}{"b": 2, "a": 1}) || hash.Key(1) < 0 {
+		t.Fatal("inconsistent hash")
+	}
+	// Integers that float64 cannot represent keep their digits
+	if hash.Key(int64(1<<53)) != hash.Key(float64(1<<53)) || hash.Key(uint64(1<<63)) != hash.Key(float64(1<<63)) ||
+		hash.Key(json.Number("9007199254740992")) != hash.Key(float64(1<<53)) {
+		t.Fatal("integers hash differently from float64")
+	} else if hash.Key(int64(1<<53+1)) == hash.Key(int64(1<<53)) || hash.Key(uint64(1<<64-1)) == hash.Key(uint64(1<<64-2)) ||
+		hash.Key(json.Number("9007199254740993")) == hash.Key(float64(1<<53)) {
+		t.Fatal("integers are rounded")
+	}
+	legacy, _ := NewIndexHash(HashSdbm)
+	if legacy.Key(1) != legacy.Key("1") || legacy.Key(1) != StrHash("1") {
+		t.Fatal("legacy hash should remain the same")
+	}
+}
+
+func TestMigrateIndexes(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.IndexWithHash([]string{"a"}, "doesNotExist"); err == nil {
+		t.Fatal("did not error")
+	}
+	if err = col.IndexWithHash([]string{"a"}, HashSdbm); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.Index([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, val := range []interface{}{1, "1", true, "true", "x"} {
+		if _, err := col.Insert(map[string]interface{}{"a": val, "b": val}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Both hash functions keep loose equality of lookup
+	lookup := func(path string, val interface{}) int {
+		result := make(map[int]struct{})
+		if err := Lookup(val, map[string]interface{}{"in": []interface{}{path}}, col, &result); err != nil {
+			t.Fatal(err)
+		}
+		return len(result)
+	}
+	for _, path := range []string{"a", "b"} {
+		if lookup(path, 1) != 2 || lookup(path, "true") != 2 || lookup(path, "x") != 1 || lookup(path, "y") != 0 {
+			t.Fatal("wrong lookup result on", path)
+		}
+	}
+	// Rebuild the legacy index
+	migrated, err := col.MigrateIndexes()
+	if err != nil || len(migrated) != 1 || migrated[0][0] != "a" {
+		t.Fatal(migrated, err)
+	}
+	if hash, err := col.IndexHash([]string{"a"}); err != nil || !hash.IsCurrent() {
+		t.Fatal(hash, err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("col")
+	if hash, err := col.IndexHash([]string{"a"}); err != nil || !hash.IsCurrent() {
+		t.Fatal(hash, err)
+	}
+	if lookup("a", 1) != 2 || lookup("a", "x") != 1 {
+		t.Fatal("wrong lookup result after migration")
+	}
+	// Reindex using a different function
+	if err = col.Reindex([]string{"b"}, HashSdbm); err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := col.IndexHash([]string{"b"}); hash.Func != HashSdbm || lookup("b", 1) != 2 {
+		t.Fatal(hash)
+	}
+	if err = col.Reindex([]string{"c"}, HashSdbm); err == nil {
+		t.Fatal("did not error")
+	}
+	if err = db.MigrateIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := col.IndexHash([]string{"b"}); !hash.IsCurrent() {
+		t.Fatal(hash)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,176 @@
+// Hash functions that turn indexed values into hash table keys.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+)
+
+const (
+	INDEX_HASH_FILE = "hash.json" // Name of the file in index directory that recorded index hash function before collection metadata file.
+
+	HashSdbm    = "sdbm"    // sdbm over the string representation of a value, it does not tell apart values of different types.
+	HashFNV1a64 = "fnv1a64" // FNV-1a 64-bit over the JSON type and canonical representation of a value.
+
+	DefaultIndexHash = HashFNV1a64 // Hash function of newly created indexes.
+)
+
+// Current version of each hash function. The version changes whenever the hashed representation of values changes.
+var indexHashVersions = map[string]int{
+	HashSdbm:    1,
+	HashFNV1a64: 1,
+}
+
+// IndexHash identifies the hash function (and its version) of an index, and the collation of indexed strings.
+type IndexHash struct {
+	Func      string
+	Version   int
+	Collation string `json:",omitempty"`
+}
+
+// Return the current version of the named hash function.
+func NewIndexHash(hashFunc string) (hash IndexHash, err error) {
+	version, exists := indexHashVersions[hashFunc]
+	if !exists {
+		return hash, fmt.Errorf("Index hash function %s is not supported", hashFunc)
+	}
+	return IndexHash{Func: hashFunc, Version: version}, nil
+}
+
+// Return true if the index hash is the current version of the default hash function.
+func (hash IndexHash) IsCurrent() bool {
+	return hash.Func == DefaultIndexHash && hash.Version == indexHashVersions[DefaultIndexHash]
+}
+
+// Return true if values of different JSON types, or values that share a string representation, hash differently.
+func (hash IndexHash) typed() bool {
+	return hash.Func == HashFNV1a64
+}
+
+// Return the hash key of an indexed value.
+func (hash IndexHash) Key(val interface{}) int {
+	if !hash.typed() {
+		return StrHash(fmt.Sprint(val))
+	}
+	h := fnv.New64a()
+	h.Write(typedRepr(collateValue(hash.Collation, val)))
+	return int(h.Sum64() & uint64(^uint(0)>>1))
+}
+
+// Return the hash keys of all indexed values that may loosely equal (by their string representation) the lookup value.
+func (hash IndexHash) lookupKeys(val interface{}) (keys []int) {
+	if !hash.typed() {
+		return []int{hash.Key(val)}
+	}
+	str := fmt.Sprint(val)
+	candidates := []interface{}{val, str}
+	if num, err := strconv.ParseFloat(str, 64); err == nil && fmt.Sprint(num) == str {
+		candidates = append(candidates, num)
+	}
+	if boolean, err := strconv.ParseBool(str); err == nil && fmt.Sprint(boolean) == str {
+		candidates = append(candidates, boolean)
+	}
+	seen := make(map[int]struct{})
+	for _, candidate := range candidates {
+		key := hash.Key(candidate)
+		if _, dup := seen[key]; !dup {
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+// Return the JSON type tag and canonical representation of a value. Numbers of all Go types are represented alike.
+func typedRepr(val interface{}) []byte {
+	var num float64
+	switch v := val.(type) {
+	case string:
+		return append([]byte{'s'}, v...)
+	case bool:
+		return strconv.AppendBool([]byte{'b'}, v)
+	case float64:
+		num = v
+	case float32:
+		num = float64(v)
+	case int:
+		return intRepr(int64(v))
+	case int8:
+		num = float64(v)
+	case int16:
+		num = float64(v)
+	case int32:
+		num = float64(v)
+	case int64:
+		return intRepr(v)
+	case uint:
+		return uintRepr(uint64(v))
+	case uint8:
+		num = float64(v)
+	case uint16:
+		num = float64(v)
+	case uint32:
+		num = float64(v)
+	case uint64:
+		return uintRepr(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return intRepr(i)
+		} else if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return uintRepr(u)
+		}
+		var err error
+		if num, err = v.Float64(); err != nil {
+			return append([]byte{'s'}, v...)
+		}
+	default:
+		// Objects and arrays - map keys are sorted by the encoder
+		if js, err := json.Marshal(v); err == nil {
+			return append([]byte{'o'}, js...)
+		}
+		return append([]byte{'x'}, fmt.Sprint(v)...)
+	}
+	return strconv.AppendFloat([]byte{'n'}, num, 'g', -1, 64)
+}
+
+// Return the canonical representation of an integer. An integer that float64 represents exactly is represented like
+// the float64, the others keep all of their digits instead of being rounded.
+func intRepr(i int64) []byte {
+	if num := float64(i); num >= -(1<<63) && num < 1<<63 && int64(num) == i {
+		return strconv.AppendFloat([]byte{'n'}, num, 'g', -1, 64)
+	}
+	return strconv.AppendInt([]byte{'n'}, i, 10)
+}
+
+// Return the canonical representation of an unsigned integer, see intRepr.
+func uintRepr(u uint64) []byte {
+	if num := float64(u); num < 1<<64 && uint64(num) == u {
+		return strconv.AppendFloat([]byte{'n'}, num, 'g', -1, 64)
+	}
+	return strconv.AppendUint([]byte{'n'}, u, 10)
+}
+
+// Read the hash function of an index from the file of an older version of tiedot. Indexes created by even older
+// versions do not have the file, they use sdbm.
+func readIndexHash(idxDir string) (hash IndexHash, err error) {
+	content, err := ioutil.ReadFile(path.Join(idxDir, INDEX_HASH_FILE))
+	if os.IsNotExist(err) {
+		return IndexHash{Func: HashSdbm, Version: indexHashVersions[HashSdbm]}, nil
+	} else if err != nil {
+		return
+	} else if err = json.Unmarshal(content, &hash); err != nil {
+		return
+	}
+	if version, supported := indexHashVersions[hash.Func]; !supported || hash.Version > version {
+		return hash, fmt.Errorf("Index %s uses hash function %s version %d, which is not supported by this version of tiedot", idxDir, hash.Func, hash.Version)
+	} else if _, err = parseCollation(hash.Collation); err != nil {
+		return
+	}
+	return
+}
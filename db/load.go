@@ -0,0 +1,233 @@
+// Bulk-load session that builds indexes after data import.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const LOAD_MARKER_FILE = "loading" // Name of the file in collection directory that exists during a bulk load.
+
+// LoadSession imports documents into a collection without maintaining its indexes, which are rebuilt upon commit.
+// Documents written by the session go straight into collection partitions; they are validated, and hooks run on
+// them, but they are not recorded in change log.
+type LoadSession struct {
+	col *Col
+}
+
+// Begin a bulk load. Until the load is committed, documents written to the collection (by the session or otherwise)
+// are not indexed, and queries on the collection fail with dberr.ErrorLoading.
+// Should the program exit before the commit, the indexes are rebuilt when the collection is opened again.
+// Change log records the beginning of the load, incremental backups cannot be taken across it.
+func (col *Col) BeginLoad() (*LoadSession, error) {
+	col.db.lockSchema()
+	defer col.db.unlockSchema()
+	if col.loading {
+		return nil, fmt.Errorf("Collection %s is already being bulk loaded", col.name)
+	}
+	marker, err := os.Create(path.Join(col.db.path, col.name, LOAD_MARKER_FILE))
+	if err != nil {
+		return nil, err
+	} else if err = marker.Close(); err != nil {
+		return nil, err
+	}
+	col.loading = true
+	col.db.logChange(Change{Op: ChangeLoad, Col: col.name})
+	return &LoadSession{col: col}, nil
+}
+
+// Return an error unless the collection is still being bulk loaded. Caller must hold schema lock.
+func (load *LoadSession) check() error {
+	if !load.col.isOpen() || !load.col.loading {
+		return fmt.Errorf("Collection %s is not being bulk loaded", load.col.name)
+	}
+	return nil
+}
+
+// Insert a document without indexing it.
+func (load *LoadSession) Insert(doc map[string]interface{}) (id int, err error) {
+	col := load.col
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return
+	}
+	col.db.schemaLock.RLock()
+	if err = load.check(); err == nil {
+		for {
+			// Pick another ID in case of collision with a caller-supplied ID
+			if id, err = col.ids.nextID(); err != nil {
+				break
+			} else if err = load.insert(id, doc, docJS); dberr.Type(err) != dberr.ErrorDocExists {
+				break
+			}
+		}
+	}
+	col.db.schemaLock.RUnlock()
+	if err == nil {
+		col.runPostHooks(ChangeInsert, id, nil, doc)
+		col.evict()
+	}
+	return
+}
+
+// Insert a document under the caller-supplied ID without indexing it.
+func (load *LoadSession) InsertWithID(id int, doc map[string]interface{}) error {
+	col := load.col
+	if id < 0 {
+		return dberr.New(dberr.ErrorBadDocID, id)
+	}
+	docJS, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	col.db.schemaLock.RLock()
+	if err = load.check(); err == nil {
+		err = load.insert(id, doc, docJS)
+	}
+	col.db.schemaLock.RUnlock()
+	if err == nil {
+		col.runPostHooks(ChangeInsert, id, nil, doc)
+		col.evict()
+	}
+	return err
+}
+
+// Put a document into its partition unless a document already exists under the ID. Caller must hold schema lock.
+func (load *LoadSession) insert(id int, doc map[string]interface{}, docJS []byte) (err error) {
+	col := load.col
+	part := col.parts[id%col.db.numParts]
+	part.DataLock.Lock()
+	defer part.DataLock.Unlock()
+	if part.Exists(id) {
+		return dberr.New(dberr.ErrorDocExists, id)
+	} else if docJS, err = col.runPreHooks(ChangeInsert, id, nil, doc, docJS); err != nil {
+		return
+	} else if _, err = part.Insert(id, docJS); err == nil {
+		col.trackDocChange(ChangeInsert, id, docJS)
+	}
+	return
+}
+
+// Update or delete a document in its partition, return the original document. Caller must hold schema lock.
+func (load *LoadSession) change(op string, id int, doc map[string]interface{}, docJS []byte) (original map[string]interface{}, err error) {
+	col := load.col
+	part := col.parts[id%col.db.numParts]
+	part.DataLock.Lock()
+	defer part.DataLock.Unlock()
+	originalB, err := part.Read(id)
+	if err != nil {
+		return
+	}
+	json.Unmarshal(originalB, &original)
+	if docJS, err = col.runPreHooks(op, id, original, doc, docJS); err != nil {
+		return
+	} else if op == ChangeUpdate {
+		err = part.Update(id, docJS)
+	} else {
+		err = part.Delete(id)
+	}
+	if err == nil {
+		col.trackDocChange(op, id, docJS)
+	}
+	return
+}
+
+// Carry out insert, update and delete operations (see Col.Bulk) without index maintenance.
+func (load *LoadSession) Bulk(ops []BulkOp) (results []BulkResult) {
+	col := load.col
+	results = make([]BulkResult, len(ops))
+	originals := make([]map[string]interface{}, len(ops))
+	col.db.schemaLock.RLock()
+	checkErr := load.check()
+	for i, op := range ops {
+		var docJS []byte
+		err := checkErr
+		if err == nil {
+			switch op.Op {
+			case BulkInsert, BulkUpdate:
+				if op.Doc == nil {
+					err = fmt.Errorf("Operation %s requires a document", op.Op)
+				} else {
+					docJS, err = json.Marshal(op.Doc)
+				}
+			case BulkDelete:
+			default:
+				err = fmt.Errorf("Operation %s is not supported", op.Op)
+			}
+		}
+		if err == nil && op.Op == BulkInsert {
+			for {
+				if op.ID, err = col.ids.nextID(); err != nil {
+					break
+				} else if err = load.insert(op.ID, op.Doc, docJS); dberr.Type(err) != dberr.ErrorDocExists {
+					break
+				}
+			}
+		} else if err == nil && op.ID < 0 {
+			err = dberr.New(dberr.ErrorBadDocID, op.ID)
+		} else if err == nil {
+			originals[i], err = load.change(op.Op, op.ID, op.Doc, docJS)
+		}
+		results[i].ID = op.ID
+		if err != nil {
+			results[i].Error = err.Error()
+		}
+	}
+	col.db.schemaLock.RUnlock()
+	for i, op := range ops {
+		if results[i].Error != "" {
+			continue
+		} else if op.Op == BulkDelete {
+			col.runPostHooks(ChangeDelete, results[i].ID, originals[i], nil)
+		} else {
+			col.runPostHooks(op.Op, results[i].ID, originals[i], op.Doc)
+		}
+	}
+	col.evict()
+	return
+}
+
+// Finish the bulk load by rebuilding all indexes in parallel, then allow queries on the collection again.
+func (load *LoadSession) Commit() error {
+	col := load.col
+	col.db.lockSchema()
+	defer col.db.unlockSchema()
+	if err := load.check(); err != nil {
+		return err
+	} else if err = col.rebuildIndexes(); err != nil {
+		return err
+	} else if err = os.Remove(path.Join(col.db.path, col.name, LOAD_MARKER_FILE)); err != nil {
+		return err
+	}
+	col.loading = false
+	return nil
+}
+
+// Clear and rebuild all indexes in parallel. Caller must hold schema lock exclusively.
+func (col *Col) rebuildIndexes() error {
+	for idxName := range col.indexPaths {
+		for i := 0; i < col.db.numParts; i++ {
+			if err := col.hts[i][idxName].Clear(); err != nil {
+				return err
+			}
+		}
+	}
+	wg := new(sync.WaitGroup)
+	for idxName := range col.indexPaths {
+		wg.Add(1)
+		go func(idxName string) {
+			col.fillIndex(idxName)
+			wg.Done()
+		}(idxName)
+	}
+	wg.Wait()
+	tdlog.Infof("Collection %s: rebuilt %d indexes", col.name, len(col.indexPaths))
+	return nil
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestLoadSession(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Index([]string{"b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := col.Insert(map[string]interface{}{"a": -1})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = db.EnableChangeLog(); err != nil {
+		t.Fatal(err)
+	} else if err = db.Backup(TEST_DATA_DIR+"/bak", nil); err != nil {
+		t.Fatal(err)
+	}
+	_, lastSeq := db.log.seqRange()
+	load, err := col.BeginLoad()
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = col.BeginLoad(); err == nil {
+		t.Fatal("did not error")
+	}
+	ids := make([]int, 100)
+	for i := range ids {
+		if ids[i], err = load.Insert(map[string]interface{}{"a": i, "b": map[string]interface{}{"c": i * 2}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted, err := load.Insert(map[string]interface{}{"a": 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := load.Bulk([]BulkOp{
+		{Op: BulkInsert, Doc: map[string]interface{}{"a": 3000}},
+		{Op: BulkUpdate, ID: ids[0], Doc: map[string]interface{}{"a": 0, "b": map[string]interface{}{"c": 0}}},
+		{Op: BulkDelete, ID: deleted},
+		{Op: BulkDelete, ID: deleted},
+		{Op: "doesNotExist"},
+	})
+	if results[0].Error != "" || results[1].Error != "" || results[2].Error != "" || results[3].Error == "" || results[4].Error == "" {
+		t.Fatal(results)
+	} else if err = load.InsertWithID(ids[0], map[string]interface{}{}); dberr.Type(err) != dberr.ErrorDocExists {
+		t.Fatal(err)
+	}
+	// Change log only records the beginning of the load, incremental backup cannot be taken across it
+	if _, seq := db.log.seqRange(); seq != lastSeq+1 {
+		t.Fatal(lastSeq, seq)
+	} else if _, err = db.IncrementalBackup(TEST_DATA_DIR+"/bak", TEST_DATA_DIR+"/inc"); err == nil {
+		t.Fatal("did not error")
+	}
+	// Documents are written but not indexed, and queries are refused
+	if err = idxHasNot(col, []string{"a"}, 1, ids[1]); err != nil {
+		t.Fatal(err)
+	} else if doc, err := col.Read(ids[1]); err != nil || doc["a"].(float64) != 1 {
+		t.Fatal(doc, err)
+	}
+	if _, err = runQuery(`{"eq": 1, "in": ["a"]}`, col); dberr.Type(err) != dberr.ErrorLoading {
+		t.Fatal(err)
+	}
+	// Documents updated during the load are indexed by their latest content
+	if err = col.Update(before, map[string]interface{}{"a": 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if err = load.Commit(); err != nil {
+		t.Fatal(err)
+	} else if err = load.Commit(); err == nil {
+		t.Fatal("did not error")
+	} else if _, err = load.Insert(map[string]interface{}{}); err == nil {
+		t.Fatal("did not error")
+	}
+	if q, err := runQuery(`{"eq": 3000, "in": ["a"]}`, col); err != nil || len(q) != 1 || !ensureMapHasKeys(q, results[0].ID) {
+		t.Fatal(q, err)
+	} else if q, err = runQuery(`{"eq": 5000, "in": ["a"]}`, col); err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	}
+	for i, id := range ids {
+		if err = idxHas(col, []string{"a"}, i, id); err != nil {
+			t.Fatal(err)
+		} else if err = idxHas(col, []string{"b", "c"}, i*2, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q, err := runQuery(`{"eq": 1000, "in": ["a"]}`, col); err != nil || len(q) != 1 || !ensureMapHasKeys(q, before) {
+		t.Fatal(q, err)
+	} else if q, err = runQuery(`{"eq": -1, "in": ["a"]}`, col); err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	}
+	// Indexes are rebuilt upon reopening if the load was not committed
+	if load, err = col.BeginLoad(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := load.Insert(map[string]interface{}{"a": 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if q, err := runQuery(`{"eq": 2000, "in": ["a"]}`, db.Use("col")); err != nil || !ensureMapHasKeys(q, id) {
+		t.Fatal(q, err)
+	}
+}
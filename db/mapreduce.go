@@ -0,0 +1,207 @@
+// Map-reduce computation using registered Go functions.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// MapFunc is called on every document that matches a map-reduce query, it may emit any number of key-value pairs.
+type MapFunc func(id int, doc map[string]interface{}, emit func(key string, val interface{}))
+
+// ReduceFunc folds all values emitted under the same key into a single value.
+type ReduceFunc func(key string, vals []interface{}) (interface{}, error)
+
+var (
+	mapFuncs    = make(map[string]MapFunc)
+	reduceFuncs = map[string]ReduceFunc{
+		"count": reduceCount,
+		"sum":   reduceSum,
+	}
+	mapReduceLock = new(sync.RWMutex) // guard against concurrent (un)registration of map/reduce functions
+)
+
+// Built-in reduce function "count" - count the number of emitted values.
+func reduceCount(_ string, vals []interface{}) (interface{}, error) {
+	return len(vals), nil
+}
+
+// Built-in reduce function "sum" - add up emitted numbers.
+func reduceSum(key string, vals []interface{}) (interface{}, error) {
+	var sum float64
+	for _, val := range vals {
+		switch num := val.(type) {
+		case float64:
+			sum += num
+		case int:
+			sum += float64(num)
+		default:
+			return nil, fmt.Errorf("Reduce sum: key %s has a non-numeric value %v", key, val)
+		}
+	}
+	return sum, nil
+}
+
+// Register a map function under the name, replacing any function previously registered under the same name.
+func RegisterMap(name string, fun MapFunc) {
+	mapReduceLock.Lock()
+	mapFuncs[name] = fun
+	mapReduceLock.Unlock()
+}
+
+// Register a reduce function under the name, replacing any function previously registered under the same name.
+func RegisterReduce(name string, fun ReduceFunc) {
+	mapReduceLock.Lock()
+	reduceFuncs[name] = fun
+	mapReduceLock.Unlock()
+}
+
+// Remove a registered map function.
+func UnregisterMap(name string) {
+	mapReduceLock.Lock()
+	delete(mapFuncs, name)
+	mapReduceLock.Unlock()
+}
+
+// Remove a registered reduce function.
+func UnregisterReduce(name string) {
+	mapReduceLock.Lock()
+	delete(reduceFuncs, name)
+	mapReduceLock.Unlock()
+}
+
+// Look up map and reduce functions by their registered names.
+func lookupMapReduce(mapName, reduceName string) (mapFun MapFunc, reduceFun ReduceFunc, err error) {
+	mapReduceLock.RLock()
+	defer mapReduceLock.RUnlock()
+	var exists bool
+	if mapFun, exists = mapFuncs[mapName]; !exists {
+		return nil, nil, fmt.Errorf("Map function %s is not registered", mapName)
+	} else if reduceFun, exists = reduceFuncs[reduceName]; !exists {
+		return nil, nil, fmt.Errorf("Reduce function %s is not registered", reduceName)
+	}
+	return
+}
+
+// Run the map function on a document, return the panic of map function as an error.
+func callMap(mapName string, mapFun MapFunc, id int, doc map[string]interface{}, emit func(key string, val interface{})) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Map function %s panicked on document %d - %v", mapName, id, r)
+		}
+	}()
+	mapFun(id, doc, emit)
+	return
+}
+
+// Run the reduce function on the values of a key, return the panic of reduce function as an error.
+func callReduce(reduceName string, reduceFun ReduceFunc, key string, vals []interface{}) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Reduce function %s panicked on key %s - %v", reduceName, key, r)
+		}
+	}()
+	return reduceFun(key, vals)
+}
+
+// Run the map function on documents matching the query, and reduce the emitted values of each key.
+// Documents of each partition are mapped in parallel.
+// A panic of map or reduce function is returned as an error.
+func (col *Col) MapReduce(query interface{}, mapName, reduceName string) (result map[string]interface{}, err error) {
+	mapFun, reduceFun, err := lookupMapReduce(mapName, reduceName)
+	if err != nil {
+		return
+	}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	// Evaluate query and group result document IDs by partition
+	queryResult := make(map[int]struct{})
+	if err = evalQuery(query, col, &queryResult, false); err != nil {
+		return
+	}
+	partIDs := make([][]int, col.db.numParts)
+	for id := range queryResult {
+		partNum := id % col.db.numParts
+		partIDs[partNum] = append(partIDs[partNum], id)
+	}
+	// Map documents of each partition in its own goroutine
+	emitted := make([]map[string][]interface{}, col.db.numParts)
+	mapErrs := make([]error, col.db.numParts)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < col.db.numParts; i++ {
+		wg.Add(1)
+		go func(partNum int) {
+			defer wg.Done()
+			partResult := make(map[string][]interface{})
+			emit := func(key string, val interface{}) {
+				partResult[key] = append(partResult[key], val)
+			}
+			part := col.parts[partNum]
+			for _, id := range partIDs[partNum] {
+				part.DataLock.RLock()
+				docB, err := part.Read(id)
+				part.DataLock.RUnlock()
+				if err != nil {
+					// The document may have been deleted after query evaluation
+					continue
+				}
+				var doc map[string]interface{}
+				if err := json.Unmarshal(docB, &doc); err != nil {
+					continue
+				}
+				if mapErrs[partNum] = callMap(mapName, mapFun, id, doc, emit); mapErrs[partNum] != nil {
+					return
+				}
+			}
+			emitted[partNum] = partResult
+		}(i)
+	}
+	wg.Wait()
+	for _, mapErr := range mapErrs {
+		if mapErr != nil {
+			return nil, mapErr
+		}
+	}
+	// Combine emitted values across partitions and reduce them
+	combined := make(map[string][]interface{})
+	for _, partResult := range emitted {
+		for key, vals := range partResult {
+			combined[key] = append(combined[key], vals...)
+		}
+	}
+	result = make(map[string]interface{}, len(combined))
+	for key, vals := range combined {
+		if result[key], err = callReduce(reduceName, reduceFun, key, vals); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Run map-reduce (see MapReduce) and insert each reduced key-value pair as a document {"key": key, "value": value}
+// into the target collection, which is created if it does not yet exist. Return the reduced result.
+func (col *Col) MapReduceInto(query interface{}, mapName, reduceName, target string) (result map[string]interface{}, err error) {
+	if target == col.name {
+		return nil, fmt.Errorf("Map-reduce output collection %s may not be the input collection", target)
+	}
+	if result, err = col.MapReduce(query, mapName, reduceName); err != nil {
+		return
+	}
+	if !col.db.ColExists(target) {
+		if err = col.db.Create(target); err != nil {
+			return
+		}
+	}
+	targetCol := col.db.Use(target)
+	if targetCol == nil {
+		return nil, fmt.Errorf("Collection %s does not exist", target)
+	}
+	for key, val := range result {
+		if _, err = targetCol.Insert(map[string]interface{}{"key": key, "value": val}); err != nil {
+			return
+		}
+	}
+	return
+}
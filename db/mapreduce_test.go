@@ -0,0 +1,107 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMapReduce(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"shop"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		if _, err := col.Insert(map[string]interface{}{"shop": fmt.Sprint(i % 3), "amount": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	RegisterMap("amountByShop", func(id int, doc map[string]interface{}, emit func(string, interface{})) {
+		emit(doc["shop"].(string), doc["amount"])
+	})
+	defer UnregisterMap("amountByShop")
+	// Unregistered functions
+	if _, err := col.MapReduce("all", "doesNotExist", "sum"); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := col.MapReduce("all", "amountByShop", "doesNotExist"); err == nil {
+		t.Fatal("did not error")
+	}
+	// Built-in reducers over all documents
+	sums, err := col.MapReduce("all", "amountByShop", "sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sums) != 3 || sums["0"].(float64) != 135 || sums["1"].(float64) != 145 || sums["2"].(float64) != 155 {
+		t.Fatal(sums)
+	}
+	counts, err := col.MapReduce("all", "amountByShop", "count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 3 || counts["0"].(int) != 10 {
+		t.Fatal(counts)
+	}
+	// Custom reducer over query result
+	RegisterReduce("max", func(key string, vals []interface{}) (interface{}, error) {
+		max := 0.0
+		for _, val := range vals {
+			if val.(float64) > max {
+				max = val.(float64)
+			}
+		}
+		return max, nil
+	})
+	defer UnregisterReduce("max")
+	maxes, err := col.MapReduce(map[string]interface{}{"eq": "1", "in": []interface{}{"shop"}}, "amountByShop", "max")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(maxes) != 1 || maxes["1"].(float64) != 28 {
+		t.Fatal(maxes)
+	}
+	// Panic of map and reduce functions is an error
+	RegisterMap("panic", func(id int, doc map[string]interface{}, emit func(string, interface{})) {
+		emit(doc["doesNotExist"].(string), 1)
+	})
+	defer UnregisterMap("panic")
+	RegisterReduce("panic", func(key string, vals []interface{}) (interface{}, error) {
+		panic("reduce")
+	})
+	defer UnregisterReduce("panic")
+	if _, err := col.MapReduce("all", "panic", "sum"); err == nil || !strings.Contains(err.Error(), "panicked") {
+		t.Fatal(err)
+	} else if _, err := col.MapReduce("all", "amountByShop", "panic"); err == nil || !strings.Contains(err.Error(), "panicked") {
+		t.Fatal(err)
+	} else if _, err := col.MapReduceInto("all", "panic", "sum", "totals"); err == nil || db.ColExists("totals") {
+		t.Fatal(err)
+	}
+	// Write result into another collection
+	if _, err := col.MapReduceInto("all", "amountByShop", "sum", "col"); err == nil {
+		t.Fatal("did not error")
+	}
+	if result, err := col.MapReduceInto("all", "amountByShop", "sum", "totals"); err != nil || len(result) != 3 {
+		t.Fatal(result, err)
+	}
+	if q, err := runQuery(`"all"`, db.Use("totals")); err != nil || len(q) != 3 {
+		t.Fatal(q, err)
+	}
+}
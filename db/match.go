@@ -0,0 +1,170 @@
+// Evaluation of queries against a single document.
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+// Convert the query path into path segments.
+func matchPath(path interface{}) ([]string, error) {
+	vecPathInterface, ok := path.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expecting vector path, but %v given", path)
+	}
+	vecPath := make([]string, 0, len(vecPathInterface))
+	for _, v := range vecPathInterface {
+		vecPath = append(vecPath, fmt.Sprint(v))
+	}
+	return vecPath, nil
+}
+
+// Return the integer value of the query parameter.
+func matchInt(name string, val interface{}) (int, error) {
+	switch val := val.(type) {
+	case float64:
+		return int(val), nil
+	case int:
+		return val, nil
+	}
+	return 0, dberr.New(dberr.ErrorExpectingInt, name, val)
+}
+
+// Return true if the document would be in the result of the query, had it been in the collection. Unlike EvalQuery,
+// the query does not need indexes; lookups use the collation of index on their path unless the query specifies one.
+// Collection may be nil. Caller must hold schema lock.
+func (col *Col) matchDoc(q interface{}, id int, doc map[string]interface{}) (bool, error) {
+	switch expr := q.(type) {
+	case []interface{}: // [sub query 1, sub query 2, etc]
+		for _, subExpr := range expr {
+			if match, err := col.matchDoc(subExpr, id, doc); err != nil || match {
+				return match, err
+			}
+		}
+		return false, nil
+	case string:
+		if expr == "all" {
+			return true, nil
+		}
+		docID, err := strconv.ParseInt(expr, 10, 64)
+		if err != nil {
+			return false, dberr.New(dberr.ErrorExpectingInt, "Single Document ID", docID)
+		}
+		return int(docID) == id, nil
+	case map[string]interface{}:
+		if lookupValue, lookup := expr["eq"]; lookup { // eq - lookup
+			return col.matchLookup(lookupValue, expr, doc)
+		} else if hasPath, exist := expr["has"]; exist { // has - path existence test
+			vecPath, err := matchPath(hasPath)
+			if err != nil {
+				return false, err
+			}
+			for _, v := range GetIn(doc, vecPath) {
+				if v != nil {
+					return true, nil
+				}
+			}
+			return false, nil
+		} else if subExprs, intersect := expr["n"]; intersect { // n - intersection
+			subExprVecs, ok := subExprs.([]interface{})
+			if !ok {
+				return false, dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+			}
+			for _, subExpr := range subExprVecs {
+				if match, err := col.matchDoc(subExpr, id, doc); err != nil || !match {
+					return false, err
+				}
+			}
+			return len(subExprVecs) > 0, nil
+		} else if subExprs, complement := expr["c"]; complement { // c - complement, i.e. in an odd number of results
+			subExprVecs, ok := subExprs.([]interface{})
+			if !ok {
+				return false, dberr.New(dberr.ErrorExpectingSubQuery, subExprs)
+			}
+			odd := false
+			for _, subExpr := range subExprVecs {
+				match, err := col.matchDoc(subExpr, id, doc)
+				if err != nil {
+					return false, err
+				}
+				odd = odd != match
+			}
+			return odd, nil
+		} else if intFrom, htRange := expr["int-from"]; htRange { // int-from, int-to - integer range query
+			return matchIntRange(intFrom, expr, expr["int-to"], doc)
+		} else if intFrom, htRange := expr["int from"]; htRange { // "int from, "int to" - integer range query
+			return matchIntRange(intFrom, expr, expr["int to"], doc)
+		}
+		return false, errors.New(fmt.Sprintf("Query %v does not contain any operation (lookup/union/etc)", expr))
+	}
+	return false, nil
+}
+
+// Return true if the document has the lookup value in the path.
+func (col *Col) matchLookup(lookupValue interface{}, expr map[string]interface{}, doc map[string]interface{}) (bool, error) {
+	path, hasPath := expr["in"]
+	if !hasPath {
+		return false, errors.New("Missing lookup path `in`")
+	}
+	vecPath, err := matchPath(path)
+	if err != nil {
+		return false, err
+	}
+	equal := looseEqual
+	if strictMode, hasStrict := expr["strict"]; hasStrict {
+		if strict, ok := strictMode.(bool); !ok {
+			return false, fmt.Errorf("Expecting `strict` as a boolean, but %v given", strictMode)
+		} else if strict {
+			equal = strictEqual
+		}
+	}
+	collation := CollationBinary
+	if collationName, hasCollation := expr["collation"]; hasCollation {
+		if collation, err = parseCollation(fmt.Sprint(collationName)); err != nil {
+			return false, err
+		}
+	} else if col != nil {
+		collation = col.indexHash[indexName(vecPath)].Collation
+	}
+	for _, v := range GetIn(doc, vecPath) {
+		if v != nil && equal(collation, v, lookupValue) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Return true if the document has an integer within the range in the path.
+func matchIntRange(intFrom interface{}, expr map[string]interface{}, intTo interface{}, doc map[string]interface{}) (bool, error) {
+	path, hasPath := expr["in"]
+	if !hasPath {
+		return false, errors.New("Missing path `in`")
+	}
+	vecPath, err := matchPath(path)
+	if err != nil {
+		return false, err
+	}
+	from, err := matchInt("int-from", intFrom)
+	if err != nil {
+		return false, err
+	} else if intTo == nil {
+		return false, dberr.New(dberr.ErrorMissing, "int-to")
+	}
+	to, err := matchInt("int-to", intTo)
+	if err != nil {
+		return false, err
+	} else if from > to {
+		from, to = to, from
+	}
+	for _, v := range GetIn(doc, vecPath) {
+		if num, isNum := v.(float64); isNum && num == math.Trunc(num) && num >= float64(from) && num <= float64(to) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
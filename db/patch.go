@@ -0,0 +1,433 @@
+// Partial document updates: JSON merge patch (RFC 7386), JSON patch (RFC 6902) and update operators.
+
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+const (
+	PatchMerge     = "merge"     // JSON merge patch (RFC 7386) - an object of the values to replace, null removes a value.
+	PatchJSON      = "json"      // JSON patch (RFC 6902) - an array of add/remove/replace/move/copy/test operations.
+	PatchOperators = "operators" // Update operators $set, $unset, $inc, $push and $pull, applied to dotted paths.
+)
+
+// Update operators in the order of application.
+var patchOperators = []string{"$set", "$unset", "$inc", "$push", "$pull"}
+
+var errPathNotFound = fmt.Errorf("path not found")
+
+// Apply a patch of the type (PatchMerge, PatchJSON or PatchOperators) to a document atomically.
+// If the patch cannot be applied, the returned error is of type dberr.ErrorPatch and the document is left untouched.
+func (col *Col) Patch(id int, patchType string, patch interface{}) error {
+	return col.UpdateFunc(id, func(doc map[string]interface{}) (map[string]interface{}, error) {
+		return ApplyPatch(doc, patchType, patch)
+	})
+}
+
+// Return a patched copy of the document, the document itself is not modified.
+func ApplyPatch(doc map[string]interface{}, patchType string, patch interface{}) (patched map[string]interface{}, err error) {
+	var result interface{}
+	switch patchType {
+	case PatchMerge:
+		result = mergePatch(doc, patch)
+	case PatchJSON:
+		ops, isArray := patch.([]interface{})
+		if !isArray {
+			return nil, dberr.New(dberr.ErrorPatch, fmt.Sprintf("JSON patch must be an array of operations, but %v given", patch))
+		}
+		result, err = jsonPatch(copyJSON(doc), ops)
+	case PatchOperators:
+		ops, isMap := patch.(map[string]interface{})
+		if !isMap {
+			return nil, dberr.New(dberr.ErrorPatch, fmt.Sprintf("update operators must be an object, but %v given", patch))
+		}
+		result, err = applyOperators(copyJSON(doc).(map[string]interface{}), ops)
+	default:
+		return nil, dberr.New(dberr.ErrorPatch, fmt.Sprintf("patch type %s is not supported", patchType))
+	}
+	if err != nil {
+		return nil, dberr.New(dberr.ErrorPatch, err.Error())
+	}
+	if patched, isMap := result.(map[string]interface{}); isMap {
+		return patched, nil
+	}
+	return nil, dberr.New(dberr.ErrorPatch, fmt.Sprintf("patched document %v is not a JSON object", result))
+}
+
+// Return a deep copy of a JSON value.
+func copyJSON(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			copied[key] = copyJSON(elem)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, elem := range v {
+			copied[i] = copyJSON(elem)
+		}
+		return copied
+	}
+	return val
+}
+
+// Return the target merged with the patch according to RFC 7386. The target is not modified.
+func mergePatch(target, patch interface{}) interface{} {
+	patchMap, isMap := patch.(map[string]interface{})
+	if !isMap {
+		return copyJSON(patch)
+	}
+	targetMap, isMap := target.(map[string]interface{})
+	if !isMap {
+		targetMap = map[string]interface{}{}
+	}
+	merged := make(map[string]interface{}, len(targetMap))
+	for key, val := range targetMap {
+		merged[key] = val
+	}
+	for key, val := range patchMap {
+		if val == nil {
+			delete(merged, key)
+		} else {
+			merged[key] = mergePatch(merged[key], val)
+		}
+	}
+	return merged
+}
+
+// Split a JSON pointer (RFC 6901) into reference tokens.
+func parsePointer(ptr interface{}) ([]string, error) {
+	str, isStr := ptr.(string)
+	if !isStr {
+		return nil, fmt.Errorf("JSON pointer must be a string, but %v given", ptr)
+	} else if str == "" {
+		return []string{}, nil
+	} else if !strings.HasPrefix(str, "/") {
+		return nil, fmt.Errorf("JSON pointer %s must start with /", str)
+	}
+	tokens := strings.Split(str[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// Return the array index referred to by the token. "-" refers to the position after the last element if allowed.
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > length || (i == length && !allowEnd) || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("array index %s is out of range", token)
+	}
+	return i, nil
+}
+
+// Walk down to the container of the last token, run the function on it, and return the updated node.
+// Missing objects along the path are created if asked to, otherwise the error is errPathNotFound.
+func patchAt(node interface{}, tokens []string, create bool, fun func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fun(node, tokens[0])
+	}
+	switch container := node.(type) {
+	case map[string]interface{}:
+		child, exists := container[tokens[0]]
+		if !exists {
+			if !create {
+				return node, errPathNotFound
+			}
+			child = map[string]interface{}{}
+		}
+		child, err := patchAt(child, tokens[1:], create, fun)
+		if err != nil {
+			return node, err
+		}
+		container[tokens[0]] = child
+		return container, nil
+	case []interface{}:
+		i, err := arrayIndex(tokens[0], len(container), false)
+		if err != nil {
+			return node, err
+		}
+		if container[i], err = patchAt(container[i], tokens[1:], create, fun); err != nil {
+			return node, err
+		}
+		return container, nil
+	}
+	return node, errPathNotFound
+}
+
+// Return the value referred to by the tokens.
+func valueAt(node interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch container := node.(type) {
+		case map[string]interface{}:
+			child, exists := container[token]
+			if !exists {
+				return nil, errPathNotFound
+			}
+			node = child
+		case []interface{}:
+			i, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			node = container[i]
+		default:
+			return nil, errPathNotFound
+		}
+	}
+	return node, nil
+}
+
+// Add the value to the location, return the updated document. An array element is inserted before the index.
+func pointerAdd(doc interface{}, tokens []string, val interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return val, nil
+	}
+	return patchAt(doc, tokens, false, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = val
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), true)
+			if err != nil {
+				return c, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = val
+			return c, nil
+		}
+		return container, errPathNotFound
+	})
+}
+
+// Remove the value from the location, return the updated document and the removed value.
+func pointerRemove(doc interface{}, tokens []string) (updated, removed interface{}, err error) {
+	if len(tokens) == 0 {
+		return doc, nil, fmt.Errorf("cannot remove the entire document")
+	}
+	updated, err = patchAt(doc, tokens, false, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			val, exists := c[token]
+			if !exists {
+				return c, errPathNotFound
+			}
+			removed = val
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return c, err
+			}
+			removed = c[i]
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return container, errPathNotFound
+	})
+	return
+}
+
+// Apply JSON patch operations one after another, return the updated document.
+func jsonPatch(doc interface{}, ops []interface{}) (interface{}, error) {
+	for _, opVal := range ops {
+		op, isMap := opVal.(map[string]interface{})
+		if !isMap {
+			return nil, fmt.Errorf("JSON patch operation must be an object, but %v given", opVal)
+		}
+		path, err := parsePointer(op["path"])
+		if err != nil {
+			return nil, err
+		}
+		value, hasValue := op["value"]
+		if !hasValue && (op["op"] == "add" || op["op"] == "replace" || op["op"] == "test") {
+			return nil, fmt.Errorf("operation %v is missing value", op)
+		}
+		var from []string
+		if op["op"] == "move" || op["op"] == "copy" {
+			if from, err = parsePointer(op["from"]); err != nil {
+				return nil, err
+			}
+		}
+		switch op["op"] {
+		case "add":
+			doc, err = pointerAdd(doc, path, copyJSON(value))
+		case "remove":
+			doc, _, err = pointerRemove(doc, path)
+		case "replace":
+			if len(path) > 0 {
+				doc, _, err = pointerRemove(doc, path)
+			}
+			if err == nil {
+				doc, err = pointerAdd(doc, path, copyJSON(value))
+			}
+		case "move":
+			if strings.HasPrefix(strings.Join(path, "/")+"/", strings.Join(from, "/")+"/") && len(path) > len(from) {
+				return nil, fmt.Errorf("cannot move %v into its own child %v", op["from"], op["path"])
+			}
+			var moved interface{}
+			if doc, moved, err = pointerRemove(doc, from); err == nil {
+				doc, err = pointerAdd(doc, path, moved)
+			}
+		case "copy":
+			var copied interface{}
+			if copied, err = valueAt(doc, from); err == nil {
+				doc, err = pointerAdd(doc, path, copyJSON(copied))
+			}
+		case "test":
+			var actual interface{}
+			if actual, err = valueAt(doc, path); err == nil && !strictEqual(CollationBinary, actual, value) {
+				err = fmt.Errorf("test failed, %v is %v instead of %v", op["path"], actual, value)
+			}
+		default:
+			return nil, fmt.Errorf("JSON patch operation %v is not supported", op["op"])
+		}
+		if err == errPathNotFound {
+			return nil, fmt.Errorf("operation %v refers to a location that does not exist", op)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// Return the numeric value of a number of any type.
+func jsonNumber(val interface{}) (float64, bool) {
+	repr := typedRepr(val)
+	if repr[0] != 'n' {
+		return 0, false
+	}
+	num, err := strconv.ParseFloat(string(repr[1:]), 64)
+	return num, err == nil
+}
+
+// Apply update operators (in the order of patchOperators) to the document, return the updated document.
+func applyOperators(doc map[string]interface{}, ops map[string]interface{}) (map[string]interface{}, error) {
+	for name := range ops {
+		supported := false
+		for _, op := range patchOperators {
+			supported = supported || name == op
+		}
+		if !supported {
+			return nil, fmt.Errorf("update operator %s is not supported", name)
+		}
+	}
+	for _, op := range patchOperators {
+		if ops[op] == nil {
+			continue
+		}
+		fields, isMap := ops[op].(map[string]interface{})
+		if !isMap {
+			return nil, fmt.Errorf("%s expects an object of paths and values, but %v given", op, ops[op])
+		}
+		for path, val := range fields {
+			tokens := strings.Split(path, ".")
+			var err error
+			switch op {
+			case "$set":
+				_, err = patchAt(doc, tokens, true, func(container interface{}, token string) (interface{}, error) {
+					return setField(container, token, copyJSON(val))
+				})
+			case "$unset":
+				_, err = patchAt(doc, tokens, false, func(container interface{}, token string) (interface{}, error) {
+					if c, isMap := container.(map[string]interface{}); isMap {
+						delete(c, token)
+						return c, nil
+					}
+					return setField(container, token, nil)
+				})
+				if err == errPathNotFound {
+					err = nil
+				}
+			case "$inc":
+				amount, isNum := jsonNumber(val)
+				if !isNum {
+					return nil, fmt.Errorf("$inc expects a number for %s, but %v given", path, val)
+				}
+				_, err = patchAt(doc, tokens, true, func(container interface{}, token string) (interface{}, error) {
+					current, err := valueAt(container, []string{token})
+					if err == errPathNotFound {
+						return setField(container, token, amount)
+					} else if err != nil {
+						return container, err
+					}
+					num, isNum := jsonNumber(current)
+					if !isNum {
+						return container, fmt.Errorf("$inc cannot increment %s, its value %v is not a number", path, current)
+					}
+					return setField(container, token, num+amount)
+				})
+			case "$push":
+				_, err = patchAt(doc, tokens, true, func(container interface{}, token string) (interface{}, error) {
+					current, err := valueAt(container, []string{token})
+					if err == errPathNotFound {
+						return setField(container, token, []interface{}{copyJSON(val)})
+					} else if err != nil {
+						return container, err
+					}
+					array, isArray := current.([]interface{})
+					if !isArray {
+						return container, fmt.Errorf("$push cannot append to %s, its value %v is not an array", path, current)
+					}
+					return setField(container, token, append(array, copyJSON(val)))
+				})
+			case "$pull":
+				_, err = patchAt(doc, tokens, false, func(container interface{}, token string) (interface{}, error) {
+					current, err := valueAt(container, []string{token})
+					if err != nil {
+						return container, err
+					}
+					array, isArray := current.([]interface{})
+					if !isArray {
+						return container, fmt.Errorf("$pull cannot remove from %s, its value %v is not an array", path, current)
+					}
+					kept := make([]interface{}, 0, len(array))
+					for _, elem := range array {
+						if !strictEqual(CollationBinary, elem, val) {
+							kept = append(kept, elem)
+						}
+					}
+					return setField(container, token, kept)
+				})
+				if err == errPathNotFound {
+					err = nil
+				}
+			}
+			if err == errPathNotFound {
+				return nil, fmt.Errorf("%s cannot reach %s", op, path)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
+
+// Set the value of an object member or an existing array element.
+func setField(container interface{}, token string, val interface{}) (interface{}, error) {
+	switch c := container.(type) {
+	case map[string]interface{}:
+		c[token] = val
+		return c, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(c), false)
+		if err != nil {
+			return c, err
+		}
+		c[i] = val
+		return c, nil
+	}
+	return container, errPathNotFound
+}
@@ -0,0 +1,155 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func patchTest(t *testing.T, patchType, docJS, patchJS, expectedJS string) {
+	var doc, expected map[string]interface{}
+	var patch interface{}
+	if err := json.Unmarshal([]byte(docJS), &doc); err != nil {
+		t.Fatal(err)
+	} else if err = json.Unmarshal([]byte(patchJS), &patch); err != nil {
+		t.Fatal(err)
+	}
+	patched, err := ApplyPatch(doc, patchType, patch)
+	if expectedJS == "" {
+		if dberr.Type(err) != dberr.ErrorPatch {
+			t.Fatalf("%s patch %s on %s should fail, but got %v %v", patchType, patchJS, docJS, patched, err)
+		}
+		return
+	} else if err != nil {
+		t.Fatalf("%s patch %s on %s: %v", patchType, patchJS, docJS, err)
+	}
+	if err := json.Unmarshal([]byte(expectedJS), &expected); err != nil {
+		t.Fatal(err)
+	}
+	if !strictEqual(CollationBinary, patched, expected) {
+		t.Fatalf("%s patch %s on %s: got %v, expecting %v", patchType, patchJS, docJS, patched, expected)
+	}
+	// The original document is not modified
+	var original map[string]interface{}
+	json.Unmarshal([]byte(docJS), &original)
+	if !strictEqual(CollationBinary, doc, original) {
+		t.Fatalf("%s patch %s modified the original document into %v", patchType, patchJS, doc)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	// Examples from RFC 7386
+	patchTest(t, PatchMerge, `{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`)
+	patchTest(t, PatchMerge, `{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`)
+	patchTest(t, PatchMerge, `{"a":"b"}`, `{"a":null}`, `{}`)
+	patchTest(t, PatchMerge, `{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`)
+	patchTest(t, PatchMerge, `{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`)
+	patchTest(t, PatchMerge, `{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`)
+	patchTest(t, PatchMerge, `{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`)
+	patchTest(t, PatchMerge, `{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`)
+	patchTest(t, PatchMerge, `{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`)
+	patchTest(t, PatchMerge, `{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`)
+	patchTest(t, PatchMerge, `{"a":"b"}`, `["c"]`, ``)
+}
+
+func TestJSONPatch(t *testing.T) {
+	// Examples from RFC 6902
+	patchTest(t, PatchJSON, `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`)
+	patchTest(t, PatchJSON, `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`)
+	patchTest(t, PatchJSON, `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`)
+	patchTest(t, PatchJSON, `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`)
+	patchTest(t, PatchJSON, `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`)
+	patchTest(t, PatchJSON, `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+		`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+		`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`)
+	patchTest(t, PatchJSON, `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`)
+	patchTest(t, PatchJSON, `{"baz":"qux","foo":["a",2,"c"]}`,
+		`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+		`{"baz":"qux","foo":["a",2,"c"]}`)
+	patchTest(t, PatchJSON, `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, ``)
+	patchTest(t, PatchJSON, `{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`)
+	patchTest(t, PatchJSON, `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, ``)
+	patchTest(t, PatchJSON, `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`)
+	patchTest(t, PatchJSON, `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10}]`, `{"/":9,"~1":10}`)
+	patchTest(t, PatchJSON, `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":"10"}]`, ``)
+	// Copy, and operations that fail
+	patchTest(t, PatchJSON, `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`)
+	patchTest(t, PatchJSON, `{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/c"}]`, ``)
+	patchTest(t, PatchJSON, `{"a":[1]}`, `[{"op":"remove","path":"/a/1"}]`, ``)
+	patchTest(t, PatchJSON, `{"a":1}`, `[{"op":"replace","path":"","value":[]}]`, ``)
+	patchTest(t, PatchJSON, `{"a":1}`, `[{"op":"replace","path":"","value":{"b":2}}]`, `{"b":2}`)
+	patchTest(t, PatchJSON, `{"a":1}`, `[{"op":"whatever","path":"/a"}]`, ``)
+	patchTest(t, PatchJSON, `{"a":1}`, `{"op":"remove","path":"/a"}`, ``)
+}
+
+func TestUpdateOperators(t *testing.T) {
+	patchTest(t, PatchOperators, `{"a":1}`, `{"$set":{"b.c":2,"a":3}}`, `{"a":3,"b":{"c":2}}`)
+	patchTest(t, PatchOperators, `{"a":[1,2]}`, `{"$set":{"a.1":3}}`, `{"a":[1,3]}`)
+	patchTest(t, PatchOperators, `{"a":1,"b":{"c":2}}`, `{"$unset":{"b.c":"","x.y":""}}`, `{"a":1,"b":{}}`)
+	patchTest(t, PatchOperators, `{"a":1}`, `{"$inc":{"a":2,"b":-1}}`, `{"a":3,"b":-1}`)
+	patchTest(t, PatchOperators, `{"a":"x"}`, `{"$inc":{"a":1}}`, ``)
+	patchTest(t, PatchOperators, `{"a":1}`, `{"$inc":{"a":"1"}}`, ``)
+	patchTest(t, PatchOperators, `{"a":[1]}`, `{"$push":{"a":{"b":2},"c":3}}`, `{"a":[1,{"b":2}],"c":[3]}`)
+	patchTest(t, PatchOperators, `{"a":1}`, `{"$push":{"a":2}}`, ``)
+	patchTest(t, PatchOperators, `{"a":[1,"1",2,1]}`, `{"$pull":{"a":1,"b":1}}`, `{"a":["1",2]}`)
+	patchTest(t, PatchOperators, `{"a":1}`, `{"$set":{"a":2},"$rename":{"a":"b"}}`, ``)
+	// Operators are applied in order of $set, $unset, $inc, $push, $pull
+	patchTest(t, PatchOperators, `{}`, `{"$inc":{"n":1},"$set":{"n":1},"$pull":{"l":1},"$push":{"l":1}}`, `{"n":2,"l":[]}`)
+}
+
+func TestColPatch(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"a": 1, "b": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = col.Patch(id, PatchMerge, map[string]interface{}{"a": 2}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Patch(id, PatchOperators, map[string]interface{}{"$inc": map[string]interface{}{"a": 1, "b": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if doc, rev, err := col.ReadRev(id); err != nil || doc["a"].(float64) != 3 || doc["b"].(float64) != 2 || rev != 3 {
+		t.Fatal(doc, rev, err)
+	}
+	if err = idxHas(col, []string{"a"}, 3, id); err != nil {
+		t.Fatal(err)
+	} else if err = idxHasNot(col, []string{"a"}, 1, id); err != nil {
+		t.Fatal(err)
+	}
+	// A failed patch leaves the document untouched
+	failing := []interface{}{
+		map[string]interface{}{"op": "replace", "path": "/a", "value": 4},
+		map[string]interface{}{"op": "test", "path": "/b", "value": 1},
+	}
+	if err = col.Patch(id, PatchJSON, failing); dberr.Type(err) != dberr.ErrorPatch {
+		t.Fatal(err)
+	}
+	if doc, rev, err := col.ReadRev(id); err != nil || doc["a"].(float64) != 3 || rev != 3 {
+		t.Fatal(doc, rev, err)
+	}
+	if err = col.Patch(id+1, PatchMerge, map[string]interface{}{"a": 2}); dberr.Type(err) != dberr.ErrorNoDoc {
+		t.Fatal(err)
+	}
+}
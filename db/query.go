@@ -3,6 +3,7 @@
 package db
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
@@ -57,23 +58,67 @@ func Lookup(lookupValue interface{}, expr map[string]interface{}, src *Col, resu
 			return dberr.New(dberr.ErrorExpectingInt, "limit", limit)
 		}
 	}
-	lookupStrValue := fmt.Sprint(lookupValue) // the value to look for
-	lookupValueHash := StrHash(lookupStrValue)
-	scanPath := strings.Join(vecPath, INDEX_PATH_SEP)
+	// Figure out equality semantics
+	strict := false
+	if strictMode, hasStrict := expr["strict"]; hasStrict {
+		var ok bool
+		if strict, ok = strictMode.(bool); !ok {
+			return fmt.Errorf("Expecting `strict` as a boolean, but %v given", strictMode)
+		}
+	}
+	scanPath := indexName(vecPath)
 	if _, indexed := src.indexPaths[scanPath]; !indexed {
 		return dberr.New(dberr.ErrorNeedIndex, scanPath, expr)
 	}
-	num := lookupValueHash % src.db.numParts
-	ht := src.hts[num][scanPath]
-	ht.Lock.RLock()
-	vals := ht.Get(lookupValueHash, intLimit)
-	ht.Lock.RUnlock()
-	for _, match := range vals {
-		// Filter result to avoid hash collision
-		if doc, err := src.read(match, false); err == nil {
-			for _, v := range GetIn(doc, vecPath) {
-				if fmt.Sprint(v) == lookupStrValue {
-					(*result)[match] = struct{}{}
+	hash := src.indexHash[scanPath]
+	collation := hash.Collation
+	if collationName, hasCollation := expr["collation"]; hasCollation {
+		if collation, err = parseCollation(fmt.Sprint(collationName)); err != nil {
+			return
+		}
+	}
+	equal := looseEqual
+	if strict {
+		equal = strictEqual
+	}
+	counter := 0
+	if collation != hash.Collation {
+		// The index does not help
+		tdlog.Noticef("Query %v uses a collation different from the index, it has to read every document", expr)
+		src.forEachDoc(func(id int, doc []byte) bool {
+			var docObj map[string]interface{}
+			if err := json.Unmarshal(doc, &docObj); err != nil {
+				return true
+			}
+			for _, v := range GetIn(docObj, vecPath) {
+				if v != nil && equal(collation, v, lookupValue) {
+					(*result)[id] = struct{}{}
+					counter++
+					break
+				}
+			}
+			return intLimit == 0 || counter < intLimit
+		}, false)
+		return
+	}
+	lookupValueHashes := hash.lookupKeys(lookupValue)
+	if strict {
+		lookupValueHashes = []int{hash.Key(lookupValue)}
+	}
+	for _, lookupValueHash := range lookupValueHashes {
+		vals := src.hashScan(scanPath, lookupValueHash, intLimit)
+		for _, match := range vals {
+			if intLimit > 0 && counter == intLimit {
+				return
+			}
+			// Filter result to avoid hash collision
+			if doc, err := src.read(match, false); err == nil {
+				for _, v := range GetIn(doc, vecPath) {
+					if equal(collation, v, lookupValue) {
+						(*result)[match] = struct{}{}
+						counter++
+						break
+					}
 				}
 			}
 		}
@@ -103,7 +148,7 @@ func PathExistence(hasPath interface{}, expr map[string]interface{}, src *Col, r
 			return dberr.New(dberr.ErrorExpectingInt, "limit", limit)
 		}
 	}
-	jointPath := strings.Join(vecPath, INDEX_PATH_SEP)
+	jointPath := indexName(vecPath)
 	if _, indexed := src.indexPaths[jointPath]; !indexed {
 		return dberr.New(dberr.ErrorNeedIndex, vecPath, expr)
 	}
@@ -267,8 +312,7 @@ func IntRange(intFrom interface{}, expr map[string]interface{}, src *Col, result
 	if from < to {
 		// Forward scan - from low value to high value
 		for lookupValue := from; lookupValue <= to; lookupValue++ {
-			lookupStrValue := fmt.Sprint(float64(lookupValue))
-			hashValue := StrHash(lookupStrValue)
+			hashValue := src.indexHash[htPath].Key(float64(lookupValue))
 			vals := src.hashScan(htPath, hashValue, int(intLimit))
 			for _, docID := range vals {
 				if intLimit > 0 && counter == intLimit {
@@ -281,8 +325,7 @@ func IntRange(intFrom interface{}, expr map[string]interface{}, src *Col, result
 	} else {
 		// Backward scan - from high value to low value
 		for lookupValue := from; lookupValue >= to; lookupValue-- {
-			lookupStrValue := fmt.Sprint(float64(lookupValue))
-			hashValue := StrHash(lookupStrValue)
+			hashValue := src.indexHash[htPath].Key(float64(lookupValue))
 			vals := src.hashScan(htPath, hashValue, int(intLimit))
 			for _, docID := range vals {
 				if intLimit > 0 && counter == intLimit {
@@ -301,6 +344,9 @@ func evalQuery(q interface{}, src *Col, result *map[int]struct{}, placeSchemaLoc
 		src.db.schemaLock.RLock()
 		defer src.db.schemaLock.RUnlock()
 	}
+	if src.loading {
+		return dberr.New(dberr.ErrorLoading, src.name)
+	}
 	switch expr := q.(type) {
 	case []interface{}: // [sub query 1, sub query 2, etc]
 		return EvalUnion(expr, src, result)
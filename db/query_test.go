@@ -352,3 +352,179 @@ func TestNameIntExpInNotFormat(t *testing.T) {
 		t.Error("Expected error")
 	}
 }
+
+func TestLookupStrictAndCollation(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	docs := []string{
+		`{"a": true, "b": true, "c": "Café"}`,
+		`{"a": "true", "b": "true", "c": "CAFÉ"}`,
+		`{"a": 1, "b": 1, "c": "cafe"}`,
+		`{"a": "1", "b": "1", "c": "café"}`,
+	}
+	ids := make([]int, len(docs))
+	for i, doc := range docs {
+		var jsonDoc map[string]interface{}
+		if err := json.Unmarshal([]byte(doc), &jsonDoc); err != nil {
+			t.Fatal(err)
+		}
+		if ids[i], err = col.Insert(jsonDoc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = col.Index([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.IndexWithHash([]string{"b"}, HashSdbm); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.IndexWithCollation([]string{"c"}, CollationNormalizeNoCase); err != nil {
+		t.Fatal(err)
+	}
+	if err = col.IndexWithCollation([]string{"d"}, "doesNotExist"); err == nil {
+		t.Fatal("did not error")
+	}
+	// Loose and strict equality on both typed and legacy index
+	for _, path := range []string{"a", "b"} {
+		expectations := []struct {
+			query string
+			ids   []int
+		}{
+			{`{"eq": "true", "in": ["%s"]}`, []int{ids[0], ids[1]}},
+			{`{"eq": "true", "in": ["%s"], "strict": true}`, []int{ids[1]}},
+			{`{"eq": true, "in": ["%s"], "strict": true}`, []int{ids[0]}},
+			{`{"eq": 1, "in": ["%s"], "strict": true}`, []int{ids[2]}},
+			{`{"eq": "1", "in": ["%s"], "strict": true}`, []int{ids[3]}},
+			{`{"eq": 1, "in": ["%s"], "strict": false}`, []int{ids[2], ids[3]}},
+		}
+		for _, expect := range expectations {
+			q, err := runQuery(fmt.Sprintf(expect.query, path), col)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ensureMapHasKeys(q, expect.ids...) {
+				t.Fatal(fmt.Sprintf(expect.query, path), q, expect.ids)
+			}
+		}
+	}
+	if _, err = runQuery(`{"eq": 1, "in": ["a"], "strict": "yes"}`, col); err == nil {
+		t.Fatal("did not error")
+	}
+	// Collated index
+	if q, err := runQuery(`{"eq": "CAFÉ", "in": ["c"], "strict": true}`, col); err != nil || !ensureMapHasKeys(q, ids[0], ids[1], ids[3]) {
+		t.Fatal(q, err)
+	}
+	// Collation that differs from the index
+	if q, err := runQuery(`{"eq": "café", "in": ["c"], "collation": "binary"}`, col); err != nil || !ensureMapHasKeys(q, ids[3]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"eq": "TRUE", "in": ["a"], "collation": "nocase", "strict": true}`, col); err != nil || !ensureMapHasKeys(q, ids[1]) {
+		t.Fatal(q, err)
+	}
+	if _, err = runQuery(`{"eq": "café", "in": ["c"], "collation": "doesNotExist"}`, col); err == nil {
+		t.Fatal("did not error")
+	}
+	// Documents found by a colliding hash key are not matched
+	hash, _ := col.IndexHash([]string{"a"})
+	collision := hash.Key("collision")
+	col.hts[collision%db.numParts]["a"].Put(collision, ids[0])
+	if q, err := runQuery(`{"eq": "collision", "in": ["a"]}`, col); err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	}
+	// Collation survives reopening and rebuilding
+	if err = col.Reindex([]string{"c"}, HashFNV1a64); err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := col.IndexHash([]string{"c"}); err != nil || hash.Collation != CollationNormalizeNoCase {
+		t.Fatal(hash, err)
+	}
+	if err = col.Reindex([]string{"c"}, HashSdbm); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestUpdateDeleteWhere(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("col"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("col")
+	if err = col.Index([]string{"year"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 0)
+	for _, doc := range []map[string]interface{}{
+		{"year": 2010, "n": 1}, {"year": 2011, "n": 2}, {"year": 2012, "n": "x"}, {"year": 2020, "n": 4},
+	} {
+		id, err := col.Insert(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	old := map[string]interface{}{"in": []interface{}{"year"}, "int-from": 2010, "int-to": 2015}
+	inc := map[string]interface{}{"$inc": map[string]interface{}{"n": 1}}
+	// Dry run does not change documents but reports the would-be outcome
+	result, err := col.UpdateWhere(old, PatchOperators, inc, true)
+	if err != nil || result.Matched != 3 || result.Changed != 2 || len(result.Errors) != 1 || result.Errors[ids[2]] == "" {
+		t.Fatal(result, err)
+	}
+	if doc, _ := col.Read(ids[0]); doc["n"].(float64) != 1 {
+		t.Fatal(doc)
+	}
+	// Update by query carries on after a document fails the patch
+	if result, err = col.UpdateWhere(old, PatchOperators, inc, false); err != nil || result.Matched != 3 || result.Changed != 2 || len(result.Errors) != 1 {
+		t.Fatal(result, err)
+	}
+	for i, expected := range []interface{}{2.0, 3.0, "x", 4.0} {
+		if doc, _ := col.Read(ids[i]); doc["n"] != expected {
+			t.Fatal(i, doc, expected)
+		}
+	}
+	if _, err = col.UpdateWhere(map[string]interface{}{"eq": 1, "in": []interface{}{"n"}}, PatchMerge, map[string]interface{}{}, false); dberr.Type(err) != dberr.ErrorNeedIndex {
+		t.Fatal(err)
+	}
+	// Delete by query
+	if result, err = col.DeleteWhere(old, true); err != nil || result.Matched != 3 || result.Changed != 3 {
+		t.Fatal(result, err)
+	}
+	if _, err = col.Read(ids[0]); err != nil {
+		t.Fatal("Dry run deleted documents", err)
+	}
+	if result, err = col.DeleteWhere(old, false); err != nil || result.Matched != 3 || result.Changed != 3 || len(result.Errors) != 0 {
+		t.Fatal(result, err)
+	}
+	if q, err := runQuery(`"all"`, col); err != nil || !ensureMapHasKeys(q, ids[3]) {
+		t.Fatal(q, err)
+	}
+	if q, err := runQuery(`{"in": ["year"], "int-from": 2010, "int-to": 2015}`, col); err != nil || len(q) != 0 {
+		t.Fatal(q, err)
+	}
+}
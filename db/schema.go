@@ -0,0 +1,433 @@
+// Collection schema (JSON Schema) that documents must match when they are inserted or updated.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const COL_SCHEMA_FILE = "schema.json" // Name of the file that recorded collection schema before collection metadata file.
+
+// Type names of JSON Schema keyword "type".
+var schemaTypes = map[string]struct{}{
+	"null": {}, "boolean": {}, "object": {}, "array": {}, "number": {}, "string": {}, "integer": {},
+}
+
+// Keywords that describe a schema without constraining documents.
+var schemaAnnotations = map[string]struct{}{
+	"$schema": {}, "$id": {}, "$comment": {}, "title": {}, "description": {}, "default": {}, "examples": {},
+	"deprecated": {}, "readOnly": {}, "writeOnly": {},
+}
+
+// SchemaViolation is an existing document that does not match a collection schema.
+type SchemaViolation struct {
+	ID    int
+	Error string
+}
+
+// A compiled JSON Schema, supporting a subset of draft 2020-12: type, enum, const, required, properties,
+// additionalProperties, items, minimum, maximum, exclusiveMinimum, exclusiveMaximum, minLength, maxLength, pattern,
+// minItems and maxItems. Patterns use Go regular expression syntax.
+type docSchema struct {
+	raw        []byte // Schema in JSON as it was set, only kept by the root schema.
+	always     *bool  // Boolean schema accepts (true) or rejects (false) any value.
+	types      []string
+	enum       []interface{}
+	hasConst   bool
+	constVal   interface{}
+	required   []string
+	properties map[string]*docSchema
+	additional *docSchema
+	items      *docSchema
+	minimum    *float64
+	maximum    *float64
+	exclMin    *float64
+	exclMax    *float64
+	minLength  *int
+	maxLength  *int
+	minItems   *int
+	maxItems   *int
+	pattern    *regexp.Regexp
+}
+
+// Return the number value of a schema keyword.
+func schemaNumber(val interface{}) (*float64, error) {
+	num, ok := val.(float64)
+	if !ok {
+		return nil, fmt.Errorf("expecting a number, but %v given", val)
+	}
+	return &num, nil
+}
+
+// Return the non-negative integer value of a schema keyword.
+func schemaCount(val interface{}) (*int, error) {
+	num, ok := val.(float64)
+	if !ok || num < 0 || num != math.Trunc(num) {
+		return nil, fmt.Errorf("expecting a non-negative integer, but %v given", val)
+	}
+	count := int(num)
+	return &count, nil
+}
+
+// Return the string array value of a schema keyword.
+func schemaStrings(val interface{}) ([]string, error) {
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expecting an array of strings, but %v given", val)
+	}
+	ret := make([]string, 0, len(list))
+	for _, item := range list {
+		str, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("expecting an array of strings, but %v given", val)
+		}
+		ret = append(ret, str)
+	}
+	return ret, nil
+}
+
+// Compile the schema definition, which is located at the JSON pointer in the root schema.
+func compileSchema(def interface{}, at string) (*docSchema, error) {
+	if accept, ok := def.(bool); ok {
+		return &docSchema{always: &accept}, nil
+	}
+	obj, ok := def.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: expecting a schema object or boolean, but %v given", at, def)
+	}
+	keywords := make([]string, 0, len(obj))
+	for keyword := range obj {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+	schema := new(docSchema)
+	for _, keyword := range keywords {
+		val := obj[keyword]
+		var err error
+		switch keyword {
+		case "type":
+			if str, isStr := val.(string); isStr {
+				schema.types = []string{str}
+			} else if schema.types, err = schemaStrings(val); err != nil {
+				break
+			}
+			for _, typeName := range schema.types {
+				if _, exists := schemaTypes[typeName]; !exists {
+					err = fmt.Errorf("type %s is unknown", typeName)
+				}
+			}
+		case "enum":
+			if list, isList := val.([]interface{}); isList {
+				schema.enum = list
+			} else {
+				err = fmt.Errorf("expecting an array, but %v given", val)
+			}
+		case "const":
+			schema.hasConst, schema.constVal = true, val
+		case "required":
+			schema.required, err = schemaStrings(val)
+		case "properties":
+			props, isObj := val.(map[string]interface{})
+			if !isObj {
+				err = fmt.Errorf("expecting an object, but %v given", val)
+				break
+			}
+			schema.properties = make(map[string]*docSchema)
+			for name, propDef := range props {
+				if schema.properties[name], err = compileSchema(propDef, at+"/properties/"+name); err != nil {
+					return nil, err
+				}
+			}
+		case "additionalProperties":
+			if schema.additional, err = compileSchema(val, at+"/"+keyword); err != nil {
+				return nil, err
+			}
+		case "items":
+			if schema.items, err = compileSchema(val, at+"/"+keyword); err != nil {
+				return nil, err
+			}
+		case "minimum":
+			schema.minimum, err = schemaNumber(val)
+		case "maximum":
+			schema.maximum, err = schemaNumber(val)
+		case "exclusiveMinimum":
+			schema.exclMin, err = schemaNumber(val)
+		case "exclusiveMaximum":
+			schema.exclMax, err = schemaNumber(val)
+		case "minLength":
+			schema.minLength, err = schemaCount(val)
+		case "maxLength":
+			schema.maxLength, err = schemaCount(val)
+		case "minItems":
+			schema.minItems, err = schemaCount(val)
+		case "maxItems":
+			schema.maxItems, err = schemaCount(val)
+		case "pattern":
+			if str, isStr := val.(string); !isStr {
+				err = fmt.Errorf("expecting a string, but %v given", val)
+			} else {
+				schema.pattern, err = regexp.Compile(str)
+			}
+		default:
+			if _, annotation := schemaAnnotations[keyword]; !annotation {
+				err = fmt.Errorf("keyword is not supported")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s/%s: %v", at, keyword, err)
+		}
+	}
+	return schema, nil
+}
+
+// Parse and compile the schema in JSON.
+func parseSchema(schemaJS []byte) (*docSchema, error) {
+	var def interface{}
+	if err := json.Unmarshal(schemaJS, &def); err != nil {
+		return nil, fmt.Errorf("Schema is not valid JSON - %v", err)
+	}
+	schema, err := compileSchema(def, "#")
+	if err != nil {
+		return nil, fmt.Errorf("Schema is invalid - %v", err)
+	}
+	schema.raw = schemaJS
+	return schema, nil
+}
+
+// Return the JSON type name of the value.
+func schemaType(val interface{}) string {
+	switch val := val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", val)
+}
+
+// Describe the location of a value in the document.
+func schemaLocation(at string) string {
+	if at == "" {
+		return "document"
+	}
+	return "value at " + at
+}
+
+// Return an error describing the first violation of the schema by the value, which is located at the JSON pointer in
+// the document.
+func (schema *docSchema) validate(val interface{}, at string) error {
+	if schema.always != nil {
+		if *schema.always {
+			return nil
+		}
+		return fmt.Errorf("%s is not allowed", schemaLocation(at))
+	}
+	if len(schema.types) > 0 {
+		valType, match := schemaType(val), false
+		for _, typeName := range schema.types {
+			if typeName == valType || typeName == "number" && valType == "integer" {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return fmt.Errorf("%s is %s, expecting %s", schemaLocation(at), valType, strings.Join(schema.types, " or "))
+		}
+	}
+	if schema.enum != nil {
+		match := false
+		for _, enumVal := range schema.enum {
+			if reflect.DeepEqual(val, enumVal) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return fmt.Errorf("%s is not one of %v", schemaLocation(at), schema.enum)
+		}
+	}
+	if schema.hasConst && !reflect.DeepEqual(val, schema.constVal) {
+		return fmt.Errorf("%s is not %v", schemaLocation(at), schema.constVal)
+	}
+	switch val := val.(type) {
+	case float64:
+		if schema.minimum != nil && val < *schema.minimum {
+			return fmt.Errorf("%s is less than minimum %v", schemaLocation(at), *schema.minimum)
+		} else if schema.maximum != nil && val > *schema.maximum {
+			return fmt.Errorf("%s is greater than maximum %v", schemaLocation(at), *schema.maximum)
+		} else if schema.exclMin != nil && val <= *schema.exclMin {
+			return fmt.Errorf("%s is not greater than exclusive minimum %v", schemaLocation(at), *schema.exclMin)
+		} else if schema.exclMax != nil && val >= *schema.exclMax {
+			return fmt.Errorf("%s is not less than exclusive maximum %v", schemaLocation(at), *schema.exclMax)
+		}
+	case string:
+		length := utf8.RuneCountInString(val)
+		if schema.minLength != nil && length < *schema.minLength {
+			return fmt.Errorf("%s is shorter than %d characters", schemaLocation(at), *schema.minLength)
+		} else if schema.maxLength != nil && length > *schema.maxLength {
+			return fmt.Errorf("%s is longer than %d characters", schemaLocation(at), *schema.maxLength)
+		} else if schema.pattern != nil && !schema.pattern.MatchString(val) {
+			return fmt.Errorf("%s does not match pattern %s", schemaLocation(at), schema.pattern)
+		}
+	case []interface{}:
+		if schema.minItems != nil && len(val) < *schema.minItems {
+			return fmt.Errorf("%s has fewer than %d items", schemaLocation(at), *schema.minItems)
+		} else if schema.maxItems != nil && len(val) > *schema.maxItems {
+			return fmt.Errorf("%s has more than %d items", schemaLocation(at), *schema.maxItems)
+		}
+		if schema.items != nil {
+			for i, item := range val {
+				if err := schema.items.validate(item, at+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range schema.required {
+			if _, exists := val[name]; !exists {
+				return fmt.Errorf("%s does not have required property %s", schemaLocation(at), name)
+			}
+		}
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			propSchema, declared := schema.properties[name]
+			if !declared {
+				propSchema = schema.additional
+			}
+			if propSchema != nil {
+				if err := propSchema.validate(val[name], at+"/"+name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Return an error describing the first violation of the schema by the document in JSON.
+func (schema *docSchema) validateJSON(docJS []byte) error {
+	var doc interface{}
+	if err := json.Unmarshal(docJS, &doc); err != nil {
+		return err
+	}
+	return schema.validate(doc, "")
+}
+
+// Read collection schema from the file of an older version of tiedot, return nil if the collection does not have one.
+func readColSchema(colDir string) (*docSchema, error) {
+	content, err := ioutil.ReadFile(path.Join(colDir, COL_SCHEMA_FILE))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseSchema(content)
+}
+
+// Record the schema in collection metadata, or remove the schema if it is nil. Caller must hold schema lock
+// exclusively.
+func (col *Col) setSchema(schema *docSchema) error {
+	change := Change{Op: ChangeSchema, Col: col.name}
+	if schema != nil {
+		change.Schema = schema.raw
+	}
+	prev := col.schema
+	col.schema = schema
+	if err := col.saveMeta(); err != nil {
+		col.schema = prev
+		return err
+	}
+	col.db.logChange(change)
+	return nil
+}
+
+// Set the JSON Schema that documents must match when they are inserted or updated, replacing the current schema.
+// Existing documents are not checked, see Validate.
+func (col *Col) SetSchema(schema map[string]interface{}) error {
+	schemaJS, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+	compiled, err := parseSchema(schemaJS)
+	if err != nil {
+		return err
+	}
+	col.db.lockSchema()
+	defer col.db.unlockSchema()
+	return col.setSchema(compiled)
+}
+
+// Return the JSON Schema of the collection, or nil if it does not have one.
+func (col *Col) Schema() (schema map[string]interface{}) {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.schema != nil {
+		json.Unmarshal(col.schema.raw, &schema)
+	}
+	return
+}
+
+// Remove the JSON Schema of the collection, so that documents are no longer checked.
+func (col *Col) RemoveSchema() error {
+	col.db.lockSchema()
+	defer col.db.unlockSchema()
+	return col.setSchema(nil)
+}
+
+// Return the documents that do not match the schema, or the collection schema if the schema is nil, in ID order.
+// Documents are only checked, nothing is changed.
+func (col *Col) Validate(schema map[string]interface{}) (violations []SchemaViolation, err error) {
+	var compiled *docSchema
+	if schema != nil {
+		schemaJS, err := json.Marshal(schema)
+		if err != nil {
+			return nil, err
+		} else if compiled, err = parseSchema(schemaJS); err != nil {
+			return nil, err
+		}
+	}
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if compiled == nil {
+		if compiled = col.schema; compiled == nil {
+			return nil, fmt.Errorf("Collection %s does not have a schema", col.name)
+		}
+	}
+	violations = make([]SchemaViolation, 0)
+	col.forEachDoc(func(id int, doc []byte) bool {
+		if err := compiled.validateJSON(doc); err != nil {
+			violations = append(violations, SchemaViolation{ID: id, Error: err.Error()})
+		}
+		return true
+	}, false)
+	sort.Slice(violations, func(i, j int) bool {
+		return violations[i].ID < violations[j].ID
+	})
+	return
+}
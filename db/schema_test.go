@@ -0,0 +1,201 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := parseSchema([]byte(`{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"type": "object",
+		"required": ["name"],
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "maxLength": 5, "pattern": "^[^A-Z]+$"},
+			"age": {"type": "integer", "minimum": 0, "exclusiveMaximum": 150},
+			"score": {"type": ["number", "null"], "maximum": 1, "exclusiveMinimum": 0},
+			"kind": {"enum": ["a", "b", 3]},
+			"version": {"const": 2},
+			"tags": {"type": "array", "minItems": 1, "maxItems": 2, "items": {"type": "string"}},
+			"meta": {"type": "object", "additionalProperties": false, "properties": {"x": true}}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := []string{
+		`{"name": "a"}`,
+		`{"name": "abcde", "age": 0, "score": null, "kind": 3, "version": 2.0, "tags": ["x", "y"], "meta": {"x": [1]}}`,
+		`{"name": "ab", "age": 149, "score": 1, "kind": "b", "other": {"any": "thing"}}`,
+		`{"name": "ééééé"}`,
+	}
+	for _, doc := range valid {
+		if err := schema.validateJSON([]byte(doc)); err != nil {
+			t.Fatal(doc, err)
+		}
+	}
+	invalid := map[string]string{
+		`{}`:                                  "document does not have required property name",
+		`{"name": 1}`:                         "value at /name is integer, expecting string",
+		`{"name": ""}`:                        "value at /name is shorter than 1 characters",
+		`{"name": "abcdef"}`:                  "value at /name is longer than 5 characters",
+		`{"name": "A"}`:                       "value at /name does not match pattern ^[^A-Z]+$",
+		`{"name": "a", "age": 1.5}`:           "value at /age is number, expecting integer",
+		`{"name": "a", "age": -1}`:            "value at /age is less than minimum 0",
+		`{"name": "a", "age": 150}`:           "value at /age is not less than exclusive maximum 150",
+		`{"name": "a", "score": 0}`:           "value at /score is not greater than exclusive minimum 0",
+		`{"name": "a", "score": 1.5}`:         "value at /score is greater than maximum 1",
+		`{"name": "a", "score": "1"}`:         "value at /score is string, expecting number or null",
+		`{"name": "a", "kind": "c"}`:          "value at /kind is not one of [a b 3]",
+		`{"name": "a", "version": 1}`:         "value at /version is not 2",
+		`{"name": "a", "tags": []}`:           "value at /tags has fewer than 1 items",
+		`{"name": "a", "tags": [1]}`:          "value at /tags/0 is integer, expecting string",
+		`{"name": "a", "tags": ["", "", ""]}`: "value at /tags has more than 2 items",
+		`{"name": "a", "meta": {"y": 1}}`:     "value at /meta/y is not allowed",
+	}
+	for doc, expected := range invalid {
+		if err := schema.validateJSON([]byte(doc)); err == nil || err.Error() != expected {
+			t.Fatal(doc, err)
+		}
+	}
+	// Schemas using unknown types, unsupported keywords or bad keyword values are rejected
+	for _, bad := range []string{
+		`[]`,
+		`{"type": "date"}`,
+		`{"minimum": "1"}`,
+		`{"minLength": -1}`,
+		`{"pattern": "("}`,
+		`{"properties": {"a": {"format": "email"}}}`,
+		`{"items": 1}`,
+	} {
+		if _, err := parseSchema([]byte(bad)); err == nil {
+			t.Fatal(bad)
+		}
+	}
+	if _, err := parseSchema([]byte(`{"properties": {"a": {"format": "email"}}}`)); err == nil || !strings.Contains(err.Error(), "#/properties/a/format") {
+		t.Fatal(err)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("a"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("a")
+	if err = col.Index([]string{"name"}); err != nil {
+		t.Fatal(err)
+	}
+	// Documents inserted before the schema is set are not checked until validation
+	oldID, err := col.Insert(map[string]interface{}{"name": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = col.Validate(nil); err == nil {
+		t.Fatal("did not error")
+	}
+	schema := map[string]interface{}{
+		"type":       "object",
+		"required":   []interface{}{"name"},
+		"properties": map[string]interface{}{"name": map[string]interface{}{"type": "string"}},
+	}
+	if err = col.SetSchema(map[string]interface{}{"type": "doc"}); err == nil {
+		t.Fatal("did not error")
+	} else if col.Schema() != nil {
+		t.Fatal(col.Schema())
+	} else if err = col.SetSchema(schema); err != nil {
+		t.Fatal(err)
+	} else if got, _ := json.Marshal(col.Schema()); !bytes.Equal(got, []byte(`{"properties":{"name":{"type":"string"}},"required":["name"],"type":"object"}`)) {
+		t.Fatal(string(got))
+	}
+	// Writes of documents that do not match the schema fail and leave the collection untouched
+	if _, err = col.Insert(map[string]interface{}{"age": 1}); dberr.Type(err) != dberr.ErrorInvalidDoc {
+		t.Fatal(err)
+	} else if err = col.InsertWithID(123, map[string]interface{}{"name": true}); dberr.Type(err) != dberr.ErrorInvalidDoc {
+		t.Fatal(err)
+	}
+	id, err := col.Insert(map[string]interface{}{"name": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = col.Update(id, map[string]interface{}{"name": 2}); dberr.Type(err) != dberr.ErrorInvalidDoc {
+		t.Fatal(err)
+	} else if err = col.UpdateFunc(id, func(doc map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{}, nil
+	}); dberr.Type(err) != dberr.ErrorInvalidDoc {
+		t.Fatal(err)
+	} else if err = col.UpdateBytesFunc(id, func(doc []byte) ([]byte, error) {
+		return []byte(`{"name": null}`), nil
+	}); dberr.Type(err) != dberr.ErrorInvalidDoc {
+		t.Fatal(err)
+	} else if err = col.Patch(id, PatchMerge, map[string]interface{}{"name": nil}); dberr.Type(err) != dberr.ErrorInvalidDoc {
+		t.Fatal(err)
+	} else if err = col.Update(id, map[string]interface{}{"name": "y"}); err != nil {
+		t.Fatal(err)
+	}
+	results := col.Bulk([]BulkOp{
+		{Op: BulkInsert, Doc: map[string]interface{}{"name": "z"}},
+		{Op: BulkInsert, Doc: map[string]interface{}{}},
+		{Op: BulkUpdate, ID: id, Doc: map[string]interface{}{"name": []interface{}{}}},
+	})
+	if results[0].Error != "" || results[1].Error == "" || results[2].Error == "" {
+		t.Fatal(results)
+	}
+	if doc, err := col.Read(id); err != nil || doc["name"] != "y" {
+		t.Fatal(doc, err)
+	}
+	// Only the documents that match the schema were indexed
+	var matches = make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": 2, "in": []interface{}{"name"}}, col, &matches); err != nil || len(matches) != 0 {
+		t.Fatal(matches, err)
+	}
+	// Validation reports existing documents that do not match the collection schema, or another schema
+	if violations, err := col.Validate(nil); err != nil || len(violations) != 1 || violations[0].ID != oldID ||
+		violations[0].Error != "value at /name is integer, expecting string" {
+		t.Fatal(violations, err)
+	}
+	if violations, err := col.Validate(map[string]interface{}{"required": []interface{}{"age"}}); err != nil || len(violations) != 3 {
+		t.Fatal(violations, err)
+	}
+	// Schema is kept when the database is opened again
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("a")
+	if _, err = col.Insert(map[string]interface{}{}); dberr.Type(err) != dberr.ErrorInvalidDoc {
+		t.Fatal(err)
+	}
+	if err = db.Scrub("a"); err != nil {
+		t.Fatal(err)
+	}
+	col = db.Use("a")
+	if col.Schema() == nil {
+		t.Fatal("schema is lost by scrub")
+	} else if err = col.RemoveSchema(); err != nil {
+		t.Fatal(err)
+	} else if col.Schema() != nil {
+		t.Fatal(col.Schema())
+	} else if _, err = col.Insert(map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+}
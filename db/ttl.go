@@ -0,0 +1,277 @@
+// Expiry of documents some time after the timestamp they carry, enforced by a background reaper.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/dberr"
+	"github.com/HouzuoGuo/tiedot/tdlog"
+)
+
+const (
+	COL_TTL_FILE = "ttl.json" // Name of the file that recorded collection TTL before collection metadata file.
+
+	ttlReapInterval = time.Minute // The reaper looks for expired documents this often.
+	ttlReapPage     = 1000        // Approximate number of documents examined while the partition is locked.
+)
+
+// TTL makes documents of a collection expire some time after the timestamp in a document path. The timestamp is a
+// number of seconds since Unix epoch or an RFC 3339 string; the earliest one is used if the path has several, and
+// documents without a timestamp never expire.
+type TTL struct {
+	Path    []string // Path of the timestamp.
+	Seconds int      // Documents expire this many seconds after the timestamp, 0 to expire at the timestamp.
+}
+
+// ReaperStats reports the work done by TTL reaper since the database was opened.
+type ReaperStats struct {
+	Runs    int            // Number of times the reaper has looked for expired documents.
+	LastRun int64          // Time when the reaper last looked for expired documents, in nanoseconds since Unix epoch.
+	Expired map[string]int // Number of expired documents deleted from each collection.
+}
+
+// Reaper deletes expired documents of all collections periodically until it is stopped.
+type ttlReaper struct {
+	stop  chan struct{}
+	done  chan struct{}
+	once  *sync.Once
+	lock  *sync.Mutex // Guards stats
+	run   *sync.Mutex // Held while looking for expired documents, or while the reaper is paused
+	stats ReaperStats
+}
+
+// Return an error if the TTL is not valid.
+func (ttl TTL) validate() error {
+	if len(ttl.Path) == 0 {
+		return fmt.Errorf("TTL requires a timestamp path")
+	} else if ttl.Seconds < 0 {
+		return fmt.Errorf("TTL seconds %d must not be negative", ttl.Seconds)
+	}
+	return nil
+}
+
+// Return the time when the document expires, or false if it does not have a timestamp.
+func (ttl TTL) expiry(doc map[string]interface{}) (expiry time.Time, expires bool) {
+	for _, val := range GetIn(doc, ttl.Path) {
+		var timestamp time.Time
+		switch val := val.(type) {
+		case float64:
+			sec, frac := math.Modf(val)
+			timestamp = time.Unix(int64(sec), int64(frac*1e9))
+		case string:
+			var err error
+			if timestamp, err = time.Parse(time.RFC3339Nano, val); err != nil {
+				continue
+			}
+		default:
+			continue
+		}
+		if !expires || timestamp.Before(expiry) {
+			expiry, expires = timestamp, true
+		}
+	}
+	return expiry.Add(time.Duration(ttl.Seconds) * time.Second), expires
+}
+
+// Read collection TTL from the file of an older version of tiedot, return nil if the collection does not have one.
+func readColTTL(colDir string) (*TTL, error) {
+	content, err := ioutil.ReadFile(path.Join(colDir, COL_TTL_FILE))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ttl := new(TTL)
+	if err = json.Unmarshal(content, ttl); err != nil {
+		return nil, err
+	}
+	return ttl, ttl.validate()
+}
+
+// Record the TTL in collection metadata, or remove the TTL if it is nil. Caller must hold schema lock exclusively.
+func (col *Col) setTTL(ttl *TTL) error {
+	if ttl != nil {
+		if err := ttl.validate(); err != nil {
+			return err
+		}
+	}
+	prev := col.ttl
+	col.ttl = ttl
+	if err := col.saveMeta(); err != nil {
+		col.ttl = prev
+		return err
+	}
+	col.db.logChange(Change{Op: ChangeTTL, Col: col.name, TTL: ttl})
+	return nil
+}
+
+// Make documents expire the number of seconds after the timestamp in the path, replacing the current TTL.
+// Expired documents are deleted by the reaper, which runs every minute, or by ReapExpired.
+func (col *Col) SetTTL(tsPath []string, seconds int) error {
+	col.db.lockSchema()
+	defer col.db.unlockSchema()
+	return col.setTTL(&TTL{Path: append([]string{}, tsPath...), Seconds: seconds})
+}
+
+// Return the TTL of the collection, or nil if documents do not expire.
+func (col *Col) TTL() *TTL {
+	col.db.schemaLock.RLock()
+	defer col.db.schemaLock.RUnlock()
+	if col.ttl == nil {
+		return nil
+	}
+	return &TTL{Path: append([]string{}, col.ttl.Path...), Seconds: col.ttl.Seconds}
+}
+
+// Remove the TTL of the collection, so that documents no longer expire.
+func (col *Col) RemoveTTL() error {
+	col.db.lockSchema()
+	defer col.db.unlockSchema()
+	return col.setTTL(nil)
+}
+
+// Return true if the collection is still open under its name, it is not after being dropped, renamed, scrubbed or
+// restored. Caller must hold schema lock.
+func (col *Col) isOpen() bool {
+	return col.db.cols[col.name] == col
+}
+
+// Delete the documents that have expired by the time, a page at a time, until done, stopped, or the collection is no
+// longer open. Return the number of deleted documents.
+func (col *Col) reapExpired(now time.Time, stop <-chan struct{}) (count int) {
+	col.db.schemaLock.RLock()
+	if !col.isOpen() || col.ttl == nil {
+		col.db.schemaLock.RUnlock()
+		return
+	}
+	ttl := col.ttl
+	pages := col.approxDocCount(false)/col.db.numParts/ttlReapPage + 1
+	col.db.schemaLock.RUnlock()
+	for partNum := 0; partNum < col.db.numParts; partNum++ {
+		for page := 0; page < pages; page++ {
+			// Find expired documents and their revisions, then delete them unless they have been updated since
+			expired := make(map[int]int)
+			col.db.schemaLock.RLock()
+			if !col.isOpen() {
+				col.db.schemaLock.RUnlock()
+				return
+			}
+			part := col.parts[partNum]
+			part.DataLock.RLock()
+			part.ForEachDoc(page, pages, func(id int, doc []byte) bool {
+				var docObj map[string]interface{}
+				if json.Unmarshal(doc, &docObj) != nil {
+					return true
+				}
+				if expiry, expires := ttl.expiry(docObj); expires && !expiry.After(now) {
+					expired[id], _ = part.Revision(id)
+				}
+				return true
+			})
+			part.DataLock.RUnlock()
+			col.db.schemaLock.RUnlock()
+			for id, rev := range expired {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				col.db.schemaLock.RLock()
+				if !col.isOpen() {
+					col.db.schemaLock.RUnlock()
+					return
+				}
+				original, err := col.deleteLocked(id, rev)
+				col.db.schemaLock.RUnlock()
+				switch dberr.Type(err) {
+				case dberr.ErrorNil:
+					col.runPostHooks(ChangeDelete, id, original, nil)
+					count++
+				case dberr.ErrorNoDoc, dberr.ErrorRevMismatch:
+				default:
+					tdlog.Noticef("TTL reaper: failed to delete expired document %d of collection %s - %v", id, col.name, err)
+				}
+			}
+		}
+	}
+	return
+}
+
+// Delete the expired documents of all collections now, return the number of deleted documents.
+func (db *DB) ReapExpired() int {
+	return db.reapExpired(nil)
+}
+
+// Delete the expired documents of all collections until done or stopped, log and count the deletions.
+func (db *DB) reapExpired(stop <-chan struct{}) (total int) {
+	db.reaper.run.Lock()
+	defer db.reaper.run.Unlock()
+	now := time.Now()
+	expired := make(map[string]int)
+	for _, name := range db.AllCols() {
+		col := db.Use(name)
+		if col == nil {
+			continue
+		}
+		if count := col.reapExpired(now, stop); count > 0 {
+			expired[name] = count
+			total += count
+			tdlog.Infof("TTL reaper: deleted %d expired documents of collection %s", count, name)
+		}
+	}
+	db.reaper.lock.Lock()
+	db.reaper.stats.Runs++
+	db.reaper.stats.LastRun = now.UnixNano()
+	for name, count := range expired {
+		db.reaper.stats.Expired[name] += count
+	}
+	db.reaper.lock.Unlock()
+	return
+}
+
+// Return the work done by TTL reaper since the database was opened.
+func (db *DB) ReaperStats() ReaperStats {
+	db.reaper.lock.Lock()
+	defer db.reaper.lock.Unlock()
+	stats := db.reaper.stats
+	stats.Expired = make(map[string]int)
+	for name, count := range db.reaper.stats.Expired {
+		stats.Expired[name] = count
+	}
+	return stats
+}
+
+// Start the reaper that deletes expired documents periodically.
+func (db *DB) startReaper() {
+	db.reaper = &ttlReaper{stop: make(chan struct{}), done: make(chan struct{}), once: new(sync.Once),
+		lock: new(sync.Mutex), run: new(sync.Mutex), stats: ReaperStats{Expired: make(map[string]int)}}
+	go func() {
+		defer close(db.reaper.done)
+		ticker := time.NewTicker(ttlReapInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				db.reapExpired(db.reaper.stop)
+			case <-db.reaper.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop the reaper and wait for it to finish the deletion in progress.
+func (db *DB) stopReaper() {
+	db.reaper.once.Do(func() {
+		close(db.reaper.stop)
+	})
+	<-db.reaper.done
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create("sessions"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("other"); err != nil {
+		t.Fatal(err)
+	}
+	col := db.Use("sessions")
+	if err = col.Index([]string{"user"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.SetTTL([]string{"seen"}, -1); err == nil {
+		t.Fatal("did not error")
+	} else if err = col.SetTTL(nil, 1); err == nil {
+		t.Fatal("did not error")
+	} else if col.TTL() != nil {
+		t.Fatal(col.TTL())
+	} else if err = col.SetTTL([]string{"seen"}, 3600); err != nil {
+		t.Fatal(err)
+	} else if ttl := col.TTL(); ttl == nil || len(ttl.Path) != 1 || ttl.Path[0] != "seen" || ttl.Seconds != 3600 {
+		t.Fatal(ttl)
+	}
+	now := time.Now()
+	docs := map[string]map[string]interface{}{
+		"expired number":  {"user": "a", "seen": float64(now.Add(-2*time.Hour).Unix()) + 0.5},
+		"expired string":  {"user": "b", "seen": now.Add(-2 * time.Hour).Format(time.RFC3339Nano)},
+		"expired array":   {"user": "c", "seen": []interface{}{float64(now.Unix()), now.Add(-61 * time.Minute).Format(time.RFC3339)}},
+		"live number":     {"user": "d", "seen": float64(now.Add(-time.Minute).Unix())},
+		"live string":     {"user": "e", "seen": now.Format(time.RFC3339)},
+		"no timestamp":    {"user": "f"},
+		"bad timestamp":   {"user": "g", "seen": "yesterday"},
+		"other timestamp": {"user": "h", "seen": true},
+	}
+	ids := make(map[string]int)
+	for name, doc := range docs {
+		if ids[name], err = col.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Documents of collections without TTL never expire
+	otherID, err := db.Use("other").Insert(map[string]interface{}{"seen": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := db.ReapExpired(); count != 3 {
+		t.Fatal(count)
+	}
+	for name, id := range ids {
+		_, err := col.Read(id)
+		if expired := name[:7] == "expired"; expired != (err != nil) {
+			t.Fatal(name, err)
+		}
+	}
+	if _, err = db.Use("other").Read(otherID); err != nil {
+		t.Fatal(err)
+	}
+	// Expired documents are removed from indexes
+	matches := make(map[int]struct{})
+	if err = EvalQuery(map[string]interface{}{"eq": "a", "in": []interface{}{"user"}}, col, &matches); err != nil || len(matches) != 0 {
+		t.Fatal(matches, err)
+	}
+	stats := db.ReaperStats()
+	if stats.Runs != 1 || stats.LastRun < now.UnixNano() || len(stats.Expired) != 1 || stats.Expired["sessions"] != 3 {
+		t.Fatal(stats)
+	}
+	// TTL is kept when the database is opened again, and the reaper stops when the database is closed
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if db, err = OpenDB(TEST_DATA_DIR); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	col = db.Use("sessions")
+	if ttl := col.TTL(); ttl == nil || ttl.Seconds != 3600 {
+		t.Fatal(ttl)
+	} else if err = col.SetTTL([]string{"seen"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if count := db.ReapExpired(); count != 2 {
+		t.Fatal(count)
+	}
+	if err = col.RemoveTTL(); err != nil {
+		t.Fatal(err)
+	} else if col.TTL() != nil {
+		t.Fatal(col.TTL())
+	} else if _, err = col.Insert(map[string]interface{}{"seen": 0}); err != nil {
+		t.Fatal(err)
+	} else if count := db.ReapExpired(); count != 0 {
+		t.Fatal(count)
+	}
+}
+
+func TestTTLReapDroppedCol(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, drop := range []bool{true, false} {
+		if err = db.Create("sessions"); err != nil {
+			t.Fatal(err)
+		}
+		col := db.Use("sessions")
+		if err = col.SetTTL([]string{"seen"}, 0); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if _, err = col.Insert(map[string]interface{}{"seen": 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The reaper stops deleting from a collection once it is dropped or renamed
+		once := new(sync.Once)
+		col.AddPostHook(func(op string, id int, oldDoc, newDoc map[string]interface{}) {
+			once.Do(func() {
+				if drop {
+					err = db.Drop("sessions")
+				} else {
+					err = db.Rename("sessions", "renamed")
+				}
+			})
+		})
+		if count := db.ReapExpired(); err != nil || count != 1 {
+			t.Fatal(count, err)
+		}
+	}
+	if count := db.ReapExpired(); count != 99 {
+		t.Fatal(count)
+	}
+}
@@ -0,0 +1,169 @@
+// Verification of a database directory or dump.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+// Check that the directory has an intact database or dump - its data file configuration, partition count,
+// collection metadata, and every data file, hash table and document - or an intact incremental backup.
+// Files are opened read-only, an interrupted compaction or rehash is not finished. The database must not be open
+// (e.g. by HTTP server) during verification. Return the first problem found.
+func Verify(dir string) error {
+	if info, err := ReadBackupInfo(dir); err == nil && info.Incremental {
+		return verifyIncrement(dir, info)
+	}
+	// Data file configuration
+	if _, err := os.Stat(path.Join(dir, "data-config.json")); err != nil {
+		return fmt.Errorf("Data file configuration is missing - %v", err)
+	}
+	conf, err := data.ReadConfig(dir)
+	if err != nil {
+		return fmt.Errorf("Data file configuration is corrupted - %v", err)
+	} else if conf.FormatVersion < data.FormatLegacy || conf.FormatVersion > data.CurrentFormat {
+		return fmt.Errorf("Data file format %d is not supported by this version of tiedot", conf.FormatVersion)
+	} else if conf.DocMaxRoom <= 0 || conf.ColFileGrowth <= 0 || conf.HTFileGrowth <= 0 || conf.PerBucket <= 0 ||
+		conf.HashBits < 1 || conf.HashBits > data.MAX_HASH_BITS {
+		return fmt.Errorf("Data file configuration has invalid parameters %+v", *conf)
+	}
+	// Partition count
+	content, err := ioutil.ReadFile(path.Join(dir, PART_NUM_FILE))
+	if err != nil {
+		return fmt.Errorf("Partition number config file is missing - %v", err)
+	}
+	numParts, err := strconv.Atoi(strings.Trim(string(content), "\r\n "))
+	if err != nil || numParts < 1 {
+		return fmt.Errorf("Partition number config file has invalid content '%s'", content)
+	}
+	// Collections
+	dirContent, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, colDir := range dirContent {
+		if !colDir.IsDir() || colDir.Name() == CHANGE_LOG_DIR {
+			continue
+		} else if err = verifyCol(conf, path.Join(dir, colDir.Name()), numParts); err != nil {
+			return fmt.Errorf("Collection %s: %v", colDir.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Return true if the path resolves to the directory of the database.
+func (db *DB) SameDir(dir string) bool {
+	dbInfo, dbErr := os.Stat(db.path)
+	info, err := os.Stat(dir)
+	return dbErr == nil && err == nil && os.SameFile(dbInfo, info)
+}
+
+// Check the collection metadata, ID sequences, documents and indexes in the collection directory.
+func verifyCol(conf *data.Config, colDir string, numParts int) error {
+	meta, _, err := readColMeta(colDir)
+	if err != nil {
+		return fmt.Errorf("collection metadata is corrupted - %v", err)
+	} else if _, err = openIDGen(colDir, meta.Options.IDStrategy, numParts); err != nil {
+		return err
+	}
+	// Every partition must have both files, and no file may belong to a partition beyond the count
+	content, err := ioutil.ReadDir(colDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range content {
+		for _, prefix := range []string{DOC_DATA_FILE, DOC_LOOKUP_FILE} {
+			if partNum, err := strconv.Atoi(strings.TrimPrefix(file.Name(), prefix)); err == nil && strings.HasPrefix(file.Name(), prefix) && partNum >= numParts {
+				return fmt.Errorf("file %s does not belong to any of the %d partitions", file.Name(), numParts)
+			}
+		}
+	}
+	for i := 0; i < numParts; i++ {
+		if err = checkFilesExist(path.Join(colDir, DOC_DATA_FILE+strconv.Itoa(i)), path.Join(colDir, DOC_LOOKUP_FILE+strconv.Itoa(i))); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < numParts; i++ {
+		colPath := path.Join(colDir, DOC_DATA_FILE+strconv.Itoa(i))
+		lookupPath := path.Join(colDir, DOC_LOOKUP_FILE+strconv.Itoa(i))
+		part, err := conf.OpenPartition(colPath, lookupPath)
+		if err != nil {
+			return err
+		}
+		if _, err = part.Verify(); err == nil {
+			part.ForEachDoc(0, 1, func(id int, doc []byte) bool {
+				var docObj map[string]interface{}
+				if id%numParts != i {
+					err = fmt.Errorf("document %d is in partition %d instead of %d", id, i, id%numParts)
+				} else if jsonErr := json.Unmarshal(doc, &docObj); jsonErr != nil {
+					err = fmt.Errorf("document %d is not valid JSON - %v", id, jsonErr)
+				}
+				return err == nil
+			})
+		}
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+	// Index files are absent if indexes are to be rebuilt when the collection is opened
+	if _, err = os.Stat(path.Join(colDir, LOAD_MARKER_FILE)); err == nil {
+		return nil
+	}
+	for _, idx := range meta.Indexes {
+		for i := 0; i < numParts; i++ {
+			htPath := path.Join(colDir, idx.Dir, strconv.Itoa(i))
+			if err = checkFilesExist(htPath); err != nil {
+				return fmt.Errorf("index %v: %v", idx.Path, err)
+			}
+			ht, err := conf.OpenHashTable(htPath)
+			if err != nil {
+				return err
+			}
+			_, err = ht.Verify()
+			ht.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Return an error if any of the files does not exist.
+func checkFilesExist(filePaths ...string) error {
+	for _, filePath := range filePaths {
+		if _, err := os.Stat(filePath); err != nil {
+			return fmt.Errorf("file %s is missing - %v", path.Base(filePath), err)
+		}
+	}
+	return nil
+}
+
+// Check that the incremental backup has all of its changes in order.
+func verifyIncrement(dir string, info BackupInfo) error {
+	expectSeq := info.FromSeq + 1
+	_, validSize, err := readChangeFile(path.Join(dir, BACKUP_CHANGES_FILE), func(change Change) (bool, error) {
+		if change.Seq != expectSeq {
+			return false, fmt.Errorf("Change %d is missing", expectSeq)
+		}
+		expectSeq++
+		return true, nil
+	})
+	if err != nil {
+		return err
+	} else if expectSeq != info.Seq+1 {
+		return fmt.Errorf("Changes after %d are missing", expectSeq-1)
+	} else if stat, err := os.Stat(path.Join(dir, BACKUP_CHANGES_FILE)); err != nil || stat.Size() != validSize {
+		return fmt.Errorf("The last change is incomplete")
+	}
+	return nil
+}
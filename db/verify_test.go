@@ -0,0 +1,141 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/data"
+)
+
+func TestVerifyRestore(t *testing.T) {
+	bak := TEST_DATA_DIR + "bak"
+	os.RemoveAll(TEST_DATA_DIR)
+	os.RemoveAll(bak)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(bak)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("a"); err != nil {
+		t.Fatal(err)
+	} else if err = db.Use("a").Index([]string{"n"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.Use("a").Insert(map[string]interface{}{"n": "needle"})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = db.Dump(bak + "/good"); err != nil {
+		t.Fatal(err)
+	} else if err = Verify(bak + "/good"); err != nil {
+		t.Fatal(err)
+	}
+	if !db.SameDir(TEST_DATA_DIR+"/.") || db.SameDir(bak+"/good") {
+		t.Fatal("did not recognise database directory")
+	}
+	// A compaction was interrupted while replacing the corrupted data file, verification does not finish it
+	if err = copyBackupDir(bak+"/good", bak+"/swap"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		dataPath := path.Join(bak, "swap", "a", DOC_DATA_FILE+strconv.Itoa(i))
+		content, err := ioutil.ReadFile(dataPath)
+		if err != nil {
+			t.Fatal(err)
+		} else if err = ioutil.WriteFile(dataPath+data.COMPACT_FILE_SUFFIX, content, 0600); err != nil {
+			t.Fatal(err)
+		} else if err = ioutil.WriteFile(dataPath+data.COMPACT_SWAP_SUFFIX, nil, 0600); err != nil {
+			t.Fatal(err)
+		} else if err = ioutil.WriteFile(dataPath, bytes.Replace(content, []byte("needle"), []byte("needlx"), 1), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := dirChecksums(t, bak+"/swap")
+	if err = Verify(bak + "/swap"); err != nil {
+		t.Fatal(err)
+	} else if after := dirChecksums(t, bak+"/swap"); fmt.Sprint(before) != fmt.Sprint(after) {
+		t.Fatal("verification changed the files")
+	}
+	// Changes after the dump are lost in restore
+	if err = db.Use("a").Update(id, map[string]interface{}{"n": "changed"}); err != nil {
+		t.Fatal(err)
+	} else if err = db.Create("b"); err != nil {
+		t.Fatal(err)
+	}
+	// Dumps that are not intact
+	if err = copyBackupDir(bak+"/good", bak+"/parts"); err != nil {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(bak+"/parts/number_of_partitions", []byte("3"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = Verify(bak + "/parts"); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatal(err)
+	} else if err = ioutil.WriteFile(bak+"/parts/number_of_partitions", []byte("1"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = Verify(bak + "/parts"); err == nil || !strings.Contains(err.Error(), "partitions") {
+		t.Fatal(err)
+	}
+	if err = copyBackupDir(bak+"/good", bak+"/corrupted"); err != nil {
+		t.Fatal(err)
+	}
+	dataPath := path.Join(bak, "corrupted", "a", DOC_DATA_FILE+"0")
+	content, err := ioutil.ReadFile(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Contains(content, []byte("needle")) {
+		dataPath = path.Join(bak, "corrupted", "a", DOC_DATA_FILE+"1")
+		content, err = ioutil.ReadFile(dataPath)
+	}
+	if err = ioutil.WriteFile(dataPath, bytes.Replace(content, []byte("needle"), []byte("needlx"), 1), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = Verify(bak + "/corrupted"); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatal(err)
+	} else if err = db.Restore(bak + "/corrupted"); err == nil {
+		t.Fatal("did not error")
+	} else if doc, err := db.Use("a").Read(id); err != nil || doc["n"] != "changed" {
+		t.Fatal(doc, err)
+	}
+	// Restore the intact dump in place, watchers are stopped
+	if err = db.EnableChangeLog(); err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := db.Watch(WatchOptions{Col: "a", Query: map[string]interface{}{"eq": "needle", "in": []interface{}{"n"}}, AfterSeq: WatchFromNow})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = db.Restore(bak + "/good"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case change, ok := <-watcher.C:
+		if ok {
+			t.Fatal(change)
+		} else if err = watcher.Close(); err == nil || !strings.Contains(err.Error(), "restored") {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher is not stopped")
+	}
+	if db.Use("b") != nil {
+		t.Fatal(db.AllCols())
+	} else if doc, err := db.Use("a").Read(id); err != nil || doc["n"] != "needle" {
+		t.Fatal(doc, err)
+	} else if q, err := runQuery(`{"eq": "needle", "in": ["n"]}`, db.Use("a")); err != nil || !ensureMapHasKeys(q, id) {
+		t.Fatal(q, err)
+	}
+	if _, err = os.Stat(TEST_DATA_DIR + ".restoring"); err == nil {
+		t.Fatal("temporary directory is left behind")
+	}
+}
@@ -0,0 +1,212 @@
+// Change feed delivers document changes recorded in change log to watchers as they happen.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+const (
+	WatchFromNow  = -1  // Sequence number to watch changes made from now on.
+	watchChanSize = 100 // Number of changes buffered in a watcher channel.
+)
+
+// WatchOptions selects the changes delivered to a watcher.
+type WatchOptions struct {
+	Col      string      // Only watch changes of the collection (empty for all collections).
+	Query    interface{} // Only watch changes of documents matched by the query before or after the change (nil for all), requires Col.
+	AfterSeq int         // Deliver changes made after the sequence number, or WatchFromNow.
+	OldDoc   bool        // Deliver document content before update and delete.
+}
+
+// Watcher receives insert, update and delete changes in order from its channel, until it is closed.
+type Watcher struct {
+	C    <-chan Change // Closed when the watcher is closed, or upon error (see Err).
+	db   *DB
+	log  *changeLog
+	opts WatchOptions
+	out  chan Change
+	stop chan struct{}
+	done chan struct{}
+	once *sync.Once
+	err  error
+	seq  int   // Sequence number of the last change seen, including the ones not delivered.
+	kill error // Reason why the database stopped the watcher, set before stop is closed
+}
+
+// Watch document changes made to the database. Change log must be enabled, changes are delivered from change log so
+// that a watcher may resume after the last change it received, as long as the change has not been purged.
+// Close the watcher when it is no longer needed.
+func (db *DB) Watch(opts WatchOptions) (*Watcher, error) {
+	db.schemaLock.RLock()
+	defer db.schemaLock.RUnlock()
+	if db.log == nil {
+		return nil, fmt.Errorf("Change log is not enabled, change feed requires it")
+	} else if opts.Query != nil && opts.Col == "" {
+		return nil, fmt.Errorf("Query of change feed requires collection name")
+	} else if opts.Col != "" && db.cols[opts.Col] == nil {
+		return nil, fmt.Errorf("Collection %s does not exist", opts.Col)
+	} else if opts.Query != nil {
+		// Validate the query against an empty document
+		if _, err := db.cols[opts.Col].matchDoc(opts.Query, 0, nil); err != nil {
+			return nil, err
+		}
+	}
+	first, last := db.log.seqRange()
+	if opts.AfterSeq == WatchFromNow {
+		opts.AfterSeq = last
+	} else if opts.AfterSeq < first-1 {
+		return nil, fmt.Errorf("Changes after %d have been purged from change log", opts.AfterSeq)
+	} else if opts.AfterSeq < 0 || opts.AfterSeq > last {
+		return nil, fmt.Errorf("Change %d does not exist", opts.AfterSeq)
+	}
+	out := make(chan Change, watchChanSize)
+	watcher := &Watcher{C: out, db: db, log: db.log, opts: opts, out: out, seq: opts.AfterSeq,
+		stop: make(chan struct{}), done: make(chan struct{}), once: new(sync.Once)}
+	db.log.lock.Lock()
+	db.log.watchers[watcher] = struct{}{}
+	db.log.lock.Unlock()
+	go watcher.run()
+	return watcher, nil
+}
+
+// Stop all watchers of the change log, they stop with the error. The watchers may still be finishing when the
+// function returns.
+func (log *changeLog) stopWatchers(err error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	for watcher := range log.watchers {
+		watcher.once.Do(func() {
+			watcher.kill = err
+			close(watcher.stop)
+		})
+	}
+}
+
+// Deliver changes from change log until the watcher is closed, the change log is closed, or an error occurs.
+func (watcher *Watcher) run() {
+	defer close(watcher.done)
+	defer close(watcher.out)
+	defer func() {
+		watcher.log.lock.Lock()
+		delete(watcher.log.watchers, watcher)
+		watcher.log.lock.Unlock()
+		if watcher.err == nil && watcher.stopped() {
+			watcher.err = watcher.kill
+		}
+	}()
+	for {
+		changes, inMemory, appended, closed := watcher.log.recentAfter(watcher.seq)
+		if !inMemory {
+			// The watcher is far behind, catch up from change log files
+			err := watcher.log.forEach(watcher.seq, watcher.deliver)
+			if err != nil || watcher.stopped() {
+				watcher.err = err
+				return
+			}
+			continue
+		}
+		for _, change := range changes {
+			if moveOn, err := watcher.deliver(change); !moveOn || err != nil {
+				watcher.err = err
+				return
+			}
+		}
+		if len(changes) > 0 {
+			continue
+		} else if closed {
+			watcher.err = fmt.Errorf("Change log is closed")
+			return
+		}
+		select {
+		case <-appended:
+		case <-watcher.stop:
+			return
+		}
+	}
+}
+
+// Return true if the watcher has been closed.
+func (watcher *Watcher) stopped() bool {
+	select {
+	case <-watcher.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Send the change to watcher channel if the watcher wants it, return false if the watcher has been closed.
+func (watcher *Watcher) deliver(change Change) (moveOn bool, err error) {
+	if watcher.stopped() {
+		return false, nil
+	}
+	watcher.seq = change.Seq
+	switch change.Op {
+	case ChangeInsert, ChangeUpdate, ChangeDelete:
+	default:
+		return !watcher.stopped(), nil
+	}
+	if watcher.opts.Col != "" && change.Col != watcher.opts.Col {
+		return !watcher.stopped(), nil
+	}
+	if watcher.opts.Query != nil {
+		if match, err := watcher.match(change); err != nil || !match {
+			return err == nil && !watcher.stopped(), err
+		}
+	}
+	if !watcher.opts.OldDoc {
+		change.OldDoc = nil
+	}
+	select {
+	case watcher.out <- change:
+		return true, nil
+	case <-watcher.stop:
+		return false, nil
+	}
+}
+
+// Return true if the document before or after the change is matched by the query.
+func (watcher *Watcher) match(change Change) (bool, error) {
+	watcher.db.schemaLock.RLock()
+	defer watcher.db.schemaLock.RUnlock()
+	col := watcher.db.cols[change.Col]
+	if col == nil || watcher.stopped() {
+		// The collection is gone, or the database has been restored
+		return false, nil
+	}
+	for _, docJS := range []json.RawMessage{change.Doc, change.OldDoc} {
+		var doc map[string]interface{}
+		if len(docJS) == 0 || json.Unmarshal(docJS, &doc) != nil {
+			continue
+		}
+		if match, err := col.matchDoc(watcher.opts.Query, change.ID, doc); err != nil || match {
+			return match, err
+		}
+	}
+	return false, nil
+}
+
+// Return the error that stopped the watcher, if any.
+func (watcher *Watcher) Err() error {
+	select {
+	case <-watcher.done:
+		return watcher.err
+	default:
+		return nil
+	}
+}
+
+// Stop the watcher and close its channel, return the error that stopped the watcher earlier, if any.
+func (watcher *Watcher) Close() error {
+	watcher.once.Do(func() {
+		close(watcher.stop)
+	})
+	// Drain the channel so that the watcher does not block on delivery
+	for range watcher.out {
+	}
+	<-watcher.done
+	return watcher.err
+}
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Receive the number of changes from the watcher, fail the test if they do not arrive in time.
+func receiveChanges(t *testing.T, watcher *Watcher, count int) (changes []Change) {
+	for len(changes) < count {
+		select {
+		case change, ok := <-watcher.C:
+			if !ok {
+				t.Fatal("watcher stopped", watcher.Err())
+			}
+			changes = append(changes, change)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out after changes", changes)
+		}
+	}
+	return
+}
+
+func TestWatch(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("a"); err != nil {
+		t.Fatal(err)
+	} else if _, err = db.Watch(WatchOptions{AfterSeq: WatchFromNow}); err == nil {
+		t.Fatal("did not error")
+	} else if err = db.EnableChangeLog(); err != nil {
+		t.Fatal(err)
+	} else if _, err = db.Watch(WatchOptions{Query: "all", AfterSeq: WatchFromNow}); err == nil {
+		t.Fatal("did not error")
+	} else if _, err = db.Watch(WatchOptions{Col: "a", Query: map[string]interface{}{"eq": 1}, AfterSeq: WatchFromNow}); err == nil {
+		t.Fatal("did not error")
+	} else if _, err = db.Watch(WatchOptions{AfterSeq: 1}); err == nil {
+		t.Fatal("did not error")
+	} else if _, err = db.Watch(WatchOptions{Col: "b", AfterSeq: WatchFromNow}); err == nil {
+		t.Fatal("did not error")
+	} else if _, err = db.Watch(WatchOptions{Col: "b", Query: "all", AfterSeq: WatchFromNow}); err == nil {
+		t.Fatal("did not error")
+	}
+	col := db.Use("a")
+	all, err := db.Watch(WatchOptions{Col: "a", AfterSeq: WatchFromNow, OldDoc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders, err := db.Watch(WatchOptions{Col: "a", Query: map[string]interface{}{"eq": "ORDER", "in": []interface{}{"kind"}, "collation": "nocase"}, AfterSeq: WatchFromNow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Changes of other collections are not delivered
+	if err = db.Create("b"); err != nil {
+		t.Fatal(err)
+	} else if _, err = db.Use("b").Insert(map[string]interface{}{"kind": "order"}); err != nil {
+		t.Fatal(err)
+	}
+	order, err := col.Insert(map[string]interface{}{"kind": "order"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := col.Insert(map[string]interface{}{"kind": "other"})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = col.Update(order, map[string]interface{}{"kind": "shipped"}); err != nil {
+		t.Fatal(err)
+	} else if err = col.Delete(other); err != nil {
+		t.Fatal(err)
+	}
+	changes := receiveChanges(t, all, 4)
+	var oldDoc map[string]interface{}
+	if changes[0].Op != ChangeInsert || changes[0].ID != order || changes[1].ID != other ||
+		changes[2].Op != ChangeUpdate || changes[3].Op != ChangeDelete || changes[3].ID != other {
+		t.Fatal(changes)
+	} else if err = json.Unmarshal(changes[2].OldDoc, &oldDoc); err != nil || oldDoc["kind"] != "order" {
+		t.Fatal(string(changes[2].OldDoc), err)
+	} else if err = json.Unmarshal(changes[3].OldDoc, &oldDoc); err != nil || oldDoc["kind"] != "other" {
+		t.Fatal(string(changes[3].OldDoc), err)
+	}
+	// The order is delivered upon insert, and upon update as it was an order before
+	orderChanges := receiveChanges(t, orders, 2)
+	if orderChanges[0].Seq != changes[0].Seq || orderChanges[1].Seq != changes[2].Seq || orderChanges[1].OldDoc != nil {
+		t.Fatal(orderChanges)
+	} else if err = orders.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := <-orders.C; ok {
+		t.Fatal("channel is not closed")
+	}
+	// Resume after a change, from the changes kept in memory and from change log files
+	resumed, err := db.Watch(WatchOptions{Col: "a", AfterSeq: changes[1].Seq})
+	if err != nil {
+		t.Fatal(err)
+	} else if resumedChanges := receiveChanges(t, resumed, 2); resumedChanges[0].Seq != changes[2].Seq || resumedChanges[1].Seq != changes[3].Seq {
+		t.Fatal(resumedChanges)
+	}
+	resumed.Close()
+	for i := 0; i < 2*changeLogRecent; i++ {
+		if _, err = col.Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receiveChanges(t, all, 2*changeLogRecent)
+	resumed, err = db.Watch(WatchOptions{Col: "a", AfterSeq: changes[1].Seq})
+	if err != nil {
+		t.Fatal(err)
+	} else if resumedChanges := receiveChanges(t, resumed, 2+2*changeLogRecent); resumedChanges[0].Seq != changes[2].Seq {
+		t.Fatal(resumedChanges[0])
+	}
+	resumed.Close()
+	// Watchers stop when database is closed
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := <-all.C; ok {
+		t.Fatal("channel is not closed")
+	} else if all.Err() == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestWatchWhileWriting(t *testing.T) {
+	os.RemoveAll(TEST_DATA_DIR)
+	defer os.RemoveAll(TEST_DATA_DIR)
+	if err := os.MkdirAll(TEST_DATA_DIR, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(TEST_DATA_DIR+"/number_of_partitions", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(TEST_DATA_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Create("a"); err != nil {
+		t.Fatal(err)
+	} else if err = db.EnableChangeLog(); err != nil {
+		t.Fatal(err)
+	}
+	// Changes arrive in order and none is skipped, though the watcher falls behind while the changes kept in memory
+	// are replaced
+	var watcher *Watcher
+	var changes []Change
+	afterSeq, total := 0, 5*changeLogRecent
+	for i := 0; i < total; i++ {
+		if _, err = db.Use("a").Insert(map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+		if i == 2*changeLogRecent {
+			_, afterSeq = db.log.seqRange()
+		} else if i == 3*changeLogRecent {
+			// The watcher starts behind and takes many changes at once
+			if watcher, err = db.Watch(WatchOptions{Col: "a", AfterSeq: afterSeq}); err != nil {
+				t.Fatal(err)
+			}
+			defer watcher.Close()
+			changes = receiveChanges(t, watcher, 1)
+		}
+	}
+	changes = append(changes, receiveChanges(t, watcher, total-afterSeq-1)...)
+	for i, change := range changes {
+		var doc map[string]interface{}
+		if change.Seq != afterSeq+1+i {
+			t.Fatal(i, change.Seq)
+		} else if err = json.Unmarshal(change.Doc, &doc); err != nil || doc["n"] != float64(2*changeLogRecent+1+i) {
+			t.Fatal(i, string(change.Doc), err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Update and delete documents matched by a query.
+
+package db
+
+import "sort"
+
+// WhereResult is the outcome of updating or deleting documents matched by a query.
+type WhereResult struct {
+	Matched int            // Number of documents matched by the query.
+	Changed int            // Number of documents updated or deleted (or that would be, in a dry run).
+	Errors  map[int]string // Errors of the documents that could not be updated or deleted, by document ID.
+}
+
+// Evaluate the query and run the function on every matched document in the order of document ID.
+func (col *Col) forEachMatch(query interface{}, fun func(id int) error) (result WhereResult, err error) {
+	matches := make(map[int]struct{})
+	if err = EvalQuery(query, col, &matches); err != nil {
+		return
+	}
+	ids := make([]int, 0, len(matches))
+	for id := range matches {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	result.Matched = len(ids)
+	result.Errors = make(map[int]string)
+	for _, id := range ids {
+		if docErr := fun(id); docErr != nil {
+			result.Errors[id] = docErr.Error()
+		} else {
+			result.Changed++
+		}
+	}
+	return
+}
+
+// Apply the patch (see Patch) to every document matched by the query. Each document is patched atomically, and a
+// document failing the patch does not stop the others from being patched. In a dry run, documents are not modified.
+func (col *Col) UpdateWhere(query interface{}, patchType string, patch interface{}, dryRun bool) (WhereResult, error) {
+	return col.forEachMatch(query, func(id int) error {
+		if !dryRun {
+			return col.Patch(id, patchType, patch)
+		}
+		doc, err := col.Read(id)
+		if err == nil {
+			_, err = ApplyPatch(doc, patchType, patch)
+		}
+		return err
+	})
+}
+
+// Delete every document matched by the query. In a dry run, documents are not deleted.
+func (col *Col) DeleteWhere(query interface{}, dryRun bool) (WhereResult, error) {
+	return col.forEachMatch(query, func(id int) error {
+		if !dryRun {
+			return col.Delete(id)
+		}
+		_, err := col.Read(id)
+		return err
+	})
+}
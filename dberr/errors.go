@@ -12,14 +12,24 @@ const (
 	ErrorIO    errorType = "IO error has occured, see log for more details."
 	ErrorNoDoc errorType = "Document `%d` does not exist"
 
+	// Document ID errors
+	ErrorDocExists errorType = "Document `%d` already exists"
+	ErrorBadDocID  errorType = "Document ID `%d` is invalid, it must not be negative"
+
 	// Document errors
-	ErrorDocTooLarge errorType = "Document is too large. Max: `%d`, Given: `%d`"
+	ErrorDocTooLarge  errorType = "Document is too large. Max: `%d`, Given: `%d`"
+	ErrorDocCorrupted errorType = "Document `%d` is corrupted (checksum mismatch)"
+	ErrorRevMismatch  errorType = "Document `%d` is at revision %d, not the expected revision %d"
+	ErrorPatch        errorType = "Cannot apply patch - %s"
+	ErrorRejected     errorType = "Document `%d` is rejected - %v"
+	ErrorInvalidDoc   errorType = "Document `%d` does not match collection schema - %v"
 
 	// Query input errors
 	ErrorNeedIndex         errorType = "Please index %v and retry query %v."
 	ErrorExpectingSubQuery errorType = "Expecting a vector of sub-queries, but %v given."
 	ErrorExpectingInt      errorType = "Expecting `%s` as an integer, but %v given."
 	ErrorMissing           errorType = "Missing `%s`"
+	ErrorLoading           errorType = "Collection `%s` is being bulk loaded, please retry query after the load is committed."
 )
 
 func New(err errorType, details ...interface{}) Error {
@@ -28,6 +28,16 @@ type MMap []byte
 // Note that because of runtime limitations, no file larger than about 2GB can
 // be completely mapped into memory.
 func Map(f *os.File) (MMap, error) {
+	return mapFile(f, false)
+}
+
+// MapPrivate maps an entire file into memory copy-on-write: the file may be
+// opened read-only, and writes to the mapping are never carried to the file.
+func MapPrivate(f *os.File) (MMap, error) {
+	return mapFile(f, true)
+}
+
+func mapFile(f *os.File, private bool) (MMap, error) {
 	fd := uintptr(f.Fd())
 	fi, err := f.Stat()
 	if err != nil {
@@ -37,7 +47,7 @@ func Map(f *os.File) (MMap, error) {
 	if int64(length) != fi.Size() {
 		return nil, errors.New("memory map file length overflow")
 	}
-	return mmap(length, fd)
+	return mmap(length, fd, private)
 }
 
 func (m *MMap) header() *reflect.SliceHeader {
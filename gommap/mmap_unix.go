@@ -10,8 +10,12 @@ import (
 	"syscall"
 )
 
-func mmap(len int, fd uintptr) ([]byte, error) {
-	return syscall.Mmap(int(fd), 0, len, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+func mmap(len int, fd uintptr, private bool) ([]byte, error) {
+	flags := syscall.MAP_SHARED
+	if private {
+		flags = syscall.MAP_PRIVATE
+	}
+	return syscall.Mmap(int(fd), 0, len, syscall.PROT_READ|syscall.PROT_WRITE, flags)
 }
 
 func unmap(addr, len uintptr) error {
@@ -22,13 +22,17 @@ var handleLock sync.Mutex
 var handleMap = map[uintptr]syscall.Handle{}
 
 // Windows mmap always mapes the entire file regardless of the specified length.
-func mmap(length int, hfile uintptr) ([]byte, error) {
-	h, errno := syscall.CreateFileMapping(syscall.Handle(hfile), nil, syscall.PAGE_READWRITE, 0, 0, nil)
+func mmap(length int, hfile uintptr, private bool) ([]byte, error) {
+	prot, access := uint32(syscall.PAGE_READWRITE), uint32(syscall.FILE_MAP_WRITE)
+	if private {
+		prot, access = syscall.PAGE_WRITECOPY, syscall.FILE_MAP_COPY
+	}
+	h, errno := syscall.CreateFileMapping(syscall.Handle(hfile), nil, prot, 0, 0, nil)
 	if h == 0 {
 		return nil, os.NewSyscallError("CreateFileMapping", errno)
 	}
 
-	addr, errno := syscall.MapViewOfFile(h, syscall.FILE_MAP_WRITE, 0, 0, 0)
+	addr, errno := syscall.MapViewOfFile(h, access, 0, 0, 0)
 	if addr == 0 {
 		return nil, os.NewSyscallError("MapViewOfFile", errno)
 	}
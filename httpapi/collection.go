@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+
+	"github.com/HouzuoGuo/tiedot/db"
 )
 
 // Create a collection.
@@ -18,7 +20,14 @@ func Create(w http.ResponseWriter, r *http.Request) {
 	if !Require(w, r, "col", &col) {
 		return
 	}
-	if err := HttpDB.Create(col); err != nil {
+	opts := db.ColOptions{IDStrategy: r.FormValue("idstrategy")}
+	var ok bool
+	if opts.MaxDocs, ok = intParam(w, r, "maxdocs", 0); !ok {
+		return
+	} else if opts.MaxBytes, ok = intParam(w, r, "maxbytes", 0); !ok {
+		return
+	}
+	if err := HttpDB.CreateWith(col, opts); err != nil {
 		http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
 	} else {
 		w.WriteHeader(http.StatusCreated)
@@ -76,10 +85,10 @@ func Drop(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// De-fragment collection free space and fix corrupted documents.
+// De-fragment collection free space and fix corrupted documents. Respond with IDs of corrupted documents.
 func Scrub(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
-	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
 	var col string
@@ -89,8 +98,40 @@ func Scrub(w http.ResponseWriter, r *http.Request) {
 	dbCol := HttpDB.Use(col)
 	if dbCol == nil {
 		http.Error(w, fmt.Sprintf("Collection %s does not exist", col), http.StatusBadRequest)
-	} else {
-		HttpDB.Scrub(col)
+		return
+	}
+	corrupted, err := HttpDB.ScrubReport(col)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	if corrupted == nil {
+		corrupted = []int{}
+	}
+	resp, err := json.Marshal(corrupted)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resp)
+}
+
+// Compact collection data files one partition at a time, without blocking document access.
+func Compact(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if HttpDB.Use(col) == nil {
+		http.Error(w, fmt.Sprintf("Collection %s does not exist", col), http.StatusBadRequest)
+		return
+	}
+	if err := HttpDB.Compact(col); err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 	}
 }
 
@@ -35,6 +35,8 @@ func TestCollection(t *testing.T) {
 		TCreateError,
 		TCreateDuplicateCollection,
 		TCreate,
+		TCreateIDStrategy,
+		TCreateCapped,
 		TAll,
 		TRename,
 		TRenameMissingOldParameter,
@@ -99,6 +101,45 @@ func TCreate(t *testing.T) {
 	}
 }
 
+func TCreateIDStrategy(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	w := httptest.NewRecorder()
+	Create(w, httptest.NewRequest("GET", requestCreate+"&idstrategy=monotonic", nil))
+	if w.Code != 201 || HttpDB.Use(collection).Options().IDStrategy != db.IDMonotonic {
+		t.Error("Expected code 201 and a collection of monotonic IDs", w.Code)
+	}
+	wBad := httptest.NewRecorder()
+	Create(wBad, httptest.NewRequest("GET", "http://localhost:8080/create?col=other&idstrategy=whatever", nil))
+	if wBad.Code != 400 || strings.TrimSpace(wBad.Body.String()) != "ID strategy whatever is not supported" {
+		t.Error("Expected code 400 for unsupported ID strategy", wBad.Code, wBad.Body.String())
+	}
+}
+func TCreateCapped(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	w := httptest.NewRecorder()
+	Create(w, httptest.NewRequest("GET", requestCreate+"&maxdocs=100&maxbytes=4096", nil))
+	if opts := HttpDB.Use(collection).Options(); w.Code != 201 || opts.IDStrategy != db.IDMonotonic || opts.MaxDocs != 100 || opts.MaxBytes != 4096 {
+		t.Error("Expected code 201 and a capped collection", w.Code, opts)
+	}
+	for _, params := range []string{"&maxdocs=x", "&maxbytes=-1", "&maxdocs=1&idstrategy=random"} {
+		wBad := httptest.NewRecorder()
+		Create(wBad, httptest.NewRequest("GET", "http://localhost:8080/create?col=other"+params, nil))
+		if wBad.Code != 400 {
+			t.Error("Expected code 400 for invalid limits", params, wBad.Code)
+		}
+	}
+}
+
 // Test All
 func TAll(t *testing.T) {
 	setupTestCase()
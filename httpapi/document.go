@@ -8,6 +8,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/tiedot/db"
+	"github.com/HouzuoGuo/tiedot/dberr"
 )
 
 // Insert a document into collection.
@@ -37,7 +41,10 @@ func Insert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	id, err := dbcol.Insert(jsonDoc)
-	if err != nil {
+	if dberr.Type(err) == dberr.ErrorRejected || dberr.Type(err) == dberr.ErrorInvalidDoc {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	} else if err != nil {
 		http.Error(w, fmt.Sprint(err), 500)
 		return
 	}
@@ -45,6 +52,152 @@ func Insert(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(fmt.Sprint(id)))
 }
 
+// Insert a document under the specified ID.
+func InsertWithID(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, id, doc string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "id", &id) {
+		return
+	}
+	defer r.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(r.Body)
+	doc = string(bodyBytes)
+	if doc == "" && !Require(w, r, "doc", &doc) {
+		return
+	}
+	docID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid document ID '%v'.", id), 400)
+		return
+	}
+	var jsonDoc map[string]interface{}
+	if err := json.Unmarshal([]byte(doc), &jsonDoc); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON document.", doc), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err = dbcol.InsertWithID(docID, jsonDoc); err != nil {
+		switch dberr.Type(err) {
+		case dberr.ErrorDocExists:
+			http.Error(w, fmt.Sprint(err), 409)
+		case dberr.ErrorBadDocID, dberr.ErrorRejected, dberr.ErrorInvalidDoc:
+			http.Error(w, fmt.Sprint(err), 400)
+		default:
+			http.Error(w, fmt.Sprint(err), 500)
+		}
+		return
+	}
+	w.WriteHeader(201)
+	w.Write([]byte(fmt.Sprint(docID)))
+}
+
+// Update the document of the specified ID, or insert it if the ID does not exist.
+func Upsert(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, id, doc string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "id", &id) {
+		return
+	}
+	defer r.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(r.Body)
+	doc = string(bodyBytes)
+	if doc == "" && !Require(w, r, "doc", &doc) {
+		return
+	}
+	docID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid document ID '%v'.", id), 400)
+		return
+	}
+	var jsonDoc map[string]interface{}
+	if err := json.Unmarshal([]byte(doc), &jsonDoc); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON document.", doc), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	inserted, err := dbcol.Upsert(docID, jsonDoc)
+	if err != nil {
+		if dberr.Type(err) == dberr.ErrorBadDocID || dberr.Type(err) == dberr.ErrorRejected || dberr.Type(err) == dberr.ErrorInvalidDoc {
+			http.Error(w, fmt.Sprint(err), 400)
+		} else {
+			http.Error(w, fmt.Sprint(err), 500)
+		}
+		return
+	}
+	if inserted {
+		w.WriteHeader(201)
+	}
+	w.Write([]byte(fmt.Sprint(docID)))
+}
+
+// Update the only document that has the value in an indexed path, or insert the document if there is none.
+func UpsertByIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, path, val, doc string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "path", &path) {
+		return
+	}
+	if !Require(w, r, "val", &val) {
+		return
+	}
+	defer r.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(r.Body)
+	doc = string(bodyBytes)
+	if doc == "" && !Require(w, r, "doc", &doc) {
+		return
+	}
+	var jsonVal interface{}
+	if err := json.Unmarshal([]byte(val), &jsonVal); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON value.", val), 400)
+		return
+	}
+	var jsonDoc map[string]interface{}
+	if err := json.Unmarshal([]byte(doc), &jsonDoc); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON document.", doc), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	id, inserted, err := dbcol.UpsertByIndex(strings.Split(path, ","), jsonVal, jsonDoc)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	if inserted {
+		w.WriteHeader(201)
+	}
+	w.Write([]byte(fmt.Sprint(id)))
+}
+
 // Find and retrieve a document by ID.
 func Get(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
@@ -68,7 +221,7 @@ func Get(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
 		return
 	}
-	doc, err := dbcol.Read(docID)
+	doc, rev, err := dbcol.ReadRev(docID)
 	if doc == nil {
 		http.Error(w, fmt.Sprintf("No such document ID %d.", docID), 404)
 		return
@@ -78,9 +231,34 @@ func Get(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprint(err), 500)
 		return
 	}
+	w.Header().Set("ETag", etag(rev))
 	w.Write(resp)
 }
 
+// Return the entity tag of a document revision.
+func etag(rev int) string {
+	return fmt.Sprintf("\"%d\"", rev)
+}
+
+// Return the document revision required by "If-Match" header or "rev" parameter, and the HTTP status code to respond
+// with if the document is not at the revision - 412 for the header and 409 for the parameter.
+func requiredRev(w http.ResponseWriter, r *http.Request) (rev, mismatchStatus int, required, ok bool) {
+	var revStr string
+	if ifMatch := strings.TrimSpace(r.Header.Get("If-Match")); ifMatch != "" && ifMatch != "*" {
+		revStr, mismatchStatus = strings.Trim(strings.TrimPrefix(ifMatch, "W/"), "\""), http.StatusPreconditionFailed
+	} else if revStr = r.FormValue("rev"); revStr != "" {
+		mismatchStatus = http.StatusConflict
+	} else {
+		return 0, 0, false, true
+	}
+	rev, err := strconv.Atoi(revStr)
+	if err != nil || rev < 0 {
+		http.Error(w, fmt.Sprintf("Invalid document revision '%v'.", revStr), 400)
+		return 0, 0, false, false
+	}
+	return rev, mismatchStatus, true, true
+}
+
 // Divide documents into roughly equally sized pages, and return documents in the specified page.
 func GetPage(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
@@ -128,12 +306,16 @@ func GetPage(w http.ResponseWriter, r *http.Request) {
 	w.Write(resp)
 }
 
-// Update a document.
+// Update a document, or apply a partial update if the request method is PATCH.
 func Update(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PATCH" {
+		Patch(w, r)
+		return
+	}
 	w.Header().Set("Cache-Control", "must-revalidate")
 	w.Header().Set("Content-Type", "text/plain")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, PATCH, OPTIONS")
 	var col, id, doc string
 	if !Require(w, r, "col", &col) {
 		return
@@ -157,16 +339,130 @@ func Update(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("'%v' is not valid JSON document.", newDoc), 400)
 		return
 	}
+	rev, mismatchStatus, revRequired, ok := requiredRev(w, r)
+	if !ok {
+		return
+	}
 	dbcol := HttpDB.Use(col)
 	if dbcol == nil {
 		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
 		return
 	}
-	err = dbcol.Update(docID, newDoc)
+	if !revRequired {
+		err = dbcol.Update(docID, newDoc)
+	} else if rev, err = dbcol.UpdateIfRev(docID, rev, newDoc); err == nil {
+		w.Header().Set("ETag", etag(rev))
+	}
+	if dberr.Type(err) == dberr.ErrorRevMismatch {
+		http.Error(w, fmt.Sprint(err), mismatchStatus)
+		return
+	} else if dberr.Type(err) == dberr.ErrorRejected || dberr.Type(err) == dberr.ErrorInvalidDoc {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+}
+
+// Apply a partial update (JSON merge patch, JSON patch or update operators) to a document.
+func Patch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, PATCH, OPTIONS")
+	var col, id, doc string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "id", &id) {
+		return
+	}
+	defer r.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(r.Body)
+	doc = string(bodyBytes)
+	if doc == "" && !Require(w, r, "doc", &doc) {
+		return
+	}
+	docID, err := strconv.Atoi(id)
 	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid document ID '%v'.", id), 400)
+		return
+	}
+	// Patch type is given by parameter, or otherwise by content type
+	patchType := r.FormValue("type")
+	if patchType == "" {
+		patchType = db.PatchMerge
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json-patch+json") {
+			patchType = db.PatchJSON
+		}
+	}
+	var patch interface{}
+	if err := json.Unmarshal([]byte(doc), &patch); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON patch.", doc), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err = dbcol.Patch(docID, patchType, patch); dberr.Type(err) == dberr.ErrorPatch || dberr.Type(err) == dberr.ErrorRejected || dberr.Type(err) == dberr.ErrorInvalidDoc {
+		http.Error(w, fmt.Sprint(err), 400)
+	} else if err != nil {
 		http.Error(w, fmt.Sprint(err), 500)
+	}
+}
+
+// Carry out insert, update and delete operations given one per line (NDJSON), respond with their outcome in the same order.
+func Bulk(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, ops string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	defer r.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(r.Body)
+	ops = string(bodyBytes)
+	if ops == "" && !Require(w, r, "ops", &ops) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
 		return
 	}
+	// Lines that are not valid operations fail on their own, the others are carried out together
+	results := make([]db.BulkResult, 0)
+	validOps := make([]db.BulkOp, 0)
+	validLines := make([]int, 0)
+	for _, line := range strings.Split(ops, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var op db.BulkOp
+		if err := json.Unmarshal([]byte(line), &op); err != nil {
+			results = append(results, db.BulkResult{Error: fmt.Sprintf("'%v' is not valid JSON operation.", line)})
+			continue
+		}
+		validOps = append(validOps, op)
+		validLines = append(validLines, len(results))
+		results = append(results, db.BulkResult{})
+	}
+	for i, result := range dbcol.Bulk(validOps) {
+		results[validLines[i]] = result
+	}
+	for _, result := range results {
+		resp, err := json.Marshal(result)
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 500)
+			return
+		}
+		w.Write(append(resp, '\n'))
+	}
 }
 
 // Delete a document.
@@ -187,12 +483,26 @@ func Delete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Invalid document ID '%v'.", id), 400)
 		return
 	}
+	rev, mismatchStatus, revRequired, ok := requiredRev(w, r)
+	if !ok {
+		return
+	}
 	dbcol := HttpDB.Use(col)
 	if dbcol == nil {
 		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
 		return
 	}
-	dbcol.Delete(docID)
+	if !revRequired {
+		if err = dbcol.Delete(docID); dberr.Type(err) == dberr.ErrorRejected {
+			http.Error(w, fmt.Sprint(err), 400)
+		}
+	} else if err = dbcol.DeleteIfRev(docID, rev); dberr.Type(err) == dberr.ErrorRejected {
+		http.Error(w, fmt.Sprint(err), 400)
+	} else if dberr.Type(err) == dberr.ErrorRevMismatch {
+		http.Error(w, fmt.Sprint(err), mismatchStatus)
+	} else if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+	}
 }
 
 // Return approximate number of documents in the collection.
@@ -2,6 +2,7 @@ package httpapi
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http/httptest"
@@ -38,6 +39,14 @@ var (
 	requestApproxDocCountNotCol = "http://localhost:8080/approxdoccount"
 	requestApproxDocCount       = "http://localhost:8080/approxdoccount?col=%s"
 
+	requestInsertWithID  = "http://localhost:8080/insertwithid?col=%s&id=%s"
+	requestUpsert        = "http://localhost:8080/upsert?col=%s&id=%s"
+	requestUpsertByIndex = "http://localhost:8080/upsertbyindex?col=%s&path=%s&val=%s"
+
+	requestPatch = "http://localhost:8080/patch?col=%s&id=%s"
+
+	requestBulk = "http://localhost:8080/bulk?col=%s"
+
 	page  = "1"
 	total = 2
 )
@@ -78,6 +87,14 @@ func TestDocument(t *testing.T) {
 		TApproxDocCountNotCol,
 		TApproxDocCountColNotExist,
 		TApproxDocCount,
+		TInsertWithID,
+		TUpsert,
+		TUpsertByIndex,
+		TUpdateIfMatch,
+		TDeleteIfMatch,
+		TPatch,
+		TBulk,
+		THookRejected,
 	}
 	managerSubTests(testsDocument, "document_test", t)
 }
@@ -839,3 +856,321 @@ func TApproxDocCount(t *testing.T) {
 		t.Error("Expected code 200 and count 0")
 	}
 }
+
+// Test InsertWithID
+func TInsertWithID(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+
+	wInsert := httptest.NewRecorder()
+	InsertWithID(wInsert, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestInsertWithID, collection, "123"), bytes.NewBufferString("{\"a\":1}")))
+	if wInsert.Code != 201 || strings.TrimSpace(wInsert.Body.String()) != "123" {
+		t.Error("Expected code 201 and the document ID", wInsert.Code, wInsert.Body.String())
+	}
+	wCollide := httptest.NewRecorder()
+	InsertWithID(wCollide, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestInsertWithID, collection, "123"), bytes.NewBufferString("{\"a\":2}")))
+	if wCollide.Code != 409 {
+		t.Error("Expected code 409 for an existing document ID", wCollide.Code)
+	}
+	wNegative := httptest.NewRecorder()
+	InsertWithID(wNegative, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestInsertWithID, collection, "-1"), bytes.NewBufferString("{\"a\":2}")))
+	if wNegative.Code != 400 {
+		t.Error("Expected code 400 for a negative document ID", wNegative.Code)
+	}
+	wGet := httptest.NewRecorder()
+	Get(wGet, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGet, collection, "123"), nil))
+	if wGet.Code != 200 || strings.TrimSpace(wGet.Body.String()) != "{\"a\":1}" {
+		t.Error("Expected the original document", wGet.Code, wGet.Body.String())
+	}
+}
+
+// Test Upsert
+func TUpsert(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+
+	wInsert := httptest.NewRecorder()
+	Upsert(wInsert, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpsert, collection, "123"), bytes.NewBufferString("{\"a\":1}")))
+	if wInsert.Code != 201 {
+		t.Error("Expected code 201 for an inserted document", wInsert.Code)
+	}
+	wUpdate := httptest.NewRecorder()
+	Upsert(wUpdate, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpsert, collection, "123"), bytes.NewBufferString("{\"a\":2}")))
+	if wUpdate.Code != 200 {
+		t.Error("Expected code 200 for an updated document", wUpdate.Code)
+	}
+	wGet := httptest.NewRecorder()
+	Get(wGet, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGet, collection, "123"), nil))
+	if wGet.Code != 200 || strings.TrimSpace(wGet.Body.String()) != "{\"a\":2}" {
+		t.Error("Expected the updated document", wGet.Code, wGet.Body.String())
+	}
+}
+
+// Test UpsertByIndex
+func TUpsertByIndex(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	Index(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIndex, collection, "email"), nil))
+
+	wInsert := httptest.NewRecorder()
+	UpsertByIndex(wInsert, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpsertByIndex, collection, "email", "%22a@example.com%22"), bytes.NewBufferString("{\"email\":\"a@example.com\",\"n\":1}")))
+	if wInsert.Code != 201 {
+		t.Error("Expected code 201 for an inserted document", wInsert.Code, wInsert.Body.String())
+	}
+	wUpdate := httptest.NewRecorder()
+	UpsertByIndex(wUpdate, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpsertByIndex, collection, "email", "%22a@example.com%22"), bytes.NewBufferString("{\"email\":\"a@example.com\",\"n\":2}")))
+	if wUpdate.Code != 200 || wUpdate.Body.String() != wInsert.Body.String() {
+		t.Error("Expected code 200 and the same document ID", wUpdate.Code, wUpdate.Body.String())
+	}
+	wMismatch := httptest.NewRecorder()
+	UpsertByIndex(wMismatch, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpsertByIndex, collection, "email", "%22b@example.com%22"), bytes.NewBufferString("{\"email\":\"c@example.com\"}")))
+	if wMismatch.Code != 400 {
+		t.Error("Expected code 400 for a document without the value", wMismatch.Code)
+	}
+	wBadVal := httptest.NewRecorder()
+	UpsertByIndex(wBadVal, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpsertByIndex, collection, "email", "a@example.com"), bytes.NewBufferString("{\"email\":\"a@example.com\"}")))
+	if wBadVal.Code != 400 || strings.TrimSpace(wBadVal.Body.String()) != "'a@example.com' is not valid JSON value." {
+		t.Error("Expected code 400 for an invalid value", wBadVal.Code, wBadVal.Body.String())
+	}
+	wGet := httptest.NewRecorder()
+	Get(wGet, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGet, collection, wInsert.Body.String()), nil))
+	if wGet.Code != 200 || strings.TrimSpace(wGet.Body.String()) != "{\"email\":\"a@example.com\",\"n\":2}" {
+		t.Error("Expected the updated document", wGet.Code, wGet.Body.String())
+	}
+}
+
+// Test conditional Update
+func TUpdateIfMatch(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	wInsert := httptest.NewRecorder()
+	Insert(wInsert, httptest.NewRequest(RandMethodRequest(), requestInsertWithoutDoc, bytes.NewBufferString("{\"a\":1}")))
+	id := strings.TrimSpace(wInsert.Body.String())
+
+	wGet := httptest.NewRecorder()
+	Get(wGet, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGet, collection, id), nil))
+	etag := wGet.Header().Get("ETag")
+	if wGet.Code != 200 || etag != "\"1\"" {
+		t.Error("Expected code 200 and ETag of the first revision", wGet.Code, etag)
+	}
+	// Update with the current revision
+	reqUpdate := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdate, collection, id), bytes.NewBufferString("{\"a\":2}"))
+	reqUpdate.Header.Set("If-Match", etag)
+	wUpdate := httptest.NewRecorder()
+	Update(wUpdate, reqUpdate)
+	if wUpdate.Code != 200 || wUpdate.Header().Get("ETag") != "\"2\"" {
+		t.Error("Expected code 200 and ETag of the second revision", wUpdate.Code, wUpdate.Header().Get("ETag"))
+	}
+	// The same header no longer matches
+	reqStale := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdate, collection, id), bytes.NewBufferString("{\"a\":3}"))
+	reqStale.Header.Set("If-Match", etag)
+	wStale := httptest.NewRecorder()
+	Update(wStale, reqStale)
+	if wStale.Code != 412 {
+		t.Error("Expected code 412 for a stale ETag", wStale.Code)
+	}
+	// Revision parameter
+	wConflict := httptest.NewRecorder()
+	Update(wConflict, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdate+"&rev=1", collection, id), bytes.NewBufferString("{\"a\":3}")))
+	if wConflict.Code != 409 {
+		t.Error("Expected code 409 for a stale revision", wConflict.Code)
+	}
+	wBadRev := httptest.NewRecorder()
+	Update(wBadRev, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdate+"&rev=x", collection, id), bytes.NewBufferString("{\"a\":3}")))
+	if wBadRev.Code != 400 || strings.TrimSpace(wBadRev.Body.String()) != "Invalid document revision 'x'." {
+		t.Error("Expected code 400 for an invalid revision", wBadRev.Code, wBadRev.Body.String())
+	}
+	wGet = httptest.NewRecorder()
+	Get(wGet, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGet, collection, id), nil))
+	if strings.TrimSpace(wGet.Body.String()) != "{\"a\":2}" || wGet.Header().Get("ETag") != "\"2\"" {
+		t.Error("Expected the document of second revision", wGet.Body.String(), wGet.Header().Get("ETag"))
+	}
+}
+
+// Test conditional Delete
+func TDeleteIfMatch(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	wInsert := httptest.NewRecorder()
+	Insert(wInsert, httptest.NewRequest(RandMethodRequest(), requestInsertWithoutDoc, bytes.NewBufferString("{\"a\":1}")))
+	id := strings.TrimSpace(wInsert.Body.String())
+
+	reqStale := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDelete, collection, id), nil)
+	reqStale.Header.Set("If-Match", "\"2\"")
+	wStale := httptest.NewRecorder()
+	Delete(wStale, reqStale)
+	if wStale.Code != 412 {
+		t.Error("Expected code 412 for a stale ETag", wStale.Code)
+	}
+	wConflict := httptest.NewRecorder()
+	Delete(wConflict, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDelete+"&rev=2", collection, id), nil))
+	if wConflict.Code != 409 {
+		t.Error("Expected code 409 for a stale revision", wConflict.Code)
+	}
+	reqDelete := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDelete, collection, id), nil)
+	reqDelete.Header.Set("If-Match", "\"1\"")
+	wDelete := httptest.NewRecorder()
+	Delete(wDelete, reqDelete)
+	wGet := httptest.NewRecorder()
+	Get(wGet, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGet, collection, id), nil))
+	if wDelete.Code != 200 || wGet.Code != 404 {
+		t.Error("Expected code 200 and the document to be deleted", wDelete.Code, wGet.Code)
+	}
+}
+
+// Test Patch
+func TPatch(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	wInsert := httptest.NewRecorder()
+	Insert(wInsert, httptest.NewRequest(RandMethodRequest(), requestInsertWithoutDoc, bytes.NewBufferString("{\"a\":1,\"b\":[1]}")))
+	id := strings.TrimSpace(wInsert.Body.String())
+
+	// Merge patch by default
+	wMerge := httptest.NewRecorder()
+	Patch(wMerge, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestPatch, collection, id), bytes.NewBufferString("{\"a\":null,\"c\":2}")))
+	// JSON patch by content type, via PATCH method of /update
+	reqJSON := httptest.NewRequest("PATCH", fmt.Sprintf(requestUpdate, collection, id), bytes.NewBufferString("[{\"op\":\"add\",\"path\":\"/b/-\",\"value\":2}]"))
+	reqJSON.Header.Set("Content-Type", "application/json-patch+json")
+	wJSON := httptest.NewRecorder()
+	Update(wJSON, reqJSON)
+	// Update operators
+	wOperators := httptest.NewRecorder()
+	Patch(wOperators, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestPatch+"&type=operators", collection, id), bytes.NewBufferString("{\"$inc\":{\"c\":1}}")))
+	if wMerge.Code != 200 || wJSON.Code != 200 || wOperators.Code != 200 {
+		t.Error("Expected code 200 for patches", wMerge.Code, wMerge.Body.String(), wJSON.Code, wJSON.Body.String(), wOperators.Code, wOperators.Body.String())
+	}
+	wGet := httptest.NewRecorder()
+	Get(wGet, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGet, collection, id), nil))
+	if strings.TrimSpace(wGet.Body.String()) != "{\"b\":[1,2],\"c\":3}" {
+		t.Error("Expected the patched document", wGet.Body.String())
+	}
+	// Patch that cannot be applied
+	wFail := httptest.NewRecorder()
+	Patch(wFail, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestPatch+"&type=json", collection, id), bytes.NewBufferString("[{\"op\":\"remove\",\"path\":\"/a\"}]")))
+	if wFail.Code != 400 {
+		t.Error("Expected code 400 for a patch that cannot be applied", wFail.Code)
+	}
+	wInvalid := httptest.NewRecorder()
+	Patch(wInvalid, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestPatch, collection, id), bytes.NewBufferString("{a")))
+	if wInvalid.Code != 400 || strings.TrimSpace(wInvalid.Body.String()) != "'{a' is not valid JSON patch." {
+		t.Error("Expected code 400 for invalid JSON", wInvalid.Code, wInvalid.Body.String())
+	}
+}
+
+// Test Bulk
+func TBulk(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	wInsert := httptest.NewRecorder()
+	Insert(wInsert, httptest.NewRequest(RandMethodRequest(), requestInsertWithoutDoc, bytes.NewBufferString("{\"a\":1}")))
+	id := strings.TrimSpace(wInsert.Body.String())
+
+	ops := "{\"op\":\"insert\",\"doc\":{\"a\":2}}\n" +
+		"{\"op\":\"update\",\"id\":" + id + ",\"doc\":{\"a\":3}}\n" +
+		"\n" +
+		"{a\n" +
+		"{\"op\":\"delete\",\"id\":" + id + "}\n" +
+		"{\"op\":\"delete\",\"id\":" + id + "}\n"
+	wBulk := httptest.NewRecorder()
+	Bulk(wBulk, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestBulk, collection), bytes.NewBufferString(ops)))
+	if wBulk.Code != 200 {
+		t.Fatal("Expected code 200", wBulk.Code, wBulk.Body.String())
+	}
+	results := strings.Split(strings.TrimSpace(wBulk.Body.String()), "\n")
+	if len(results) != 5 {
+		t.Fatal("Expected a result for each operation", results)
+	}
+	var inserted db.BulkResult
+	if err := json.Unmarshal([]byte(results[0]), &inserted); err != nil || inserted.Error != "" {
+		t.Error("Expected the document to be inserted", results[0])
+	}
+	if results[1] != "{\"ID\":"+id+"}" || results[3] != "{\"ID\":"+id+"}" {
+		t.Error("Expected the document to be updated and deleted", results)
+	}
+	if !strings.Contains(results[2], "is not valid JSON operation") || !strings.Contains(results[4], "\"Error\"") {
+		t.Error("Expected invalid operations to fail", results)
+	}
+	wGet := httptest.NewRecorder()
+	Get(wGet, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGet, collection, fmt.Sprint(inserted.ID)), nil))
+	if strings.TrimSpace(wGet.Body.String()) != "{\"a\":2}" {
+		t.Error("Expected the inserted document", wGet.Body.String())
+	}
+	wNoCol := httptest.NewRecorder()
+	Bulk(wNoCol, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestBulk, "nocol"), bytes.NewBufferString(ops)))
+	if wNoCol.Code != 400 {
+		t.Error("Expected code 400 for a collection that does not exist", wNoCol.Code)
+	}
+}
+
+// Test writes rejected by hooks
+func THookRejected(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	id, err := HttpDB.Use(collection).Insert(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	HttpDB.Use(collection).AddPreHook(func(op string, id int, oldDoc, newDoc map[string]interface{}) error {
+		return fmt.Errorf("%s is not allowed", op)
+	})
+	docID := strconv.Itoa(id)
+	wInsert := httptest.NewRecorder()
+	Insert(wInsert, httptest.NewRequest(RandMethodRequest(), requestInsertWithoutDoc, bytes.NewBufferString("{\"a\":2}")))
+	wUpdate := httptest.NewRecorder()
+	Update(wUpdate, httptest.NewRequest("PUT", fmt.Sprintf(requestUpdate, collection, docID), bytes.NewBufferString("{\"a\":2}")))
+	wPatch := httptest.NewRecorder()
+	Patch(wPatch, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestPatch, collection, docID), bytes.NewBufferString("{\"a\":2}")))
+	wDelete := httptest.NewRecorder()
+	Delete(wDelete, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDelete, collection, docID), nil))
+	for _, w := range []*httptest.ResponseRecorder{wInsert, wUpdate, wPatch, wDelete} {
+		if w.Code != 400 || !strings.Contains(w.Body.String(), "is rejected - ") {
+			t.Error("Expected code 400 and rejection", w.Code, w.Body.String())
+		}
+	}
+	wGet := httptest.NewRecorder()
+	Get(wGet, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGet, collection, docID), nil))
+	if strings.TrimSpace(wGet.Body.String()) != "{\"a\":1}" {
+		t.Error("Expected the document to be untouched", wGet.Body.String())
+	}
+}
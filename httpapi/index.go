@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+
+	"github.com/HouzuoGuo/tiedot/db"
 )
 
 // Put an index on a document path.
@@ -27,7 +29,21 @@ func Index(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
 		return
 	}
-	if err := dbcol.Index(strings.Split(path, ",")); err != nil {
+	hash := db.DefaultIndexHash
+	if hashFunc := r.FormValue("hash"); hashFunc != "" {
+		hash = hashFunc
+	}
+	var err error
+	if collation := r.FormValue("collation"); collation != "" {
+		if hash != db.HashFNV1a64 {
+			http.Error(w, fmt.Sprintf("Collation is not supported by hash function %s.", hash), 400)
+			return
+		}
+		err = dbcol.IndexWithCollation(strings.Split(path, ","), collation)
+	} else {
+		err = dbcol.IndexWithHash(strings.Split(path, ","), hash)
+	}
+	if err != nil {
 		http.Error(w, fmt.Sprint(err), 400)
 		return
 	}
@@ -84,3 +100,31 @@ func Unindex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// Rebuild an index, optionally using a different hash function.
+func Reindex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, path string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "path", &path) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	hash := db.DefaultIndexHash
+	if hashFunc := r.FormValue("hash"); hashFunc != "" {
+		hash = hashFunc
+	}
+	if err := dbcol.Reindex(strings.Split(path, ","), hash); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+}
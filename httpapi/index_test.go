@@ -14,6 +14,7 @@ var (
 	requestIndex     = "http://localhost:8080/index?col=%s&path=%s"
 	requestIndexes   = "http://localhost:8080/indexes?col=%s"
 	requestUnIndexes = "http://localhost:8080/unindex?col=%s&path=%s"
+	requestReindex   = "http://localhost:8080/reindex?col=%s&path=%s&hash=%s"
 
 	path = "a"
 )
@@ -33,6 +34,8 @@ func TestIndex(t *testing.T) {
 		TUnIndexNotCol,
 		TUnIndexNotPath,
 		TUnIndexErrorNotHave,
+		TReindex,
+		TIndexCollation,
 	}
 	managerSubTests(testsIndex, "index_test", t)
 }
@@ -296,3 +299,83 @@ func TUnIndexErrorNotHave(t *testing.T) {
 		t.Error("Expected code 400 and get message error indexed not exist.")
 	}
 }
+
+// Reindex
+func TReindex(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+
+	b := &bytes.Buffer{}
+	b.WriteString("{\"a\": 1, \"b\": 2}")
+
+	reqCreate := httptest.NewRequest("GET", requestCreate, nil)
+	reqInsert := httptest.NewRequest(RandMethodRequest(), requestInsertWithoutDoc, b)
+	reqIndex := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIndex+"&hash=sdbm", collection, path), nil)
+	reqReindex := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestReindex, collection, path, "fnv1a64"), nil)
+	reqReindexBadHash := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestReindex, collection, path, "doesNotExist"), nil)
+	reqReindexNotIndexed := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestReindex, collection, "b", ""), nil)
+
+	wCreate := httptest.NewRecorder()
+	wInsert := httptest.NewRecorder()
+	wIndex := httptest.NewRecorder()
+	wReindex := httptest.NewRecorder()
+	wReindexBadHash := httptest.NewRecorder()
+	wReindexNotIndexed := httptest.NewRecorder()
+
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(wCreate, reqCreate)
+	Insert(wInsert, reqInsert)
+	Index(wIndex, reqIndex)
+	if hash, err := HttpDB.Use(collection).IndexHash([]string{path}); wIndex.Code != 201 || err != nil || hash.Func != db.HashSdbm {
+		t.Error("Expected code 201 and an index using sdbm", wIndex.Code, hash, err)
+	}
+	Reindex(wReindex, reqReindex)
+	if hash, err := HttpDB.Use(collection).IndexHash([]string{path}); wReindex.Code != 200 || err != nil || !hash.IsCurrent() {
+		t.Error("Expected code 200 and a rebuilt index", wReindex.Code, hash, err)
+	}
+	Reindex(wReindexBadHash, reqReindexBadHash)
+	if wReindexBadHash.Code != 400 || strings.TrimSpace(wReindexBadHash.Body.String()) != "Index hash function doesNotExist is not supported" {
+		t.Error("Expected code 400 and error message of unsupported hash function.", wReindexBadHash.Body.String())
+	}
+	Reindex(wReindexNotIndexed, reqReindexNotIndexed)
+	if wReindexNotIndexed.Code != 400 || strings.TrimSpace(wReindexNotIndexed.Body.String()) != "Path [b] is not indexed" {
+		t.Error("Expected code 400 and error message of path not indexed.", wReindexNotIndexed.Body.String())
+	}
+}
+
+// Index with collation
+func TIndexCollation(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+
+	reqCreate := httptest.NewRequest("GET", requestCreate, nil)
+	reqIndex := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIndex+"&collation=nocase", collection, path), nil)
+	reqIndexSdbm := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIndex+"&collation=nocase&hash=sdbm", collection, "b"), nil)
+	reqIndexBad := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIndex+"&collation=doesNotExist", collection, "b"), nil)
+
+	wCreate := httptest.NewRecorder()
+	wIndex := httptest.NewRecorder()
+	wIndexSdbm := httptest.NewRecorder()
+	wIndexBad := httptest.NewRecorder()
+
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(wCreate, reqCreate)
+	Index(wIndex, reqIndex)
+	if hash, err := HttpDB.Use(collection).IndexHash([]string{path}); wIndex.Code != 201 || err != nil || hash.Collation != db.CollationNoCase {
+		t.Error("Expected code 201 and a case-insensitive index", wIndex.Code, hash, err)
+	}
+	Index(wIndexSdbm, reqIndexSdbm)
+	if wIndexSdbm.Code != 400 || strings.TrimSpace(wIndexSdbm.Body.String()) != "Collation is not supported by hash function sdbm." {
+		t.Error("Expected code 400 and error message of unsupported collation.", wIndexSdbm.Body.String())
+	}
+	Index(wIndexBad, reqIndexBad)
+	if wIndexBad.Code != 400 || strings.TrimSpace(wIndexBad.Body.String()) != "Collation doesNotExist is not supported" {
+		t.Error("Expected code 400 and error message of unsupported collation.", wIndexBad.Body.String())
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"os"
 	"runtime"
+
+	"github.com/HouzuoGuo/tiedot/db"
 )
 
 // Flush and close all data files and shutdown the entire program.
@@ -20,17 +22,76 @@ func Shutdown(w http.ResponseWriter, r *http.Request) {
 	os.Exit(0)
 }
 
-// Copy this database into destination directory.
+// Copy this database into destination directory while it remains available, and report progress (one JSON object
+// per line) as partitions are copied. If a previous backup is given, only save the changes made since then.
 func Dump(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "must-revalidate")
-	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Type", "application/x-ndjson")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
 	var dest string
 	if !Require(w, r, "dest", &dest) {
 		return
 	}
-	if err := HttpDB.Dump(dest); err != nil {
+	if prev := r.FormValue("prev"); prev != "" {
+		count, err := HttpDB.IncrementalBackup(prev, dest)
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), 500)
+			return
+		}
+		resp, _ := json.Marshal(db.BackupProgress{Changes: count, Done: true})
+		w.Write(append(resp, '\n'))
+		return
+	}
+	reported := false
+	err := HttpDB.Backup(dest, func(progress db.BackupProgress) {
+		resp, _ := json.Marshal(progress)
+		w.Write(append(resp, '\n'))
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		reported = true
+	})
+	if err != nil && !reported {
+		http.Error(w, fmt.Sprint(err), 500)
+	} else if err != nil {
+		// Status code has been sent along with the progress
+		resp, _ := json.Marshal(map[string]string{"Error": fmt.Sprint(err)})
+		w.Write(append(resp, '\n'))
+	}
+}
+
+// Replace all collections with the dump in source directory, after verifying that the dump is intact.
+func Restore(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var src string
+	if !Require(w, r, "src", &src) {
+		return
+	}
+	if err := HttpDB.Restore(src); err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+}
+
+// Verify that the dump in source directory is intact.
+func Verify(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var src string
+	if !Require(w, r, "src", &src) {
+		return
+	}
+	if HttpDB.SameDir(src) {
+		http.Error(w, "The database is open and cannot be verified, verify a dump of it instead.", 400)
+		return
+	}
+	if err := db.Verify(src); err != nil {
 		http.Error(w, fmt.Sprint(err), 500)
 		return
 	}
@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -15,6 +16,8 @@ var (
 	requestShutDown    = "http://localhost:8080/shutdown"
 	requestDumpNotDest = "http://localhost:8080/dump"
 	requestDump        = "http://localhost:8080/dump?dest=%s"
+	requestRestore     = "http://localhost:8080/restore?src=%s"
+	requestVerify      = "http://localhost:8080/verify?src=%s"
 	requestMemstats    = "http://localhost:8080/memstats"
 	requestVersion     = "http://localhost:8080/version"
 
@@ -34,6 +37,9 @@ func TestMisc(t *testing.T) {
 		TDumpNotDest,
 		TDump,
 		TDumpError,
+		TDumpProgress,
+		TDumpIncremental,
+		TRestore,
 		TMemStats,
 		TVersion,
 	}
@@ -92,6 +98,99 @@ func TDumpError(t *testing.T) {
 		t.Error("Expected code 500 and error message folder exists.", wDump.Code, wDump.Body.String())
 	}
 }
+func TDumpProgress(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	var tmp2 = "./tmp2"
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmp2)
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	wInsert := httptest.NewRecorder()
+	Insert(wInsert, httptest.NewRequest(RandMethodRequest(), requestInsertWithoutDoc, strings.NewReader("{\"a\":1}")))
+	id, _ := strconv.Atoi(strings.TrimSpace(wInsert.Body.String()))
+
+	wDump := httptest.NewRecorder()
+	Dump(wDump, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDump, tmp2), nil))
+	lines := strings.Split(strings.TrimSpace(wDump.Body.String()), "\n")
+	if wDump.Code != 200 || len(lines) < 2 || !strings.Contains(lines[0], "\"Collection\":\""+collection+"\"") || !strings.Contains(lines[len(lines)-1], "\"Done\":true") {
+		t.Error("Expected code 200 and progress of each partition", wDump.Code, lines)
+	}
+	backup, err := db.OpenDB(tmp2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	if backup.Use(collection) == nil {
+		t.Fatal("Expected the collection to be backed up")
+	} else if _, err = backup.Use(collection).Read(id); err != nil {
+		t.Error("Expected the document to be backed up", err)
+	}
+}
+func TDumpIncremental(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	var tmp2, tmp3 = "./tmp2", "./tmp3"
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmp2)
+	defer os.RemoveAll(tmp3)
+	if err = HttpDB.EnableChangeLog(); err != nil {
+		t.Fatal(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	Dump(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDump, tmp2), nil))
+	Insert(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestInsertWithoutDoc, strings.NewReader("{\"a\":1}")))
+
+	wDump := httptest.NewRecorder()
+	Dump(wDump, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDump, tmp3)+"&prev="+tmp2, nil))
+	if wDump.Code != 200 || strings.TrimSpace(wDump.Body.String()) != `{"Collection":"","Copied":0,"Total":0,"Done":true,"Changes":1}` {
+		t.Error("Expected code 200 and number of saved changes", wDump.Code, wDump.Body.String())
+	}
+	wDump = httptest.NewRecorder()
+	Dump(wDump, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDump, tmp3)+"&prev="+tmp2, nil))
+	if wDump.Code != 500 {
+		t.Error("Expected code 500 for existing backup", wDump.Code, wDump.Body.String())
+	}
+}
+func TRestore(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	var tmp2 = "./tmp2"
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmp2)
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	Dump(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDump, tmp2), nil))
+	Drop(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestDrop, nil))
+
+	wVerify := httptest.NewRecorder()
+	Verify(wVerify, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestVerify, tmp2), nil))
+	if wVerify.Code != 200 {
+		t.Error("Expected code 200 for intact dump", wVerify.Code, wVerify.Body.String())
+	}
+	wVerify = httptest.NewRecorder()
+	Verify(wVerify, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestVerify, "./tmp3"), nil))
+	if wVerify.Code != 500 {
+		t.Error("Expected code 500 for missing dump", wVerify.Code, wVerify.Body.String())
+	}
+	wVerify = httptest.NewRecorder()
+	Verify(wVerify, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestVerify, tempDir+"/."), nil))
+	if wVerify.Code != 400 {
+		t.Error("Expected code 400 for the open database", wVerify.Code, wVerify.Body.String())
+	}
+	wRestore := httptest.NewRecorder()
+	Restore(wRestore, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestRestore, tmp2), nil))
+	if wRestore.Code != 200 || !HttpDB.ColExists(collection) {
+		t.Error("Expected code 200 and the dropped collection to be restored", wRestore.Code, wRestore.Body.String())
+	}
+}
 func TMemStats(t *testing.T) {
 	setupTestCase()
 	defer tearDownTestCase()
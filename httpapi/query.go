@@ -5,6 +5,7 @@ package httpapi
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 
@@ -89,3 +90,160 @@ func Count(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Write([]byte(strconv.Itoa(len(queryResult))))
 }
+
+// Run registered map and reduce functions over documents matching a query, and return the reduced result.
+// If output collection "out" is given, the result is also inserted into that collection.
+func MapReduce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, q, mapName, reduceName string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "q", &q) {
+		return
+	}
+	if !Require(w, r, "map", &mapName) {
+		return
+	}
+	if !Require(w, r, "reduce", &reduceName) {
+		return
+	}
+	var qJson interface{}
+	if err := json.Unmarshal([]byte(q), &qJson); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	var result map[string]interface{}
+	var err error
+	if out := r.FormValue("out"); out != "" {
+		result, err = dbcol.MapReduceInto(qJson, mapName, reduceName, out)
+	} else {
+		result, err = dbcol.MapReduce(qJson, mapName, reduceName)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	resp, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Return the value of the optional boolean parameter, respond with HTTP 400 if it is invalid.
+func boolParam(w http.ResponseWriter, r *http.Request, name string) (val, ok bool) {
+	str := r.FormValue(name)
+	if str == "" {
+		return false, true
+	}
+	val, err := strconv.ParseBool(str)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid boolean value '%v' of parameter '%s'.", str, name), 400)
+		return false, false
+	}
+	return val, true
+}
+
+// Respond with the outcome of updating or deleting documents by query.
+func writeWhereResult(w http.ResponseWriter, result db.WhereResult) {
+	resp, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Apply a patch to every document matched by a query, and return the numbers of matched and updated documents.
+func UpdateWhere(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, q, doc string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "q", &q) {
+		return
+	}
+	defer r.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(r.Body)
+	doc = string(bodyBytes)
+	if doc == "" && !Require(w, r, "doc", &doc) {
+		return
+	}
+	dryRun, ok := boolParam(w, r, "dryrun")
+	if !ok {
+		return
+	}
+	patchType := r.FormValue("type")
+	if patchType == "" {
+		patchType = db.PatchMerge
+	}
+	var qJson, patch interface{}
+	if err := json.Unmarshal([]byte(q), &qJson); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
+		return
+	}
+	if err := json.Unmarshal([]byte(doc), &patch); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON patch.", doc), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	result, err := dbcol.UpdateWhere(qJson, patchType, patch, dryRun)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	writeWhereResult(w, result)
+}
+
+// Delete every document matched by a query, and return the numbers of matched and deleted documents.
+func DeleteWhere(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, q string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "q", &q) {
+		return
+	}
+	dryRun, ok := boolParam(w, r, "dryrun")
+	if !ok {
+		return
+	}
+	var qJson interface{}
+	if err := json.Unmarshal([]byte(q), &qJson); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	result, err := dbcol.DeleteWhere(qJson, dryRun)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	writeWhereResult(w, result)
+}
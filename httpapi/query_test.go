@@ -1,6 +1,7 @@
 package httpapi
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -18,6 +19,12 @@ var (
 	requestCount        = "http://localhost:8080/count"
 	requestCountWithCol = "http://localhost:8080/count?col=%s"
 	requestCountWithAll = "http://localhost:8080/count?col=%s&q=%s"
+
+	requestMapReduce    = "http://localhost:8080/mapreduce?col=%s&q=%s&map=%s&reduce=%s"
+	requestMapReduceOut = "http://localhost:8080/mapreduce?col=%s&q=%s&map=%s&reduce=%s&out=%s"
+
+	requestUpdateWhere = "http://localhost:8080/updatewhere?col=%s&q=%s&type=%s"
+	requestDeleteWhere = "http://localhost:8080/deletewhere?col=%s&q=%s"
 )
 
 func TestQueryNotCol(t *testing.T) {
@@ -144,3 +151,80 @@ func TestCountJsonIsNotValid(t *testing.T) {
 		t.Errorf("Expected status %d and json is not valid ", http.StatusBadRequest)
 	}
 }
+func TestMapReduce(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	for _, doc := range []map[string]interface{}{{"a": "x"}, {"a": "y"}, {"a": "x"}} {
+		if _, err := HttpDB.Use(collection).Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.RegisterMap("byA", func(id int, doc map[string]interface{}, emit func(string, interface{})) {
+		emit(doc["a"].(string), 1)
+	})
+	defer db.UnregisterMap("byA")
+	// Unregistered map function
+	w := httptest.NewRecorder()
+	MapReduce(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestMapReduce, collection, "%22all%22", "nope", "count"), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d", http.StatusBadRequest)
+	}
+	// Count with output collection
+	w = httptest.NewRecorder()
+	MapReduce(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestMapReduceOut, collection, "%22all%22", "byA", "count", "out"), nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"x":2,"y":1}` {
+		t.Errorf("Expected status %d and reduced counts, got %d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if !HttpDB.ColExists("out") {
+		t.Error("Expected output collection to be created")
+	}
+}
+
+func TestUpdateDeleteWhere(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	Index(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestIndex, collection, "a"), nil))
+	for _, doc := range []map[string]interface{}{{"a": "x", "n": 1}, {"a": "y", "n": 1}, {"a": "x", "n": "1"}} {
+		if _, err := HttpDB.Use(collection).Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := "%7B%22eq%22:%22x%22,%22in%22:%5B%22a%22%5D%7D" // {"eq":"x","in":["a"]}
+	// Dry run
+	w := httptest.NewRecorder()
+	UpdateWhere(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdateWhere+"&dryrun=true", collection, q, "operators"), bytes.NewBufferString(`{"$inc":{"n":1}}`)))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Matched":2,"Changed":1`) {
+		t.Errorf("Expected status %d and dry run result, got %d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	UpdateWhere(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdateWhere, collection, q, "merge"), bytes.NewBufferString(`{"archived":true}`)))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"Matched":2,"Changed":2,"Errors":{}}` {
+		t.Errorf("Expected status %d and update result, got %d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	UpdateWhere(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestUpdateWhere+"&dryrun=maybe", collection, q, "merge"), bytes.NewBufferString(`{}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid dry run parameter", http.StatusBadRequest)
+	}
+	// Delete by query
+	w = httptest.NewRecorder()
+	DeleteWhere(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestDeleteWhere, collection, "%7B%22has%22:%5B%22a%22%5D%7D"), nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"Matched":3,"Changed":3,"Errors":{}}` {
+		t.Errorf("Expected status %d and delete result, got %d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	Count(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestCountWithAll, collection, "%22all%22"), nil))
+	if strings.TrimSpace(w.Body.String()) != "0" {
+		t.Errorf("Expected all documents to be deleted, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,128 @@
+// Collection schema handlers.
+
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// Set the JSON Schema that documents of a collection must match.
+func SetSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, schema string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	defer r.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(r.Body)
+	schema = string(bodyBytes)
+	if schema == "" && !Require(w, r, "schema", &schema) {
+		return
+	}
+	var jsonSchema map[string]interface{}
+	if err := json.Unmarshal([]byte(schema), &jsonSchema); err != nil {
+		http.Error(w, fmt.Sprintf("'%v' is not valid JSON schema.", schema), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err := dbcol.SetSchema(jsonSchema); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+}
+
+// Return the JSON Schema of a collection, or null if it does not have one.
+func GetSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	resp, err := json.Marshal(dbcol.Schema())
+	if err != nil {
+		http.Error(w, fmt.Sprint("Server error."), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Remove the JSON Schema of a collection.
+func RemoveSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err := dbcol.RemoveSchema(); err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+}
+
+// Report the documents that do not match the collection schema, or the schema given in the request, without changing
+// anything.
+func Validate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	defer r.Body.Close()
+	bodyBytes, _ := ioutil.ReadAll(r.Body)
+	schema := string(bodyBytes)
+	if schema == "" {
+		schema = r.FormValue("schema")
+	}
+	var jsonSchema map[string]interface{}
+	if schema != "" {
+		if err := json.Unmarshal([]byte(schema), &jsonSchema); err != nil {
+			http.Error(w, fmt.Sprintf("'%v' is not valid JSON schema.", schema), 400)
+			return
+		}
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	violations, err := dbcol.Validate(jsonSchema)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	resp, err := json.Marshal(violations)
+	if err != nil {
+		http.Error(w, fmt.Sprint("Server error."), 500)
+		return
+	}
+	w.Write(resp)
+}
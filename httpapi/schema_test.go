@@ -0,0 +1,167 @@
+package httpapi
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+var (
+	requestSetSchema    = "http://localhost:8080/setschema?col=%s"
+	requestGetSchema    = "http://localhost:8080/getschema?col=%s"
+	requestRemoveSchema = "http://localhost:8080/removeschema?col=%s"
+	requestValidate     = "http://localhost:8080/validate?col=%s"
+
+	schema = "{\"type\":\"object\",\"required\":[\"a\"],\"properties\":{\"a\":{\"type\":\"integer\",\"minimum\":0}}}"
+)
+
+func TestSchema(t *testing.T) {
+	testsSchema := []func(t *testing.T){
+		TSetSchema,
+		TSetSchemaInvalid,
+		TSetSchemaColNotExist,
+		TValidate,
+	}
+	managerSubTests(testsSchema, "schema_test", t)
+}
+
+// Set, enforce, view and remove a schema
+func TSetSchema(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	wSet := httptest.NewRecorder()
+	SetSchema(wSet, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestSetSchema, collection), bytes.NewBufferString(schema)))
+	if wSet.Code != 200 {
+		t.Fatal("Expected code 200", wSet.Code, wSet.Body.String())
+	}
+	wGet := httptest.NewRecorder()
+	GetSchema(wGet, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGetSchema, collection), nil))
+	if wGet.Code != 200 || wGet.Body.String() != "{\"properties\":{\"a\":{\"minimum\":0,\"type\":\"integer\"}},\"required\":[\"a\"],\"type\":\"object\"}" {
+		t.Error("Expected the schema", wGet.Code, wGet.Body.String())
+	}
+	wInsert := httptest.NewRecorder()
+	Insert(wInsert, httptest.NewRequest(RandMethodRequest(), requestInsertWithoutDoc, bytes.NewBufferString("{\"a\":-1}")))
+	if wInsert.Code != 400 || !strings.Contains(wInsert.Body.String(), "does not match collection schema - value at /a is less than minimum 0") {
+		t.Error("Expected code 400 and schema violation", wInsert.Code, wInsert.Body.String())
+	}
+	wInsert = httptest.NewRecorder()
+	Insert(wInsert, httptest.NewRequest(RandMethodRequest(), requestInsertWithoutDoc, bytes.NewBufferString("{\"a\":1}")))
+	if wInsert.Code != 201 {
+		t.Fatal("Expected code 201", wInsert.Code, wInsert.Body.String())
+	}
+	wUpdate := httptest.NewRecorder()
+	Update(wUpdate, httptest.NewRequest("PUT", fmt.Sprintf(requestUpdate, collection, wInsert.Body.String()), bytes.NewBufferString("{\"b\":1}")))
+	wPatch := httptest.NewRecorder()
+	Patch(wPatch, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestPatch, collection, wInsert.Body.String()), bytes.NewBufferString("{\"a\":\"x\"}")))
+	for _, w := range []*httptest.ResponseRecorder{wUpdate, wPatch} {
+		if w.Code != 400 || !strings.Contains(w.Body.String(), "does not match collection schema") {
+			t.Error("Expected code 400 and schema violation", w.Code, w.Body.String())
+		}
+	}
+	wRemove := httptest.NewRecorder()
+	RemoveSchema(wRemove, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestRemoveSchema, collection), nil))
+	wGet = httptest.NewRecorder()
+	GetSchema(wGet, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGetSchema, collection), nil))
+	if wRemove.Code != 200 || wGet.Body.String() != "null" {
+		t.Error("Expected the schema to be removed", wRemove.Code, wGet.Body.String())
+	}
+	wInsert = httptest.NewRecorder()
+	Insert(wInsert, httptest.NewRequest(RandMethodRequest(), requestInsertWithoutDoc, bytes.NewBufferString("{\"a\":-1}")))
+	if wInsert.Code != 201 {
+		t.Error("Expected code 201", wInsert.Code, wInsert.Body.String())
+	}
+}
+func TSetSchemaInvalid(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	for _, invalid := range []string{"[]", "{\"type\":\"date\"}"} {
+		w := httptest.NewRecorder()
+		SetSchema(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestSetSchema, collection), bytes.NewBufferString(invalid)))
+		if w.Code != 400 {
+			t.Error("Expected code 400", invalid, w.Code, w.Body.String())
+		}
+	}
+	w := httptest.NewRecorder()
+	SetSchema(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestSetSchema, collection), nil))
+	if w.Code != 400 || strings.TrimSpace(w.Body.String()) != "Please pass POST/PUT/GET parameter value of 'schema'." {
+		t.Error("Expected code 400 and message error parameter schema not exist", w.Code, w.Body.String())
+	}
+}
+func TSetSchemaColNotExist(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	for _, handler := range []func(w *httptest.ResponseRecorder){
+		func(w *httptest.ResponseRecorder) {
+			SetSchema(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestSetSchema, collection), bytes.NewBufferString(schema)))
+		},
+		func(w *httptest.ResponseRecorder) {
+			GetSchema(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGetSchema, collection), nil))
+		},
+		func(w *httptest.ResponseRecorder) {
+			RemoveSchema(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestRemoveSchema, collection), nil))
+		},
+		func(w *httptest.ResponseRecorder) {
+			Validate(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestValidate, collection), nil))
+		},
+	} {
+		w := httptest.NewRecorder()
+		handler(w)
+		if w.Code != 400 || strings.TrimSpace(w.Body.String()) != fmt.Sprintf("Collection '%s' does not exist.", collection) {
+			t.Error("Expected code 400 and collection does not exist", w.Code, w.Body.String())
+		}
+	}
+}
+
+// Report documents that do not match the collection schema, or the schema in request
+func TValidate(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	id, err := HttpDB.Use(collection).Insert(map[string]interface{}{"a": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = HttpDB.Use(collection).Insert(map[string]interface{}{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	wNoSchema := httptest.NewRecorder()
+	Validate(wNoSchema, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestValidate, collection), nil))
+	if wNoSchema.Code != 400 {
+		t.Error("Expected code 400 without schema", wNoSchema.Code, wNoSchema.Body.String())
+	}
+	wTrial := httptest.NewRecorder()
+	Validate(wTrial, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestValidate, collection), bytes.NewBufferString(schema)))
+	expected := "[{\"ID\":" + strconv.Itoa(id) + ",\"Error\":\"value at /a is string, expecting integer\"}]"
+	if wTrial.Code != 200 || wTrial.Body.String() != expected {
+		t.Error("Expected violation", wTrial.Code, wTrial.Body.String())
+	}
+	SetSchema(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestSetSchema, collection), bytes.NewBufferString(schema)))
+	wValidate := httptest.NewRecorder()
+	Validate(wValidate, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestValidate, collection), nil))
+	if wValidate.Code != 200 || wValidate.Body.String() != expected {
+		t.Error("Expected violation", wValidate.Code, wValidate.Body.String())
+	}
+}
@@ -97,24 +97,48 @@ func Start(dir string, port int, tlsCrt, tlsKey, jwtPubKey, jwtPrivateKey, bind,
 	http.HandleFunc("/drop", authWrap(Drop))
 	http.HandleFunc("/all", authWrap(All))
 	http.HandleFunc("/scrub", authWrap(Scrub))
+	http.HandleFunc("/compact", authWrap(Compact))
 	http.HandleFunc("/sync", authWrap(Sync))
 	// query
 	http.HandleFunc("/query", authWrap(Query))
 	http.HandleFunc("/count", authWrap(Count))
+	http.HandleFunc("/mapreduce", authWrap(MapReduce))
+	http.HandleFunc("/updatewhere", authWrap(UpdateWhere))
+	http.HandleFunc("/deletewhere", authWrap(DeleteWhere))
+	// change feed
+	http.HandleFunc("/watch", authWrap(Watch))
 	// document management
 	http.HandleFunc("/insert", authWrap(Insert))
+	http.HandleFunc("/insertwithid", authWrap(InsertWithID))
+	http.HandleFunc("/upsert", authWrap(Upsert))
+	http.HandleFunc("/upsertbyindex", authWrap(UpsertByIndex))
 	http.HandleFunc("/get", authWrap(Get))
 	http.HandleFunc("/getpage", authWrap(GetPage))
 	http.HandleFunc("/update", authWrap(Update))
+	http.HandleFunc("/patch", authWrap(Patch))
 	http.HandleFunc("/delete", authWrap(Delete))
+	http.HandleFunc("/bulk", authWrap(Bulk))
 	http.HandleFunc("/approxdoccount", authWrap(ApproxDocCount))
 	// index management (stop-the-world)
 	http.HandleFunc("/index", authWrap(Index))
 	http.HandleFunc("/indexes", authWrap(Indexes))
 	http.HandleFunc("/unindex", authWrap(Unindex))
+	http.HandleFunc("/reindex", authWrap(Reindex))
+	// schema management (stop-the-world)
+	http.HandleFunc("/setschema", authWrap(SetSchema))
+	http.HandleFunc("/getschema", authWrap(GetSchema))
+	http.HandleFunc("/removeschema", authWrap(RemoveSchema))
+	http.HandleFunc("/validate", authWrap(Validate))
+	// document expiry
+	http.HandleFunc("/setttl", authWrap(SetTTL))
+	http.HandleFunc("/getttl", authWrap(GetTTL))
+	http.HandleFunc("/removettl", authWrap(RemoveTTL))
+	http.HandleFunc("/reaperstats", authWrap(ReaperStats))
 	// misc (stop-the-world)
 	http.HandleFunc("/shutdown", authWrap(Shutdown))
 	http.HandleFunc("/dump", authWrap(Dump))
+	http.HandleFunc("/restore", authWrap(Restore))
+	http.HandleFunc("/verify", authWrap(Verify))
 
 	iface := "all interfaces"
 	if bind != "" {
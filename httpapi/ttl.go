@@ -0,0 +1,101 @@
+// Document expiry handlers.
+
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Make documents of a collection expire a number of seconds after the timestamp in a document path.
+func SetTTL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col, path, seconds string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	if !Require(w, r, "path", &path) {
+		return
+	}
+	if !Require(w, r, "seconds", &seconds) {
+		return
+	}
+	secondsNum, err := strconv.Atoi(seconds)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid number of seconds '%v'.", seconds), 400)
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err := dbcol.SetTTL(strings.Split(path, ","), secondsNum); err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+}
+
+// Return the TTL of a collection, or null if its documents do not expire.
+func GetTTL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	resp, err := json.Marshal(dbcol.TTL())
+	if err != nil {
+		http.Error(w, fmt.Sprint("Server error."), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Remove the TTL of a collection, so that its documents no longer expire.
+func RemoveTTL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	var col string
+	if !Require(w, r, "col", &col) {
+		return
+	}
+	dbcol := HttpDB.Use(col)
+	if dbcol == nil {
+		http.Error(w, fmt.Sprintf("Collection '%s' does not exist.", col), 400)
+		return
+	}
+	if err := dbcol.RemoveTTL(); err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+}
+
+// Return the number of expired documents deleted from each collection since the server started.
+func ReaperStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	resp, err := json.Marshal(HttpDB.ReaperStats())
+	if err != nil {
+		http.Error(w, fmt.Sprint("Server error."), 500)
+		return
+	}
+	w.Write(resp)
+}
@@ -0,0 +1,100 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+var (
+	requestSetTTL    = "http://localhost:8080/setttl?col=%s&path=%s&seconds=%s"
+	requestGetTTL    = "http://localhost:8080/getttl?col=%s"
+	requestRemoveTTL = "http://localhost:8080/removettl?col=%s"
+)
+
+func TestTTL(t *testing.T) {
+	testsTTL := []func(t *testing.T){
+		TSetTTL,
+		TSetTTLInvalid,
+		TReaperStats,
+	}
+	managerSubTests(testsTTL, "ttl_test", t)
+}
+
+// Set, view and remove a TTL
+func TSetTTL(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer HttpDB.Close()
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	wSet := httptest.NewRecorder()
+	SetTTL(wSet, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestSetTTL, collection, "a,b", "60"), nil))
+	wGet := httptest.NewRecorder()
+	GetTTL(wGet, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGetTTL, collection), nil))
+	if wSet.Code != 200 || wGet.Code != 200 || wGet.Body.String() != "{\"Path\":[\"a\",\"b\"],\"Seconds\":60}" {
+		t.Error("Expected the TTL", wSet.Code, wSet.Body.String(), wGet.Body.String())
+	}
+	wRemove := httptest.NewRecorder()
+	RemoveTTL(wRemove, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestRemoveTTL, collection), nil))
+	wGet = httptest.NewRecorder()
+	GetTTL(wGet, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestGetTTL, collection), nil))
+	if wRemove.Code != 200 || wGet.Body.String() != "null" {
+		t.Error("Expected the TTL to be removed", wRemove.Code, wGet.Body.String())
+	}
+}
+func TSetTTLInvalid(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer HttpDB.Close()
+	w := httptest.NewRecorder()
+	SetTTL(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestSetTTL, collection, "a", "60"), nil))
+	if w.Code != 400 || strings.TrimSpace(w.Body.String()) != fmt.Sprintf("Collection '%s' does not exist.", collection) {
+		t.Error("Expected code 400 and collection does not exist", w.Code, w.Body.String())
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	for _, seconds := range []string{"x", "-1"} {
+		w := httptest.NewRecorder()
+		SetTTL(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestSetTTL, collection, "a", seconds), nil))
+		if w.Code != 400 {
+			t.Error("Expected code 400", seconds, w.Code, w.Body.String())
+		}
+	}
+	w = httptest.NewRecorder()
+	SetTTL(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf("http://localhost:8080/setttl?col=%s&path=a", collection), nil))
+	if w.Code != 400 || strings.TrimSpace(w.Body.String()) != "Please pass POST/PUT/GET parameter value of 'seconds'." {
+		t.Error("Expected code 400 and message error parameter seconds not exist", w.Code, w.Body.String())
+	}
+}
+
+// Report expired documents deleted by the reaper
+func TReaperStats(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer HttpDB.Close()
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	SetTTL(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestSetTTL, collection, "t", "0"), nil))
+	if _, err = HttpDB.Use(collection).Insert(map[string]interface{}{"t": 1}); err != nil {
+		t.Fatal(err)
+	}
+	HttpDB.ReapExpired()
+	w := httptest.NewRecorder()
+	ReaperStats(w, httptest.NewRequest(RandMethodRequest(), "http://localhost:8080/reaperstats", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "\"Runs\":1,") || !strings.Contains(w.Body.String(), "\"Expired\":{\""+collection+"\":1}") {
+		t.Error("Expected one expired document", w.Code, w.Body.String())
+	}
+}
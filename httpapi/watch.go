@@ -0,0 +1,157 @@
+// Change feed handler.
+
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+const (
+	watchTimeout  = 30  // Default number of seconds a long poll waits for changes.
+	watchMaxBatch = 100 // Default maximum number of changes returned by a long poll.
+)
+
+// Return the value of the optional non-negative integer parameter, respond with HTTP 400 if it is invalid.
+func intParam(w http.ResponseWriter, r *http.Request, name string, defaultVal int) (val int, ok bool) {
+	str := r.FormValue(name)
+	if str == "" {
+		return defaultVal, true
+	}
+	val, err := strconv.Atoi(str)
+	if err != nil || val < 0 {
+		http.Error(w, fmt.Sprintf("Invalid non-negative integer value '%v' of parameter '%s'.", str, name), 400)
+		return 0, false
+	}
+	return val, true
+}
+
+// Deliver document changes made after a sequence number (or from now on), optionally only those of a collection
+// and of documents matched by a query. Clients accepting text/event-stream receive Server-Sent Events as changes
+// happen; other clients long poll - the response has changes as soon as there is any, or none after the timeout.
+func Watch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "must-revalidate")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, OPTIONS")
+	opts := db.WatchOptions{Col: r.FormValue("col")}
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	// Resume after the last change received, or start from now on
+	after := r.FormValue("after")
+	if lastEventID := r.Header.Get("Last-Event-ID"); after == "" && sse {
+		after = lastEventID
+	}
+	var err error
+	if after == "" {
+		if opts.AfterSeq, err = HttpDB.LastChangeSeq(); err != nil {
+			http.Error(w, fmt.Sprint(err), 400)
+			return
+		}
+	} else if opts.AfterSeq, err = strconv.Atoi(after); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid sequence number '%v' of parameter 'after'.", after), 400)
+		return
+	}
+	if q := r.FormValue("q"); q != "" {
+		if err := json.Unmarshal([]byte(q), &opts.Query); err != nil {
+			http.Error(w, fmt.Sprintf("'%v' is not valid JSON.", q), 400)
+			return
+		}
+	}
+	var ok bool
+	if opts.OldDoc, ok = boolParam(w, r, "old"); !ok {
+		return
+	}
+	defaultLimit := watchMaxBatch
+	if sse {
+		defaultLimit = 0
+	}
+	limit, ok := intParam(w, r, "limit", defaultLimit)
+	if !ok {
+		return
+	}
+	timeout, ok := intParam(w, r, "timeout", watchTimeout)
+	if !ok {
+		return
+	}
+	watcher, err := HttpDB.Watch(opts)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 400)
+		return
+	}
+	defer watcher.Close()
+	if sse {
+		watchEvents(w, r, watcher, limit)
+		return
+	}
+	// Long poll: wait for the first change, then collect the changes that are already available
+	w.Header().Set("Content-Type", "application/json")
+	result := struct {
+		Seq     int // Sequence number to resume after
+		Changes []db.Change
+	}{Seq: opts.AfterSeq, Changes: []db.Change{}}
+	timer := time.NewTimer(time.Duration(timeout) * time.Second)
+	defer timer.Stop()
+	select {
+	case change, ok := <-watcher.C:
+		if !ok {
+			http.Error(w, fmt.Sprint(watcher.Err()), 500)
+			return
+		}
+		result.Changes = append(result.Changes, change)
+	collect:
+		for limit == 0 || len(result.Changes) < limit {
+			select {
+			case change, ok := <-watcher.C:
+				if !ok {
+					break collect
+				}
+				result.Changes = append(result.Changes, change)
+			default:
+				break collect
+			}
+		}
+		result.Seq = result.Changes[len(result.Changes)-1].Seq
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+	resp, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), 500)
+		return
+	}
+	w.Write(resp)
+}
+
+// Send changes as Server-Sent Events until the client goes away, or after the number of events (0 for no limit).
+func watchEvents(w http.ResponseWriter, r *http.Request, watcher *db.Watcher, limit int) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	for sent := 0; limit == 0 || sent < limit; sent++ {
+		select {
+		case change, ok := <-watcher.C:
+			if !ok {
+				fmt.Fprintf(w, "event: error\ndata: %v\n\n", watcher.Err())
+				return
+			}
+			data, err := json.Marshal(change)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.Seq, change.Op, data)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/tiedot/db"
+)
+
+var (
+	requestWatch = "http://localhost:8080/watch?col=%s"
+)
+
+func TestWatch(t *testing.T) {
+	setupTestCase()
+	defer tearDownTestCase()
+	var err error
+	if HttpDB, err = db.OpenDB(tempDir); err != nil {
+		panic(err)
+	}
+	defer HttpDB.Close()
+	// Change log is required
+	w := httptest.NewRecorder()
+	Watch(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestWatch, collection), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without change log, got %d", http.StatusBadRequest, w.Code)
+	}
+	if err = HttpDB.EnableChangeLog(); err != nil {
+		t.Fatal(err)
+	}
+	Create(httptest.NewRecorder(), httptest.NewRequest(RandMethodRequest(), requestCreate, nil))
+	// Long poll times out without changes
+	w = httptest.NewRecorder()
+	Watch(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestWatch, collection)+"&timeout=0", nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"Seq":1,"Changes":[]}` {
+		t.Errorf("Expected status %d and no change, got %d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	// Long poll returns as soon as a matching change is made
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		HttpDB.Use(collection).Insert(map[string]interface{}{"kind": "other"})
+		HttpDB.Use(collection).Insert(map[string]interface{}{"kind": "order"})
+	}()
+	q := "%7B%22eq%22:%22order%22,%22in%22:%5B%22kind%22%5D%7D" // {"eq":"order","in":["kind"]}
+	w = httptest.NewRecorder()
+	Watch(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestWatch, collection)+"&q="+q, nil))
+	var result struct {
+		Seq     int
+		Changes []db.Change
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK || len(result.Changes) != 1 ||
+		result.Seq != 3 || result.Changes[0].Op != db.ChangeInsert || !strings.Contains(string(result.Changes[0].Doc), "order") {
+		t.Errorf("Expected status %d and the order, got %d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	// Server-Sent Events resume after the last event
+	req := httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestWatch, collection)+"&limit=2", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", "1")
+	w = httptest.NewRecorder()
+	Watch(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/event-stream" ||
+		!strings.HasPrefix(w.Body.String(), "id: 2\nevent: insert\ndata: {") || !strings.Contains(w.Body.String(), "\n\nid: 3\nevent: insert\n") {
+		t.Errorf("Expected status %d and two events, got %d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	// Invalid parameters
+	for _, params := range []string{"&after=x", "&after=100", "&q=x", "&timeout=-1", "&old=x"} {
+		w = httptest.NewRecorder()
+		Watch(w, httptest.NewRequest(RandMethodRequest(), fmt.Sprintf(requestWatch, collection)+params, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for %s, got %d", http.StatusBadRequest, params, w.Code)
+		}
+	}
+}
@@ -2,7 +2,10 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/signal"
@@ -10,8 +13,10 @@ import (
 	"runtime/pprof"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/HouzuoGuo/tiedot/benchmark"
+	"github.com/HouzuoGuo/tiedot/db"
 	"github.com/HouzuoGuo/tiedot/examples"
 	"github.com/HouzuoGuo/tiedot/httpapi"
 	"github.com/HouzuoGuo/tiedot/tdlog"
@@ -41,6 +46,107 @@ func linuxPerfAdvice() {
 	}
 }
 
+// Export a collection to file or import a collection from file.
+func exportImport(mode, dir, colName, format, file, query, columns string) (err error) {
+	var csvColumns []db.CSVColumn
+	if csvColumns, err = db.ParseCSVColumns(columns); err != nil {
+		return
+	}
+	database, err := db.OpenDB(dir)
+	if err != nil {
+		return
+	}
+	defer database.Close()
+	var count int
+	if mode == "export" {
+		opts := db.ExportOptions{Format: format, Columns: csvColumns}
+		if query != "" {
+			if err = json.Unmarshal([]byte(query), &opts.Query); err != nil {
+				return
+			}
+		}
+		var out io.Writer = os.Stdout
+		if file != "" {
+			outFile, err := os.Create(file)
+			if err != nil {
+				return err
+			}
+			defer outFile.Close()
+			out = outFile
+		}
+		count, err = database.Export(colName, out, opts)
+	} else {
+		var in io.Reader = os.Stdin
+		if file != "" {
+			inFile, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer inFile.Close()
+			in = inFile
+		}
+		count, err = database.Import(colName, in, db.ImportOptions{Format: format, Columns: csvColumns})
+	}
+	tdlog.Noticef("%d documents processed by %s of collection %s", count, mode, colName)
+	return
+}
+
+// Restore a full backup and a chain of incremental backups, up to the point in time, into the database directory.
+// An existing database in the directory is replaced.
+func restore(dir, backups, until string) (err error) {
+	var pointInTime time.Time
+	if until != "" {
+		if pointInTime, err = time.Parse(time.RFC3339, until); err != nil {
+			return
+		}
+	}
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		return db.RestoreBackups(dir, strings.Split(backups, ","), pointInTime)
+	}
+	restored := strings.TrimRight(dir, "/") + ".restored"
+	if err = db.RestoreBackups(restored, strings.Split(backups, ","), pointInTime); err != nil {
+		return
+	}
+	defer os.RemoveAll(restored)
+	database, err := db.OpenDB(dir)
+	if err != nil {
+		return
+	}
+	defer database.Close()
+	return database.Restore(restored)
+}
+
+// Turn on the change log of the database, it remains on when the database is opened again. The database is opened
+// read-only, so that its recovery and migration are left to HTTP server.
+func enableChangeLog(dir string) error {
+	database, err := db.OpenDBReadOnly(dir)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+	return database.EnableChangeLog()
+}
+
+// Check the consistency of the database and print the problems found, return the number of problems. The database
+// is opened read-only unless it is to be repaired.
+func fsck(dir string, repair bool) (problems int, err error) {
+	var database *db.DB
+	if repair {
+		database, err = db.OpenDB(dir)
+	} else {
+		database, err = db.OpenDBReadOnly(dir)
+	}
+	if err != nil {
+		return
+	}
+	defer database.Close()
+	report, err := database.Fsck(repair)
+	for _, problem := range report {
+		fmt.Println(problem)
+	}
+	return len(report), err
+}
+
 func main() {
 	var err error
 	var defaultMaxprocs int
@@ -53,7 +159,7 @@ func main() {
 	// General params
 	var mode string
 	var maxprocs int
-	flag.StringVar(&mode, "mode", "", "Mandatory - specify the execution mode [httpd|bench|bench2|example]")
+	flag.StringVar(&mode, "mode", "", "Mandatory - specify the execution mode [httpd|bench|bench2|example|export|import|restore|verify|fsck]")
 	flag.IntVar(&maxprocs, "gomaxprocs", defaultMaxprocs, "GOMAXPROCS")
 	// Debug params
 	var profile, debug bool
@@ -66,18 +172,37 @@ func main() {
 	var port int
 	var authToken string
 	var tlsCrt, tlsKey string
-	flag.StringVar(&dir, "dir", "", "(HTTP server) database directory")
+	var changeLog bool
+	flag.StringVar(&dir, "dir", "", "(HTTP server, export, import, restore, verify and fsck) database directory")
 	flag.StringVar(&bind, "bind", "", "(HTTP server) bind to IP address (all network interfaces by default)")
 	flag.IntVar(&port, "port", 8080, "(HTTP server) port number")
 	flag.StringVar(&tlsCrt, "tlscrt", "", "(HTTP server) TLS certificate (empty to disable TLS).")
 	flag.StringVar(&tlsKey, "tlskey", "", "(HTTP server) TLS certificate key (empty to disable TLS).")
 	flag.StringVar(&authToken, "authtoken", "", "(HTTP server) Only authorize requests carrying this token in 'Authorization: token TOKEN' header. (empty to disable)")
+	flag.BoolVar(&changeLog, "changelog", false, "(HTTP server) Record all changes in change log to allow incremental backups, it stays on once enabled")
 
 	// HTTP + JWT params
 	var jwtPubKey, jwtPrivateKey string
 	flag.StringVar(&jwtPubKey, "jwtpubkey", "", "(HTTP JWT server) Public key for signing tokens (empty to disable JWT)")
 	flag.StringVar(&jwtPrivateKey, "jwtprivatekey", "", "(HTTP JWT server) Private key for decoding tokens (empty to disable JWT)")
 
+	// Export and import mode params
+	var colName, format, file, query, columns string
+	flag.StringVar(&colName, "col", "", "(Export and import) collection name")
+	flag.StringVar(&format, "format", db.ExportNDJSON, "(Export and import) file format [ndjson|json|csv]")
+	flag.StringVar(&file, "file", "", "(Export and import) file to write to or read from (empty for standard output/input)")
+	flag.StringVar(&query, "query", "", "(Export) only export documents matched by the query (empty for all documents)")
+	flag.StringVar(&columns, "columns", "", "(Export and import) CSV column mapping, e.g. title=Title,author=Author.Name")
+
+	// Restore mode params
+	var backups, until string
+	flag.StringVar(&backups, "backups", "", "(Restore) directories of a full backup followed by incremental backups, separated by comma")
+	flag.StringVar(&until, "until", "", "(Restore) only restore changes made up to the time, e.g. 2017-01-02T15:04:05Z (empty for all changes)")
+
+	// Fsck mode params
+	var repair bool
+	flag.BoolVar(&repair, "repair", false, "(Fsck) repair the problems found")
+
 	// Benchmark mode params
 	var (
 		// Size of benchmark sample
@@ -146,7 +271,62 @@ func main() {
 			tdlog.Notice("To enable JWT, please specify RSA private and public key.")
 			os.Exit(1)
 		}
+		if changeLog {
+			if err := enableChangeLog(dir); err != nil {
+				tdlog.Noticef("Failed to enable change log - %v", err)
+				os.Exit(1)
+			}
+		}
 		httpapi.Start(dir, port, tlsCrt, tlsKey, jwtPubKey, jwtPrivateKey, bind, authToken)
+	case "export", "import":
+		// Export a collection to file or import a collection from file, HTTP server must not run on the database
+		if dir == "" || colName == "" {
+			tdlog.Notice("Please specify database directory and collection name, for example -dir=/tmp/db -col=Feeds")
+			os.Exit(1)
+		}
+		if err := exportImport(mode, dir, colName, format, file, query, columns); err != nil {
+			tdlog.Noticef("Failed to %s collection %s - %v", mode, colName, err)
+			os.Exit(1)
+		}
+	case "restore":
+		// Restore backups into the database directory, HTTP server must not run on the database
+		if dir == "" || backups == "" {
+			tdlog.Notice("Please specify database directory and backups, for example -dir=/tmp/db -backups=/tmp/full,/tmp/inc1")
+			os.Exit(1)
+		}
+		if err := restore(dir, backups, until); err != nil {
+			tdlog.Noticef("Failed to restore backups - %v", err)
+			os.Exit(1)
+		}
+	case "verify":
+		// Verify a database or dump, HTTP server must not run on it
+		if dir == "" {
+			tdlog.Notice("Please specify the database or dump directory, for example -dir=/tmp/dump")
+			os.Exit(1)
+		}
+		if err := db.Verify(dir); err != nil {
+			tdlog.Noticef("Verification of %s failed - %v", dir, err)
+			os.Exit(1)
+		}
+		tdlog.Noticef("%s is intact", dir)
+	case "fsck":
+		// Check and optionally repair a database, HTTP server must not run on it
+		if dir == "" {
+			tdlog.Notice("Please specify database directory, for example -dir=/tmp/db")
+			os.Exit(1)
+		}
+		problems, err := fsck(dir, repair)
+		if err != nil {
+			tdlog.Noticef("Failed to check %s - %v", dir, err)
+			os.Exit(1)
+		} else if problems == 0 {
+			tdlog.Noticef("%s is consistent", dir)
+		} else if repair {
+			tdlog.Noticef("Repaired %d problems of %s", problems, dir)
+		} else {
+			tdlog.Noticef("Found %d problems of %s, run with -repair to repair them", problems, dir)
+			os.Exit(1)
+		}
 	case "example":
 		// Run embedded usage examples
 		examples.EmbeddedExample()